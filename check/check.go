@@ -1,9 +1,14 @@
 package check
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/hashicorp/go-multierror"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
 	"reflect"
 	"runtime"
 	"sync"
@@ -27,6 +32,12 @@ type Check struct {
 	// check.
 	Meta map[string]any
 
+	// HandlerState is a key/value store of state Handlers keep with the check
+	// between executions, such as learned models.  Unlike Meta it is not
+	// exported by Handlers.  Be sure it's stored and restored along with the
+	// Check when loading a check from an external database.
+	HandlerState map[string]any
+
 	// Incident needs to be the current active incident for this check
 	// or else nil.
 	Incident *Incident
@@ -61,6 +72,10 @@ type Check struct {
 	// you want to debug a particular Check.
 	debugLogger debugLogger
 
+	// tracer creates the spans of ExecuteContext().  When nil, no spans are
+	// recorded.
+	tracer trace.Tracer
+
 	// Executed is true when the Check has had Execute() called on it.  You should
 	// set this back to false prior to queueing it again.
 	Executed bool
@@ -131,6 +146,16 @@ func (c *Check) SetDebugLogger(logger debugLogger) {
 	c.debugLogger = logger
 }
 
+func WithTracer(tracer trace.Tracer) Option {
+	return func(c *Check) {
+		c.tracer = tracer
+	}
+}
+
+func (c *Check) SetTracer(tracer trace.Tracer) {
+	c.tracer = tracer
+}
+
 // DueAt returns the time when check is due (could be past or future)
 func (c *Check) DueAt() time.Time {
 	return c.Schedule.DueAt(c)
@@ -159,25 +184,45 @@ func (c *Check) Debugf(format string, args ...any) {
 // Execute executes a Check's Command followed by its Handlers.  It then sets the Incident (if there is one),
 // LastCheck and LastResult fields on the Check.
 func (c *Check) Execute() error {
+	return c.ExecuteContext(context.Background())
+}
+
+// ExecuteContext is Execute() with a context.Context that the Check's trace
+// span is a child of.  When the Check has a tracer, the execution is recorded
+// as a "check.execute" span with child spans for the Command and for each
+// Handler's mutation and processing.
+func (c *Check) ExecuteContext(ctx context.Context) (err error) {
 	c.Executed = true
 
+	ctx, span := c.startSpan(ctx, "check.execute", attribute.String("check.command.type", typeName(c.Command)))
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	var result *Result
-	var err error
 	if c.Command == nil {
 		result, err = MakeUnknownResult("CMD_FAILURE"), errors.New("command not defined in check")
 	} else {
-		result, err = c.Command.Run(c)
+		result, err = c.runCommand(ctx)
 	}
 
+	c.runResultMutations(ctx, result)
+
 	c.Debugf("result-state=%s result-reason-code=%s result-metrics=%d result-time=%d",
 		result.State.String(), result.ReasonCode, len(result.Metrics), result.Time.Unix())
 
 	newIncident := c.makeNewIncidentIfJustified(result)
 	c.Debugf("new-incident=%v", newIncident != nil)
-	c.resolveOrDiscardPreviousIncident(result, newIncident)
+	events := c.resolveOrDiscardPreviousIncident(result, newIncident)
 
-	c.runResultHandlerMutations(result, newIncident)
-	errP := c.runResultHandlerProcessing(result, newIncident)
+	span.SetAttributes(
+		attribute.String("check.result.state", result.State.String()),
+		attribute.String("check.result.reason_code", result.ReasonCode),
+		attribute.Bool("check.new_incident", newIncident != nil),
+	)
+
+	c.runResultHandlerMutations(ctx, result, newIncident)
+	errP := c.runResultHandlerProcessing(ctx, result, newIncident, events)
 	if errP != nil {
 		err = multierror.Append(err, errP)
 	}
@@ -192,13 +237,112 @@ func (c *Check) Execute() error {
 	return err
 }
 
-func (c *Check) runResultHandlerMutations(result *Result, newIncident *Incident) {
+func (c *Check) runCommand(ctx context.Context) (result *Result, err error) {
+	_, span := c.startSpan(ctx, "check.command", attribute.String("check.command.type", typeName(c.Command)))
+	defer func() {
+		if result != nil {
+			span.SetAttributes(
+				attribute.String("check.result.state", result.State.String()),
+				attribute.String("check.result.reason_code", result.ReasonCode),
+			)
+		}
+		endSpan(span, err)
+	}()
+
+	return c.Command.Run(c)
+}
+
+func (c *Check) runResultMutations(ctx context.Context, result *Result) {
 	for _, h := range c.Handlers {
+		if m, ok := h.(ResultMutator); ok {
+			_, span := c.startSpan(ctx, "handler.mutate_result", attribute.String("handler.type", typeName(h)))
+			m.MutateResult(c, result)
+			span.End()
+		}
+	}
+}
+
+func (c *Check) runResultHandlerMutations(ctx context.Context, result *Result, newIncident *Incident) {
+	for _, h := range c.Handlers {
+		_, span := c.startSpan(ctx, "handler.mutate", attribute.String("handler.type", typeName(h)))
 		h.Mutate(c, result, newIncident)
+		span.End()
 	}
 }
 
-func (c *Check) runResultHandlerProcessing(result *Result, newIncident *Incident) error {
+func (c *Check) runResultHandlerProcessing(ctx context.Context, result *Result, newIncident *Incident,
+	events []IncidentEvent) error {
+	return c.runHandlersConcurrently(func(h Handler) (err error) {
+		_, span := c.startSpan(ctx, "handler.process",
+			attribute.String("handler.type", typeName(h)),
+			attribute.Int("check.incident_events", len(events)),
+		)
+		defer func() {
+			endSpan(span, err)
+		}()
+
+		err = h.Process(c, result, newIncident)
+
+		if errE := c.processIncidentEvents(h, events); errE != nil {
+			err = multierror.Append(err, errE)
+		}
+
+		return err
+	})
+}
+
+var noopTracer = noop.NewTracerProvider().Tracer("")
+
+// startSpan starts a span with the Check's tracer (if any) that has the check.id attribute plus attrs.
+func (c *Check) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	tracer := c.tracer
+	if tracer == nil {
+		tracer = noopTracer
+	}
+
+	attrs = append([]attribute.KeyValue{attribute.String("check.id", c.Id)}, attrs...)
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err (if any) on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// typeName returns the package qualified name of v's type, dereferencing pointers.
+func typeName(v any) string {
+	if v == nil {
+		return ""
+	}
+	t := reflect.TypeOf(v)
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// processIncidentEvents passes events to h if it is an IncidentEventHandler.
+func (c *Check) processIncidentEvents(h Handler, events []IncidentEvent) error {
+	eh, ok := h.(IncidentEventHandler)
+	if !ok {
+		return nil
+	}
+
+	var errs error
+	for _, event := range events {
+		if err := eh.ProcessIncidentEvent(c, event); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// runHandlersConcurrently calls fn for each of the Check's Handlers in its own goroutine and returns their errors.
+func (c *Check) runHandlersConcurrently(fn func(h Handler) error) error {
 	if c.Handlers == nil {
 		return nil
 	}
@@ -210,14 +354,10 @@ func (c *Check) runResultHandlerProcessing(result *Result, newIncident *Incident
 		go func(h Handler) {
 			defer wg.Done()
 
-			err := h.Process(c, result, newIncident)
+			err := fn(h)
 
 			if err != nil {
-				t := reflect.TypeOf(h)
-				if t.Kind() == reflect.Ptr {
-					t = t.Elem()
-				}
-				errorCh <- fmt.Errorf("error in handler '%s': %v", t.PkgPath()+"."+t.Name(), err)
+				errorCh <- fmt.Errorf("error in handler '%s': %v", typeName(h), err)
 			}
 		}(h)
 	}
@@ -246,20 +386,58 @@ func (c *Check) makeNewIncidentIfJustified(result *Result) *Incident {
 }
 
 // resolveOrDiscardPreviousIncident takes a new result and incident and determines if an old incident within the
-// check should be resolved or discarded.
-func (c *Check) resolveOrDiscardPreviousIncident(newResult *Result, newIncident *Incident) {
+// check should be resolved or discarded.  It returns the resulting incident lifecycle events.
+func (c *Check) resolveOrDiscardPreviousIncident(newResult *Result, newIncident *Incident) []IncidentEvent {
+	var events []IncidentEvent
+
 	// if an existing incident exists and the current state is OK or there is now a new incident
 	if c.Incident != nil && (newResult.State == StateOk || newIncident != nil) {
 		if c.Incident.Resolved == nil {
 			// resolve it since we are now OK or have new incident
 			c.Debugf("resolving previous incident")
 			c.Incident.Resolve()
+
+			if newIncident != nil {
+				newIncident.inheritStickyAcknowledgement(c.Incident, newIncident.Time)
+				eventType := IncidentDeEscalated
+				if newIncident.ToState.Overrides(c.Incident.ToState) {
+					eventType = IncidentEscalated
+				}
+				return append(events, newIncidentEvent(eventType, newIncident, c.Incident, newResult))
+			}
+			return append(events, newIncidentEvent(IncidentResolved, c.Incident, nil, newResult))
 		} else {
 			// already resolved(old incident), discard it
 			c.Debugf("discarding previous incident")
+			events = append(events, newIncidentEvent(IncidentDiscarded, c.Incident, nil, newResult))
 			c.Incident = nil
 		}
 	}
+
+	if newIncident != nil {
+		events = append(events, newIncidentEvent(IncidentOpened, newIncident, nil, newResult))
+	} else if c.Incident != nil && !c.Incident.IsResolved() && c.Incident.expireAcknowledgement(time.Now()) {
+		c.Debugf("acknowledgement of incident expired")
+		events = append(events, newIncidentEvent(IncidentAcknowledgementExpired, c.Incident, nil, newResult))
+	}
+
+	return events
+}
+
+// AcknowledgeIncident acknowledges the Check's current unresolved Incident with
+// ack and passes an IncidentAcknowledged event to the Check's
+// IncidentEventHandlers.  It should not be called while the Check is executing.
+func (c *Check) AcknowledgeIncident(ack Acknowledgement) error {
+	if c.Incident == nil || c.Incident.IsResolved() {
+		return errors.New("check has no unresolved incident to acknowledge")
+	}
+
+	c.Incident.AcknowledgeWith(ack)
+
+	events := []IncidentEvent{newIncidentEvent(IncidentAcknowledged, c.Incident, nil, nil)}
+	return c.runHandlersConcurrently(func(h Handler) error {
+		return c.processIncidentEvents(h, events)
+	})
 }
 
 // Command is a simple interface with a Run(Check) method that returns a Result
@@ -282,6 +460,26 @@ type Handler interface {
 	Process(check *Check, newResult *Result, newIncident *Incident) error
 }
 
+// ResultMutator is an optional interface a Handler may implement to mutate a
+// Result before the Check determines if it justifies a new Incident.  This
+// allows a Handler to alter the Result's State and ReasonCode (for example,
+// from a learned baseline) and have the Incident reflect that.  MutateResult()
+// is called sequentially in the order the Handlers are defined on the Check
+// and prior to any Mutate() calls.
+type ResultMutator interface {
+	MutateResult(check *Check, newResult *Result)
+}
+
+// IncidentEventHandler is an optional interface a Handler may implement to
+// receive Incident lifecycle events.  ProcessIncidentEvent() is called
+// asynchronously, after Process(), once for each event that occurred during
+// the Check's execution.  It is also called when an Incident is acknowledged
+// through Check.AcknowledgeIncident().  Like Process(), it should not mutate
+// data.
+type IncidentEventHandler interface {
+	ProcessIncidentEvent(check *Check, event IncidentEvent) error
+}
+
 // Queue is used by a server.Server to feed it work (Checks to execute).
 type Queue interface {
 	Enqueue(chk *Check)
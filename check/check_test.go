@@ -1,6 +1,13 @@
 package check
 
 import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 )
@@ -78,3 +85,245 @@ func TestPeriodicSchedule_DueAt(t *testing.T) {
 		}
 	}
 }
+
+type testCommand struct {
+	result *Result
+}
+
+func (c testCommand) Run(*Check) (*Result, error) {
+	return c.result, nil
+}
+
+type testResultMutator struct {
+	state ResultState
+}
+
+func (m testResultMutator) MutateResult(_ *Check, result *Result) {
+	result.State, result.ReasonCode = m.state, "MUTATED"
+}
+
+func (m testResultMutator) Mutate(*Check, *Result, *Incident) {}
+
+func (m testResultMutator) Process(*Check, *Result, *Incident) error {
+	return nil
+}
+
+func TestCheck_ExecuteCreatesIncidentFromMutatedResult(t *testing.T) {
+	c := &Check{
+		Command:  testCommand{result: NewResult(StateOk, "", nil)},
+		Handlers: []Handler{testResultMutator{state: StateCrit}},
+	}
+
+	if err := c.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if c.Incident == nil {
+		t.Fatal("expected an incident from the mutated result, got nil")
+	}
+	if c.Incident.ToState != StateCrit || c.Incident.ReasonCode != "MUTATED" {
+		t.Errorf("expected incident to CRIT with reason MUTATED, got %v/%v", c.Incident.ToState, c.Incident.ReasonCode)
+	}
+}
+
+type testEventHandler struct {
+	events []IncidentEvent
+}
+
+func (h *testEventHandler) Mutate(*Check, *Result, *Incident) {}
+
+func (h *testEventHandler) Process(*Check, *Result, *Incident) error {
+	return nil
+}
+
+func (h *testEventHandler) ProcessIncidentEvent(_ *Check, event IncidentEvent) error {
+	h.events = append(h.events, event)
+	return nil
+}
+
+func TestCheck_ExecuteProducesIncidentEvents(t *testing.T) {
+	tests := []struct {
+		state ResultState
+		want  []IncidentEventType
+	}{
+		{state: StateOk, want: nil},
+		{state: StateWarn, want: []IncidentEventType{IncidentOpened}},
+		{state: StateWarn, want: nil},
+		{state: StateCrit, want: []IncidentEventType{IncidentEscalated}},
+		{state: StateWarn, want: []IncidentEventType{IncidentDeEscalated}},
+		{state: StateOk, want: []IncidentEventType{IncidentResolved}},
+		{state: StateOk, want: []IncidentEventType{IncidentDiscarded}},
+		{state: StateCrit, want: []IncidentEventType{IncidentOpened}},
+	}
+
+	h := &testEventHandler{}
+	c := &Check{Handlers: []Handler{h}}
+
+	for i, tt := range tests {
+		h.events = nil
+		c.Command = testCommand{result: NewResult(tt.state, "", nil)}
+		if err := c.Execute(); err != nil {
+			t.Fatalf("step %d: unexpected error: %v", i, err)
+		}
+
+		var got []IncidentEventType
+		for _, e := range h.events {
+			got = append(got, e.Type)
+		}
+		if !reflect.DeepEqual(tt.want, got) {
+			t.Errorf("step %d: expected events %v, got %v", i, tt.want, got)
+		}
+	}
+}
+
+func TestCheck_EscalationEventReferencesResolvedPreviousIncident(t *testing.T) {
+	h := &testEventHandler{}
+	c := &Check{Handlers: []Handler{h}, Command: testCommand{result: NewResult(StateWarn, "", nil)}}
+	_ = c.Execute()
+	previous := c.Incident
+
+	h.events = nil
+	c.Command = testCommand{result: NewResult(StateCrit, "", nil)}
+	_ = c.Execute()
+
+	if len(h.events) != 1 {
+		t.Fatalf("expected 1 event, got %d", len(h.events))
+	}
+	e := h.events[0]
+	if e.PreviousIncident != previous || !previous.IsResolved() {
+		t.Error("expected escalation event to reference the resolved previous incident")
+	}
+	if e.Incident != c.Incident {
+		t.Error("expected escalation event to reference the check's new incident")
+	}
+}
+
+func TestCheck_AcknowledgeIncident(t *testing.T) {
+	h := &testEventHandler{}
+	c := &Check{Handlers: []Handler{h}}
+
+	if err := c.AcknowledgeIncident(Acknowledgement{By: "noc"}); err == nil {
+		t.Error("expected error acknowledging without an incident")
+	}
+
+	c.Command = testCommand{result: NewResult(StateCrit, "", nil)}
+	_ = c.Execute()
+	h.events = nil
+
+	if err := c.AcknowledgeIncident(Acknowledgement{By: "noc"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !c.Incident.IsAcknowledged() {
+		t.Error("expected incident to be acknowledged")
+	}
+	if len(h.events) != 1 || h.events[0].Type != IncidentAcknowledged {
+		t.Errorf("expected a single acknowledged event, got %v", h.events)
+	}
+}
+
+// testTracer records the spans started with it.
+type testTracer struct {
+	noop.Tracer
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	parent, _ := trace.SpanFromContext(ctx).(*testSpan)
+	cfg := trace.NewSpanStartConfig(opts...)
+	s := &testSpan{name: name, parent: parent, attrs: cfg.Attributes()}
+
+	t.mu.Lock()
+	t.spans = append(t.spans, s)
+	t.mu.Unlock()
+
+	return trace.ContextWithSpan(ctx, s), s
+}
+
+func (t *testTracer) span(name, handlerType string) *testSpan {
+	for _, s := range t.spans {
+		if s.name == name && (handlerType == "" || s.attr("handler.type") == handlerType) {
+			return s
+		}
+	}
+	return nil
+}
+
+type testSpan struct {
+	noop.Span
+	name   string
+	parent *testSpan
+	attrs  []attribute.KeyValue
+	err    error
+	ended  bool
+}
+
+func (s *testSpan) SetAttributes(kv ...attribute.KeyValue)        { s.attrs = append(s.attrs, kv...) }
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) { s.err = err }
+func (s *testSpan) End(...trace.SpanEndOption)                    { s.ended = true }
+
+func (s *testSpan) attr(key string) string {
+	for _, kv := range s.attrs {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+type testFailingHandler struct{}
+
+func (testFailingHandler) Mutate(*Check, *Result, *Incident) {}
+
+func (testFailingHandler) Process(*Check, *Result, *Incident) error {
+	return errors.New("unavailable")
+}
+
+func TestCheck_ExecuteRecordsSpans(t *testing.T) {
+	tracer := &testTracer{}
+	c := New("router1",
+		WithCommand(testCommand{result: NewResult(StateCrit, "UNREACHABLE", nil)}),
+		WithHandlers([]Handler{&testEventHandler{}, testFailingHandler{}}),
+		WithTracer(tracer),
+	)
+
+	if err := c.Execute(); err == nil {
+		t.Fatal("expected handler error")
+	}
+
+	root := tracer.span("check.execute", "")
+	if root == nil || !root.ended {
+		t.Fatal("expected ended check.execute span")
+	}
+	if root.attr("check.id") != "router1" || root.attr("check.result.state") != "CRIT" ||
+		root.attr("check.result.reason_code") != "UNREACHABLE" {
+		t.Errorf("unexpected check.execute attributes %v", root.attrs)
+	}
+	if root.attr("check.command.type") != "github.com/seankndy/gopoller/check.testCommand" {
+		t.Errorf("unexpected command type %s", root.attr("check.command.type"))
+	}
+	if root.err == nil {
+		t.Error("expected error recorded on check.execute span")
+	}
+
+	cmd := tracer.span("check.command", "")
+	if cmd == nil || cmd.parent != root {
+		t.Fatal("expected check.command span as child of check.execute")
+	}
+
+	for _, name := range []string{"handler.mutate", "handler.process"} {
+		for _, h := range []string{"testEventHandler", "testFailingHandler"} {
+			s := tracer.span(name, "github.com/seankndy/gopoller/check."+h)
+			if s == nil || s.parent != root || !s.ended {
+				t.Errorf("expected ended %s span for %s as child of check.execute", name, h)
+			}
+		}
+	}
+
+	if s := tracer.span("handler.process", "github.com/seankndy/gopoller/check.testFailingHandler"); s.err == nil {
+		t.Error("expected error recorded on failing handler's span")
+	}
+	if s := tracer.span("handler.process", "github.com/seankndy/gopoller/check.testEventHandler"); s.err != nil {
+		t.Errorf("unexpected error recorded on span: %v", s.err)
+	}
+}
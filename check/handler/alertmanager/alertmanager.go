@@ -0,0 +1,443 @@
+// Package alertmanager provides a check.Handler that pushes open Incidents as alerts to Prometheus Alertmanager's
+// /api/v2/alerts API, so that they are routed, grouped and silenced with the rest of Alertmanager's alerts.
+package alertmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/background"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultAlertname = "GopollerCheck"
+
+var errClosed = errors.New("alertmanager handler is closed")
+
+// Alert is a postable Alertmanager alert.
+type Alert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// Handler posts an alert to Alertmanager for every open Incident of the Checks it processes.
+//
+// Alertmanager identifies an alert by its labels: alertname (Alertname), check_id, severity (see Severity),
+// reason_code (when the Incident has one), the LabelMetaKeys of Check.Meta and ExternalLabels.  Annotations are the
+// summary, the incident_id, from_state and acknowledgement of the Incident and the metrics of the Result that
+// opened it (or the latest Result), each prefixed with "metric_".
+//
+// Alertmanager resolves an alert at its endsAt, so like Prometheus the Handler re-posts firing alerts every
+// RepostInterval with an endsAt ResolveTimeout in the future, and posts an alert with endsAt at the time its Incident
+// was resolved (or superseded by an escalation or de-escalation).  Resolved alerts are re-posted for ResendResolved
+// so that an Alertmanager that missed the resolve learns of it.  Firing alerts are tracked in memory; after a restart
+// they are picked up again from the open Incident of the next Result of their Check.  Close the Handler on shutdown
+// to stop re-posting.
+type Handler struct {
+	// URLs are the base URLs of the Alertmanagers (ex. http://alertmanager:9093).  Alerts are posted to every one, as
+	// Alertmanagers in a cluster expect, and a post succeeds if any of them accepts it.
+	URLs []string
+
+	// Alertname is the alertname label (default DefaultAlertname).
+	Alertname string
+
+	// LabelMetaKeys are the Check.Meta keys added as labels.  Keys missing from a Check or with empty values are
+	// omitted.
+	LabelMetaKeys []string
+
+	// ExternalLabels are added to every alert (ex. the poller's name).  The labels above take precedence.
+	ExternalLabels map[string]string
+
+	// GeneratorURL returns a link back to a Check for its alerts.
+	GeneratorURL func(*check.Check) string
+
+	// RepostInterval is how often firing and recently resolved alerts are re-posted (default 1 minute).
+	RepostInterval time.Duration
+
+	// ResolveTimeout is how long after a post Alertmanager resolves a firing alert if it is not posted again
+	// (default 4 times RepostInterval).
+	ResolveTimeout time.Duration
+
+	// ResendResolved is how long resolved alerts keep being re-posted (default 15 minutes).
+	ResendResolved time.Duration
+
+	// Headers are added to every request, ex. Authorization.
+	Headers map[string]string
+
+	// Retries is how many times to retry a request on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	Client *http.Client
+
+	// OnError is called with errors re-posting alerts in the background, and posting to some but not all URLs.
+	OnError func(err error)
+
+	firing   map[uuid.UUID]*Alert
+	resolved map[uuid.UUID]*Alert
+	mu       sync.Mutex
+	reposter background.Loop
+	nowFunc  func() time.Time
+}
+
+func NewHandler(urls ...string) *Handler {
+	return &Handler{
+		URLs:           urls,
+		Alertname:      DefaultAlertname,
+		RepostInterval: time.Minute,
+		ResendResolved: 15 * time.Minute,
+		Retries:        3,
+		RetryBackoff:   time.Second,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+// Process keeps the annotations of a firing alert up to date with the latest Result of its Check, and picks up the
+// open Incident of a Check the Handler is not tracking, such as after a restart.
+func (h *Handler) Process(chk *check.Check, result *check.Result, newIncident *check.Incident) error {
+	if !h.reposter.Start(h.repostInterval(), h.Repost, h.OnError) {
+		return errClosed
+	}
+
+	incident := chk.Incident
+	if newIncident != nil || incident == nil || incident.IsResolved() {
+		return nil
+	}
+
+	alert := h.alert(chk, incident, result)
+
+	h.mu.Lock()
+	firing, ok := h.firing[incident.Id]
+	if ok {
+		firing.Annotations = alert.Annotations
+	} else {
+		h.track(incident.Id, alert)
+	}
+	h.mu.Unlock()
+
+	if ok {
+		return nil
+	}
+	chk.Debugf("posting alert of open incident %s to alertmanager", incident.Id)
+	return h.post(h.withEndsAt([]*Alert{alert}))
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	if !h.reposter.Start(h.repostInterval(), h.Repost, h.OnError) {
+		return errClosed
+	}
+
+	incident := event.Incident
+	now := h.now()
+
+	var alerts []*Alert
+	h.mu.Lock()
+	switch event.Type {
+	case check.IncidentOpened, check.IncidentEscalated, check.IncidentDeEscalated:
+		alert := h.alert(chk, incident, event.Result)
+		if prev := event.PreviousIncident; prev != nil {
+			if resolved := h.resolve(prev.Id, resolvedAt(prev, now)); resolved != nil &&
+				!maps.Equal(resolved.Labels, alert.Labels) {
+				alerts = append(alerts, resolved)
+			}
+		}
+		h.track(incident.Id, alert)
+		alerts = append(alerts, alert)
+	case check.IncidentAcknowledged, check.IncidentAcknowledgementExpired:
+		if firing, ok := h.firing[incident.Id]; ok {
+			alert := h.alert(chk, incident, nil)
+			for k, v := range firing.Annotations {
+				if strings.HasPrefix(k, "metric_") {
+					alert.Annotations[k] = v
+				}
+			}
+			firing.Annotations = alert.Annotations
+			alerts = append(alerts, firing)
+		}
+	case check.IncidentResolved, check.IncidentDiscarded:
+		if resolved := h.resolve(incident.Id, resolvedAt(incident, now)); resolved != nil {
+			alerts = append(alerts, resolved)
+		}
+	}
+	alerts = h.withEndsAt(alerts)
+	h.mu.Unlock()
+
+	if len(alerts) == 0 {
+		return nil
+	}
+	chk.Debugf("posting %d alerts to alertmanager for incident %s event", len(alerts), event.Type)
+	return h.post(alerts)
+}
+
+// Close stops re-posting alerts.  Results and Incident events processed after Close are refused.
+func (h *Handler) Close() error {
+	h.reposter.Stop()
+	return nil
+}
+
+// Firing returns copies of the alerts the Handler is re-posting as firing.
+func (h *Handler) Firing() []Alert {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	alerts := make([]Alert, 0, len(h.firing))
+	for _, a := range h.withEndsAt(mapValues(h.firing)) {
+		alerts = append(alerts, *a)
+	}
+	return alerts
+}
+
+// Repost posts every firing and recently resolved alert now.
+func (h *Handler) Repost() error {
+	h.mu.Lock()
+	now := h.now()
+	for id, a := range h.resolved {
+		if now.Sub(a.EndsAt) > h.resendResolved() {
+			delete(h.resolved, id)
+		}
+	}
+	alerts := h.withEndsAt(append(mapValues(h.firing), mapValues(h.resolved)...))
+	h.mu.Unlock()
+
+	if len(alerts) == 0 {
+		return nil
+	}
+	return h.post(alerts)
+}
+
+// Severity maps a check.ResultState to the severity label of its alerts.
+func Severity(state check.ResultState) string {
+	switch state {
+	case check.StateCrit:
+		return "critical"
+	case check.StateWarn:
+		return "warning"
+	case check.StateOk:
+		return "info"
+	default:
+		return "unknown"
+	}
+}
+
+// alert returns the alert of a Check's Incident, with annotations of the metrics of result (which may be nil).
+func (h *Handler) alert(chk *check.Check, incident *check.Incident, result *check.Result) *Alert {
+	alertname := h.Alertname
+	if alertname == "" {
+		alertname = DefaultAlertname
+	}
+
+	labels := make(map[string]string, len(h.ExternalLabels)+len(h.LabelMetaKeys)+4)
+	for k, v := range h.ExternalLabels {
+		labels[LabelName(k)] = v
+	}
+	for _, key := range h.LabelMetaKeys {
+		if v, ok := chk.Meta[key]; ok && v != nil {
+			if s := fmt.Sprint(v); s != "" {
+				labels[LabelName(key)] = s
+			}
+		}
+	}
+	labels["alertname"] = alertname
+	labels["check_id"] = chk.Id
+	labels["severity"] = Severity(incident.ToState)
+	if incident.ReasonCode != "" {
+		labels["reason_code"] = incident.ReasonCode
+	}
+
+	summary := chk.Id + " is " + incident.ToState.String()
+	if incident.ReasonCode != "" {
+		summary += ": " + incident.ReasonCode
+	}
+	annotations := map[string]string{
+		"summary":     summary,
+		"incident_id": incident.Id.String(),
+		"from_state":  incident.FromState.String(),
+	}
+	if ack := incident.Acknowledgement; ack != nil {
+		annotations["acknowledged_by"] = ack.By
+		if ack.Comment != "" {
+			annotations["acknowledgement_comment"] = ack.Comment
+		}
+	}
+	if result != nil {
+		for _, m := range result.Metrics {
+			annotations["metric_"+LabelName(m.Label)] = m.Value
+		}
+	}
+
+	alert := &Alert{
+		Labels:      labels,
+		Annotations: annotations,
+		StartsAt:    incident.Time,
+	}
+	if h.GeneratorURL != nil {
+		alert.GeneratorURL = h.GeneratorURL(chk)
+	}
+	return alert
+}
+
+// LabelName returns s as a valid Prometheus label name, replacing invalid characters with underscores.
+func LabelName(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+// track adds a firing alert, forgetting resolved alerts with the same labels since Alertmanager sees them as the
+// same alert and re-posting them would resolve the firing one.  h.mu must be held.
+func (h *Handler) track(id uuid.UUID, alert *Alert) {
+	if h.firing == nil {
+		h.firing = make(map[uuid.UUID]*Alert)
+	}
+	h.firing[id] = alert
+
+	for resolvedId, resolved := range h.resolved {
+		if maps.Equal(resolved.Labels, alert.Labels) {
+			delete(h.resolved, resolvedId)
+		}
+	}
+}
+
+// resolve moves the firing alert of an Incident to the resolved alerts, ending at endsAt, and returns it or nil if
+// it was not firing.  h.mu must be held.
+func (h *Handler) resolve(id uuid.UUID, endsAt time.Time) *Alert {
+	alert, ok := h.firing[id]
+	if !ok {
+		return nil
+	}
+	delete(h.firing, id)
+
+	alert.EndsAt = endsAt
+	if h.resolved == nil {
+		h.resolved = make(map[uuid.UUID]*Alert)
+	}
+	h.resolved[id] = alert
+	return alert
+}
+
+// withEndsAt returns copies of alerts to post, with firing alerts ending ResolveTimeout from now.  h.mu must be
+// held.
+func (h *Handler) withEndsAt(alerts []*Alert) []*Alert {
+	endsAt := h.now().Add(h.resolveTimeout())
+
+	copies := make([]*Alert, len(alerts))
+	for i, a := range alerts {
+		c := *a
+		if c.EndsAt.IsZero() {
+			c.EndsAt = endsAt
+		}
+		copies[i] = &c
+	}
+	return copies
+}
+
+// post posts alerts to every Alertmanager, returning an error if none accepted them.
+func (h *Handler) post(alerts []*Alert) error {
+	body, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, u := range h.URLs {
+		u = strings.TrimSuffix(u, "/") + "/api/v2/alerts"
+		_, err := retryhttp.Do(context.Background(), h.client(), func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			for k, v := range h.Headers {
+				req.Header.Set(k, v)
+			}
+			return req, nil
+		}, h.Retries, h.RetryBackoff)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error posting alerts to %s: %v", u, err))
+		}
+	}
+
+	if len(errs) > 0 && len(errs) == len(h.URLs) {
+		return errors.Join(errs...)
+	}
+	if len(errs) > 0 && h.OnError != nil {
+		h.OnError(errors.Join(errs...))
+	}
+	return nil
+}
+
+// resolvedAt returns when an Incident was resolved, or now if it is not (yet).
+func resolvedAt(incident *check.Incident, now time.Time) time.Time {
+	if incident.Resolved != nil {
+		return *incident.Resolved
+	}
+	return now
+}
+
+func mapValues(m map[uuid.UUID]*Alert) []*Alert {
+	alerts := make([]*Alert, 0, len(m))
+	for _, a := range m {
+		alerts = append(alerts, a)
+	}
+	return alerts
+}
+
+func (h *Handler) repostInterval() time.Duration {
+	if h.RepostInterval <= 0 {
+		return time.Minute
+	}
+	return h.RepostInterval
+}
+
+func (h *Handler) resolveTimeout() time.Duration {
+	if h.ResolveTimeout <= 0 {
+		return 4 * h.repostInterval()
+	}
+	return h.ResolveTimeout
+}
+
+func (h *Handler) resendResolved() time.Duration {
+	if h.ResendResolved <= 0 {
+		return 15 * time.Minute
+	}
+	return h.ResendResolved
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h *Handler) client() *http.Client {
+	if h.Client == nil {
+		return defaultClient
+	}
+	return h.Client
+}
+
+func (h *Handler) now() time.Time {
+	if h.nowFunc != nil {
+		return h.nowFunc()
+	}
+	return time.Now()
+}
@@ -0,0 +1,333 @@
+package alertmanager
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	posts  [][]Alert
+	status int
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	s := &stubServer{status: http.StatusOK}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		var alerts []Alert
+		if err := json.NewDecoder(r.Body).Decode(&alerts); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.status == http.StatusOK {
+			s.posts = append(s.posts, alerts)
+		}
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubServer) takePosts() [][]Alert {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	posts := s.posts
+	s.posts = nil
+	return posts
+}
+
+type testCommand struct {
+	state   check.ResultState
+	reason  string
+	metrics []check.ResultMetric
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(c.state, c.reason, c.metrics), nil
+}
+
+func TestIncidentLifecycle(t *testing.T) {
+	srv := newStubServer(t)
+	now := time.Date(2023, 11, 14, 22, 0, 0, 0, time.UTC)
+	h := NewHandler(srv.URL + "/")
+	h.LabelMetaKeys = []string{"site", "missing"}
+	h.ExternalLabels = map[string]string{"poller": "poller1", "check_id": "overridden"}
+	h.GeneratorURL = func(chk *check.Check) string { return "https://poller1/checks/" + chk.Id }
+	h.nowFunc = func() time.Time { return now }
+	defer h.Close()
+
+	chk := check.New("router1", check.WithHandlers([]check.Handler{h}),
+		check.WithMeta(map[string]any{"site": "dc-1"}))
+	chk.Command = testCommand{state: check.StateWarn, reason: "LATENCY_HIGH",
+		metrics: []check.ResultMetric{{Label: "rtt ms", Value: "250"}}}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	warn := chk.Incident
+
+	posts := srv.takePosts()
+	if len(posts) != 1 || len(posts[0]) != 1 {
+		t.Fatalf("expected one alert posted, got %+v", posts)
+	}
+	a := posts[0][0]
+	wantLabels := map[string]string{"alertname": "GopollerCheck", "check_id": "router1", "severity": "warning",
+		"reason_code": "LATENCY_HIGH", "site": "dc-1", "poller": "poller1"}
+	if len(a.Labels) != len(wantLabels) {
+		t.Errorf("wanted labels %v, got %v", wantLabels, a.Labels)
+	}
+	for k, v := range wantLabels {
+		if a.Labels[k] != v {
+			t.Errorf("wanted label %s=%s, got %v", k, v, a.Labels)
+		}
+	}
+	if a.Annotations["summary"] != "router1 is WARN: LATENCY_HIGH" || a.Annotations["metric_rtt_ms"] != "250" ||
+		a.Annotations["incident_id"] != warn.Id.String() || a.Annotations["from_state"] != "UNKNOWN" {
+		t.Errorf("unexpected annotations %v", a.Annotations)
+	}
+	if !a.StartsAt.Equal(warn.Time) || !a.EndsAt.Equal(now.Add(4*time.Minute)) ||
+		a.GeneratorURL != "https://poller1/checks/router1" {
+		t.Errorf("unexpected alert %+v", a)
+	}
+
+	// escalation resolves the warning alert and fires a critical one
+	chk.Command = testCommand{state: check.StateCrit, reason: "LATENCY_HIGH"}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	posts = srv.takePosts()
+	if len(posts) != 1 || len(posts[0]) != 2 {
+		t.Fatalf("expected the resolved and new alerts posted together, got %+v", posts)
+	}
+	if r, f := posts[0][0], posts[0][1]; r.Labels["severity"] != "warning" || !r.EndsAt.Equal(*warn.Resolved) ||
+		f.Labels["severity"] != "critical" || !f.EndsAt.After(now) {
+		t.Errorf("unexpected alerts %+v", posts[0])
+	}
+
+	if err := chk.AcknowledgeIncident(check.Acknowledgement{By: "alice", Comment: "on it"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	posts = srv.takePosts()
+	if len(posts) != 1 || posts[0][0].Annotations["acknowledged_by"] != "alice" ||
+		posts[0][0].Annotations["acknowledgement_comment"] != "on it" {
+		t.Fatalf("expected the acknowledgement posted, got %+v", posts)
+	}
+
+	chk.Command = testCommand{state: check.StateOk}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	posts = srv.takePosts()
+	if len(posts) != 1 || len(posts[0]) != 1 || posts[0][0].Labels["severity"] != "critical" ||
+		!posts[0][0].EndsAt.Equal(*chk.Incident.Resolved) {
+		t.Fatalf("expected the critical alert resolved, got %+v", posts)
+	}
+	if firing := h.Firing(); len(firing) != 0 {
+		t.Errorf("expected no firing alerts, got %+v", firing)
+	}
+}
+
+func TestRepost(t *testing.T) {
+	srv := newStubServer(t)
+	now := time.Now()
+	h := NewHandler(srv.URL)
+	h.RepostInterval = time.Hour
+	h.ResolveTimeout = 5 * time.Minute
+	h.nowFunc = func() time.Time { return now }
+	defer h.Close()
+
+	a := check.New("a", check.WithHandlers([]check.Handler{h}), check.WithCommand(testCommand{state: check.StateCrit}))
+	b := check.New("b", check.WithHandlers([]check.Handler{h}), check.WithCommand(testCommand{state: check.StateCrit}))
+	for _, chk := range []*check.Check{a, b} {
+		if err := chk.Execute(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	b.Command = testCommand{state: check.StateOk}
+	if err := b.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	srv.takePosts()
+
+	now = now.Add(time.Minute)
+	if err := h.Repost(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	posts := srv.takePosts()
+	if len(posts) != 1 || len(posts[0]) != 2 {
+		t.Fatalf("expected the firing and resolved alerts re-posted, got %+v", posts)
+	}
+	for _, alert := range posts[0] {
+		if alert.Labels["check_id"] == "a" && !alert.EndsAt.Equal(now.Add(5*time.Minute)) {
+			t.Errorf("expected the firing alert's endsAt extended, got %v", alert.EndsAt)
+		}
+		if alert.Labels["check_id"] == "b" && !alert.EndsAt.Equal(*b.Incident.Resolved) {
+			t.Errorf("expected the resolved alert's endsAt kept, got %v", alert.EndsAt)
+		}
+	}
+
+	// resolved alerts are re-posted for ResendResolved
+	now = now.Add(16 * time.Minute)
+	if err := h.Repost(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if posts = srv.takePosts(); len(posts) != 1 || len(posts[0]) != 1 || posts[0][0].Labels["check_id"] != "a" {
+		t.Fatalf("expected only the firing alert re-posted, got %+v", posts)
+	}
+}
+
+func TestRepostForgetsResolvedAlertWithSameLabels(t *testing.T) {
+	srv := newStubServer(t)
+	h := NewHandler(srv.URL)
+	h.RepostInterval = time.Hour
+	defer h.Close()
+
+	chk := check.New("a", check.WithHandlers([]check.Handler{h}))
+	var critId string
+	for _, state := range []check.ResultState{check.StateCrit, check.StateOk, check.StateWarn, check.StateCrit} {
+		chk.Command = testCommand{state: state, reason: "DOWN"}
+		if err := chk.Execute(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if critId == "" {
+			critId = chk.Incident.Id.String()
+		}
+	}
+	srv.takePosts()
+
+	// the first critical alert has the same fingerprint as the firing one, so re-posting it would resolve it
+	if err := h.Repost(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	posts := srv.takePosts()
+	if len(posts) != 1 || len(posts[0]) != 2 {
+		t.Fatalf("expected the firing and resolved warning alerts re-posted, got %+v", posts)
+	}
+	for _, alert := range posts[0] {
+		if alert.Annotations["incident_id"] == critId {
+			t.Errorf("expected the resolved critical alert forgotten, got %+v", alert)
+		}
+	}
+}
+
+func TestBackgroundRepost(t *testing.T) {
+	srv := newStubServer(t)
+	h := NewHandler(srv.URL)
+	h.RepostInterval = 10 * time.Millisecond
+
+	chk := check.New("a", check.WithHandlers([]check.Handler{h}), check.WithCommand(testCommand{state: check.StateCrit}))
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(srv.takePosts()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if len(srv.takePosts()) == 0 {
+		t.Errorf("expected the alert to be re-posted")
+	}
+
+	h.Close()
+	srv.takePosts()
+	time.Sleep(30 * time.Millisecond)
+	if posts := srv.takePosts(); len(posts) != 0 {
+		t.Errorf("expected no posts after Close, got %+v", posts)
+	}
+}
+
+func TestPicksUpOpenIncidents(t *testing.T) {
+	srv := newStubServer(t)
+	chk := check.New("a", check.WithCommand(testCommand{state: check.StateCrit, reason: "DOWN"}))
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// as though the poller restarted with the Incident open
+	h := NewHandler(srv.URL)
+	defer h.Close()
+	chk.Handlers = []check.Handler{h}
+	chk.Command = testCommand{state: check.StateCrit, reason: "DOWN",
+		metrics: []check.ResultMetric{{Label: "loss", Value: "100"}}}
+	for i := 0; i < 2; i++ {
+		if err := chk.Execute(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	posts := srv.takePosts()
+	if len(posts) != 1 || posts[0][0].Annotations["incident_id"] != chk.Incident.Id.String() {
+		t.Fatalf("expected the open incident posted once, got %+v", posts)
+	}
+	if firing := h.Firing(); len(firing) != 1 || firing[0].Annotations["metric_loss"] != "100" {
+		t.Errorf("expected the firing alert to have the latest metrics, got %+v", firing)
+	}
+}
+
+func TestMultipleAlertmanagers(t *testing.T) {
+	up, down := newStubServer(t), newStubServer(t)
+	down.status = http.StatusBadRequest
+
+	h := NewHandler(up.URL, down.URL)
+	var errs []error
+	h.OnError = func(err error) { errs = append(errs, err) }
+	defer h.Close()
+
+	chk := check.New("a", check.WithHandlers([]check.Handler{h}), check.WithCommand(testCommand{state: check.StateCrit}))
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("expected success when any alertmanager accepts, got %v", err)
+	}
+	if len(up.takePosts()) != 1 || len(errs) != 1 {
+		t.Errorf("expected a post and an error for the failed alertmanager, got %v", errs)
+	}
+
+	up.status = http.StatusBadRequest
+	chk.Command = testCommand{state: check.StateOk}
+	if err := chk.Execute(); err == nil {
+		t.Errorf("expected an error when no alertmanager accepts")
+	}
+}
+
+func TestLabelName(t *testing.T) {
+	tests := map[string]string{
+		"site":      "site",
+		"rtt ms":    "rtt_ms",
+		"9lives":    "_lives",
+		"a9":        "a9",
+		"dc-1.x":    "dc_1_x",
+		"":          "_",
+		"ünïcode_k": "__n__code_k",
+	}
+	for in, want := range tests {
+		if got := LabelName(in); got != want {
+			t.Errorf("%q: wanted %q, got %q", in, want, got)
+		}
+	}
+}
+
+func TestRefusesAfterClose(t *testing.T) {
+	srv := newStubServer(t)
+	h := NewHandler(srv.URL)
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	chk := check.New("router1", check.WithHandlers([]check.Handler{h}),
+		check.WithCommand(testCommand{state: check.StateCrit}))
+	if err := chk.Execute(); err == nil {
+		t.Error("expected an error processing after Close")
+	}
+	if posts := srv.takePosts(); len(posts) != 0 {
+		t.Errorf("expected nothing posted after Close, got %+v", posts)
+	}
+}
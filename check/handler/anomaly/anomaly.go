@@ -0,0 +1,287 @@
+// Package anomaly provides a check.Handler that learns a per-check, per-metric baseline and raises the Result state
+// when a metric deviates from that baseline beyond configurable sigma bands.
+package anomaly
+
+import (
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/metamodel"
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	ReasonAnomalyHigh = "ANOMALY_HIGH"
+	ReasonAnomalyLow  = "ANOMALY_LOW"
+
+	// DefaultStateKey is the Check.HandlerState key the Model is stored under when Handler.StateKey is empty.
+	DefaultStateKey = "anomaly"
+
+	DefaultAlpha      = 0.1
+	DefaultMinSamples = 10
+
+	week = 7 * 24 * time.Hour
+)
+
+// Direction limits which deviations from the baseline are considered anomalous.
+type Direction uint8
+
+const (
+	Both Direction = iota
+	HighOnly
+	LowOnly
+)
+
+// MetricMonitor defines the sigma bands for a single metric of a Result.
+type MetricMonitor struct {
+	// Label is the ResultMetric label to monitor.
+	Label string
+
+	// Direction limits the deviations that trip the bands (default Both).
+	Direction Direction
+
+	// WarnSigma and CritSigma are the number of standard deviations from the baseline mean a value must be to be
+	// considered WARN or CRIT respectively.  A zero value disables that band.
+	WarnSigma float64
+	CritSigma float64
+
+	// MinStdDev is a floor for the learned standard deviation so that near-constant metrics don't trip the bands on
+	// tiny changes.
+	MinStdDev float64
+}
+
+// Handler is a check.ResultMutator that compares the configured metrics of a Result to a learned baseline and
+// raises the Result state to WARN/CRIT with reason ANOMALY_HIGH or ANOMALY_LOW when a value deviates beyond the
+// MetricMonitor sigma bands.  The baseline is an exponentially weighted moving mean and variance, optionally keyed
+// by time-of-week so that diurnal/weekly traffic patterns are learned.  Model state lives in the Check's
+// HandlerState so that it is stored along with the Check without being exported by handlers that export Meta.
+//
+// Counter metrics are monitored by their per-second rate rather than their raw value.
+type Handler struct {
+	Monitors []MetricMonitor
+
+	// Alpha is the EWMA smoothing factor between 0 and 1.  Higher values adapt faster to change (default 0.1).
+	Alpha float64
+
+	// SeasonBuckets splits the week into this many equal buckets, each with its own baseline.  For example, 168
+	// gives each hour of the week its own baseline.  0 or 1 uses a single baseline.
+	SeasonBuckets int
+
+	// MinSamples is the number of samples a baseline must have learned before it is used to raise the Result state
+	// (default 10).
+	MinSamples int
+
+	// StateKey is the Check.HandlerState key that the Model is stored under (default "anomaly").
+	StateKey string
+}
+
+func NewHandler(monitors []MetricMonitor) *Handler {
+	return &Handler{
+		Monitors:   monitors,
+		Alpha:      DefaultAlpha,
+		MinSamples: DefaultMinSamples,
+		StateKey:   DefaultStateKey,
+	}
+}
+
+func (h *Handler) MutateResult(chk *check.Check, result *check.Result) {
+	if len(h.Monitors) == 0 || len(result.Metrics) == 0 {
+		return
+	}
+
+	model := h.model(chk)
+
+	for _, monitor := range h.Monitors {
+		metric := metamodel.FindMetric(result, monitor.Label)
+		if metric == nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(metric.Value, 64)
+		if err != nil {
+			chk.Debugf("metric %s value %q is not numeric: %v", metric.Label, metric.Value, err)
+			continue
+		}
+
+		mm := model.Metrics[monitor.Label]
+		if mm == nil {
+			mm = &MetricModel{}
+			model.Metrics[monitor.Label] = mm
+		}
+
+		if metric.Type == check.ResultMetricCounter {
+			var ok bool
+			if value, ok = mm.rate(value, result.Time); !ok {
+				chk.Debugf("metric %s has no usable previous counter value yet", metric.Label)
+				continue
+			}
+		}
+
+		baseline := mm.baseline(h.bucket(result.Time), h.seasonBuckets())
+
+		if baseline.Samples >= h.minSamples() {
+			state, reason, sigma := monitor.evaluate(value, baseline)
+			chk.Debugf("metric %s value=%f mean=%f stddev=%f sigma=%.2f state=%s",
+				metric.Label, value, baseline.Mean, baseline.StdDev(), sigma, state.String())
+
+			if state.Overrides(result.State) {
+				result.State, result.ReasonCode = state, reason
+			}
+		}
+
+		baseline.Update(value, h.alpha())
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+// model returns the Model stored in the Check's HandlerState, creating it if it does not exist.
+func (h *Handler) model(chk *check.Check) *Model {
+	model := metamodel.Load[Model](chk, h.stateKey(), "anomaly")
+	if model.Metrics == nil {
+		model.Metrics = make(map[string]*MetricModel)
+	}
+	return model
+}
+
+// bucket returns the time-of-week bucket index for t.
+func (h *Handler) bucket(t time.Time) int {
+	n := h.seasonBuckets()
+	if n == 1 {
+		return 0
+	}
+
+	y, m, d := t.Date()
+	startOfWeek := time.Date(y, m, d-int(t.Weekday()), 0, 0, 0, 0, t.Location())
+	idx := int(t.Sub(startOfWeek) * time.Duration(n) / week)
+
+	return min(max(idx, 0), n-1)
+}
+
+func (h *Handler) seasonBuckets() int {
+	if h.SeasonBuckets < 1 {
+		return 1
+	}
+	return h.SeasonBuckets
+}
+
+func (h *Handler) alpha() float64 {
+	if h.Alpha <= 0 || h.Alpha > 1 {
+		return DefaultAlpha
+	}
+	return h.Alpha
+}
+
+func (h *Handler) minSamples() int {
+	if h.MinSamples <= 0 {
+		return DefaultMinSamples
+	}
+	return h.MinSamples
+}
+
+func (h *Handler) stateKey() string {
+	if h.StateKey == "" {
+		return DefaultStateKey
+	}
+	return h.StateKey
+}
+
+// evaluate returns the state and reason code for value given the baseline, along with how many standard deviations
+// value is from the baseline's mean.
+func (m MetricMonitor) evaluate(value float64, baseline *Baseline) (check.ResultState, string, float64) {
+	stdDev := max(baseline.StdDev(), m.MinStdDev)
+	if stdDev == 0 {
+		return check.StateOk, "", 0
+	}
+
+	sigma := (value - baseline.Mean) / stdDev
+
+	reason := ReasonAnomalyHigh
+	if sigma < 0 {
+		if m.Direction == HighOnly {
+			return check.StateOk, "", sigma
+		}
+		reason = ReasonAnomalyLow
+	} else if m.Direction == LowOnly {
+		return check.StateOk, "", sigma
+	}
+
+	if m.CritSigma > 0 && math.Abs(sigma) > m.CritSigma {
+		return check.StateCrit, reason, sigma
+	} else if m.WarnSigma > 0 && math.Abs(sigma) > m.WarnSigma {
+		return check.StateWarn, reason, sigma
+	}
+
+	return check.StateOk, "", sigma
+}
+
+// Model is the learned state for a Check.  It only contains exported fields so that it serializes along with the
+// rest of the Check's HandlerState.
+type Model struct {
+	Metrics map[string]*MetricModel
+}
+
+// MetricModel is the learned state of a single metric.
+type MetricModel struct {
+	// Baselines holds one Baseline per time-of-week bucket.
+	Baselines []Baseline
+
+	// LastValue and LastTime are the previous raw counter value and its time, used to calculate counter rates.
+	LastValue *float64
+	LastTime  time.Time
+}
+
+// baseline returns the Baseline for bucket idx, resizing Baselines if the number of buckets has changed.
+func (m *MetricModel) baseline(idx, buckets int) *Baseline {
+	if len(m.Baselines) != buckets {
+		m.Baselines = make([]Baseline, buckets)
+	}
+	return &m.Baselines[idx]
+}
+
+// rate records the counter value at t and returns the per-second rate since the previous value.  ok is false if
+// there is no previous value or the counter reset/rolled over.
+func (m *MetricModel) rate(value float64, t time.Time) (rate float64, ok bool) {
+	lastValue, lastTime := m.LastValue, m.LastTime
+	m.LastValue, m.LastTime = &value, t
+
+	if lastValue == nil || value < *lastValue {
+		return 0, false
+	}
+	secs := t.Sub(lastTime).Seconds()
+	if secs <= 0 {
+		return 0, false
+	}
+
+	return (value - *lastValue) / secs, true
+}
+
+// Baseline is an exponentially weighted moving mean and variance.
+type Baseline struct {
+	Mean     float64
+	Variance float64
+	Samples  int
+}
+
+// Update folds value into the Baseline using smoothing factor alpha.
+func (b *Baseline) Update(value, alpha float64) {
+	if b.Samples == 0 {
+		b.Mean, b.Variance = value, 0
+	} else {
+		diff := value - b.Mean
+		incr := alpha * diff
+		b.Mean += incr
+		b.Variance = (1 - alpha) * (b.Variance + diff*incr)
+	}
+	b.Samples++
+}
+
+// StdDev returns the standard deviation of the Baseline.
+func (b *Baseline) StdDev() float64 {
+	return math.Sqrt(b.Variance)
+}
@@ -0,0 +1,193 @@
+package anomaly
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/check/handler/webhook"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRaisesStateWhenValueDeviatesFromBaseline(t *testing.T) {
+	tests := []struct {
+		name           string
+		value          string
+		wantState      check.ResultState
+		wantReasonCode string
+	}{
+		{name: "within_bands", value: "10.5", wantState: check.StateOk, wantReasonCode: ""},
+		{name: "warn_high", value: "13.5", wantState: check.StateWarn, wantReasonCode: ReasonAnomalyHigh},
+		{name: "crit_high", value: "20", wantState: check.StateCrit, wantReasonCode: ReasonAnomalyHigh},
+		{name: "crit_low", value: "0", wantState: check.StateCrit, wantReasonCode: ReasonAnomalyLow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler([]MetricMonitor{{Label: "avg", WarnSigma: 2, CritSigma: 4}})
+			chk := &check.Check{}
+			tm := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+			// learn a baseline alternating between 9 and 11
+			for i := 0; i < 50; i++ {
+				v := "9"
+				if i%2 == 0 {
+					v = "11"
+				}
+				r := &check.Result{State: check.StateOk, Metrics: []check.ResultMetric{{Label: "avg", Value: v}}, Time: tm}
+				h.MutateResult(chk, r)
+				if r.State != check.StateOk {
+					t.Fatalf("unexpected state %v while learning baseline", r.State)
+				}
+				tm = tm.Add(time.Minute)
+			}
+
+			r := &check.Result{State: check.StateOk, Metrics: []check.ResultMetric{{Label: "avg", Value: tt.value}}, Time: tm}
+			h.MutateResult(chk, r)
+
+			if r.State != tt.wantState {
+				t.Errorf("wanted state %v, got %v", tt.wantState, r.State)
+			}
+			if r.ReasonCode != tt.wantReasonCode {
+				t.Errorf("wanted reason code %q, got %q", tt.wantReasonCode, r.ReasonCode)
+			}
+		})
+	}
+}
+
+func TestDoesNotRaiseStateBeforeMinSamples(t *testing.T) {
+	h := NewHandler([]MetricMonitor{{Label: "avg", WarnSigma: 1, CritSigma: 2}})
+	h.MinSamples = 5
+	chk := &check.Check{}
+
+	for _, v := range []string{"1", "2", "1", "2", "100"} {
+		r := &check.Result{State: check.StateOk, Metrics: []check.ResultMetric{{Label: "avg", Value: v}}, Time: time.Now()}
+		h.MutateResult(chk, r)
+		if r.State != check.StateOk {
+			t.Errorf("wanted state OK before min samples reached, got %v", r.State)
+		}
+	}
+}
+
+func TestDirectionLimitsBands(t *testing.T) {
+	h := NewHandler([]MetricMonitor{{Label: "avg", Direction: HighOnly, WarnSigma: 1, MinStdDev: 1}})
+	h.MinSamples = 1
+	chk := &check.Check{}
+
+	h.MutateResult(chk, &check.Result{Metrics: []check.ResultMetric{{Label: "avg", Value: "10"}}})
+
+	r := &check.Result{State: check.StateOk, Metrics: []check.ResultMetric{{Label: "avg", Value: "0"}}}
+	h.MutateResult(chk, r)
+	if r.State != check.StateOk {
+		t.Errorf("wanted low deviation to be ignored with HighOnly, got state %v", r.State)
+	}
+}
+
+func TestSeasonBucketsLearnSeparateBaselines(t *testing.T) {
+	h := NewHandler([]MetricMonitor{{Label: "bps", WarnSigma: 3, MinStdDev: 1}})
+	h.SeasonBuckets = 168
+	h.MinSamples = 3
+	chk := &check.Check{}
+
+	night := time.Date(2024, 1, 1, 3, 0, 0, 0, time.UTC)
+	day := time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		h.MutateResult(chk, &check.Result{Metrics: []check.ResultMetric{{Label: "bps", Value: "10"}}, Time: night.Add(time.Duration(i) * week)})
+		h.MutateResult(chk, &check.Result{Metrics: []check.ResultMetric{{Label: "bps", Value: "1000"}}, Time: day.Add(time.Duration(i) * week)})
+	}
+
+	r := &check.Result{State: check.StateOk, Metrics: []check.ResultMetric{{Label: "bps", Value: "1000"}}, Time: day.Add(5 * week)}
+	h.MutateResult(chk, r)
+	if r.State != check.StateOk {
+		t.Errorf("wanted daytime traffic to match daytime baseline, got state %v", r.State)
+	}
+
+	r = &check.Result{State: check.StateOk, Metrics: []check.ResultMetric{{Label: "bps", Value: "1000"}}, Time: night.Add(5 * week)}
+	h.MutateResult(chk, r)
+	if r.State != check.StateWarn || r.ReasonCode != ReasonAnomalyHigh {
+		t.Errorf("wanted nighttime traffic at daytime levels to be anomalous, got state %v reason %q", r.State, r.ReasonCode)
+	}
+}
+
+func TestCountersAreMonitoredByRate(t *testing.T) {
+	h := NewHandler([]MetricMonitor{{Label: "octets", WarnSigma: 1}})
+	chk := &check.Check{}
+	tm := time.Now()
+
+	h.MutateResult(chk, &check.Result{Metrics: []check.ResultMetric{{Label: "octets", Value: "1000", Type: check.ResultMetricCounter}}, Time: tm})
+	h.MutateResult(chk, &check.Result{Metrics: []check.ResultMetric{{Label: "octets", Value: "1600", Type: check.ResultMetricCounter}}, Time: tm.Add(60 * time.Second)})
+
+	model := chk.HandlerState[DefaultStateKey].(*Model)
+	got := model.Metrics["octets"].Baselines[0]
+	if got.Samples != 1 || got.Mean != 10 {
+		t.Errorf("wanted a single sample with rate 10, got %+v", got)
+	}
+}
+
+func TestModelSurvivesSerialization(t *testing.T) {
+	h := NewHandler([]MetricMonitor{{Label: "avg", WarnSigma: 2}})
+	chk := &check.Check{}
+	h.MutateResult(chk, &check.Result{Metrics: []check.ResultMetric{{Label: "avg", Value: "5"}}})
+
+	b, err := json.Marshal(chk.HandlerState)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var state map[string]any
+	if err := json.Unmarshal(b, &state); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	restored := &check.Check{HandlerState: state}
+	h.MutateResult(restored, &check.Result{Metrics: []check.ResultMetric{{Label: "avg", Value: "5"}}})
+
+	model := restored.HandlerState[DefaultStateKey].(*Model)
+	if got := model.Metrics["avg"].Baselines[0].Samples; got != 2 {
+		t.Errorf("wanted restored model to have 2 samples, got %d", got)
+	}
+}
+
+func TestModelIsNotExportedWithMeta(t *testing.T) {
+	var payloads [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payloads = append(payloads, body)
+	}))
+	defer srv.Close()
+
+	wh, _ := webhook.NewHandler(srv.URL, "")
+	wh.SendResults = true
+	chk := check.New("router1",
+		check.WithCommand(testCommand{value: "5"}),
+		check.WithMeta(map[string]any{"site": "dc1"}),
+		check.WithHandlers([]check.Handler{NewHandler([]MetricMonitor{{Label: "avg", WarnSigma: 2}}), wh}),
+	)
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := chk.HandlerState[DefaultStateKey].(*Model); !ok {
+		t.Fatal("expected the model to be kept in the check's handler state")
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 payload, got %d", len(payloads))
+	}
+	var got struct{ Meta map[string]any }
+	if err := json.Unmarshal(payloads[0], &got); err != nil {
+		t.Fatalf("bad payload %s: %v", payloads[0], err)
+	}
+	if want := map[string]any{"site": "dc1"}; !reflect.DeepEqual(got.Meta, want) {
+		t.Errorf("expected exported meta %v, got %v", want, got.Meta)
+	}
+}
+
+type testCommand struct {
+	value string
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "avg", Value: c.value}}), nil
+}
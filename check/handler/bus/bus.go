@@ -0,0 +1,353 @@
+// Package bus provides a check.Handler that publishes Results and Incident events to a message bus, with
+// Publishers for MQTT (3.1.1 and 5) and NATS core.  Messages are serialized as JSON or protobuf and published to a
+// topic rendered from a template of the Check, and are buffered while the bus is unreachable.
+//
+// Other buses, such as Kafka, can be published to by implementing Publisher with their client library.
+package bus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/background"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// TypeResult is the Type of the Message of a Result.  Incident event Messages have the check.IncidentEventType as
+// their Type (ex. "OPENED").
+const TypeResult = "RESULT"
+
+// DefaultTopicTemplate is the topic template used when Handler.TopicTemplate is nil.
+var DefaultTopicTemplate = template.Must(
+	template.New("topic").Option("missingkey=zero").Parse("gopoller/{{ .CheckId }}/{{ .Type }}"),
+)
+
+// ErrRejected is wrapped by Publisher errors for messages the bus refused (ex. not authorized to publish to the
+// topic, or too large), which would be refused again if retried.
+var ErrRejected = errors.New("message rejected")
+
+// Publisher publishes messages to a message bus.
+type Publisher interface {
+	// Publish publishes payload to topic, connecting first if needed, and returns once the bus has acknowledged the
+	// message to the extent the Publisher is configured to wait for.  contentType is the MIME type of the payload,
+	// sent along with it where the bus supports message metadata.
+	Publish(ctx context.Context, topic, contentType string, payload []byte) error
+
+	// Close disconnects from the bus.
+	Close() error
+}
+
+// Message is a Result or Incident event to be serialized and published.
+type Message struct {
+	// Type is TypeResult or the Incident event type (ex. OPENED).
+	Type  string
+	Check *check.Check
+	Time  time.Time
+
+	// Result is the Result of a RESULT Message, or the Result that caused an Incident event (if any).
+	Result *check.Result
+
+	// Incident and PreviousIncident are those of an Incident event.
+	Incident         *check.Incident
+	PreviousIncident *check.Incident
+}
+
+// TopicData is the data a topic template is executed with.  Every value is sanitized with SanitizeToken so that it
+// is a single topic level or subject token.
+type TopicData struct {
+	CheckId string
+	Type    string
+
+	// State is the state of the Result, or the to-state of the Incident for Incident events.
+	State string
+
+	Meta map[string]string
+}
+
+// Handler publishes a Message for every Result and Incident event of the Checks it processes with Publisher.
+//
+// Messages are published in order by a background goroutine.  While the bus is unreachable they are buffered, up
+// to MaxBuffered, and retried every RetryInterval; messages the bus rejects (see ErrRejected) are discarded.  Close
+// the Handler on shutdown to publish what is buffered and disconnect.
+type Handler struct {
+	Publisher Publisher
+
+	// TopicTemplate renders the topic (or subject) of a Message from a TopicData (default DefaultTopicTemplate).
+	// Missing Meta keys render empty with the missingkey=zero option.
+	TopicTemplate *template.Template
+
+	// Serializer encodes Messages (default JSON).
+	Serializer Serializer
+
+	// Results and IncidentEvents select what is published (NewHandler enables both).
+	Results        bool
+	IncidentEvents bool
+
+	// MaxBuffered is the most messages buffered waiting to be published.  Messages processed while the buffer is
+	// full are dropped and counted in Stats (default 10000).
+	MaxBuffered int
+
+	// RetryInterval is how long to wait before retrying after a failure to publish (default 5 seconds).
+	RetryInterval time.Duration
+
+	// PublishTimeout bounds each Publish, including connecting (default 10 seconds).
+	PublishTimeout time.Duration
+
+	// OnError is called with publish errors, as publishing happens in the background rather than in Process.
+	OnError func(err error)
+
+	buffer    []publication
+	mu        sync.Mutex
+	publisher background.Loop
+	publishMu sync.Mutex
+
+	published atomic.Uint64
+	dropped   atomic.Uint64
+	rejected  atomic.Uint64
+}
+
+// Stats counts the messages a Handler has handled.
+type Stats struct {
+	// Published is the number of messages successfully published.
+	Published uint64
+	// Dropped is the number of messages discarded because the buffer was full.
+	Dropped uint64
+	// Rejected is the number of messages discarded because the bus refused them.
+	Rejected uint64
+	// Buffered is the number of messages waiting to be published.
+	Buffered int
+}
+
+// publication is a serialized Message waiting to be published.
+type publication struct {
+	topic   string
+	payload []byte
+}
+
+// NewHandler creates a new Handler publishing with publisher to topics rendered from topicTmpl.  An empty topicTmpl
+// uses DefaultTopicTemplate.
+func NewHandler(publisher Publisher, topicTmpl string) (*Handler, error) {
+	h := &Handler{
+		Publisher:      publisher,
+		Serializer:     JSON,
+		Results:        true,
+		IncidentEvents: true,
+		MaxBuffered:    10000,
+		RetryInterval:  5 * time.Second,
+		PublishTimeout: 10 * time.Second,
+	}
+
+	if topicTmpl != "" {
+		t, err := template.New("topic").Option("missingkey=zero").Parse(topicTmpl)
+		if err != nil {
+			return nil, err
+		}
+		h.TopicTemplate = t
+	}
+
+	return h, nil
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	if !h.Results {
+		return nil
+	}
+
+	return h.enqueue(&Message{
+		Type:   TypeResult,
+		Check:  chk,
+		Time:   result.Time,
+		Result: result,
+	})
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	if !h.IncidentEvents {
+		return nil
+	}
+
+	return h.enqueue(&Message{
+		Type:             event.Type.String(),
+		Check:            chk,
+		Time:             event.Time,
+		Result:           event.Result,
+		Incident:         event.Incident,
+		PreviousIncident: event.PreviousIncident,
+	})
+}
+
+// Topic returns the topic msg is published to.
+func (h *Handler) Topic(msg *Message) (string, error) {
+	tmpl := h.TopicTemplate
+	if tmpl == nil {
+		tmpl = DefaultTopicTemplate
+	}
+
+	data := TopicData{
+		CheckId: SanitizeToken(msg.Check.Id),
+		Type:    SanitizeToken(msg.Type),
+		Meta:    make(map[string]string, len(msg.Check.Meta)),
+	}
+	if msg.Incident != nil && msg.Type != TypeResult {
+		data.State = msg.Incident.ToState.String()
+	} else if msg.Result != nil {
+		data.State = msg.Result.State.String()
+	}
+	for k, v := range msg.Check.Meta {
+		if v != nil {
+			data.Meta[k] = SanitizeToken(fmt.Sprint(v))
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error rendering topic: %v", err)
+	}
+	if buf.Len() == 0 {
+		return "", errors.New("topic template rendered an empty topic")
+	}
+	return buf.String(), nil
+}
+
+// SanitizeToken replaces the characters MQTT and NATS treat as level separators or wildcards ('/', '.', '+', '#',
+// '*' and '>'), whitespace and control characters with underscores.
+func SanitizeToken(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r <= ' ', r == 0x7f, strings.ContainsRune("/.+#*>", r):
+			return '_'
+		default:
+			return r
+		}
+	}, s)
+}
+
+// Flush publishes every buffered message now, stopping at the first failure to publish that is not a rejection.
+func (h *Handler) Flush() error {
+	h.publishMu.Lock()
+	defer h.publishMu.Unlock()
+
+	for {
+		h.mu.Lock()
+		if len(h.buffer) == 0 {
+			h.mu.Unlock()
+			return nil
+		}
+		p := h.buffer[0]
+		h.mu.Unlock()
+
+		err := h.publish(p)
+		if err != nil && !errors.Is(err, ErrRejected) {
+			return err
+		}
+
+		h.mu.Lock()
+		h.buffer[0] = publication{}
+		h.buffer = h.buffer[1:]
+		h.mu.Unlock()
+
+		if err != nil {
+			h.rejected.Add(1)
+			if h.OnError != nil {
+				h.OnError(err)
+			}
+			continue
+		}
+		h.published.Add(1)
+	}
+}
+
+// Close stops the background publisher, publishes every buffered message and closes the Publisher.  Messages are
+// refused after Close.
+func (h *Handler) Close() error {
+	h.publisher.Stop()
+	return errors.Join(h.Flush(), h.Publisher.Close())
+}
+
+// Stats returns the message counts of the Handler.
+func (h *Handler) Stats() Stats {
+	h.mu.Lock()
+	buffered := len(h.buffer)
+	h.mu.Unlock()
+
+	return Stats{
+		Published: h.published.Load(),
+		Dropped:   h.dropped.Load(),
+		Rejected:  h.rejected.Load(),
+		Buffered:  buffered,
+	}
+}
+
+func (h *Handler) enqueue(msg *Message) error {
+	topic, err := h.Topic(msg)
+	if err != nil {
+		return err
+	}
+	serializer := h.Serializer
+	if serializer == nil {
+		serializer = JSON
+	}
+	payload, err := serializer.Serialize(msg)
+	if err != nil {
+		return fmt.Errorf("error serializing %s message: %v", msg.Type, err)
+	}
+
+	if !h.publisher.Start(h.retryInterval(), h.Flush, h.OnError) {
+		return errors.New("bus handler is closed")
+	}
+
+	h.mu.Lock()
+	if len(h.buffer) >= h.maxBuffered() {
+		h.mu.Unlock()
+		h.dropped.Add(1)
+		msg.Check.Debugf("bus buffer full, dropping %s message", msg.Type)
+		return nil
+	}
+	h.buffer = append(h.buffer, publication{topic: topic, payload: payload})
+	h.mu.Unlock()
+
+	h.publisher.Kick()
+	return nil
+}
+
+func (h *Handler) publish(p publication) error {
+	timeout := h.PublishTimeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	serializer := h.Serializer
+	if serializer == nil {
+		serializer = JSON
+	}
+	if err := h.Publisher.Publish(ctx, p.topic, serializer.ContentType(), p.payload); err != nil {
+		return fmt.Errorf("error publishing to %s: %w", p.topic, err)
+	}
+	return nil
+}
+
+func (h *Handler) retryInterval() time.Duration {
+	if h.RetryInterval <= 0 {
+		return 5 * time.Second
+	}
+	return h.RetryInterval
+}
+
+func (h *Handler) maxBuffered() int {
+	if h.MaxBuffered <= 0 {
+		return 10000
+	}
+	return h.MaxBuffered
+}
@@ -0,0 +1,294 @@
+package bus
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/protowire"
+	"sync"
+	"testing"
+	"time"
+)
+
+type published struct {
+	topic, contentType string
+	payload            []byte
+}
+
+// fakePublisher records what it publishes, failing while down and rejecting topics in reject.
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []published
+	down      bool
+	reject    map[string]bool
+	closed    bool
+}
+
+func (p *fakePublisher) Publish(_ context.Context, topic, contentType string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.down {
+		return errors.New("connection refused")
+	}
+	if p.reject[topic] {
+		return ErrRejected
+	}
+	p.published = append(p.published, published{topic, contentType, payload})
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *fakePublisher) setDown(down bool) {
+	p.mu.Lock()
+	p.down = down
+	p.mu.Unlock()
+}
+
+func (p *fakePublisher) topics() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var topics []string
+	for _, m := range p.published {
+		topics = append(topics, m.topic)
+	}
+	return topics
+}
+
+var t0 = time.Date(2023, 11, 14, 22, 13, 20, 0, time.UTC)
+
+func testEvent() check.IncidentEvent {
+	result := check.NewResult(check.StateCrit, "TIMEOUT",
+		[]check.ResultMetric{{Label: "rtt", Value: "1.5", Type: check.ResultMetricGauge}})
+	result.Time = t0
+	incident := check.MakeIncidentFromResults(check.NewResult(check.StateOk, "", nil), result)
+	return check.IncidentEvent{Type: check.IncidentOpened, Incident: incident, Result: result, Time: t0}
+}
+
+func TestTopic(t *testing.T) {
+	chk := check.New("router1.example.com", check.WithMeta(map[string]any{"site": "dc 1/a", "rack": 4}))
+	event := testEvent()
+
+	tests := []struct {
+		name string
+		tmpl string
+		msg  *Message
+		want string
+	}{
+		{"default", "", &Message{Type: TypeResult, Check: chk, Result: event.Result},
+			"gopoller/router1_example_com/RESULT"},
+		{"meta", "checks.{{ .Meta.site }}.{{ .Meta.rack }}.{{ .CheckId }}.{{ .State }}",
+			&Message{Type: TypeResult, Check: chk, Result: check.NewResult(check.StateWarn, "", nil)},
+			"checks.dc_1_a.4.router1_example_com.WARN"},
+		{"missing meta", "{{ .Meta.missing }}x/{{ .Type }}",
+			&Message{Type: "OPENED", Check: chk, Incident: event.Incident}, "x/OPENED"},
+		{"incident state", "{{ .State }}",
+			&Message{Type: "RESOLVED", Check: chk, Result: check.NewResult(check.StateOk, "", nil),
+				Incident: event.Incident}, "CRIT"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHandler(&fakePublisher{}, tt.tmpl)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got, err := h.Topic(tt.msg); err != nil || got != tt.want {
+				t.Errorf("wanted %q, got %q (%v)", tt.want, got, err)
+			}
+		})
+	}
+
+	h, _ := NewHandler(&fakePublisher{}, "{{ .Meta.missing }}")
+	if _, err := h.Topic(&Message{Type: TypeResult, Check: chk}); err == nil {
+		t.Errorf("expected an error for an empty topic")
+	}
+}
+
+func TestHandlerPublishesInOrderAndRetries(t *testing.T) {
+	publisher := &fakePublisher{down: true}
+	h, _ := NewHandler(publisher, "")
+	h.RetryInterval = 10 * time.Millisecond
+	errs := make(chan error, 100)
+	h.OnError = func(err error) { errs <- err }
+
+	chk := check.New("router1")
+	event := testEvent()
+	if err := h.Process(chk, event.Result, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := h.ProcessIncidentEvent(chk, event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected an error while the bus is down")
+	}
+	if s := h.Stats(); s.Buffered != 2 || s.Published != 0 {
+		t.Errorf("expected 2 messages buffered while the bus is down, got %+v", s)
+	}
+
+	publisher.setDown(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for h.Stats().Published < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if topics := publisher.topics(); len(topics) != 2 || topics[0] != "gopoller/router1/RESULT" ||
+		topics[1] != "gopoller/router1/OPENED" {
+		t.Fatalf("expected the result then the incident event, got %v", topics)
+	}
+	if publisher.published[0].contentType != "application/json" {
+		t.Errorf("unexpected content type %q", publisher.published[0].contentType)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !publisher.closed {
+		t.Errorf("expected the publisher to be closed")
+	}
+	if err := h.ProcessIncidentEvent(chk, event); err == nil {
+		t.Errorf("expected an error processing after Close")
+	}
+}
+
+func TestHandlerDropsWhenFullAndDiscardsRejected(t *testing.T) {
+	publisher := &fakePublisher{down: true, reject: map[string]bool{"gopoller/bad/RESULT": true}}
+	h, _ := NewHandler(publisher, "")
+	h.MaxBuffered = 2
+	h.RetryInterval = time.Hour
+	h.IncidentEvents = false
+
+	result := testEvent().Result
+	for _, id := range []string{"bad", "good", "dropped"} {
+		if err := h.Process(check.New(id), result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := h.ProcessIncidentEvent(check.New("good"), testEvent()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	publisher.setDown(false)
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if topics := publisher.topics(); len(topics) != 1 || topics[0] != "gopoller/good/RESULT" {
+		t.Errorf("expected only the good result published, got %v", topics)
+	}
+	if s := h.Stats(); s.Published != 1 || s.Rejected != 1 || s.Dropped != 1 || s.Buffered != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestJSONSerializer(t *testing.T) {
+	event := testEvent()
+	chk := check.New("router1", check.WithMeta(map[string]any{"site": "dc1"}))
+	b, err := JSON.Serialize(&Message{Type: "OPENED", Check: chk, Time: t0, Result: event.Result,
+		Incident: event.Incident})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got map[string]any
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	result, _ := got["result"].(map[string]any)
+	incident, _ := got["incident"].(map[string]any)
+	if got["type"] != "OPENED" || got["check_id"] != "router1" || got["time"] != "2023-11-14T22:13:20Z" ||
+		got["meta"].(map[string]any)["site"] != "dc1" || got["previous_incident"] != nil {
+		t.Errorf("unexpected event %s", b)
+	}
+	if result["state"] != "CRIT" || result["reason_code"] != "TIMEOUT" ||
+		result["metrics"].([]any)[0].(map[string]any)["type"] != "GAUGE" {
+		t.Errorf("unexpected result %v", result)
+	}
+	if incident["id"] != event.Incident.Id.String() || incident["from_state"] != "OK" || incident["to_state"] != "CRIT" {
+		t.Errorf("unexpected incident %v", incident)
+	}
+}
+
+// decodeProto decodes the fields of a protobuf message, which are all strings, embedded messages or fixed64 in the
+// Protobuf schema, into their raw values by field number.
+func decodeProto(t *testing.T, b []byte) map[int][][]byte {
+	t.Helper()
+	fields := make(map[int][][]byte)
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			t.Fatalf("malformed tag")
+		}
+		b = b[n:]
+		field := int(key >> 3)
+		switch key & 7 {
+		case protowire.Fixed64:
+			fields[field] = append(fields[field], b[:8])
+			b = b[8:]
+		case protowire.Bytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || int(l) > len(b)-n {
+				t.Fatalf("malformed length")
+			}
+			fields[field] = append(fields[field], b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestProtobufSerializer(t *testing.T) {
+	event := testEvent()
+	resolved := t0.Add(time.Minute)
+	event.Incident.Resolved = &resolved
+	chk := check.New("router1", check.WithMeta(map[string]any{"site": "dc1", "rack": 4}))
+	b, err := Protobuf.Serialize(&Message{Type: "RESOLVED", Check: chk, Time: resolved, Result: event.Result,
+		Incident: event.Incident})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	e := decodeProto(t, b)
+	if string(e[fieldEventType][0]) != "RESOLVED" || string(e[fieldEventCheckId][0]) != "router1" ||
+		binary.LittleEndian.Uint64(e[fieldEventTimeUnixNano][0]) != uint64(resolved.UnixNano()) {
+		t.Errorf("unexpected event fields %v", e)
+	}
+	if len(e[fieldEventMeta]) != 2 || len(e[fieldEventPreviousIncident]) != 0 {
+		t.Fatalf("expected 2 meta entries and no previous incident, got %v", e)
+	}
+	if entry := decodeProto(t, e[fieldEventMeta][0]); string(entry[fieldMapKey][0]) != "rack" ||
+		string(entry[fieldMapValue][0]) != "4" {
+		t.Errorf("unexpected meta entry %v", entry)
+	}
+
+	r := decodeProto(t, e[fieldEventResult][0])
+	m := decodeProto(t, r[fieldResultMetrics][0])
+	if string(r[fieldResultState][0]) != "CRIT" || string(r[fieldResultReasonCode][0]) != "TIMEOUT" ||
+		string(m[fieldMetricLabel][0]) != "rtt" || string(m[fieldMetricValue][0]) != "1.5" ||
+		string(m[fieldMetricType][0]) != "GAUGE" {
+		t.Errorf("unexpected result fields %v, metric %v", r, m)
+	}
+
+	i := decodeProto(t, e[fieldEventIncident][0])
+	if string(i[fieldIncidentId][0]) != event.Incident.Id.String() || string(i[fieldIncidentFromState][0]) != "OK" ||
+		binary.LittleEndian.Uint64(i[fieldIncidentResolvedUnixNano][0]) != uint64(resolved.UnixNano()) ||
+		len(i[fieldIncidentAcknowledgedBy]) != 0 {
+		t.Errorf("unexpected incident fields %v", i)
+	}
+
+	if Protobuf.ContentType() != "application/x-protobuf" {
+		t.Errorf("unexpected content type %q", Protobuf.ContentType())
+	}
+}
@@ -0,0 +1,356 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTTVersion is the MQTT protocol version spoken to the broker.
+type MQTTVersion uint8
+
+const (
+	MQTT311 MQTTVersion = 4
+	MQTT5   MQTTVersion = 5
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttPubrec     = 5
+	mqttPubrel     = 6
+	mqttPubcomp    = 7
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttDisconnect = 14
+)
+
+// mqttPropContentType is the MQTT 5 Content Type property identifier.
+const mqttPropContentType = 0x03
+
+// MQTTPublisher publishes to an MQTT broker.  The connection is kept open across messages and re-established when
+// it fails, with a clean session, so messages not acknowledged before a failure are published again by the Handler.
+//
+// Publish waits for the acknowledgement flow of QoS: none for 0, PUBACK for 1 and PUBREC/PUBCOMP for 2.  With MQTT
+// 5, the payload content type is sent as the Content Type property and a failure reason code in the acknowledgement
+// rejects the message.
+type MQTTPublisher struct {
+	// Addr is the host:port of the broker.
+	Addr string
+
+	// TLSConfig, when set, connects with TLS.
+	TLSConfig *tls.Config
+
+	// Version is the protocol version (NewMQTTPublisher defaults to MQTT311).
+	Version MQTTVersion
+
+	ClientId string
+	Username string
+	Password string
+
+	// QoS is the quality of service messages are published with: 0, 1 or 2.
+	QoS byte
+
+	// Retain sets the retain flag, so that the broker keeps the last message of each topic for new subscribers.
+	Retain bool
+
+	// KeepAlive is the keep alive interval sent to the broker (default 60 seconds).  When the connection has been
+	// idle this long it is checked with a ping before publishing.
+	KeepAlive time.Duration
+
+	// Timeout bounds connecting and each publish when the context has no earlier deadline (default 10 seconds).
+	Timeout time.Duration
+
+	conn       net.Conn
+	r          *bufio.Reader
+	packetId   uint16
+	lastActive time.Time
+	mu         sync.Mutex
+}
+
+func NewMQTTPublisher(addr, clientId string) *MQTTPublisher {
+	return &MQTTPublisher{
+		Addr:      addr,
+		Version:   MQTT311,
+		ClientId:  clientId,
+		QoS:       1,
+		KeepAlive: 60 * time.Second,
+		Timeout:   10 * time.Second,
+	}
+}
+
+func (p *MQTTPublisher) Publish(ctx context.Context, topic, contentType string, payload []byte) error {
+	if topic == "" || strings.ContainsAny(topic, "+#\x00") || len(topic) > 65535 {
+		return fmt.Errorf("invalid mqtt topic %q: %w", topic, ErrRejected)
+	}
+	if p.QoS > 2 {
+		return fmt.Errorf("invalid mqtt qos %d", p.QoS)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deadline := time.Now().Add(p.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if p.conn != nil && time.Since(p.lastActive) >= p.keepAlive() {
+		// the broker may have dropped an idle connection without our noticing, which would lose a QoS 0 message
+		if err := p.ping(deadline); err != nil {
+			p.disconnect()
+		}
+	}
+	if p.conn == nil {
+		if err := p.connect(ctx, deadline); err != nil {
+			p.disconnect()
+			return fmt.Errorf("error connecting to mqtt broker %s: %v", p.Addr, err)
+		}
+	}
+
+	if err := p.publish(topic, contentType, payload, deadline); err != nil {
+		if !errors.Is(err, ErrRejected) {
+			p.disconnect()
+		}
+		return err
+	}
+	return nil
+}
+
+// Close disconnects from the broker.
+func (p *MQTTPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn == nil {
+		return nil
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout()))
+	_, err := p.conn.Write([]byte{mqttDisconnect << 4, 0})
+	return errors.Join(err, p.disconnect())
+}
+
+func (p *MQTTPublisher) connect(ctx context.Context, deadline time.Time) error {
+	dialer := &net.Dialer{Deadline: deadline}
+	var err error
+	if p.TLSConfig != nil {
+		td := &tls.Dialer{NetDialer: dialer, Config: p.TLSConfig}
+		p.conn, err = td.DialContext(ctx, "tcp", p.Addr)
+	} else {
+		p.conn, err = dialer.DialContext(ctx, "tcp", p.Addr)
+	}
+	if err != nil {
+		return err
+	}
+	p.r = bufio.NewReader(p.conn)
+	p.conn.SetDeadline(deadline)
+
+	flags := byte(0x02) // clean session
+	if p.Username != "" {
+		flags |= 0x80
+	}
+	// MQTT 3.1.1 only allows a password along with a user name
+	password := p.Password != "" && (p.Username != "" || p.version() == MQTT5)
+	if password {
+		flags |= 0x40
+	}
+
+	b := mqttString(nil, "MQTT")
+	b = append(b, byte(p.version()), flags)
+	b = binary.BigEndian.AppendUint16(b, uint16(p.keepAlive()/time.Second))
+	if p.version() == MQTT5 {
+		b = append(b, 0) // no properties
+	}
+	b = mqttString(b, p.ClientId)
+	if p.Username != "" {
+		b = mqttString(b, p.Username)
+	}
+	if password {
+		b = mqttString(b, p.Password)
+	}
+	if err = p.write(mqttConnect<<4, b); err != nil {
+		return err
+	}
+
+	packetType, body, err := p.read()
+	if err != nil {
+		return err
+	}
+	if packetType != mqttConnack || len(body) < 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", packetType)
+	}
+	if p.version() == MQTT5 && body[1] >= 0x80 || p.version() != MQTT5 && body[1] != 0 {
+		return fmt.Errorf("connection refused with reason code 0x%02x", body[1])
+	}
+	return nil
+}
+
+func (p *MQTTPublisher) publish(topic, contentType string, payload []byte, deadline time.Time) error {
+	p.conn.SetDeadline(deadline)
+
+	header := byte(mqttPublish<<4) | p.QoS<<1
+	if p.Retain {
+		header |= 0x01
+	}
+
+	b := mqttString(nil, topic)
+	var id uint16
+	if p.QoS > 0 {
+		p.packetId++
+		if p.packetId == 0 {
+			p.packetId = 1
+		}
+		id = p.packetId
+		b = binary.BigEndian.AppendUint16(b, id)
+	}
+	if p.version() == MQTT5 {
+		var props []byte
+		if contentType != "" {
+			props = mqttString(append(props, mqttPropContentType), contentType)
+		}
+		b = binary.AppendUvarint(b, uint64(len(props)))
+		b = append(b, props...)
+	}
+	b = append(b, payload...)
+	if err := p.write(header, b); err != nil {
+		return fmt.Errorf("error publishing to mqtt broker %s: %v", p.Addr, err)
+	}
+
+	switch p.QoS {
+	case 1:
+		return p.awaitAck(mqttPuback, id)
+	case 2:
+		if err := p.awaitAck(mqttPubrec, id); err != nil {
+			return err
+		}
+		if err := p.write(mqttPubrel<<4|0x02, binary.BigEndian.AppendUint16(nil, id)); err != nil {
+			return fmt.Errorf("error publishing to mqtt broker %s: %v", p.Addr, err)
+		}
+		return p.awaitAck(mqttPubcomp, id)
+	}
+	return nil
+}
+
+// awaitAck reads the acknowledgement packet of packetType for packet id.  An MQTT 5 failure reason code rejects the
+// message.
+func (p *MQTTPublisher) awaitAck(packetType byte, id uint16) error {
+	t, body, err := p.read()
+	if err != nil {
+		return fmt.Errorf("error reading acknowledgement from mqtt broker %s: %v", p.Addr, err)
+	}
+	if t != packetType || len(body) < 2 || binary.BigEndian.Uint16(body) != id {
+		return fmt.Errorf("expected acknowledgement of packet %d from mqtt broker %s, got packet type %d", id,
+			p.Addr, t)
+	}
+	if len(body) > 2 && body[2] >= 0x80 {
+		return fmt.Errorf("mqtt broker %s refused message with reason code 0x%02x: %w", p.Addr, body[2], ErrRejected)
+	}
+	return nil
+}
+
+func (p *MQTTPublisher) ping(deadline time.Time) error {
+	p.conn.SetDeadline(deadline)
+	if err := p.write(mqttPingreq<<4, nil); err != nil {
+		return err
+	}
+	t, _, err := p.read()
+	if err == nil && t != mqttPingresp {
+		err = fmt.Errorf("expected PINGRESP, got packet type %d", t)
+	}
+	return err
+}
+
+// write writes a packet with the fixed header byte and body.
+func (p *MQTTPublisher) write(header byte, body []byte) error {
+	b := append([]byte{header}, mqttRemainingLength(len(body))...)
+	if _, err := p.conn.Write(append(b, body...)); err != nil {
+		return err
+	}
+	p.lastActive = time.Now()
+	return nil
+}
+
+// read reads a packet and returns its type and body.
+func (p *MQTTPublisher) read() (byte, []byte, error) {
+	header, err := p.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var length, shift int
+	for i := 0; ; i++ {
+		c, err := p.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		if i == 4 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		length |= int(c&0x7f) << shift
+		if c&0x80 == 0 {
+			break
+		}
+		shift += 7
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(p.r, body); err != nil {
+		return 0, nil, err
+	}
+	if header>>4 == mqttDisconnect {
+		return 0, nil, errors.New("disconnected by broker")
+	}
+	p.lastActive = time.Now()
+	return header >> 4, body, nil
+}
+
+func (p *MQTTPublisher) disconnect() error {
+	if p.conn == nil {
+		return nil
+	}
+	err := p.conn.Close()
+	p.conn, p.r = nil, nil
+	return err
+}
+
+func (p *MQTTPublisher) version() MQTTVersion {
+	if p.Version == 0 {
+		return MQTT311
+	}
+	return p.Version
+}
+
+func (p *MQTTPublisher) keepAlive() time.Duration {
+	if p.KeepAlive <= 0 {
+		return 60 * time.Second
+	}
+	return min(p.KeepAlive, 65535*time.Second)
+}
+
+func (p *MQTTPublisher) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
+
+// mqttString appends s as a length prefixed UTF-8 string.
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// mqttRemainingLength encodes the remaining length of a packet, which is the same variable byte integer encoding as
+// a protobuf varint.
+func mqttRemainingLength(n int) []byte {
+	return binary.AppendUvarint(nil, uint64(n))
+}
@@ -0,0 +1,306 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mqttMessage is a PUBLISH received by mqttBroker.
+type mqttMessage struct {
+	topic       string
+	payload     string
+	qos         byte
+	retain      bool
+	contentType string
+}
+
+// mqttBroker is an in-process stand-in for an MQTT broker, accepting any client and acknowledging what it publishes.
+type mqttBroker struct {
+	l        net.Listener
+	messages chan mqttMessage
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	connects []mqttConnectPacket
+
+	// reject is the reason code MQTT 5 acknowledgements carry for topics it has (ex. 0x87 not authorized)
+	reject map[string]byte
+}
+
+type mqttConnectPacket struct {
+	version            byte
+	clientId, username string
+	password           string
+}
+
+func newMQTTBroker(t *testing.T) *mqttBroker {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	b := &mqttBroker{l: l, messages: make(chan mqttMessage, 10), reject: make(map[string]byte)}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.conns = append(b.conns, conn)
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+// dropConnections closes every client connection, as a restarting broker would.
+func (b *mqttBroker) dropConnections() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, c := range b.conns {
+		c.Close()
+	}
+	b.conns = nil
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func writeMQTTPacket(conn net.Conn, header byte, body []byte) {
+	conn.Write(append(append([]byte{header}, mqttRemainingLength(len(body))...), body...))
+}
+
+// mqttReadString reads a length prefixed string from b, returning it and the rest of b.
+func mqttReadString(b []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(b))
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func (b *mqttBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	header, body, err := readMQTTPacket(r)
+	if err != nil || header>>4 != mqttConnect {
+		return
+	}
+	var c mqttConnectPacket
+	_, body = mqttReadString(body)
+	c.version, body = body[0], body[1:]
+	flags := body[0]
+	body = body[3:] // flags and keep alive
+	if c.version == byte(MQTT5) {
+		body = body[1:] // empty properties
+	}
+	c.clientId, body = mqttReadString(body)
+	if flags&0x80 != 0 {
+		c.username, body = mqttReadString(body)
+	}
+	if flags&0x40 != 0 {
+		c.password, _ = mqttReadString(body)
+	}
+	b.mu.Lock()
+	b.connects = append(b.connects, c)
+	b.mu.Unlock()
+
+	if c.version == byte(MQTT5) {
+		writeMQTTPacket(conn, mqttConnack<<4, []byte{0, 0, 0})
+	} else {
+		writeMQTTPacket(conn, mqttConnack<<4, []byte{0, 0})
+	}
+
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			m := mqttMessage{qos: header >> 1 & 3, retain: header&1 != 0}
+			m.topic, body = mqttReadString(body)
+			var id []byte
+			if m.qos > 0 {
+				id, body = body[:2], body[2:]
+			}
+			if c.version == byte(MQTT5) {
+				props, n := binary.Uvarint(body)
+				if p := body[n : n+int(props)]; len(p) > 0 && p[0] == mqttPropContentType {
+					m.contentType, _ = mqttReadString(p[1:])
+				}
+				body = body[n+int(props):]
+			}
+			m.payload = string(body)
+
+			ack := append([]byte(nil), id...)
+			if code, ok := b.reject[m.topic]; ok {
+				ack = append(ack, code, 0)
+			} else {
+				b.messages <- m
+			}
+			switch m.qos {
+			case 1:
+				writeMQTTPacket(conn, mqttPuback<<4, ack)
+			case 2:
+				writeMQTTPacket(conn, mqttPubrec<<4, ack)
+			}
+		case mqttPubrel:
+			writeMQTTPacket(conn, mqttPubcomp<<4, body)
+		case mqttPingreq:
+			writeMQTTPacket(conn, mqttPingresp<<4, nil)
+		case mqttDisconnect:
+			return
+		}
+	}
+}
+
+func nextMQTTMessage(t *testing.T, messages chan mqttMessage) mqttMessage {
+	t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a message")
+		return mqttMessage{}
+	}
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	for _, version := range []MQTTVersion{MQTT311, MQTT5} {
+		for _, qos := range []byte{0, 1, 2} {
+			b := newMQTTBroker(t)
+			p := NewMQTTPublisher(b.l.Addr().String(), "poller1")
+			p.Version = version
+			p.QoS = qos
+			p.Retain = true
+			p.Username, p.Password = "user", "secret"
+
+			for i := 0; i < 2; i++ {
+				if err := p.Publish(context.Background(), "gopoller/router1/RESULT", "application/json",
+					[]byte(`{"type":"RESULT"}`)); err != nil {
+					t.Fatalf("v%d qos %d: unexpected error: %v", version, qos, err)
+				}
+				m := nextMQTTMessage(t, b.messages)
+				if m.topic != "gopoller/router1/RESULT" || m.payload != `{"type":"RESULT"}` || m.qos != qos ||
+					!m.retain {
+					t.Errorf("v%d qos %d: unexpected message %+v", version, qos, m)
+				}
+				if version == MQTT5 && m.contentType != "application/json" {
+					t.Errorf("v%d: expected the content type property, got %q", version, m.contentType)
+				}
+			}
+			if err := p.Close(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			b.mu.Lock()
+			if len(b.connects) != 1 || b.connects[0] != (mqttConnectPacket{byte(version), "poller1", "user", "secret"}) {
+				t.Errorf("v%d: expected one connection, got %+v", version, b.connects)
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+func TestMQTTPublisherReconnects(t *testing.T) {
+	b := newMQTTBroker(t)
+	p := NewMQTTPublisher(b.l.Addr().String(), "poller1")
+	defer p.Close()
+
+	if err := p.Publish(context.Background(), "a", "", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nextMQTTMessage(t, b.messages)
+
+	// the failed acknowledgement is reported, and the next publish reconnects
+	b.dropConnections()
+	if err := p.Publish(context.Background(), "a", "", []byte("2")); err == nil {
+		t.Fatalf("expected an error publishing on a dropped connection")
+	}
+	if err := p.Publish(context.Background(), "a", "", []byte("3")); err != nil {
+		t.Fatalf("expected a reconnect, got %v", err)
+	}
+	if m := nextMQTTMessage(t, b.messages); m.payload != "3" {
+		t.Errorf("unexpected message %+v", m)
+	}
+
+	// an idle QoS 0 connection is pinged before publishing, so a dropped one is noticed before losing a message
+	p.QoS = 0
+	p.KeepAlive = time.Millisecond
+	b.dropConnections()
+	time.Sleep(10 * time.Millisecond)
+	if err := p.Publish(context.Background(), "a", "", []byte("4")); err != nil {
+		t.Fatalf("expected a reconnect, got %v", err)
+	}
+	if m := nextMQTTMessage(t, b.messages); m.payload != "4" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestMQTTPublisherRejections(t *testing.T) {
+	b := newMQTTBroker(t)
+	b.reject["denied"] = 0x87
+	p := NewMQTTPublisher(b.l.Addr().String(), "poller1")
+	p.Version = MQTT5
+	defer p.Close()
+
+	for _, topic := range []string{"denied", "wild/+", "wild/#", ""} {
+		if err := p.Publish(context.Background(), topic, "", []byte("x")); !errors.Is(err, ErrRejected) {
+			t.Errorf("%q: expected a rejection, got %v", topic, err)
+		}
+	}
+
+	// the connection survives a rejection
+	if err := p.Publish(context.Background(), "allowed", "", []byte("x")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nextMQTTMessage(t, b.messages)
+	b.mu.Lock()
+	if len(b.connects) != 1 {
+		t.Errorf("expected one connection, got %d", len(b.connects))
+	}
+	b.mu.Unlock()
+}
+
+func TestMQTTHandler(t *testing.T) {
+	b := newMQTTBroker(t)
+	h, err := NewHandler(NewMQTTPublisher(b.l.Addr().String(), "poller1"), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.Serializer = Protobuf
+
+	event := testEvent()
+	if err = h.ProcessIncidentEvent(check.New("router1"), event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := nextMQTTMessage(t, b.messages); m.topic != "gopoller/router1/OPENED" ||
+		string(decodeProto(t, []byte(m.payload))[fieldEventType][0]) != "OPENED" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
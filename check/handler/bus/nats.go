@@ -0,0 +1,362 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NATSPublisher publishes to a NATS server using the core protocol.  The connection is kept open across messages and
+// re-established when it fails.
+//
+// Core NATS has no acknowledgements, so a published message is only known to have reached the server when Confirm
+// is set, which follows every message with a PING and waits for the PONG (and for any error the server reports
+// before it).  Permissions, maximum payload and invalid subject violations reject the message with ErrRejected; any
+// other server error closes the connection, so the message is retried.  The payload content type is sent as the
+// Content-Type header when the server supports headers.
+type NATSPublisher struct {
+	// Addr is the host:port of the server.
+	Addr string
+
+	// TLSConfig, when set, upgrades the connection to TLS.  The connection is also upgraded when the server requires
+	// TLS.
+	TLSConfig *tls.Config
+
+	// Name identifies the connection in the server's monitoring.
+	Name string
+
+	// User and Password, or Token, authenticate the connection.
+	User     string
+	Password string
+	Token    string
+
+	// Confirm waits for the server to confirm each message.
+	Confirm bool
+
+	// Timeout bounds connecting and each publish when the context has no earlier deadline (default 10 seconds).
+	Timeout time.Duration
+
+	conn *natsConn
+	mu   sync.Mutex
+}
+
+// natsInfo is the part of the server's INFO the publisher uses.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+	MaxPayload  int  `json:"max_payload"`
+}
+
+// natsConn is a connection to the server, with a goroutine reading what the server sends: answering its PINGs,
+// counting PONGs and passing rejections to a waiting publish.  Errors other than rejections close the connection.
+type natsConn struct {
+	conn    net.Conn
+	info    natsInfo
+	writeMu sync.Mutex
+
+	// pings counts the PINGs sent by publishes and pongs the PONGs received.  The server answers PINGs in order, so
+	// a publish's PING is answered once pongs reaches the count including it.
+	pings    int64
+	pongs    atomic.Int64
+	pongRecv chan struct{}
+
+	errs   chan error
+	closed chan struct{}
+	err    error // why the connection closed, set before closed is
+}
+
+func NewNATSPublisher(addr string) *NATSPublisher {
+	return &NATSPublisher{
+		Addr:    addr,
+		Confirm: true,
+		Timeout: 10 * time.Second,
+	}
+}
+
+func (p *NATSPublisher) Publish(ctx context.Context, subject, contentType string, payload []byte) error {
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") || strings.HasPrefix(subject, ".") ||
+		strings.HasSuffix(subject, ".") || strings.Contains(subject, "..") {
+		return fmt.Errorf("invalid nats subject %q: %w", subject, ErrRejected)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	deadline := time.Now().Add(p.timeout())
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	if p.conn != nil {
+		select {
+		case <-p.conn.closed:
+			p.conn = nil
+		default:
+		}
+	}
+	if p.conn == nil {
+		c, err := p.connect(ctx, deadline)
+		if err != nil {
+			return fmt.Errorf("error connecting to nats server %s: %v", p.Addr, err)
+		}
+		p.conn = c
+	}
+	c := p.conn
+
+	if c.info.MaxPayload > 0 && len(payload) > c.info.MaxPayload {
+		return fmt.Errorf("payload of %d bytes exceeds the nats server maximum of %d: %w", len(payload),
+			c.info.MaxPayload, ErrRejected)
+	}
+
+	// errors reported since the last publish can't be attributed to a message without Confirm
+	select {
+	case <-c.errs:
+	default:
+	}
+
+	var b []byte
+	if c.info.Headers && contentType != "" {
+		headers := "NATS/1.0\r\nContent-Type: " + contentType + "\r\n\r\n"
+		b = fmt.Appendf(b, "HPUB %s %d %d\r\n%s", subject, len(headers), len(headers)+len(payload), headers)
+	} else {
+		b = fmt.Appendf(b, "PUB %s %d\r\n", subject, len(payload))
+	}
+	b = append(b, payload...)
+	b = append(b, "\r\n"...)
+	if p.Confirm {
+		b = append(b, "PING\r\n"...)
+		c.pings++
+	}
+
+	if err := c.write(b, deadline); err != nil {
+		c.close(err)
+		p.conn = nil
+		return fmt.Errorf("error publishing to nats server %s: %v", p.Addr, err)
+	}
+	if !p.Confirm {
+		return nil
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for c.pongs.Load() < c.pings {
+		select {
+		case <-c.pongRecv:
+		case err := <-c.errs:
+			return fmt.Errorf("nats server %s refused message: %v: %w", p.Addr, err, ErrRejected)
+		case <-c.closed:
+			p.conn = nil
+			// the server closes the connection after some rejections, ex. a maximum payload violation
+			select {
+			case err := <-c.errs:
+				return fmt.Errorf("nats server %s refused message: %v: %w", p.Addr, err, ErrRejected)
+			default:
+			}
+			return fmt.Errorf("error publishing to nats server %s: %v", p.Addr, c.err)
+		case <-timer.C:
+			c.close(errors.New("timeout waiting for PONG"))
+			p.conn = nil
+			return fmt.Errorf("timeout waiting for nats server %s to confirm message", p.Addr)
+		}
+	}
+	// the server reports an error with a message before answering the PING following it
+	select {
+	case err := <-c.errs:
+		return fmt.Errorf("nats server %s refused message: %v: %w", p.Addr, err, ErrRejected)
+	default:
+		return nil
+	}
+}
+
+// Close disconnects from the server.
+func (p *NATSPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conn != nil {
+		p.conn.close(errors.New("closed"))
+		p.conn = nil
+	}
+	return nil
+}
+
+// connect connects and handshakes with the server: reading its INFO, upgrading to TLS if needed, then sending
+// CONNECT and a PING, to which the server replies PONG once the connection is accepted.
+func (p *NATSPublisher) connect(ctx context.Context, deadline time.Time) (*natsConn, error) {
+	dialer := &net.Dialer{Deadline: deadline}
+	conn, err := dialer.DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline)
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	infoJSON, ok := strings.CutPrefix(line, "INFO ")
+	if !ok {
+		conn.Close()
+		return nil, fmt.Errorf("expected INFO, got %q", strings.TrimSpace(line))
+	}
+	var info natsInfo
+	if err = json.Unmarshal([]byte(infoJSON), &info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error decoding INFO: %v", err)
+	}
+
+	tlsRequired := p.TLSConfig != nil || info.TLSRequired
+	if tlsRequired {
+		config := p.TLSConfig
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(p.Addr)
+		}
+		tlsConn := tls.Client(conn, config)
+		if err = tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn, r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	connect, _ := json.Marshal(map[string]any{
+		"verbose":      false,
+		"pedantic":     false,
+		"tls_required": tlsRequired,
+		"name":         p.Name,
+		"lang":         "go",
+		"version":      "gopoller",
+		"protocol":     1,
+		"headers":      true,
+		"user":         p.User,
+		"pass":         p.Password,
+		"auth_token":   p.Token,
+	})
+	if _, err = conn.Write([]byte("CONNECT " + string(connect) + "\r\nPING\r\n")); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if msg, ok := strings.CutPrefix(line, "-ERR "); ok {
+			conn.Close()
+			return nil, errors.New(strings.Trim(msg, "'"))
+		}
+	}
+	conn.SetDeadline(time.Time{})
+
+	c := &natsConn{
+		conn:     conn,
+		info:     info,
+		pongRecv: make(chan struct{}, 1),
+		errs:     make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+	go c.read(r)
+	return c, nil
+}
+
+func (c *natsConn) write(b []byte, deadline time.Time) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.conn.SetWriteDeadline(deadline)
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *natsConn) read(r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			c.close(err)
+			return
+		}
+
+		op, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(op) {
+		case "PING":
+			if err = c.write([]byte("PONG\r\n"), time.Now().Add(10*time.Second)); err != nil {
+				c.close(err)
+				return
+			}
+		case "PONG":
+			c.pongs.Add(1)
+			select {
+			case c.pongRecv <- struct{}{}:
+			default:
+			}
+		case "-ERR":
+			msg := strings.Trim(arg, "'")
+			if !natsRejection(msg) {
+				c.close(fmt.Errorf("server error: %s", msg))
+				return
+			}
+			select {
+			case c.errs <- errors.New(msg):
+			default:
+			}
+		case "MSG", "HMSG":
+			// not subscribed to anything, but skip the payload all the same
+			if fields := strings.Fields(arg); len(fields) > 0 {
+				if n, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+					r.Discard(n + 2)
+				}
+			}
+		}
+	}
+}
+
+// natsRejection returns true if the server error msg refuses a message rather than the connection, so the message
+// should not be retried.  Other errors, ex. "Stale Connection" or an authorization timeout, are followed by the
+// server closing the connection.
+func natsRejection(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.HasPrefix(msg, "permissions violation") || strings.HasPrefix(msg, "maximum payload") ||
+		strings.HasPrefix(msg, "invalid publish subject")
+}
+
+// close closes the connection, recording err as the reason if it is not already closed.
+func (c *natsConn) close(err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	select {
+	case <-c.closed:
+		return
+	default:
+	}
+	c.err = err
+	close(c.closed)
+	c.conn.Close()
+}
+
+func (p *NATSPublisher) timeout() time.Duration {
+	if p.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return p.Timeout
+}
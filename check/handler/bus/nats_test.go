@@ -0,0 +1,305 @@
+package bus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// natsMessage is a PUB or HPUB received by natsServer.
+type natsMessage struct {
+	subject string
+	headers string
+	payload string
+}
+
+// natsServer is an in-process stand-in for a NATS server, accepting any client, reporting a permissions
+// violation for subjects in deny and reporting a stale connection then closing it for subjects in stale.
+type natsServer struct {
+	l        net.Listener
+	info     string
+	messages chan natsMessage
+	connects chan string
+	deny     map[string]bool
+	stale    map[string]bool
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newNATSServer(t *testing.T, info string) *natsServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	s := &natsServer{
+		l:        l,
+		info:     info,
+		messages: make(chan natsMessage, 10),
+		connects: make(chan string, 10),
+		deny:     make(map[string]bool),
+		stale:    make(map[string]bool),
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// dropConnections closes every client connection, as a restarting server would.
+func (s *natsServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// ping sends a PING to every client connection.
+func (s *natsServer) ping() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Write([]byte("PING\r\n"))
+	}
+}
+
+func (s *natsServer) serve(conn net.Conn) {
+	defer conn.Close()
+	fmt.Fprintf(conn, "INFO %s\r\n", s.info)
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, arg, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch op {
+		case "CONNECT":
+			s.connects <- arg
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "PONG":
+			s.connects <- "PONG"
+		case "PUB", "HPUB":
+			fields := strings.Fields(arg)
+			total, _ := strconv.Atoi(fields[len(fields)-1])
+			headerLen := 0
+			if op == "HPUB" {
+				headerLen, _ = strconv.Atoi(fields[1])
+			}
+			data := make([]byte, total+2)
+			if _, err = io.ReadFull(r, data); err != nil {
+				return
+			}
+			if s.deny[fields[0]] {
+				fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to \"%s\"'\r\n", fields[0])
+				continue
+			}
+			if s.stale[fields[0]] {
+				conn.Write([]byte("-ERR 'Stale Connection'\r\n"))
+				return
+			}
+			s.messages <- natsMessage{fields[0], string(data[:headerLen]), string(data[headerLen:total])}
+		}
+	}
+}
+
+func nextNATSMessage(t *testing.T, messages chan natsMessage) natsMessage {
+	t.Helper()
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a message")
+		return natsMessage{}
+	}
+}
+
+func TestNATSPublisher(t *testing.T) {
+	tests := []struct {
+		name        string
+		info        string
+		confirm     bool
+		wantHeaders string
+	}{
+		{"headers", `{"headers":true,"max_payload":1048576}`, true, "NATS/1.0\r\nContent-Type: application/json\r\n\r\n"},
+		{"no headers", `{"max_payload":1048576}`, true, ""},
+		{"unconfirmed", `{"headers":true}`, false, "NATS/1.0\r\nContent-Type: application/json\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newNATSServer(t, tt.info)
+			p := NewNATSPublisher(s.l.Addr().String())
+			p.Name = "poller1"
+			p.Token = "secret"
+			p.Confirm = tt.confirm
+			defer p.Close()
+
+			for i := 0; i < 2; i++ {
+				if err := p.Publish(context.Background(), "gopoller.router1.RESULT", "application/json",
+					[]byte(`{"type":"RESULT"}`)); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				m := nextNATSMessage(t, s.messages)
+				if m.subject != "gopoller.router1.RESULT" || m.payload != `{"type":"RESULT"}` ||
+					m.headers != tt.wantHeaders {
+					t.Errorf("unexpected message %+v", m)
+				}
+			}
+
+			if connect := <-s.connects; !strings.Contains(connect, `"name":"poller1"`) ||
+				!strings.Contains(connect, `"auth_token":"secret"`) || !strings.Contains(connect, `"verbose":false`) {
+				t.Errorf("unexpected CONNECT %s", connect)
+			}
+			if len(s.connects) != 0 {
+				t.Errorf("expected one connection")
+			}
+		})
+	}
+}
+
+func TestNATSPublisherAnswersPings(t *testing.T) {
+	s := newNATSServer(t, `{}`)
+	p := NewNATSPublisher(s.l.Addr().String())
+	defer p.Close()
+
+	if err := p.Publish(context.Background(), "a", "", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	<-s.connects
+	s.ping()
+	select {
+	case pong := <-s.connects:
+		if pong != "PONG" {
+			t.Errorf("expected a PONG, got %s", pong)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the server's PING to be answered")
+	}
+}
+
+func TestNATSPublisherReconnects(t *testing.T) {
+	s := newNATSServer(t, `{}`)
+	p := NewNATSPublisher(s.l.Addr().String())
+	defer p.Close()
+
+	if err := p.Publish(context.Background(), "a", "", []byte("1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nextNATSMessage(t, s.messages)
+
+	s.dropConnections()
+	var err error
+	for i := 0; i < 2; i++ {
+		// the reader notices the closed connection asynchronously, so the first publish may fail
+		if err = p.Publish(context.Background(), "a", "", []byte("2")); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("expected a reconnect, got %v", err)
+	}
+	if m := nextNATSMessage(t, s.messages); m.payload != "2" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestNATSPublisherRejections(t *testing.T) {
+	s := newNATSServer(t, `{"max_payload":8}`)
+	s.deny["denied"] = true
+	p := NewNATSPublisher(s.l.Addr().String())
+	defer p.Close()
+
+	tests := []struct {
+		subject string
+		payload string
+	}{
+		{"denied", "x"},
+		{"too.large", "123456789"},
+		{"has space", "x"},
+		{"empty..token", "x"},
+		{"", "x"},
+	}
+	for _, tt := range tests {
+		if err := p.Publish(context.Background(), tt.subject, "", []byte(tt.payload)); !errors.Is(err, ErrRejected) {
+			t.Errorf("%q: expected a rejection, got %v", tt.subject, err)
+		}
+	}
+
+	// the PONG following a rejected message doesn't confirm the next one
+	time.Sleep(10 * time.Millisecond)
+	if err := p.Publish(context.Background(), "denied", "", []byte("x")); !errors.Is(err, ErrRejected) {
+		t.Errorf("expected a rejection after the previous PONG, got %v", err)
+	}
+
+	// the connection survives a rejection
+	if err := p.Publish(context.Background(), "allowed", "", []byte("x")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	nextNATSMessage(t, s.messages)
+	<-s.connects
+	if len(s.connects) != 0 {
+		t.Errorf("expected one connection")
+	}
+}
+
+func TestNATSPublisherServerErrorsAreNotRejections(t *testing.T) {
+	s := newNATSServer(t, `{}`)
+	s.stale["stale"] = true
+	p := NewNATSPublisher(s.l.Addr().String())
+	defer p.Close()
+
+	if err := p.Publish(context.Background(), "stale", "", []byte("1")); err == nil || errors.Is(err, ErrRejected) {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+	if err := p.Publish(context.Background(), "a", "", []byte("2")); err != nil {
+		t.Fatalf("expected a reconnect, got %v", err)
+	}
+	if m := nextNATSMessage(t, s.messages); m.payload != "2" {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
+
+func TestNATSHandler(t *testing.T) {
+	s := newNATSServer(t, `{"headers":true}`)
+	h, err := NewHandler(NewNATSPublisher(s.l.Addr().String()), "gopoller.{{ .Meta.site }}.{{ .CheckId }}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	chk := check.New("router1.example.com", check.WithMeta(map[string]any{"site": "dc1"}))
+	if err = h.Process(chk, testEvent().Result, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if m := nextNATSMessage(t, s.messages); m.subject != "gopoller.dc1.router1_example_com" ||
+		!strings.HasPrefix(m.payload, `{"type":"RESULT","check_id":"router1.example.com"`) {
+		t.Errorf("unexpected message %+v", m)
+	}
+}
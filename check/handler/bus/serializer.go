@@ -0,0 +1,287 @@
+package bus
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/protowire"
+	"slices"
+	"time"
+)
+
+// Serializer encodes Messages for publishing.
+type Serializer interface {
+	// ContentType is the MIME type of the encoding.
+	ContentType() string
+
+	Serialize(msg *Message) ([]byte, error)
+}
+
+var (
+	// JSON encodes Messages as a JSON object, ex.
+	//
+	//	{"type":"OPENED","check_id":"router1","time":"2023-11-14T22:13:20Z","meta":{"site":"dc1"},
+	//	 "result":{"id":"...","state":"CRIT","reason_code":"TIMEOUT","time":"...","metrics":[{"label":"rtt",
+	//	 "value":"1.5","type":"GAUGE"}]},"incident":{"id":"...","from_state":"OK","to_state":"CRIT",...}}
+	//
+	// result, incident and previous_incident are omitted when the Message has none.
+	JSON Serializer = jsonSerializer{}
+
+	// Protobuf encodes Messages as the Event message of this schema:
+	//
+	//	syntax = "proto3";
+	//	package gopoller.bus.v1;
+	//
+	//	message Event {
+	//	  string type = 1;
+	//	  string check_id = 2;
+	//	  fixed64 time_unix_nano = 3;
+	//	  map<string, string> meta = 4;
+	//	  Result result = 5;
+	//	  Incident incident = 6;
+	//	  Incident previous_incident = 7;
+	//	}
+	//
+	//	message Result {
+	//	  string id = 1;
+	//	  string state = 2;
+	//	  string reason_code = 3;
+	//	  fixed64 time_unix_nano = 4;
+	//	  repeated Metric metrics = 5;
+	//	}
+	//
+	//	message Metric {
+	//	  string label = 1;
+	//	  string value = 2;
+	//	  string type = 3;
+	//	}
+	//
+	//	message Incident {
+	//	  string id = 1;
+	//	  string from_state = 2;
+	//	  string to_state = 3;
+	//	  string reason_code = 4;
+	//	  fixed64 time_unix_nano = 5;
+	//	  fixed64 resolved_unix_nano = 6;
+	//	  string acknowledged_by = 7;
+	//	}
+	Protobuf Serializer = protobufSerializer{}
+)
+
+// metricType returns the name of a check.ResultMetricType.
+func metricType(t check.ResultMetricType) string {
+	switch t {
+	case check.ResultMetricCounter:
+		return "COUNTER"
+	case check.ResultMetricGauge:
+		return "GAUGE"
+	default:
+		return ""
+	}
+}
+
+// meta returns the Check.Meta values as strings.
+func meta(chk *check.Check) map[string]string {
+	m := make(map[string]string, len(chk.Meta))
+	for k, v := range chk.Meta {
+		if v != nil {
+			m[k] = fmt.Sprint(v)
+		}
+	}
+	return m
+}
+
+type jsonSerializer struct{}
+
+type jsonEvent struct {
+	Type             string            `json:"type"`
+	CheckId          string            `json:"check_id"`
+	Time             time.Time         `json:"time"`
+	Meta             map[string]string `json:"meta,omitempty"`
+	Result           *jsonResult       `json:"result,omitempty"`
+	Incident         *jsonIncident     `json:"incident,omitempty"`
+	PreviousIncident *jsonIncident     `json:"previous_incident,omitempty"`
+}
+
+type jsonResult struct {
+	Id         string       `json:"id"`
+	State      string       `json:"state"`
+	ReasonCode string       `json:"reason_code,omitempty"`
+	Time       time.Time    `json:"time"`
+	Metrics    []jsonMetric `json:"metrics,omitempty"`
+}
+
+type jsonMetric struct {
+	Label string `json:"label"`
+	Value string `json:"value"`
+	Type  string `json:"type,omitempty"`
+}
+
+type jsonIncident struct {
+	Id             string     `json:"id"`
+	FromState      string     `json:"from_state"`
+	ToState        string     `json:"to_state"`
+	ReasonCode     string     `json:"reason_code,omitempty"`
+	Time           time.Time  `json:"time"`
+	Resolved       *time.Time `json:"resolved,omitempty"`
+	AcknowledgedBy string     `json:"acknowledged_by,omitempty"`
+}
+
+func (jsonSerializer) ContentType() string {
+	return "application/json"
+}
+
+func (jsonSerializer) Serialize(msg *Message) ([]byte, error) {
+	e := jsonEvent{
+		Type:             msg.Type,
+		CheckId:          msg.Check.Id,
+		Time:             msg.Time,
+		Meta:             meta(msg.Check),
+		Incident:         newJSONIncident(msg.Incident),
+		PreviousIncident: newJSONIncident(msg.PreviousIncident),
+	}
+	if r := msg.Result; r != nil {
+		e.Result = &jsonResult{
+			Id:         r.Id.String(),
+			State:      r.State.String(),
+			ReasonCode: r.ReasonCode,
+			Time:       r.Time,
+		}
+		for _, m := range r.Metrics {
+			e.Result.Metrics = append(e.Result.Metrics, jsonMetric{m.Label, m.Value, metricType(m.Type)})
+		}
+	}
+	return json.Marshal(e)
+}
+
+func newJSONIncident(incident *check.Incident) *jsonIncident {
+	if incident == nil {
+		return nil
+	}
+	i := &jsonIncident{
+		Id:         incident.Id.String(),
+		FromState:  incident.FromState.String(),
+		ToState:    incident.ToState.String(),
+		ReasonCode: incident.ReasonCode,
+		Time:       incident.Time,
+		Resolved:   incident.Resolved,
+	}
+	if ack := incident.Acknowledgement; ack != nil {
+		i.AcknowledgedBy = ack.By
+	}
+	return i
+}
+
+type protobufSerializer struct{}
+
+// protobuf field numbers of the Protobuf schema
+const (
+	fieldEventType             = 1
+	fieldEventCheckId          = 2
+	fieldEventTimeUnixNano     = 3
+	fieldEventMeta             = 4
+	fieldEventResult           = 5
+	fieldEventIncident         = 6
+	fieldEventPreviousIncident = 7
+
+	fieldMapKey   = 1
+	fieldMapValue = 2
+
+	fieldResultId           = 1
+	fieldResultState        = 2
+	fieldResultReasonCode   = 3
+	fieldResultTimeUnixNano = 4
+	fieldResultMetrics      = 5
+
+	fieldMetricLabel = 1
+	fieldMetricValue = 2
+	fieldMetricType  = 3
+
+	fieldIncidentId               = 1
+	fieldIncidentFromState        = 2
+	fieldIncidentToState          = 3
+	fieldIncidentReasonCode       = 4
+	fieldIncidentTimeUnixNano     = 5
+	fieldIncidentResolvedUnixNano = 6
+	fieldIncidentAcknowledgedBy   = 7
+)
+
+func (protobufSerializer) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufSerializer) Serialize(msg *Message) ([]byte, error) {
+	b := appendString(nil, fieldEventType, msg.Type)
+	b = appendString(b, fieldEventCheckId, msg.Check.Id)
+	b = appendTime(b, fieldEventTimeUnixNano, msg.Time)
+
+	m := meta(msg.Check)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		b = b.Message(fieldEventMeta, func(e protowire.Buffer) protowire.Buffer {
+			return appendString(appendString(e, fieldMapKey, k), fieldMapValue, m[k])
+		})
+	}
+
+	if r := msg.Result; r != nil {
+		b = b.Message(fieldEventResult, func(rb protowire.Buffer) protowire.Buffer {
+			rb = appendString(rb, fieldResultId, r.Id.String())
+			rb = appendString(rb, fieldResultState, r.State.String())
+			rb = appendString(rb, fieldResultReasonCode, r.ReasonCode)
+			rb = appendTime(rb, fieldResultTimeUnixNano, r.Time)
+			for _, metric := range r.Metrics {
+				rb = rb.Message(fieldResultMetrics, func(mb protowire.Buffer) protowire.Buffer {
+					mb = appendString(mb, fieldMetricLabel, metric.Label)
+					mb = appendString(mb, fieldMetricValue, metric.Value)
+					return appendString(mb, fieldMetricType, metricType(metric.Type))
+				})
+			}
+			return rb
+		})
+	}
+	b = appendIncident(b, fieldEventIncident, msg.Incident)
+	b = appendIncident(b, fieldEventPreviousIncident, msg.PreviousIncident)
+
+	return b, nil
+}
+
+// appendString appends a string field unless it is empty, as proto3 omits fields with zero values.
+func appendString(b protowire.Buffer, field int, v string) protowire.Buffer {
+	if v == "" {
+		return b
+	}
+	return b.String(field, v)
+}
+
+// appendTime appends a time as fixed64 Unix nanoseconds unless it is zero.
+func appendTime(b protowire.Buffer, field int, t time.Time) protowire.Buffer {
+	if t.IsZero() || t.UnixNano() == 0 {
+		return b
+	}
+	return b.Fixed64(field, uint64(t.UnixNano()))
+}
+
+// appendIncident appends an Incident message unless incident is nil.
+func appendIncident(b protowire.Buffer, field int, incident *check.Incident) protowire.Buffer {
+	if incident == nil {
+		return b
+	}
+	return b.Message(field, func(ib protowire.Buffer) protowire.Buffer {
+		ib = appendString(ib, fieldIncidentId, incident.Id.String())
+		ib = appendString(ib, fieldIncidentFromState, incident.FromState.String())
+		ib = appendString(ib, fieldIncidentToState, incident.ToState.String())
+		ib = appendString(ib, fieldIncidentReasonCode, incident.ReasonCode)
+		ib = appendTime(ib, fieldIncidentTimeUnixNano, incident.Time)
+		if incident.Resolved != nil {
+			ib = appendTime(ib, fieldIncidentResolvedUnixNano, *incident.Resolved)
+		}
+		if ack := incident.Acknowledgement; ack != nil {
+			ib = appendString(ib, fieldIncidentAcknowledgedBy, ack.By)
+		}
+		return ib
+	})
+}
@@ -0,0 +1,268 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// postJSON POSTs v as JSON to url with the given headers, returning the response body.
+func postJSON(ctx context.Context, client *http.Client, url string, headers map[string]string, v any) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if client == nil {
+		client = defaultClient
+	}
+
+	return retryhttp.Do(ctx, client, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	}, 2, time.Second)
+}
+
+// slackAttachment is a Slack (and Mattermost) message attachment.
+type slackAttachment struct {
+	Fallback string       `json:"fallback"`
+	Color    string       `json:"color"`
+	Title    string       `json:"title"`
+	Text     string       `json:"text"`
+	Fields   []slackField `json:"fields,omitempty"`
+	Footer   string       `json:"footer,omitempty"`
+	Ts       int64        `json:"ts,omitempty"`
+}
+
+type slackField struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short"`
+}
+
+func slackAttachments(msg *Message) []slackAttachment {
+	fields := []slackField{
+		{Title: "State", Value: msg.State.String(), Short: true},
+	}
+	if msg.ReasonCode != "" {
+		fields = append(fields, slackField{Title: "Reason", Value: msg.ReasonCode, Short: true})
+	}
+	if msg.Duration > 0 {
+		fields = append(fields, slackField{Title: "Duration", Value: msg.Duration.String(), Short: true})
+	}
+	for _, m := range msg.Metrics {
+		fields = append(fields, slackField{Title: m.Label, Value: m.Value, Short: true})
+	}
+
+	return []slackAttachment{{
+		Fallback: msg.Title,
+		Color:    msg.Color,
+		Title:    msg.Title,
+		Text:     msg.Text,
+		Fields:   fields,
+		Footer:   "gopoller | " + msg.CheckId,
+		Ts:       msg.Time.Unix(),
+	}}
+}
+
+// SlackWebhook posts to a Slack-compatible incoming webhook (Slack, Mattermost and others accept this format).
+// Incoming webhooks do not return message IDs, so messages are not threaded.
+type SlackWebhook struct {
+	Url string
+
+	// Channel, Username and IconEmoji optionally override the webhook's defaults where the service allows it.
+	Channel   string
+	Username  string
+	IconEmoji string
+
+	Client *http.Client
+}
+
+func (a *SlackWebhook) Post(ctx context.Context, msg *Message, _ string) (string, error) {
+	_, err := postJSON(ctx, a.Client, a.Url, nil, map[string]any{
+		"text":        msg.Title,
+		"channel":     a.Channel,
+		"username":    a.Username,
+		"icon_emoji":  a.IconEmoji,
+		"attachments": slackAttachments(msg),
+	})
+	return "", err
+}
+
+// SlackApi posts with the Slack Web API chat.postMessage method using a bot token, which returns message timestamps
+// so that later events are threaded.
+type SlackApi struct {
+	Token   string
+	Channel string
+
+	// BaseUrl is the Slack Web API base URL (default https://slack.com/api).
+	BaseUrl string
+
+	Client *http.Client
+}
+
+func (a *SlackApi) Post(ctx context.Context, msg *Message, threadId string) (string, error) {
+	baseUrl := a.BaseUrl
+	if baseUrl == "" {
+		baseUrl = "https://slack.com/api"
+	}
+
+	req := map[string]any{
+		"channel":     a.Channel,
+		"text":        msg.Title,
+		"attachments": slackAttachments(msg),
+	}
+	if threadId != "" {
+		req["thread_ts"] = threadId
+	}
+
+	body, err := postJSON(ctx, a.Client, baseUrl+"/chat.postMessage", map[string]string{
+		"Authorization": "Bearer " + a.Token,
+	}, req)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Ok    bool   `json:"ok"`
+		Error string `json:"error"`
+		Ts    string `json:"ts"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if !resp.Ok {
+		return "", fmt.Errorf("slack chat.postMessage failed: %s", resp.Error)
+	}
+	return resp.Ts, nil
+}
+
+// Mattermost posts with the Mattermost REST API using a bot or personal access token, which returns post IDs so
+// that later events are threaded.  For a Mattermost incoming webhook, use SlackWebhook.
+type Mattermost struct {
+	// Url is the base URL of the Mattermost server.
+	Url       string
+	Token     string
+	ChannelId string
+
+	Client *http.Client
+}
+
+func (a *Mattermost) Post(ctx context.Context, msg *Message, threadId string) (string, error) {
+	req := map[string]any{
+		"channel_id": a.ChannelId,
+		"message":    msg.Title,
+		"props": map[string]any{
+			"attachments": slackAttachments(msg),
+		},
+	}
+	if threadId != "" {
+		req["root_id"] = threadId
+	}
+
+	body, err := postJSON(ctx, a.Client, strings.TrimRight(a.Url, "/")+"/api/v4/posts", map[string]string{
+		"Authorization": "Bearer " + a.Token,
+	}, req)
+	if err != nil {
+		return "", err
+	}
+
+	var resp struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return "", err
+	}
+	if resp.Id == "" {
+		return "", errors.New("mattermost did not return a post id")
+	}
+	return resp.Id, nil
+}
+
+// Teams posts an Adaptive Card to a Microsoft Teams incoming webhook or workflow URL.  Teams webhooks do not return
+// message IDs, so messages are not threaded.
+type Teams struct {
+	Url string
+
+	Client *http.Client
+}
+
+func (a *Teams) Post(ctx context.Context, msg *Message, _ string) (string, error) {
+	facts := []map[string]string{
+		{"title": "State", "value": msg.State.String()},
+	}
+	if msg.ReasonCode != "" {
+		facts = append(facts, map[string]string{"title": "Reason", "value": msg.ReasonCode})
+	}
+	if msg.Duration > 0 {
+		facts = append(facts, map[string]string{"title": "Duration", "value": msg.Duration.String()})
+	}
+	for _, m := range msg.Metrics {
+		facts = append(facts, map[string]string{"title": m.Label, "value": m.Value})
+	}
+
+	card := map[string]any{
+		"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+		"type":    "AdaptiveCard",
+		"version": "1.4",
+		"body": []any{
+			map[string]any{
+				"type":   "TextBlock",
+				"text":   msg.Title,
+				"weight": "Bolder",
+				"size":   "Medium",
+				"color":  teamsColor(msg.State),
+				"wrap":   true,
+			},
+			map[string]any{
+				"type": "TextBlock",
+				"text": msg.Text,
+				"wrap": true,
+			},
+			map[string]any{
+				"type":  "FactSet",
+				"facts": facts,
+			},
+		},
+	}
+
+	_, err := postJSON(ctx, a.Client, a.Url, nil, map[string]any{
+		"type": "message",
+		"attachments": []any{
+			map[string]any{
+				"contentType": "application/vnd.microsoft.card.adaptive",
+				"content":     card,
+			},
+		},
+	})
+	return "", err
+}
+
+// teamsColor maps a check.ResultState to an Adaptive Card text color.
+func teamsColor(state check.ResultState) string {
+	switch state {
+	case check.StateOk:
+		return "Good"
+	case check.StateWarn:
+		return "Warning"
+	case check.StateCrit:
+		return "Attention"
+	default:
+		return "Default"
+	}
+}
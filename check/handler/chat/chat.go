@@ -0,0 +1,239 @@
+// Package chat provides a check.Handler that posts rich Incident messages to chat services such as Slack,
+// Mattermost and Microsoft Teams.
+package chat
+
+import (
+	"context"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DefaultEvents are the Incident events posted when Handler.Events is nil.
+var DefaultEvents = []check.IncidentEventType{
+	check.IncidentOpened,
+	check.IncidentEscalated,
+	check.IncidentDeEscalated,
+	check.IncidentAcknowledged,
+	check.IncidentResolved,
+	check.IncidentAcknowledgementExpired,
+}
+
+// Adapter formats and posts a Message to a chat service.
+type Adapter interface {
+	// Post posts msg, as a reply in the thread of message threadId when threadId is non-empty and the service
+	// supports threads.  It returns the ID of the posted message, or "" if the service does not provide one.
+	Post(ctx context.Context, msg *Message, threadId string) (string, error)
+}
+
+// MessageStore keeps the ID of the chat message an Incident was first posted as, so that later events for the
+// Incident are posted as thread replies.
+type MessageStore interface {
+	Get(incidentId string) (messageId string, ok bool)
+	Set(incidentId, messageId string)
+	Delete(incidentId string)
+}
+
+// Message is a chat service neutral rich message for an Incident event.
+type Message struct {
+	CheckId    string
+	Event      string
+	State      check.ResultState
+	ReasonCode string
+
+	// Title and Text are a one-line headline and a longer description of the event.
+	Title string
+	Text  string
+
+	// Color is a hex color (ex. #a30200) for the State.
+	Color string
+
+	// Metrics are the metrics of the Result that caused the event.
+	Metrics []check.ResultMetric
+
+	// Duration is how long the Incident has been open.
+	Duration time.Duration
+
+	Time time.Time
+}
+
+// Colors maps a check.ResultState to the hex color of its Messages.
+var Colors = map[check.ResultState]string{
+	check.StateOk:      "#2eb886",
+	check.StateWarn:    "#daa038",
+	check.StateCrit:    "#a30200",
+	check.StateUnknown: "#808080",
+}
+
+// Handler posts Incident events as rich chat messages using Adapter.  Subsequent events for an Incident (including
+// escalations to a new Incident) are posted as replies in the thread of the first message when the Adapter supports
+// threads.
+type Handler struct {
+	Adapter Adapter
+
+	// Events are the Incident events to post (default DefaultEvents).
+	Events []check.IncidentEventType
+
+	// MessageStore holds the IDs of posted messages for threading (default is in memory).
+	MessageStore MessageStore
+
+	mu sync.Mutex
+}
+
+func NewHandler(adapter Adapter) *Handler {
+	return &Handler{Adapter: adapter, MessageStore: NewMemoryMessageStore()}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	events := h.Events
+	if events == nil {
+		events = DefaultEvents
+	}
+	if !slices.Contains(events, event.Type) {
+		return nil
+	}
+
+	store := h.messageStore()
+	incidentId := event.Incident.Id.String()
+
+	// escalations continue in the thread of the incident they supersede
+	threadKey := incidentId
+	if event.PreviousIncident != nil {
+		threadKey = event.PreviousIncident.Id.String()
+	}
+	threadId, _ := store.Get(threadKey)
+
+	msg := NewMessage(chk, event)
+	chk.Debugf("posting chat message for %s event of incident %s (thread %q)", msg.Event, incidentId, threadId)
+
+	messageId, err := h.Adapter.Post(context.Background(), msg, threadId)
+	if err != nil {
+		return err
+	}
+
+	if threadId == "" {
+		threadId = messageId
+	}
+	switch {
+	case event.Type == check.IncidentResolved:
+		store.Delete(incidentId)
+	case threadId != "":
+		store.Set(incidentId, threadId)
+	}
+	if event.PreviousIncident != nil {
+		store.Delete(event.PreviousIncident.Id.String())
+	}
+
+	return nil
+}
+
+func (h *Handler) messageStore() MessageStore {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.MessageStore == nil {
+		h.MessageStore = NewMemoryMessageStore()
+	}
+	return h.MessageStore
+}
+
+// NewMessage builds the Message for a Check's Incident event.
+func NewMessage(chk *check.Check, event check.IncidentEvent) *Message {
+	incident := event.Incident
+
+	state := incident.ToState
+	if event.Type == check.IncidentResolved {
+		state = check.StateOk
+	}
+
+	msg := &Message{
+		CheckId:    chk.Id,
+		Event:      event.Type.String(),
+		State:      state,
+		ReasonCode: incident.ReasonCode,
+		Color:      Colors[state],
+		Time:       event.Time,
+	}
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+	msg.Duration = msg.Time.Sub(incident.Time).Round(time.Second)
+	if event.Result != nil {
+		msg.Metrics = event.Result.Metrics
+	}
+
+	switch event.Type {
+	case check.IncidentResolved:
+		msg.Title = fmt.Sprintf("RESOLVED: %s is OK", chk.Id)
+		msg.Text = fmt.Sprintf("Recovered from %s after %s.", incident.ToState, msg.Duration)
+	case check.IncidentAcknowledged:
+		msg.Title = fmt.Sprintf("ACKNOWLEDGED: %s is %s", chk.Id, state)
+		msg.Text = "Acknowledged"
+		if ack := incident.Acknowledgement; ack != nil {
+			if ack.By != "" {
+				msg.Text += " by " + ack.By
+			}
+			if ack.Comment != "" {
+				msg.Text += ": " + ack.Comment
+			}
+		}
+	case check.IncidentAcknowledgementExpired:
+		msg.Title = fmt.Sprintf("ACKNOWLEDGEMENT EXPIRED: %s is %s", chk.Id, state)
+		msg.Text = "Acknowledgement expired, the incident is unacknowledged."
+	default:
+		msg.Title = fmt.Sprintf("%s: %s is %s", event.Type, chk.Id, state)
+		msg.Text = fmt.Sprintf("Changed from %s to %s", incident.FromState, incident.ToState)
+		if incident.ReasonCode != "" {
+			msg.Text += " (" + incident.ReasonCode + ")"
+		}
+		msg.Text += "."
+		if event.PreviousIncident != nil {
+			msg.Duration = msg.Time.Sub(event.PreviousIncident.Time).Round(time.Second)
+			msg.Text += fmt.Sprintf(" Not OK for %s.", msg.Duration)
+		}
+	}
+
+	return msg
+}
+
+// MemoryMessageStore is a MessageStore that keeps message IDs in memory.
+type MemoryMessageStore struct {
+	ids map[string]string
+	mu  sync.Mutex
+}
+
+func NewMemoryMessageStore() *MemoryMessageStore {
+	return &MemoryMessageStore{ids: make(map[string]string)}
+}
+
+func (s *MemoryMessageStore) Get(incidentId string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id, ok := s.ids[incidentId]
+	return id, ok
+}
+
+func (s *MemoryMessageStore) Set(incidentId, messageId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ids[incidentId] = messageId
+}
+
+func (s *MemoryMessageStore) Delete(incidentId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.ids, incidentId)
+}
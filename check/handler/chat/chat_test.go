@@ -0,0 +1,210 @@
+package chat
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is an httptest handler that records decoded JSON request bodies.
+type recorder struct {
+	mu       sync.Mutex
+	requests []map[string]any
+	headers  []http.Header
+	respond  func(n int) string
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	var v map[string]any
+	_ = json.Unmarshal(body, &v)
+
+	r.mu.Lock()
+	r.requests = append(r.requests, v)
+	r.headers = append(r.headers, req.Header.Clone())
+	n := len(r.requests)
+	r.mu.Unlock()
+
+	if r.respond != nil {
+		io.WriteString(w, r.respond(n))
+	}
+}
+
+func openedEvent() check.IncidentEvent {
+	result := check.NewResult(check.StateCrit, "UNREACHABLE", []check.ResultMetric{{Label: "loss", Value: "100"}})
+	incident := check.MakeIncidentFromResults(nil, result)
+	incident.Time = time.Now().Add(-time.Minute)
+	return check.IncidentEvent{Type: check.IncidentOpened, Incident: incident, Result: result, Time: time.Now()}
+}
+
+func resolvedEvent(opened check.IncidentEvent) check.IncidentEvent {
+	incident := *opened.Incident
+	incident.Resolve()
+	return check.IncidentEvent{
+		Type:     check.IncidentResolved,
+		Incident: &incident,
+		Result:   check.NewResult(check.StateOk, "", nil),
+		Time:     time.Now(),
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	opened := openedEvent()
+	chk := &check.Check{Id: "router1"}
+
+	tests := []struct {
+		name      string
+		event     check.IncidentEvent
+		wantTitle string
+		wantColor string
+	}{
+		{name: "opened", event: opened, wantTitle: "OPENED: router1 is CRIT", wantColor: Colors[check.StateCrit]},
+		{name: "resolved", event: resolvedEvent(opened), wantTitle: "RESOLVED: router1 is OK", wantColor: Colors[check.StateOk]},
+		{name: "acknowledgement expired", event: check.IncidentEvent{Type: check.IncidentAcknowledgementExpired,
+			Incident: opened.Incident, Result: opened.Result, Time: time.Now()},
+			wantTitle: "ACKNOWLEDGEMENT EXPIRED: router1 is CRIT", wantColor: Colors[check.StateCrit]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := NewMessage(chk, tt.event)
+			if msg.Title != tt.wantTitle {
+				t.Errorf("expected title %q, got %q", tt.wantTitle, msg.Title)
+			}
+			if msg.Color != tt.wantColor {
+				t.Errorf("expected color %s, got %s", tt.wantColor, msg.Color)
+			}
+			if msg.Duration < time.Minute {
+				t.Errorf("expected duration of at least 1m, got %s", msg.Duration)
+			}
+		})
+	}
+}
+
+func TestSlackApiThreadsResolutionUnderOpenedMessage(t *testing.T) {
+	rec := &recorder{respond: func(n int) string {
+		return `{"ok":true,"ts":"1700000000.00000` + strconv.Itoa(n) + `"}`
+	}}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	h := NewHandler(&SlackApi{Token: "xoxb-test", Channel: "C123", BaseUrl: srv.URL})
+	chk := &check.Check{Id: "router1"}
+
+	opened := openedEvent()
+	if err := h.ProcessIncidentEvent(chk, opened); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := h.ProcessIncidentEvent(chk, resolvedEvent(opened)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(rec.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(rec.requests))
+	}
+	if got := rec.headers[0].Get("Authorization"); got != "Bearer xoxb-test" {
+		t.Errorf("expected bearer token, got %q", got)
+	}
+	if _, ok := rec.requests[0]["thread_ts"]; ok {
+		t.Error("expected opening message not to be threaded")
+	}
+	if got := rec.requests[1]["thread_ts"]; got != "1700000000.000001" {
+		t.Errorf("expected resolution in thread 1700000000.000001, got %v", got)
+	}
+
+	attachment := rec.requests[0]["attachments"].([]any)[0].(map[string]any)
+	if attachment["color"] != Colors[check.StateCrit] {
+		t.Errorf("expected crit color, got %v", attachment["color"])
+	}
+	if len(attachment["fields"].([]any)) != 4 {
+		t.Errorf("expected state, reason, duration and metric fields, got %v", attachment["fields"])
+	}
+
+	if _, ok := h.MessageStore.Get(opened.Incident.Id.String()); ok {
+		t.Error("expected resolved incident to be removed from the message store")
+	}
+}
+
+func TestSlackApiError(t *testing.T) {
+	srv := httptest.NewServer(&recorder{respond: func(int) string { return `{"ok":false,"error":"channel_not_found"}` }})
+	defer srv.Close()
+
+	h := NewHandler(&SlackApi{Channel: "C123", BaseUrl: srv.URL})
+	if err := h.ProcessIncidentEvent(&check.Check{Id: "router1"}, openedEvent()); err == nil {
+		t.Error("expected error for ok=false response")
+	}
+}
+
+func TestEscalationContinuesThread(t *testing.T) {
+	rec := &recorder{respond: func(n int) string { return `{"id":"post` + strconv.Itoa(n) + `"}` }}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	h := NewHandler(&Mattermost{Url: srv.URL, Token: "token", ChannelId: "chan"})
+	chk := &check.Check{Id: "router1"}
+
+	warn := openedEvent()
+	warn.Incident.ToState = check.StateWarn
+	crit := check.IncidentEvent{
+		Type:             check.IncidentEscalated,
+		Incident:         check.MakeIncidentFromResults(check.NewResult(check.StateWarn, "", nil), check.NewResult(check.StateCrit, "", nil)),
+		PreviousIncident: warn.Incident,
+		Time:             time.Now(),
+	}
+
+	for _, e := range []check.IncidentEvent{warn, crit, resolvedEvent(check.IncidentEvent{Incident: crit.Incident})} {
+		if err := h.ProcessIncidentEvent(chk, e); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if len(rec.requests) != 3 {
+		t.Fatalf("expected 3 posts, got %d", len(rec.requests))
+	}
+	for i, want := range []any{nil, "post1", "post1"} {
+		if got := rec.requests[i]["root_id"]; got != want {
+			t.Errorf("post %d: expected root_id %v, got %v", i, want, got)
+		}
+	}
+}
+
+func TestTeamsPostsAdaptiveCard(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	h := NewHandler(&Teams{Url: srv.URL})
+	if err := h.ProcessIncidentEvent(&check.Check{Id: "router1"}, openedEvent()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	attachment := rec.requests[0]["attachments"].([]any)[0].(map[string]any)
+	if attachment["contentType"] != "application/vnd.microsoft.card.adaptive" {
+		t.Errorf("unexpected content type %v", attachment["contentType"])
+	}
+	card := attachment["content"].(map[string]any)
+	if card["type"] != "AdaptiveCard" {
+		t.Errorf("expected AdaptiveCard, got %v", card["type"])
+	}
+}
+
+func TestSkipsEventsNotConfigured(t *testing.T) {
+	rec := &recorder{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	h := NewHandler(&SlackWebhook{Url: srv.URL})
+	h.Events = []check.IncidentEventType{check.IncidentResolved}
+	if err := h.ProcessIncidentEvent(&check.Check{Id: "router1"}, openedEvent()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(rec.requests) != 0 {
+		t.Errorf("expected no posts, got %d", len(rec.requests))
+	}
+}
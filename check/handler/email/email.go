@@ -0,0 +1,465 @@
+// Package email provides a check.Handler that sends Incident notifications over SMTP, optionally digesting the
+// notifications from a short window into a single email.
+package email
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	htmltemplate "html/template"
+	"maps"
+	"net"
+	"net/smtp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// DefaultRecipientsMetaKey is the Check.Meta key recipients are read from when Handler.Recipients is nil.  The value
+// may be a comma separated string or a []string.
+const DefaultRecipientsMetaKey = "email_recipients"
+
+// DefaultEvents are the Incident events notified on when Handler.Events is nil.
+var DefaultEvents = []check.IncidentEventType{
+	check.IncidentOpened,
+	check.IncidentEscalated,
+	check.IncidentDeEscalated,
+	check.IncidentResolved,
+	check.IncidentAcknowledgementExpired,
+}
+
+// Security is how the connection to the SMTP server is secured.
+type Security uint8
+
+const (
+	// Plain is an unencrypted connection.
+	Plain Security = iota
+	// StartTLS upgrades a plain connection with the STARTTLS command and fails if the server doesn't support it.
+	StartTLS
+	// ImplicitTLS connects with TLS from the start (typically port 465).
+	ImplicitTLS
+)
+
+// AuthMechanism is the SMTP AUTH mechanism used when Handler.Username is set.
+type AuthMechanism uint8
+
+const (
+	AuthPlain AuthMechanism = iota
+	AuthLogin
+)
+
+// Handler emails Incident events to recipients routed from the Check's Meta.
+type Handler struct {
+	Host string
+	Port uint16
+
+	Security  Security
+	TLSConfig *tls.Config
+
+	// Username and Password authenticate with the server when Username is set.  Like net/smtp, credentials are
+	// only sent over TLS or to localhost.
+	Username string
+	Password string
+	Auth     AuthMechanism
+
+	// LocalName is the name sent with EHLO (default "localhost").
+	LocalName string
+
+	From string
+
+	// Recipients returns the recipients for a Check.  By default, they are read from the Check's Meta under
+	// DefaultRecipientsMetaKey.
+	Recipients func(*check.Check) []string
+
+	// DefaultRecipients are used when a Check has no recipients of its own.
+	DefaultRecipients []string
+
+	// SubjectTemplate, TextTemplate and HTMLTemplate render the email from a Message.  HTMLTemplate is optional,
+	// without it a text only email is sent.
+	SubjectTemplate *texttemplate.Template
+	TextTemplate    *texttemplate.Template
+	HTMLTemplate    *htmltemplate.Template
+
+	// Events are the Incident events to notify on (default DefaultEvents).
+	Events []check.IncidentEventType
+
+	// DigestWindow, when set, collects the notifications for the same recipients for this long and sends them
+	// together in one email.
+	DigestWindow time.Duration
+
+	// Timeout bounds connecting to and talking with the SMTP server (default 30 seconds).
+	Timeout time.Duration
+
+	// OnError is called with errors sending digested emails, since they are sent outside Process (useful for
+	// logging).
+	OnError func(err error)
+
+	pending map[string]*digest
+	mu      sync.Mutex
+}
+
+// Message is the data the templates are executed with.
+type Message struct {
+	Notifications []Notification
+}
+
+// Digest returns true if the Message holds more than one Notification.
+func (m Message) Digest() bool {
+	return len(m.Notifications) > 1
+}
+
+// Notification is a snapshot of a single Incident event.
+type Notification struct {
+	Event            string
+	CheckId          string
+	Meta             map[string]any
+	Incident         *check.Incident
+	PreviousIncident *check.Incident
+	Result           *check.Result
+	Time             time.Time
+}
+
+type digest struct {
+	recipients    []string
+	notifications []Notification
+	timer         *time.Timer
+}
+
+// DefaultSubjectTemplate, DefaultTextTemplate and DefaultHTMLTemplate are used when the Handler's are nil.
+var (
+	DefaultSubjectTemplate = texttemplate.Must(texttemplate.New("subject").Parse(
+		`{{ if .Digest }}[gopoller] {{ len .Notifications }} incident notifications` +
+			`{{ else }}{{ with index .Notifications 0 }}[{{ .Incident.ToState }}] {{ .CheckId }} {{ .Event }}` +
+			`{{ with .Incident.ReasonCode }} ({{ . }}){{ end }}{{ end }}{{ end }}`,
+	))
+
+	DefaultTextTemplate = texttemplate.Must(texttemplate.New("text").Parse(
+		`{{ range .Notifications }}Check:    {{ .CheckId }}
+Event:    {{ .Event }}
+State:    {{ .Incident.FromState }} -> {{ .Incident.ToState }}
+Reason:   {{ .Incident.ReasonCode }}
+Incident: {{ .Incident.Id }}
+Since:    {{ .Incident.Time.Format "2006-01-02 15:04:05 MST" }}
+{{ with .Result }}{{ range .Metrics }}  {{ .Label }} = {{ .Value }}
+{{ end }}{{ end }}
+{{ end }}`,
+	))
+
+	DefaultHTMLTemplate = htmltemplate.Must(htmltemplate.New("html").Parse(
+		`<html><body>{{ range .Notifications }}
+<h3>{{ .CheckId }}: {{ .Event }}</h3>
+<table>
+<tr><th align="left">State</th><td>{{ .Incident.FromState }} &rarr; {{ .Incident.ToState }}</td></tr>
+<tr><th align="left">Reason</th><td>{{ .Incident.ReasonCode }}</td></tr>
+<tr><th align="left">Incident</th><td>{{ .Incident.Id }}</td></tr>
+<tr><th align="left">Since</th><td>{{ .Incident.Time.Format "2006-01-02 15:04:05 MST" }}</td></tr>
+{{ with .Result }}{{ range .Metrics }}<tr><th align="left">{{ .Label }}</th><td>{{ .Value }}</td></tr>
+{{ end }}{{ end }}</table>
+{{ end }}</body></html>`,
+	))
+)
+
+func NewHandler(host string, port uint16, from string) *Handler {
+	return &Handler{
+		Host:            host,
+		Port:            port,
+		From:            from,
+		SubjectTemplate: DefaultSubjectTemplate,
+		TextTemplate:    DefaultTextTemplate,
+		HTMLTemplate:    DefaultHTMLTemplate,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	events := h.Events
+	if events == nil {
+		events = DefaultEvents
+	}
+	if !slices.Contains(events, event.Type) {
+		return nil
+	}
+
+	recipients := h.recipients(chk)
+	if len(recipients) == 0 {
+		chk.Debugf("no email recipients for incident %s", event.Incident.Id)
+		return nil
+	}
+
+	n := Notification{
+		Event:    event.Type.String(),
+		CheckId:  chk.Id,
+		Meta:     maps.Clone(chk.Meta),
+		Incident: event.Incident.Clone(),
+		Time:     event.Time,
+	}
+	if event.PreviousIncident != nil {
+		n.PreviousIncident = event.PreviousIncident.Clone()
+	}
+	if event.Result != nil {
+		r := *event.Result
+		n.Result = &r
+	}
+
+	if h.DigestWindow <= 0 {
+		chk.Debugf("emailing incident %s to %s", event.Incident.Id, strings.Join(recipients, ","))
+		return h.send(recipients, []Notification{n})
+	}
+
+	chk.Debugf("queueing incident %s for digest to %s", event.Incident.Id, strings.Join(recipients, ","))
+	h.queue(recipients, n)
+	return nil
+}
+
+// queue adds n to the digest for recipients, starting the digest window if it is the first Notification.
+func (h *Handler) queue(recipients []string, n Notification) {
+	key := strings.Join(recipients, ",")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.pending == nil {
+		h.pending = make(map[string]*digest)
+	}
+	d, ok := h.pending[key]
+	if !ok {
+		d = &digest{recipients: recipients}
+		d.timer = time.AfterFunc(h.DigestWindow, func() {
+			h.flushDigest(key)
+		})
+		h.pending[key] = d
+	}
+	d.notifications = append(d.notifications, n)
+}
+
+func (h *Handler) flushDigest(key string) {
+	h.mu.Lock()
+	d, ok := h.pending[key]
+	delete(h.pending, key)
+	h.mu.Unlock()
+
+	if !ok {
+		return
+	}
+	if err := h.send(d.recipients, d.notifications); err != nil && h.OnError != nil {
+		h.OnError(err)
+	}
+}
+
+// Flush immediately sends all pending digests.  Call it prior to shut down so that notifications are not lost.
+func (h *Handler) Flush() error {
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = nil
+	h.mu.Unlock()
+
+	var errs []error
+	for _, d := range pending {
+		d.timer.Stop()
+		errs = append(errs, h.send(d.recipients, d.notifications))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *Handler) recipients(chk *check.Check) []string {
+	var recipients []string
+	if h.Recipients != nil {
+		recipients = h.Recipients(chk)
+	} else {
+		switch v := chk.Meta[DefaultRecipientsMetaKey].(type) {
+		case string:
+			for _, r := range strings.Split(v, ",") {
+				if r = strings.TrimSpace(r); r != "" {
+					recipients = append(recipients, r)
+				}
+			}
+		case []string:
+			recipients = v
+		case []any:
+			for _, r := range v {
+				if s, ok := r.(string); ok {
+					recipients = append(recipients, s)
+				}
+			}
+		}
+	}
+
+	if len(recipients) == 0 {
+		recipients = h.DefaultRecipients
+	}
+
+	recipients = slices.Clone(recipients)
+	slices.Sort(recipients)
+	return slices.Compact(recipients)
+}
+
+func (h *Handler) send(recipients []string, notifications []Notification) error {
+	msg, err := h.buildMessage(recipients, Message{Notifications: notifications})
+	if err != nil {
+		return fmt.Errorf("error building email: %v", err)
+	}
+
+	if err := h.sendMail(recipients, msg); err != nil {
+		return fmt.Errorf("error sending email: %v", err)
+	}
+	return nil
+}
+
+func (h *Handler) sendMail(recipients []string, msg []byte) (err error) {
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	tlsConfig := h.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: h.Host}
+	}
+
+	addr := net.JoinHostPort(h.Host, strconv.Itoa(int(h.Port)))
+	dialer := &net.Dialer{Timeout: timeout}
+
+	var conn net.Conn
+	if h.Security == ImplicitTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, h.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	localName := h.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err = c.Hello(localName); err != nil {
+		return err
+	}
+
+	if h.Security == StartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("server does not support STARTTLS")
+		}
+		if err = c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	if h.Username != "" {
+		var auth smtp.Auth
+		switch h.Auth {
+		case AuthLogin:
+			auth = &loginAuth{username: h.Username, password: h.Password, host: h.Host}
+		default:
+			auth = smtp.PlainAuth("", h.Username, h.Password, h.Host)
+		}
+		if err = c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(h.From); err != nil {
+		return err
+	}
+	for _, r := range recipients {
+		if err = c.Rcpt(r); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(msg); err != nil {
+		return err
+	}
+	if err = w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func (h *Handler) buildMessage(recipients []string, m Message) ([]byte, error) {
+	subjectTmpl := h.SubjectTemplate
+	if subjectTmpl == nil {
+		subjectTmpl = DefaultSubjectTemplate
+	}
+	textTmpl := h.TextTemplate
+	if textTmpl == nil {
+		textTmpl = DefaultTextTemplate
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := subjectTmpl.Execute(&subject, m); err != nil {
+		return nil, err
+	}
+	if err := textTmpl.Execute(&text, m); err != nil {
+		return nil, err
+	}
+	if h.HTMLTemplate != nil {
+		if err := h.HTMLTemplate.Execute(&html, m); err != nil {
+			return nil, err
+		}
+	}
+
+	return buildMIME(h.From, recipients, subject.String(), text.Bytes(), html.Bytes(), time.Now())
+}
+
+// loginAuth implements the LOGIN smtp.Auth mechanism which net/smtp lacks.
+type loginAuth struct {
+	username, password, host string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:":
+		return []byte(a.username), nil
+	case "password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+	}
+}
+
+func isLocalhost(name string) bool {
+	return name == "localhost" || name == "127.0.0.1" || name == "::1"
+}
@@ -0,0 +1,337 @@
+package email
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http/httptest"
+	"net/mail"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSmtpServer is a minimal in-process SMTP server that records the mail it receives.
+type fakeSmtpServer struct {
+	listener    net.Listener
+	tlsConfig   *tls.Config
+	implicitTLS bool
+
+	mu       sync.Mutex
+	messages []fakeMessage
+	auths    []string
+}
+
+type fakeMessage struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+}
+
+func newFakeSmtpServer(t *testing.T, tlsConfig *tls.Config, implicitTLS bool) *fakeSmtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	if implicitTLS {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	s := &fakeSmtpServer{listener: l, tlsConfig: tlsConfig, implicitTLS: implicitTLS}
+	go s.serve()
+	t.Cleanup(func() { l.Close() })
+	return s
+}
+
+func (s *fakeSmtpServer) port() uint16 {
+	return uint16(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (s *fakeSmtpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *fakeSmtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	isTLS := s.implicitTLS
+	r := bufio.NewReader(conn)
+	reply := func(lines ...string) {
+		for _, l := range lines {
+			io.WriteString(conn, l+"\r\n")
+		}
+	}
+	readLine := func() string {
+		l, _ := r.ReadString('\n')
+		return strings.TrimRight(l, "\r\n")
+	}
+	decode := func(s string) string {
+		b, _ := base64.StdEncoding.DecodeString(s)
+		return string(b)
+	}
+
+	reply("220 localhost ESMTP fake")
+	var msg fakeMessage
+	for {
+		line := readLine()
+		cmd, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(cmd) {
+		case "EHLO", "HELO":
+			if s.tlsConfig != nil && !isTLS {
+				reply("250-localhost", "250-STARTTLS", "250 AUTH PLAIN LOGIN")
+			} else {
+				reply("250-localhost", "250 AUTH PLAIN LOGIN")
+			}
+		case "STARTTLS":
+			reply("220 ready to start TLS")
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn, r, isTLS = tlsConn, bufio.NewReader(tlsConn), true
+		case "AUTH":
+			mech, initial, _ := strings.Cut(arg, " ")
+			var creds string
+			if mech == "PLAIN" {
+				creds = "PLAIN:" + strings.ReplaceAll(decode(initial), "\x00", ":")
+			} else {
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Username:")))
+				user := decode(readLine())
+				reply("334 " + base64.StdEncoding.EncodeToString([]byte("Password:")))
+				pass := decode(readLine())
+				creds = "LOGIN:" + user + ":" + pass
+			}
+			s.mu.Lock()
+			s.auths = append(s.auths, creds)
+			s.mu.Unlock()
+			reply("235 authenticated")
+		case "MAIL":
+			msg = fakeMessage{from: strings.TrimSuffix(strings.TrimPrefix(arg, "FROM:<"), ">"), tls: isTLS}
+			reply("250 ok")
+		case "RCPT":
+			msg.to = append(msg.to, strings.TrimSuffix(strings.TrimPrefix(arg, "TO:<"), ">"))
+			reply("250 ok")
+		case "DATA":
+			reply("354 go ahead")
+			var data strings.Builder
+			for {
+				l := readLine()
+				if l == "." {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, ".") + "\r\n")
+			}
+			msg.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		case "":
+			return
+		default:
+			reply("502 not implemented")
+		}
+	}
+}
+
+func (s *fakeSmtpServer) received() []fakeMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeMessage(nil), s.messages...)
+}
+
+// testTLSConfigs returns a server TLS config and a client TLS config trusting it.
+func testTLSConfigs() (*tls.Config, *tls.Config) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+
+	return &tls.Config{Certificates: srv.TLS.Certificates}, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"}
+}
+
+func openedEvent(reason string) check.IncidentEvent {
+	result := check.NewResult(check.StateCrit, reason, []check.ResultMetric{{Label: "loss", Value: "100"}})
+	return check.IncidentEvent{
+		Type:     check.IncidentOpened,
+		Incident: check.MakeIncidentFromResults(nil, result),
+		Result:   result,
+		Time:     time.Now(),
+	}
+}
+
+func TestSendsMultipartEmailToMetaRecipients(t *testing.T) {
+	srv := newFakeSmtpServer(t, nil, false)
+
+	h := NewHandler("127.0.0.1", srv.port(), "poller@example.com")
+	h.Username, h.Password = "user", "pass"
+
+	chk := &check.Check{Id: "router1", Meta: map[string]any{DefaultRecipientsMetaKey: "noc@example.com, ops@example.com"}}
+	if err := h.ProcessIncidentEvent(chk, openedEvent("UNREACHABLE")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	msgs := srv.received()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	if got := strings.Join(msgs[0].to, ","); got != "noc@example.com,ops@example.com" {
+		t.Errorf("expected recipients from meta, got %s", got)
+	}
+	if srv.auths[0] != "PLAIN::user:pass" {
+		t.Errorf("expected AUTH PLAIN with credentials, got %s", srv.auths[0])
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(msgs[0].data))
+	if err != nil {
+		t.Fatalf("unable to parse message: %v", err)
+	}
+	if got := m.Header.Get("Subject"); got != "[CRIT] router1 OPENED (UNREACHABLE)" {
+		t.Errorf("unexpected subject %q", got)
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("expected multipart/alternative, got %s", mediaType)
+	}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, _ := io.ReadAll(p)
+		types = append(types, p.Header.Get("Content-Type"))
+		if !strings.Contains(string(body), "loss") {
+			t.Errorf("expected %s part to contain metrics, got %s", p.Header.Get("Content-Type"), body)
+		}
+	}
+	if len(types) != 2 {
+		t.Errorf("expected text and html parts, got %v", types)
+	}
+}
+
+func TestSecurityModes(t *testing.T) {
+	serverTLS, clientTLS := testTLSConfigs()
+
+	tests := []struct {
+		name     string
+		security Security
+		auth     AuthMechanism
+		wantAuth string
+	}{
+		{name: "starttls_login", security: StartTLS, auth: AuthLogin, wantAuth: "LOGIN:user:pass"},
+		{name: "implicit_tls_plain", security: ImplicitTLS, auth: AuthPlain, wantAuth: "PLAIN::user:pass"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeSmtpServer(t, serverTLS, tt.security == ImplicitTLS)
+
+			h := NewHandler("127.0.0.1", srv.port(), "poller@example.com")
+			h.Security = tt.security
+			h.TLSConfig = clientTLS
+			h.Username, h.Password, h.Auth = "user", "pass", tt.auth
+			h.DefaultRecipients = []string{"noc@example.com"}
+
+			if err := h.ProcessIncidentEvent(&check.Check{Id: "router1"}, openedEvent("")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			msgs := srv.received()
+			if len(msgs) != 1 || !msgs[0].tls {
+				t.Fatalf("expected 1 message over TLS, got %+v", msgs)
+			}
+			if srv.auths[0] != tt.wantAuth {
+				t.Errorf("expected auth %s, got %s", tt.wantAuth, srv.auths[0])
+			}
+		})
+	}
+}
+
+func TestStartTLSRequiredButUnsupported(t *testing.T) {
+	srv := newFakeSmtpServer(t, nil, false)
+
+	h := NewHandler("127.0.0.1", srv.port(), "poller@example.com")
+	h.Security = StartTLS
+	h.DefaultRecipients = []string{"noc@example.com"}
+
+	if err := h.ProcessIncidentEvent(&check.Check{Id: "router1"}, openedEvent("")); err == nil {
+		t.Error("expected error when server lacks STARTTLS")
+	}
+}
+
+func TestDigestsNotificationsWithinWindow(t *testing.T) {
+	srv := newFakeSmtpServer(t, nil, false)
+
+	h := NewHandler("127.0.0.1", srv.port(), "poller@example.com")
+	h.DigestWindow = 50 * time.Millisecond
+	h.DefaultRecipients = []string{"noc@example.com"}
+	errs := make(chan error, 1)
+	h.OnError = func(err error) { errs <- err }
+
+	for i := 0; i < 3; i++ {
+		chk := &check.Check{Id: "router" + strconv.Itoa(i)}
+		if err := h.ProcessIncidentEvent(chk, openedEvent("")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(srv.received()) != 0 {
+		t.Fatal("expected no email before the digest window closes")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(srv.received()) == 0 && time.Now().Before(deadline) {
+		select {
+		case err := <-errs:
+			t.Fatalf("unexpected error: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	msgs := srv.received()
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 digest email, got %d", len(msgs))
+	}
+	m, _ := mail.ReadMessage(strings.NewReader(msgs[0].data))
+	if got := m.Header.Get("Subject"); got != "[gopoller] 3 incident notifications" {
+		t.Errorf("unexpected digest subject %q", got)
+	}
+}
+
+func TestFlushSendsPendingDigests(t *testing.T) {
+	srv := newFakeSmtpServer(t, nil, false)
+
+	h := NewHandler("127.0.0.1", srv.port(), "poller@example.com")
+	h.DigestWindow = time.Hour
+	h.DefaultRecipients = []string{"noc@example.com"}
+
+	_ = h.ProcessIncidentEvent(&check.Check{Id: "router1"}, openedEvent(""))
+	if err := h.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.received()) != 1 {
+		t.Errorf("expected flushed digest to be sent, got %d emails", len(srv.received()))
+	}
+}
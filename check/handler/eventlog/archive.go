@@ -0,0 +1,221 @@
+package eventlog
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// archiveTimeFormat is the rotation time in the names of rotated files, which sorts in time order.
+const archiveTimeFormat = "20060102T150405.000000Z"
+
+// ErrCorruptLine is wrapped by the error ReadEvents returns when lines could not be decoded.
+var ErrCorruptLine = errors.New("corrupt event log line")
+
+// Filter narrows the Events read by ReadEvents.  Zero value fields match everything.
+type Filter struct {
+	// CheckId matches Events of the Check with this ID.
+	CheckId string
+
+	// Types matches Events with any of these Types.
+	Types []string
+
+	// Since and Until match Events with a Time within [Since, Until).
+	Since time.Time
+	Until time.Time
+}
+
+// Matches returns true if the Event e satisfies the filter.
+func (f Filter) Matches(e *Event) bool {
+	if f.CheckId != "" && e.CheckId != f.CheckId {
+		return false
+	}
+	if len(f.Types) > 0 && !slices.Contains(f.Types, e.Type) {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+// ReadEvents calls fn with each Event of the log at path matching filter, reading the rotated files oldest first and
+// then the current file.  Reading stops at the first error, including those returned by fn.  An incomplete last
+// line, such as one torn by a crash or still being written, is skipped.  Lines that cannot be decoded are skipped
+// too, and reported once every file is read by an error wrapping ErrCorruptLine.
+func ReadEvents(path string, filter Filter, fn func(*Event) error) error {
+	archives, err := listArchives(path)
+	if err != nil {
+		return err
+	}
+
+	files := make([]archive, 0, len(archives)+1)
+	files = append(files, archives...)
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, archive{path: path})
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var corrupt []error
+	for _, f := range files {
+		if err := readFile(f, filter, fn, &corrupt); err != nil {
+			return err
+		}
+	}
+	return errors.Join(corrupt...)
+}
+
+// readFile calls fn with the Events of a matching filter, appending errors decoding lines to corrupt.
+func readFile(a archive, filter Filter, fn func(*Event) error, corrupt *[]error) error {
+	f, err := os.Open(a.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		// removed by rotation since listing
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if a.compressed {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", a.path, err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	br := bufio.NewReader(r)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading %s: %v", a.path, err)
+		}
+
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			*corrupt = append(*corrupt, fmt.Errorf("%w: %s line %d: %v", ErrCorruptLine, a.path, n, err))
+			continue
+		}
+		if !filter.Matches(&e) {
+			continue
+		}
+		if err := fn(&e); err != nil {
+			return err
+		}
+	}
+}
+
+// archive is a rotated file.
+type archive struct {
+	path       string
+	compressed bool
+}
+
+// archiveName returns the name the file at path is rotated to at time t.
+func archiveName(path string, t time.Time) string {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+
+	for {
+		name := filepath.Join(dir, stem+"-"+t.UTC().Format(archiveTimeFormat)+ext)
+		_, err := os.Stat(name)
+		_, errGz := os.Stat(name + ".gz")
+		if errors.Is(err, fs.ErrNotExist) && errors.Is(errGz, fs.ErrNotExist) {
+			return name
+		}
+		t = t.Add(time.Microsecond)
+	}
+}
+
+// listArchives returns the rotated files of the file at path, oldest first.  A file that was being compressed when
+// interrupted is only listed compressed.
+func listArchives(path string) ([]archive, error) {
+	dir, base := filepath.Split(path)
+	ext := filepath.Ext(base)
+	prefix := strings.TrimSuffix(base, ext) + "-"
+
+	if dir == "" {
+		dir = "."
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var archives []archive
+	for _, e := range entries {
+		name, ok := strings.CutPrefix(e.Name(), prefix)
+		if !ok || e.IsDir() {
+			continue
+		}
+		name, compressed := strings.CutSuffix(name, ".gz")
+		if name, ok = strings.CutSuffix(name, ext); !ok {
+			continue
+		}
+		if _, err := time.Parse(archiveTimeFormat, name); err != nil {
+			continue
+		}
+		archives = append(archives, archive{path: filepath.Join(dir, e.Name()), compressed: compressed})
+	}
+
+	slices.SortFunc(archives, func(a, b archive) int {
+		return strings.Compare(a.path, b.path)
+	})
+	// a compressed file sorts right after its uncompressed original
+	return slices.DeleteFunc(archives, func(a archive) bool {
+		if a.compressed {
+			return false
+		}
+		_, err := os.Stat(a.path + ".gz")
+		return err == nil
+	}), nil
+}
+
+// compress gzips the file at path to path.gz, removing the original.
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error compressing rotated event log: %v", err)
+	}
+	defer src.Close()
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("error compressing rotated event log: %v", err)
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Sync(), dst.Close())
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("error compressing rotated event log: %v", err)
+	}
+
+	src.Close()
+	return os.Remove(path)
+}
@@ -0,0 +1,377 @@
+// Package eventlog provides a check.Handler that appends every Result and Incident event as a line of JSON to a
+// local file for auditing and replay, rotating and optionally compressing the file, and ReadEvents to read the
+// events back from the file and its archives.
+package eventlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/background"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EventResult is the Type of the Event of a Result.  Incident Events have the check.IncidentEventType as their Type
+// (ex. "OPENED").
+const EventResult = "RESULT"
+
+var errClosed = errors.New("event log is closed")
+
+// Event is a line of the log.
+type Event struct {
+	Type    string    `json:"type"`
+	CheckId string    `json:"check_id"`
+	Time    time.Time `json:"time"`
+
+	// Result is the Result of a RESULT Event.
+	Result *check.Result `json:"result,omitempty"`
+
+	// Incident and PreviousIncident are those of an Incident Event, and ResultId is the id of the Result that caused
+	// it (if any).
+	Incident         *check.Incident `json:"incident,omitempty"`
+	PreviousIncident *check.Incident `json:"previous_incident,omitempty"`
+	ResultId         *uuid.UUID      `json:"result_id,omitempty"`
+}
+
+// SyncPolicy is when the log file is fsynced, trading durability of the latest events on a crash for throughput.
+type SyncPolicy uint8
+
+const (
+	// SyncPeriodic fsyncs every SyncInterval if events were written since the last fsync.
+	SyncPeriodic SyncPolicy = iota
+	// SyncAlways fsyncs after every event.
+	SyncAlways
+	// SyncNever leaves writing events to disk to the operating system.
+	SyncNever
+)
+
+// Handler appends the Events of the Check Results and Incident events it processes to the file at Path.
+//
+// The file is rotated (renamed with the time of rotation, ex. events-20231114T150405.000000Z.jsonl) before it would
+// exceed MaxSize, and when a RotateInterval boundary passes.  Rotated files are gzipped when Compress is set and the
+// oldest are removed beyond MaxBackups.  Close the Handler on shutdown to sync and close the file.
+type Handler struct {
+	// Path is the file events are appended to (ex. /var/log/gopoller/events.jsonl).
+	Path string
+
+	// MaxSize is the most bytes written to a file before it is rotated (default 100 MiB).
+	MaxSize int64
+
+	// RotateInterval, when set, also rotates the file at each multiple of RotateInterval since the Unix epoch (ex.
+	// 24 hours rotates at midnight UTC).
+	RotateInterval time.Duration
+
+	// MaxBackups is the most rotated files kept, or 0 to keep them all.
+	MaxBackups int
+
+	// Compress gzips rotated files.
+	Compress bool
+
+	Sync SyncPolicy
+
+	// SyncInterval is how often the SyncPeriodic policy fsyncs (default 1 second).
+	SyncInterval time.Duration
+
+	// OnError is called with errors syncing, compressing and removing files, as they happen in the background, and
+	// when a partially written Event is discarded on opening the file.
+	OnError func(err error)
+
+	file    *os.File
+	size    int64
+	period  int64 // the RotateInterval period the file was last written in
+	dirty   bool
+	mu      sync.Mutex
+	syncer  background.Loop
+	archive sync.WaitGroup
+	nowFunc func() time.Time
+}
+
+func NewHandler(path string) *Handler {
+	return &Handler{
+		Path:         path,
+		MaxSize:      100 << 20,
+		SyncInterval: time.Second,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	return h.Write(&Event{
+		Type:    EventResult,
+		CheckId: chk.Id,
+		Time:    result.Time,
+		Result:  result,
+	})
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	e := &Event{
+		Type:             event.Type.String(),
+		CheckId:          chk.Id,
+		Time:             event.Time,
+		Incident:         event.Incident,
+		PreviousIncident: event.PreviousIncident,
+	}
+	if event.Result != nil {
+		e.ResultId = &event.Result.Id
+	}
+	return h.Write(e)
+}
+
+// Write appends an Event to the log.
+func (h *Handler) Write(e *Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("error encoding %s event: %v", e.Type, err)
+	}
+	line = append(line, '\n')
+
+	if h.Sync == SyncPeriodic {
+		h.syncer.Start(h.syncInterval(), h.sync, h.OnError)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Close stops the syncer before closing the file, so the file isn't opened again once closed
+	if h.syncer.Stopped() {
+		return errClosed
+	}
+	if h.file == nil {
+		if err = h.open(); err != nil {
+			return err
+		}
+	}
+
+	period := h.currentPeriod()
+	if h.size > 0 && (h.size+int64(len(line)) > h.maxSize() || period != h.period) {
+		if err = h.rotate(); err != nil {
+			return err
+		}
+		if err = h.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := h.file.Write(line)
+	h.size += int64(n)
+	h.period = period
+	if err != nil {
+		return fmt.Errorf("error writing event log: %v", err)
+	}
+
+	if h.Sync == SyncAlways {
+		return h.file.Sync()
+	}
+	h.dirty = true
+	return nil
+}
+
+// Rotate rotates the file now, if anything has been written to it.
+func (h *Handler) Rotate() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.syncer.Stopped() {
+		return errClosed
+	}
+	if h.file == nil {
+		if err := h.open(); err != nil {
+			return err
+		}
+	}
+	if h.size == 0 {
+		return nil
+	}
+	return h.rotate()
+}
+
+// Close syncs and closes the file, and waits for rotated files to finish compressing.  Events written after Close
+// are refused.
+func (h *Handler) Close() error {
+	h.syncer.Stop()
+
+	h.mu.Lock()
+	var err error
+	if h.file != nil {
+		err = errors.Join(h.file.Sync(), h.file.Close())
+		h.file = nil
+	}
+	h.mu.Unlock()
+
+	h.archive.Wait()
+	return err
+}
+
+// open opens the file for appending, creating it and its directory if needed.  A partial last line, left by a crash
+// while writing it, is truncated so the next Event starts on its own line.
+func (h *Handler) open() error {
+	if err := os.MkdirAll(filepath.Dir(h.Path), 0755); err != nil {
+		return fmt.Errorf("error creating event log directory: %v", err)
+	}
+	f, err := os.OpenFile(h.Path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("error opening event log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error opening event log: %v", err)
+	}
+	size, err := truncatePartialLine(f, info.Size())
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error repairing event log: %v", err)
+	}
+	if size != info.Size() && h.OnError != nil {
+		h.OnError(fmt.Errorf("discarded %d bytes of a partially written event at the end of %s",
+			info.Size()-size, h.Path))
+	}
+
+	h.file, h.size, h.dirty = f, size, false
+	h.period = h.currentPeriod()
+	if h.size > 0 {
+		// the file was last written in the period of its modification time
+		h.period = h.periodOf(info.ModTime())
+	}
+	return nil
+}
+
+// truncatePartialLine truncates f, of size bytes, after its last newline, returning the new size.
+func truncatePartialLine(f *os.File, size int64) (int64, error) {
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := f.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if end == size {
+		return size, nil
+	}
+	return end, f.Truncate(end)
+}
+
+// rotate closes the file and renames it, then compresses and removes rotated files in the background.
+func (h *Handler) rotate() error {
+	err := errors.Join(h.file.Sync(), h.file.Close())
+	h.file = nil
+	if err != nil {
+		return fmt.Errorf("error closing event log for rotation: %v", err)
+	}
+
+	if err = os.Rename(h.Path, archiveName(h.Path, h.now())); err != nil {
+		return fmt.Errorf("error rotating event log: %v", err)
+	}
+
+	h.archive.Add(1)
+	go func() {
+		defer h.archive.Done()
+		if err := h.maintainArchives(); err != nil && h.OnError != nil {
+			h.OnError(err)
+		}
+	}()
+	return nil
+}
+
+// archiveMu serializes archive maintenance across Handlers, which is rare enough not to matter.
+var archiveMu sync.Mutex
+
+// maintainArchives compresses rotated files (if Compress is set) and removes the oldest beyond MaxBackups.
+func (h *Handler) maintainArchives() error {
+	archiveMu.Lock()
+	defer archiveMu.Unlock()
+
+	archives, err := listArchives(h.Path)
+	if err != nil {
+		return err
+	}
+
+	var errs error
+	if h.Compress {
+		for i, a := range archives {
+			if a.compressed {
+				continue
+			}
+			if err := compress(a.path); err != nil {
+				errs = errors.Join(errs, err)
+				continue
+			}
+			archives[i] = archive{path: a.path + ".gz", compressed: true}
+		}
+	}
+
+	if h.MaxBackups > 0 && len(archives) > h.MaxBackups {
+		for _, a := range archives[:len(archives)-h.MaxBackups] {
+			if err := os.Remove(a.path); err != nil {
+				errs = errors.Join(errs, fmt.Errorf("error removing rotated event log: %v", err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// sync fsyncs the file if events were written since the last fsync.
+func (h *Handler) sync() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil || !h.dirty {
+		return nil
+	}
+	h.dirty = false
+	if err := h.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing event log: %v", err)
+	}
+	return nil
+}
+
+// currentPeriod returns the RotateInterval period of the current time.
+func (h *Handler) currentPeriod() int64 {
+	return h.periodOf(h.now())
+}
+
+func (h *Handler) periodOf(t time.Time) int64 {
+	if h.RotateInterval <= 0 {
+		return 0
+	}
+	return t.UnixNano() / int64(h.RotateInterval)
+}
+
+func (h *Handler) syncInterval() time.Duration {
+	if h.SyncInterval <= 0 {
+		return time.Second
+	}
+	return h.SyncInterval
+}
+
+func (h *Handler) maxSize() int64 {
+	if h.MaxSize <= 0 {
+		return 100 << 20
+	}
+	return h.MaxSize
+}
+
+func (h *Handler) now() time.Time {
+	if h.nowFunc != nil {
+		return h.nowFunc()
+	}
+	return time.Now()
+}
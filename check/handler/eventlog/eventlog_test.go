@@ -0,0 +1,281 @@
+package eventlog
+
+import (
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+
+func readAll(t *testing.T, path string, filter Filter) []*Event {
+	t.Helper()
+	var events []*Event
+	err := ReadEvents(path, filter, func(e *Event) error {
+		events = append(events, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return events
+}
+
+func result(state check.ResultState, at time.Time) *check.Result {
+	r := check.NewResult(state, "", []check.ResultMetric{{Label: "rtt", Value: "1.5", Type: check.ResultMetricGauge}})
+	r.Time = at
+	return r
+}
+
+func TestHandlerWritesResultsAndIncidentEvents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log", "events.jsonl")
+	h := NewHandler(path)
+	h.Sync = SyncAlways
+
+	chk := check.New("router1")
+	first, second := result(check.StateOk, t0), result(check.StateCrit, t0.Add(time.Minute))
+	incident := check.MakeIncidentFromResults(first, second)
+	for _, r := range []*check.Result{first, second} {
+		if err := h.Process(chk, r, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	err := h.ProcessIncidentEvent(chk, check.IncidentEvent{
+		Type:     check.IncidentOpened,
+		Incident: incident,
+		Result:   second,
+		Time:     second.Time,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = h.Process(chk, result(check.StateOk, t0.Add(2*time.Minute)), nil); err == nil {
+		t.Error("expected an error writing after Close")
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(b), "\n"), "\n"); len(lines) != 3 ||
+		!strings.HasPrefix(lines[0], `{"type":"RESULT","check_id":"router1"`) {
+		t.Errorf("unexpected log contents %s", b)
+	}
+
+	events := readAll(t, path, Filter{})
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if e := events[1]; e.Result == nil || e.Result.Id != second.Id || e.Result.State != check.StateCrit ||
+		e.Result.Metrics[0].Value != "1.5" || !e.Time.Equal(second.Time) {
+		t.Errorf("unexpected result event %+v", e)
+	}
+	if e := events[2]; e.Type != "OPENED" || e.Incident == nil || e.Incident.Id != incident.Id ||
+		e.ResultId == nil || *e.ResultId != second.Id {
+		t.Errorf("unexpected incident event %+v", e)
+	}
+}
+
+func TestRotationCompressionAndBackups(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "events.jsonl")
+	h := NewHandler(path)
+	h.MaxSize = 1000
+	h.MaxBackups = 3
+	h.Compress = true
+	h.Sync = SyncNever
+	now := t0
+	h.nowFunc = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	chk := check.New("router1")
+	for i := 0; i < 40; i++ {
+		if err := h.Process(chk, result(check.StateOk, t0.Add(time.Duration(i)*time.Minute)), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	archives, err := listArchives(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(archives) != 3 {
+		t.Fatalf("expected 3 rotated files kept, got %v", archives)
+	}
+	for _, a := range archives {
+		info, err := os.Stat(a.path)
+		if !a.compressed || err != nil || !strings.HasPrefix(filepath.Base(a.path), "events-2023") {
+			t.Errorf("expected a compressed rotated file, got %v (%v)", a, err)
+		}
+		if err == nil && info.Size() >= 1000 {
+			t.Errorf("expected %s to be smaller once compressed", a.path)
+		}
+	}
+
+	// the newest events remain, in order
+	events := readAll(t, path, Filter{})
+	if len(events) == 0 || len(events) >= 40 {
+		t.Fatalf("expected the oldest events to be removed, got %d", len(events))
+	}
+	for i, e := range events {
+		if want := t0.Add(time.Duration(40-len(events)+i) * time.Minute); !e.Time.Equal(want) {
+			t.Errorf("expected event %d at %v, got %v", i, want, e.Time)
+		}
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	h := NewHandler(path)
+	h.RotateInterval = time.Hour
+	h.Sync = SyncNever
+	now := t0.Add(59 * time.Minute)
+	h.nowFunc = func() time.Time { return now }
+
+	chk := check.New("router1")
+	for _, offset := range []time.Duration{59 * time.Minute, 60 * time.Minute, 61 * time.Minute} {
+		now = t0.Add(offset)
+		if err := h.Process(chk, result(check.StateOk, now), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	archives, _ := listArchives(path)
+	if len(archives) != 1 || filepath.Base(archives[0].path) != "events-20231114T010000.000000Z.jsonl" {
+		t.Fatalf("expected a file rotated at the hour, got %v", archives)
+	}
+	if events := readAll(t, path, Filter{}); len(events) != 3 {
+		t.Errorf("expected 3 events, got %d", len(events))
+	}
+}
+
+func TestReadEventsFilters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	h := NewHandler(path)
+	h.Sync = SyncNever
+	h.Compress = true
+
+	for i, id := range []string{"a", "b", "a", "b", "a"} {
+		if err := h.Process(check.New(id), result(check.StateOk, t0.Add(time.Duration(i)*time.Minute)), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i == 2 {
+			if err := h.Rotate(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+	incident := &check.Incident{ToState: check.StateCrit, Time: t0}
+	if err := h.ProcessIncidentEvent(check.New("a"), check.IncidentEvent{Type: check.IncidentOpened,
+		Incident: incident, Time: t0.Add(10 * time.Minute)}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// a torn last line is skipped
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.WriteString(`{"type":"RESULT","check_id":"a","ti`)
+	f.Close()
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   []time.Duration
+	}{
+		{"all", Filter{}, []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute, 4 * time.Minute, 10 * time.Minute}},
+		{"check", Filter{CheckId: "a"}, []time.Duration{0, 2 * time.Minute, 4 * time.Minute, 10 * time.Minute}},
+		{"type", Filter{CheckId: "a", Types: []string{EventResult}}, []time.Duration{0, 2 * time.Minute, 4 * time.Minute}},
+		{"range", Filter{Since: t0.Add(time.Minute), Until: t0.Add(4 * time.Minute)}, []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []time.Duration
+			for _, e := range readAll(t, path, tt.filter) {
+				got = append(got, e.Time.Sub(t0))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("wanted %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	stop := errors.New("stop")
+	var n int
+	err = ReadEvents(path, Filter{}, func(*Event) error {
+		n++
+		return stop
+	})
+	if !errors.Is(err, stop) || n != 1 {
+		t.Errorf("expected reading to stop at the callback's error, got %v after %d events", err, n)
+	}
+
+	// a corrupt line before the end is skipped and reported after reading the rest
+	if err = os.WriteFile(path, []byte("not json\n{\"type\":\"RESULT\",\"check_id\":\"a\"}\n"), 0644); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	n = 0
+	err = ReadEvents(path, Filter{}, func(*Event) error {
+		n++
+		return nil
+	})
+	if !errors.Is(err, ErrCorruptLine) || n != 4 {
+		t.Errorf("expected the corrupt line skipped and reported, got %v after %d events", err, n)
+	}
+}
+
+func TestOpenTruncatesTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	h := NewHandler(path)
+	if err := h.Process(check.New("a"), result(check.StateOk, t0), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// as though the poller crashed while writing an event
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	f.WriteString(`{"type":"RESULT","check_id":"a","ti`)
+	f.Close()
+
+	h = NewHandler(path)
+	var errs []error
+	h.OnError = func(err error) { errs = append(errs, err) }
+	if err = h.Process(check.New("b"), result(check.StateOk, t0.Add(time.Minute)), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if events := readAll(t, path, Filter{}); len(events) != 2 || events[1].CheckId != "b" {
+		t.Errorf("expected both complete events, got %+v", events)
+	}
+	if len(errs) != 1 {
+		t.Errorf("expected the discarded partial event reported, got %v", errs)
+	}
+}
@@ -0,0 +1,333 @@
+// Package forecast provides a check.Handler that fits a regression over recent metric history to project when a
+// metric will reach its capacity.
+package forecast
+
+import (
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/metamodel"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+const (
+	ReasonForecastFull = "FORECAST_FULL"
+
+	// DefaultStateKey is the Check.HandlerState key the Model is stored under when Handler.StateKey is empty.
+	DefaultStateKey = "forecast"
+
+	DefaultWindow     = 7 * 24 * time.Hour
+	DefaultMinSamples = 5
+	DefaultMaxSamples = 500
+)
+
+// Method is the regression method used to fit metric history.
+type Method uint8
+
+const (
+	// Linear is an ordinary least squares fit.
+	Linear Method = iota
+	// TheilSen is a robust fit using the median of pairwise slopes, which is far less sensitive to outliers than
+	// Linear at the cost of O(n^2) time in the number of samples.
+	TheilSen
+)
+
+// MetricForecast defines the capacity and alerting horizons for a single metric of a Result.
+type MetricForecast struct {
+	// Label is the ResultMetric label to forecast.
+	Label string
+
+	// Capacity is the value at which the metric is considered full (ex. 100 for a percentage gauge).
+	Capacity float64
+
+	// CapacityLabel is the label of another metric in the same Result holding the capacity (ex. a pool size).  When
+	// that metric is present it takes precedence over Capacity.
+	CapacityLabel string
+
+	// WarnHorizon and CritHorizon set the Result state to WARN or CRIT when projected exhaustion falls within them.
+	// A zero value disables that horizon.
+	WarnHorizon time.Duration
+	CritHorizon time.Duration
+
+	// TimeToFullLabel is the label of the derived metric holding the projected seconds until full (default is Label
+	// suffixed with "_time_to_full").
+	TimeToFullLabel string
+}
+
+func (f MetricForecast) timeToFullLabel() string {
+	if f.TimeToFullLabel == "" {
+		return f.Label + "_time_to_full"
+	}
+	return f.TimeToFullLabel
+}
+
+// Handler is a check.ResultMutator that keeps a history of the configured gauge metrics in the Check's HandlerState,
+// fits a regression over it, and appends a derived time-to-full gauge metric (in seconds) to the Result.  The
+// derived metric is only added when the metric is trending toward its capacity.  When the projected exhaustion falls
+// inside a MetricForecast horizon the Result state is raised with reason FORECAST_FULL.  HandlerState rather than
+// Meta keeps the history out of what handlers export.
+type Handler struct {
+	Forecasts []MetricForecast
+
+	// Method is the regression method (default Linear).
+	Method Method
+
+	// Window is how much history is kept and fit (default 7 days).
+	Window time.Duration
+
+	// MinSamples is the number of samples required before a forecast is made (default 5).
+	MinSamples int
+
+	// MaxSamples caps the number of samples kept per metric, dropping the oldest first (default 500).
+	MaxSamples int
+
+	// StateKey is the Check.HandlerState key that the Model is stored under (default "forecast").
+	StateKey string
+}
+
+func NewHandler(forecasts []MetricForecast) *Handler {
+	return &Handler{
+		Forecasts:  forecasts,
+		Window:     DefaultWindow,
+		MinSamples: DefaultMinSamples,
+		MaxSamples: DefaultMaxSamples,
+		StateKey:   DefaultStateKey,
+	}
+}
+
+func (h *Handler) MutateResult(chk *check.Check, result *check.Result) {
+	if len(h.Forecasts) == 0 || len(result.Metrics) == 0 {
+		return
+	}
+
+	model := h.model(chk)
+
+	for _, forecast := range h.Forecasts {
+		metric := metamodel.FindMetric(result, forecast.Label)
+		if metric == nil {
+			continue
+		}
+		if metric.Type == check.ResultMetricCounter {
+			chk.Debugf("metric %s is a counter, skipping forecast", metric.Label)
+			continue
+		}
+		value, err := strconv.ParseFloat(metric.Value, 64)
+		if err != nil {
+			chk.Debugf("metric %s value %q is not numeric: %v", metric.Label, metric.Value, err)
+			continue
+		}
+
+		capacity := forecast.Capacity
+		if forecast.CapacityLabel != "" {
+			if m := metamodel.FindMetric(result, forecast.CapacityLabel); m != nil {
+				if c, err := strconv.ParseFloat(m.Value, 64); err == nil {
+					capacity = c
+				}
+			}
+		}
+
+		history := model.Metrics[forecast.Label]
+		if history == nil {
+			history = &History{}
+			model.Metrics[forecast.Label] = history
+		}
+		history.add(Sample{Time: result.Time, Value: value}, h.window(), h.maxSamples())
+
+		if len(history.Samples) < h.minSamples() || capacity <= 0 {
+			continue
+		}
+
+		ttf, ok := history.TimeToFull(capacity, result.Time, h.Method)
+		if !ok {
+			chk.Debugf("metric %s is not trending toward capacity %f", metric.Label, capacity)
+			continue
+		}
+		chk.Debugf("metric %s projected full in %s (capacity %f)", metric.Label, ttf, capacity)
+
+		result.Metrics = append(result.Metrics, check.ResultMetric{
+			Label: forecast.timeToFullLabel(),
+			Value: fmt.Sprintf("%.0f", ttf.Seconds()),
+			Type:  check.ResultMetricGauge,
+		})
+
+		var state check.ResultState
+		if forecast.CritHorizon > 0 && ttf <= forecast.CritHorizon {
+			state = check.StateCrit
+		} else if forecast.WarnHorizon > 0 && ttf <= forecast.WarnHorizon {
+			state = check.StateWarn
+		} else {
+			continue
+		}
+		if state.Overrides(result.State) {
+			result.State, result.ReasonCode = state, ReasonForecastFull
+		}
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+// model returns the Model stored in the Check's HandlerState, creating it if it does not exist.
+func (h *Handler) model(chk *check.Check) *Model {
+	model := metamodel.Load[Model](chk, h.stateKey(), "forecast")
+	if model.Metrics == nil {
+		model.Metrics = make(map[string]*History)
+	}
+	return model
+}
+
+func (h *Handler) window() time.Duration {
+	if h.Window <= 0 {
+		return DefaultWindow
+	}
+	return h.Window
+}
+
+func (h *Handler) minSamples() int {
+	if h.MinSamples < 2 {
+		return DefaultMinSamples
+	}
+	return h.MinSamples
+}
+
+func (h *Handler) maxSamples() int {
+	if h.MaxSamples <= 0 {
+		return DefaultMaxSamples
+	}
+	return h.MaxSamples
+}
+
+func (h *Handler) stateKey() string {
+	if h.StateKey == "" {
+		return DefaultStateKey
+	}
+	return h.StateKey
+}
+
+// Model is the metric history for a Check.  It only contains exported fields so that it serializes along with the
+// rest of the Check's HandlerState.
+type Model struct {
+	Metrics map[string]*History
+}
+
+// History is the recent samples of a single metric, oldest first.
+type History struct {
+	Samples []Sample
+}
+
+// Sample is a single metric value at a point in time.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// add appends s to the history and prunes samples older than window or beyond maxSamples.
+func (h *History) add(s Sample, window time.Duration, maxSamples int) {
+	h.Samples = append(h.Samples, s)
+
+	cutoff := s.Time.Add(-window)
+	drop := 0
+	for drop < len(h.Samples) && h.Samples[drop].Time.Before(cutoff) {
+		drop++
+	}
+	drop = max(drop, len(h.Samples)-maxSamples)
+	if drop > 0 {
+		h.Samples = slices.Delete(h.Samples, 0, drop)
+	}
+}
+
+// TimeToFull fits the history using method and returns how long after now the fitted line reaches capacity.  ok is
+// false when the metric isn't trending upward.  A metric projected to already be at or beyond capacity returns 0.
+func (h *History) TimeToFull(capacity float64, now time.Time, method Method) (ttf time.Duration, ok bool) {
+	if len(h.Samples) < 2 {
+		return 0, false
+	}
+
+	origin := h.Samples[0].Time
+	xs := make([]float64, len(h.Samples))
+	ys := make([]float64, len(h.Samples))
+	for i, s := range h.Samples {
+		xs[i] = s.Time.Sub(origin).Seconds()
+		ys[i] = s.Value
+	}
+
+	var slope, intercept float64
+	switch method {
+	case TheilSen:
+		slope, intercept = theilSen(xs, ys)
+	default:
+		slope, intercept = leastSquares(xs, ys)
+	}
+	if slope <= 0 || math.IsNaN(slope) || math.IsInf(slope, 0) {
+		return 0, false
+	}
+
+	fullAt := (capacity - intercept) / slope
+	secs := fullAt - now.Sub(origin).Seconds()
+	if secs <= 0 {
+		return 0, true
+	}
+	if secs > math.MaxInt64/float64(time.Second) {
+		return 0, false
+	}
+
+	return time.Duration(secs * float64(time.Second)), true
+}
+
+func leastSquares(xs, ys []float64) (slope, intercept float64) {
+	n := float64(len(xs))
+	var sumX, sumY, sumXY, sumXX float64
+	for i := range xs {
+		sumX += xs[i]
+		sumY += ys[i]
+		sumXY += xs[i] * ys[i]
+		sumXX += xs[i] * xs[i]
+	}
+
+	denom := n*sumXX - sumX*sumX
+	if denom == 0 {
+		return 0, sumY / n
+	}
+	slope = (n*sumXY - sumX*sumY) / denom
+	intercept = (sumY - slope*sumX) / n
+
+	return slope, intercept
+}
+
+func theilSen(xs, ys []float64) (slope, intercept float64) {
+	slopes := make([]float64, 0, len(xs)*(len(xs)-1)/2)
+	for i := range xs {
+		for j := i + 1; j < len(xs); j++ {
+			if dx := xs[j] - xs[i]; dx != 0 {
+				slopes = append(slopes, (ys[j]-ys[i])/dx)
+			}
+		}
+	}
+	if len(slopes) == 0 {
+		return 0, median(ys)
+	}
+	slope = median(slopes)
+
+	residuals := make([]float64, len(xs))
+	for i := range xs {
+		residuals[i] = ys[i] - slope*xs[i]
+	}
+
+	return slope, median(residuals)
+}
+
+func median(v []float64) float64 {
+	s := slices.Clone(v)
+	slices.Sort(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
@@ -0,0 +1,167 @@
+package forecast
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/check/handler/webhook"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTimeToFull(t *testing.T) {
+	origin := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// grows 1 unit per hour from 50
+	h := &History{}
+	for i := 0; i < 10; i++ {
+		h.Samples = append(h.Samples, Sample{Time: origin.Add(time.Duration(i) * time.Hour), Value: 50 + float64(i)})
+	}
+	now := origin.Add(9 * time.Hour)
+
+	for _, method := range []Method{Linear, TheilSen} {
+		ttf, ok := h.TimeToFull(100, now, method)
+		if !ok {
+			t.Fatalf("method %v: expected a forecast", method)
+		}
+		if want := 41 * time.Hour; math.Abs((ttf - want).Seconds()) > 1 {
+			t.Errorf("method %v: wanted time to full of %v, got %v", method, want, ttf)
+		}
+	}
+}
+
+func TestTimeToFullNotTrendingUp(t *testing.T) {
+	origin := time.Now()
+	h := &History{Samples: []Sample{
+		{Time: origin, Value: 10},
+		{Time: origin.Add(time.Hour), Value: 9},
+		{Time: origin.Add(2 * time.Hour), Value: 8},
+	}}
+
+	if _, ok := h.TimeToFull(100, origin.Add(2*time.Hour), Linear); ok {
+		t.Error("expected no forecast for decreasing metric")
+	}
+}
+
+func TestTheilSenIgnoresOutliers(t *testing.T) {
+	origin := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := &History{}
+	for i := 0; i < 11; i++ {
+		v := 50 + float64(i)
+		if i == 5 {
+			v = 99 // a single spike
+		}
+		h.Samples = append(h.Samples, Sample{Time: origin.Add(time.Duration(i) * time.Hour), Value: v})
+	}
+
+	ttf, ok := h.TimeToFull(100, origin.Add(10*time.Hour), TheilSen)
+	if !ok {
+		t.Fatal("expected a forecast")
+	}
+	if want := 40 * time.Hour; math.Abs((ttf - want).Seconds()) > 1 {
+		t.Errorf("wanted time to full of %v, got %v", want, ttf)
+	}
+}
+
+func TestMutateResultRaisesStateAndAddsDerivedMetric(t *testing.T) {
+	h := NewHandler([]MetricForecast{{
+		Label:         "total_pool_usage",
+		CapacityLabel: "total_pool_size",
+		WarnHorizon:   7 * 24 * time.Hour,
+		CritHorizon:   12 * time.Hour,
+	}})
+	chk := &check.Check{}
+	origin := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var r *check.Result
+	// 1000 addresses, 100 more in use every day starting at 500
+	for i := 0; i < 5; i++ {
+		r = &check.Result{
+			State: check.StateOk,
+			Metrics: []check.ResultMetric{
+				{Label: "total_pool_usage", Value: strconv.Itoa(500 + i*100), Type: check.ResultMetricGauge},
+				{Label: "total_pool_size", Value: "1000", Type: check.ResultMetricGauge},
+			},
+			Time: origin.Add(time.Duration(i) * 24 * time.Hour),
+		}
+		h.MutateResult(chk, r)
+	}
+
+	if r.State != check.StateWarn || r.ReasonCode != ReasonForecastFull {
+		t.Errorf("wanted WARN/%s, got %v/%s", ReasonForecastFull, r.State, r.ReasonCode)
+	}
+
+	var got string
+	for _, m := range r.Metrics {
+		if m.Label == "total_pool_usage_time_to_full" {
+			got = m.Value
+		}
+	}
+	if want := "86400"; got != want {
+		t.Errorf("wanted time to full metric of %s, got %q", want, got)
+	}
+}
+
+func TestHistoryIsPrunedToWindowAndMaxSamples(t *testing.T) {
+	h := &History{}
+	origin := time.Now()
+	for i := 0; i < 10; i++ {
+		h.add(Sample{Time: origin.Add(time.Duration(i) * time.Hour), Value: 1}, 5*time.Hour, 100)
+	}
+	if len(h.Samples) != 6 {
+		t.Errorf("wanted 6 samples inside window, got %d", len(h.Samples))
+	}
+
+	for i := 10; i < 20; i++ {
+		h.add(Sample{Time: origin.Add(time.Duration(i) * time.Hour), Value: 1}, 100*time.Hour, 3)
+	}
+	if len(h.Samples) != 3 {
+		t.Errorf("wanted 3 samples after max samples pruning, got %d", len(h.Samples))
+	}
+}
+
+func TestHistoryIsNotExportedWithMeta(t *testing.T) {
+	var payloads [][]byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payloads = append(payloads, body)
+	}))
+	defer srv.Close()
+
+	wh, _ := webhook.NewHandler(srv.URL, "")
+	wh.SendResults = true
+	chk := check.New("pool1",
+		check.WithCommand(testCommand{usage: "500"}),
+		check.WithMeta(map[string]any{"site": "dc1"}),
+		check.WithHandlers([]check.Handler{NewHandler([]MetricForecast{{Label: "usage", Capacity: 1000}}), wh}),
+	)
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if _, ok := chk.HandlerState[DefaultStateKey].(*Model); !ok {
+		t.Fatal("expected the model to be kept in the check's handler state")
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("expected 1 payload, got %d", len(payloads))
+	}
+	var got struct{ Meta map[string]any }
+	if err := json.Unmarshal(payloads[0], &got); err != nil {
+		t.Fatalf("bad payload %s: %v", payloads[0], err)
+	}
+	if want := map[string]any{"site": "dc1"}; !reflect.DeepEqual(got.Meta, want) {
+		t.Errorf("expected exported meta %v, got %v", want, got.Meta)
+	}
+}
+
+type testCommand struct {
+	usage string
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "usage", Value: c.usage}}), nil
+}
@@ -0,0 +1,249 @@
+// Package graphite provides a check.Handler that sends Result metrics to a Graphite carbon daemon using the
+// plaintext or pickle protocols over a persistent TCP connection.
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Protocol is a carbon receiver protocol.
+type Protocol uint8
+
+const (
+	// Plaintext sends one "path value timestamp" line per metric (carbon's default port 2003).
+	Plaintext Protocol = iota
+	// Pickle sends every metric of a Result in one pickled batch (carbon's default port 2004).
+	Pickle
+)
+
+// DefaultPathTemplate is the metric path template used when Handler.PathTemplate is nil.
+var DefaultPathTemplate = template.Must(
+	template.New("path").Option("missingkey=zero").Parse("gopoller.{{ .CheckId }}.{{ .Label }}"),
+)
+
+// PathData is the data a path template is executed with.  Every value is sanitized to be a single path node, so
+// dots and other characters Graphite does not allow in a node are replaced with underscores.
+type PathData struct {
+	CheckId string
+	Label   string
+	Meta    map[string]string
+}
+
+// Handler sends the metrics of every Result it processes to carbon at Addr.  The connection is kept open across
+// Results (and Checks sharing the Handler) and re-established when it fails.
+//
+// Metrics are sent with the Result time.  Counters are sent as their raw value, so use Graphite functions such as
+// nonNegativeDerivative() to graph them as rates.
+type Handler struct {
+	// Addr is the host:port of the carbon receiver.
+	Addr string
+
+	Protocol Protocol
+
+	// PathTemplate renders the metric path from a PathData (default DefaultPathTemplate).  Empty path nodes are
+	// removed, so a template with the missingkey=zero option referencing a missing Meta key still produces a valid
+	// path.
+	PathTemplate *template.Template
+
+	// Timeout bounds connecting and each write (default 10 seconds).
+	Timeout time.Duration
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+// NewHandler creates a new Handler sending to addr using protocol, with metric paths rendered from pathTmpl.  An
+// empty pathTmpl uses DefaultPathTemplate.
+func NewHandler(addr string, protocol Protocol, pathTmpl string) (*Handler, error) {
+	h := &Handler{
+		Addr:     addr,
+		Protocol: protocol,
+		Timeout:  10 * time.Second,
+	}
+
+	if pathTmpl != "" {
+		t, err := template.New("path").Option("missingkey=zero").Parse(pathTmpl)
+		if err != nil {
+			return nil, err
+		}
+		h.PathTemplate = t
+	}
+
+	return h, nil
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	datapoints, err := h.datapoints(chk, result)
+	if err != nil || len(datapoints) == 0 {
+		return err
+	}
+
+	var msg []byte
+	if h.Protocol == Pickle {
+		msg = encodePickle(datapoints)
+	} else {
+		msg = encodePlaintext(datapoints)
+	}
+
+	chk.Debugf("sending %d metrics to graphite %s", len(datapoints), h.Addr)
+
+	return h.send(msg)
+}
+
+// Close closes the connection to carbon.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
+
+// datapoint is a single metric sample.
+type datapoint struct {
+	path      string
+	value     float64
+	timestamp int64
+}
+
+func (h *Handler) datapoints(chk *check.Check, result *check.Result) ([]datapoint, error) {
+	tmpl := h.PathTemplate
+	if tmpl == nil {
+		tmpl = DefaultPathTemplate
+	}
+
+	meta := make(map[string]string, len(chk.Meta))
+	for k, v := range chk.Meta {
+		meta[k] = SanitizeNode(fmt.Sprint(v))
+	}
+
+	var datapoints []datapoint
+	var buf bytes.Buffer
+	for _, m := range result.Metrics {
+		value, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil {
+			continue
+		}
+
+		buf.Reset()
+		err = tmpl.Execute(&buf, PathData{
+			CheckId: SanitizeNode(chk.Id),
+			Label:   SanitizeNode(m.Label),
+			Meta:    meta,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		datapoints = append(datapoints, datapoint{
+			path:      cleanPath(buf.String()),
+			value:     value,
+			timestamp: result.Time.Unix(),
+		})
+	}
+
+	return datapoints, nil
+}
+
+// send writes msg to the carbon connection, connecting if needed.  A failed write is retried once on a new
+// connection, as the error is usually the receiver having closed an idle connection.
+//
+// The retry resends only what carbon has not received whole: plaintext lines written before the failure are not
+// sent again, while a partially written line, or a partially written pickle, is resent in full since carbon discards
+// incomplete lines and messages when the connection closes.  Lines the old connection wrote to its socket but carbon
+// never read are lost rather than risking duplicates.
+func (h *Handler) send(msg []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if h.conn == nil {
+			dialer := net.Dialer{Timeout: h.timeout()}
+			if h.conn, err = dialer.Dial("tcp", h.Addr); err != nil {
+				h.conn = nil
+				return err
+			}
+		}
+
+		var n int
+		if err = h.conn.SetWriteDeadline(time.Now().Add(h.timeout())); err == nil {
+			if n, err = h.conn.Write(msg); err == nil {
+				return nil
+			}
+		}
+		msg = h.unsent(msg, n)
+
+		h.conn.Close()
+		h.conn = nil
+	}
+
+	return err
+}
+
+// unsent returns the part of msg to resend after n bytes of it were written.
+func (h *Handler) unsent(msg []byte, n int) []byte {
+	if h.Protocol == Pickle {
+		return msg
+	}
+	return msg[bytes.LastIndexByte(msg[:n], '\n')+1:]
+}
+
+func (h *Handler) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return h.Timeout
+}
+
+func encodePlaintext(datapoints []datapoint) []byte {
+	var b []byte
+	for _, dp := range datapoints {
+		b = append(b, dp.path...)
+		b = append(b, ' ')
+		b = strconv.AppendFloat(b, dp.value, 'f', -1, 64)
+		b = append(b, ' ')
+		b = strconv.AppendInt(b, dp.timestamp, 10)
+		b = append(b, '\n')
+	}
+	return b
+}
+
+// SanitizeNode makes s usable as a single Graphite path node by replacing every character other than letters,
+// digits, '-' and '_' with an underscore.
+func SanitizeNode(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// cleanPath removes empty nodes and whitespace from a rendered path.
+func cleanPath(path string) string {
+	nodes := strings.Split(strings.TrimSpace(path), ".")
+	clean := nodes[:0]
+	for _, n := range nodes {
+		if n = strings.TrimSpace(n); n != "" {
+			clean = append(clean, n)
+		}
+	}
+	return strings.Join(clean, ".")
+}
@@ -0,0 +1,292 @@
+package graphite
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeCarbon accepts connections and passes each one to handle.
+func fakeCarbon(t *testing.T, handle func(conn net.Conn)) (addr string, accepted chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	accepted = make(chan struct{}, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go handle(conn)
+		}
+	}()
+
+	return l.Addr().String(), accepted
+}
+
+func testResult() *check.Result {
+	result := check.NewResult(check.StateOk, "", []check.ResultMetric{
+		{Label: "avg.rtt ms", Value: "12.5"},
+		{Label: "bogus", Value: "n/a"},
+		{Label: "ifHCInOctets", Value: "1234567", Type: check.ResultMetricCounter},
+	})
+	result.Time = time.Unix(1700000000, 0)
+	return result
+}
+
+func TestPathTemplate(t *testing.T) {
+	h, err := NewHandler("", Plaintext, "net.{{ .Meta.site }}.{{ .Meta.missing }}.{{ .CheckId }}.{{ .Label }}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	chk := &check.Check{Id: "router1.example.com", Meta: map[string]any{"site": "dc 1"}}
+	datapoints, err := h.datapoints(chk, testResult())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var paths []string
+	for _, dp := range datapoints {
+		paths = append(paths, dp.path)
+	}
+	want := []string{"net.dc_1.router1_example_com.avg_rtt_ms", "net.dc_1.router1_example_com.ifHCInOctets"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("expected paths %v, got %v", want, paths)
+	}
+}
+
+func TestPlaintextReusesConnection(t *testing.T) {
+	lines := make(chan string, 10)
+	addr, accepted := fakeCarbon(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSuffix(l, "\n")
+		}
+	})
+
+	h, _ := NewHandler(addr, Plaintext, "")
+	defer h.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	want := []string{
+		"gopoller.router1.avg_rtt_ms 12.5 1700000000",
+		"gopoller.router1.ifHCInOctets 1234567 1700000000",
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case l := <-lines:
+			if l != want[i%2] {
+				t.Errorf("expected %q, got %q", want[i%2], l)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for metrics")
+		}
+	}
+	if len(accepted) != 1 {
+		t.Errorf("expected a single connection, got %d", len(accepted))
+	}
+}
+
+func TestReconnectsAfterWriteFailure(t *testing.T) {
+	addr, accepted := fakeCarbon(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	h, _ := NewHandler(addr, Plaintext, "")
+	defer h.Close()
+
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.conn.Close() // simulate a broken connection
+
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+		t.Fatalf("expected reconnect, got error: %v", err)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	if len(accepted) != 2 {
+		t.Errorf("expected 2 connections, got %d", len(accepted))
+	}
+}
+
+// partialConn is a net.Conn whose Write writes only n bytes before failing.
+type partialConn struct {
+	net.Conn
+	n int
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	return min(c.n, len(b)), errors.New("connection reset by peer")
+}
+
+func TestResendsOnlyUnsentLines(t *testing.T) {
+	lines := make(chan string, 10)
+	addr, _ := fakeCarbon(t, func(conn net.Conn) {
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			lines <- strings.TrimSuffix(l, "\n")
+		}
+	})
+
+	tests := []struct {
+		name    string
+		written int
+		want    []string
+	}{
+		{"nothing written", 0, []string{
+			"gopoller.router1.avg_rtt_ms 12.5 1700000000",
+			"gopoller.router1.ifHCInOctets 1234567 1700000000",
+		}},
+		{"part of first line written", 10, []string{
+			"gopoller.router1.avg_rtt_ms 12.5 1700000000",
+			"gopoller.router1.ifHCInOctets 1234567 1700000000",
+		}},
+		{"first line written", len("gopoller.router1.avg_rtt_ms 12.5 1700000000\n"), []string{
+			"gopoller.router1.ifHCInOctets 1234567 1700000000",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := NewHandler(addr, Plaintext, "")
+			defer h.Close()
+
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			h.conn = &partialConn{Conn: conn, n: tt.written}
+
+			if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+				t.Fatalf("expected reconnect, got error: %v", err)
+			}
+
+			for _, w := range tt.want {
+				select {
+				case l := <-lines:
+					if l != w {
+						t.Errorf("expected %q, got %q", w, l)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatal("timed out waiting for metrics")
+				}
+			}
+			select {
+			case l := <-lines:
+				t.Errorf("unexpected line %q", l)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestPickle(t *testing.T) {
+	messages := make(chan []byte, 1)
+	addr, _ := fakeCarbon(t, func(conn net.Conn) {
+		defer conn.Close()
+		var size uint32
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		msg := make([]byte, size)
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		messages <- msg
+	})
+
+	h, _ := NewHandler(addr, Pickle, "")
+	defer h.Close()
+
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var msg []byte
+	select {
+	case msg = <-messages:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for pickle")
+	}
+
+	got, err := unpickle(msg)
+	if err != nil {
+		t.Fatalf("unable to unpickle: %v", err)
+	}
+	want := []any{
+		[2]any{"gopoller.router1.avg_rtt_ms", [2]any{int32(1700000000), 12.5}},
+		[2]any{"gopoller.router1.ifHCInOctets", [2]any{int32(1700000000), 1234567.0}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+// unpickle decodes the subset of pickle opcodes encodePickle produces.
+func unpickle(b []byte) (any, error) {
+	var stack []any
+	var marks []int
+	for i := 0; i < len(b); {
+		op := b[i]
+		i++
+		switch op {
+		case opProto:
+			i++
+		case opEmptyList:
+			stack = append(stack, []any{})
+		case opMark:
+			marks = append(marks, len(stack))
+		case opBinUnicode:
+			n := int(binary.LittleEndian.Uint32(b[i:]))
+			stack = append(stack, string(b[i+4:i+4+n]))
+			i += 4 + n
+		case opBinInt:
+			stack = append(stack, int32(binary.LittleEndian.Uint32(b[i:])))
+			i += 4
+		case opBinFloat:
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b[i:])))
+			i += 8
+		case opTuple2:
+			n := len(stack)
+			stack = append(stack[:n-2], [2]any{stack[n-2], stack[n-1]})
+		case opAppends:
+			m := marks[len(marks)-1]
+			marks = marks[:len(marks)-1]
+			list := append(stack[m-1].([]any), stack[m:]...)
+			stack = append(stack[:m-1], list)
+		case opStop:
+			return stack[len(stack)-1], nil
+		default:
+			return nil, io.ErrUnexpectedEOF
+		}
+	}
+	return nil, io.ErrUnexpectedEOF
+}
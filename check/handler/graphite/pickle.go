@@ -0,0 +1,50 @@
+package graphite
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// pickle opcodes used to encode datapoints (see Python's Lib/pickletools.py).
+const (
+	opProto      = 0x80
+	opEmptyList  = ']'
+	opMark       = '('
+	opAppends    = 'e'
+	opBinUnicode = 'X'
+	opBinInt     = 'J'
+	opBinFloat   = 'G'
+	opTuple2     = 0x86
+	opStop       = '.'
+)
+
+// encodePickle encodes datapoints as carbon's pickle protocol message: a 4-byte big-endian length header followed
+// by a protocol 2 pickle of [(path, (timestamp, value)), ...].
+func encodePickle(datapoints []datapoint) []byte {
+	b := make([]byte, 4, 64*len(datapoints))
+	b = append(b, opProto, 2, opEmptyList, opMark)
+
+	for _, dp := range datapoints {
+		b = append(b, opBinUnicode)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(dp.path)))
+		b = append(b, dp.path...)
+
+		if dp.timestamp >= math.MinInt32 && dp.timestamp <= math.MaxInt32 {
+			b = append(b, opBinInt)
+			b = binary.LittleEndian.AppendUint32(b, uint32(int32(dp.timestamp)))
+		} else {
+			b = append(b, opBinFloat)
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(float64(dp.timestamp)))
+		}
+
+		b = append(b, opBinFloat)
+		b = binary.BigEndian.AppendUint64(b, math.Float64bits(dp.value))
+
+		b = append(b, opTuple2, opTuple2)
+	}
+
+	b = append(b, opAppends, opStop)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+
+	return b
+}
@@ -0,0 +1,36 @@
+// Package incidents provides a check.Handler that records Incident lifecycle events into a check.IncidentStore.
+package incidents
+
+import (
+	"github.com/seankndy/gopoller/check"
+)
+
+// Handler saves Incidents to Store whenever they undergo a lifecycle change.
+type Handler struct {
+	Store check.IncidentStore
+}
+
+func NewHandler(store check.IncidentStore) *Handler {
+	return &Handler{Store: store}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	chk.Debugf("saving incident %s after %s event", event.Incident.Id, event.Type)
+
+	// the superseded incident was resolved, so it needs saving as well
+	if event.PreviousIncident != nil {
+		if err := h.Store.Save(chk.Id, event.PreviousIncident); err != nil {
+			return err
+		}
+	}
+
+	return h.Store.Save(chk.Id, event.Incident)
+}
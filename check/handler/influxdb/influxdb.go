@@ -0,0 +1,319 @@
+// Package influxdb provides a check.Handler that writes Result metrics as InfluxDB line protocol, batching lines
+// across Checks and writing them over the HTTP v1 or v2 write APIs or UDP.
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/background"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultMeasurement        = "gopoller"
+	DefaultMeasurementMetaKey = "influxdb_measurement"
+)
+
+// Writer writes a batch of newline terminated line protocol lines to InfluxDB.
+type Writer interface {
+	Write(ctx context.Context, lines []byte) error
+}
+
+// Handler buffers the metrics of every Result it processes as line protocol and writes them with Writer in
+// batches, once MaxBatchSize lines are buffered or every FlushInterval, whichever comes first.  A batch that fails
+// to write stays buffered and is retried, unless InfluxDB refused it with a 4xx response.
+//
+// Each Result becomes one line: the measurement is Check.Meta[MeasurementMetaKey] (or Measurement), tags are the
+// check_id and the TagMetaKeys of Check.Meta, and fields are the Result metrics keyed by label.  Counters are
+// written as integers and gauges as floats, with the timestamp taken from Result.Time in nanoseconds.  InfluxDB
+// rejects a value whose type differs from the field's, so a counter value that isn't an integer within the int64
+// range is left out rather than written as another type.
+type Handler struct {
+	Writer Writer
+
+	// Measurement is the measurement name used when Check.Meta has no MeasurementMetaKey (default "gopoller").
+	Measurement        string
+	MeasurementMetaKey string
+
+	// TagMetaKeys are the Check.Meta keys written as tags.  Keys missing from a Check or with empty values are
+	// omitted.
+	TagMetaKeys []string
+
+	// StateField, when set, adds the check.ResultState as an integer field with this key.
+	StateField string
+
+	// FlushInterval is the most time lines are buffered before being written (default 10 seconds).
+	FlushInterval time.Duration
+
+	// MaxBatchSize is the most lines written per request (default 5000).
+	MaxBatchSize int
+
+	// MaxBufferedLines is the most lines buffered waiting to be written.  Lines of Results processed while the
+	// buffer is full are dropped and counted in Stats (default 100000).
+	MaxBufferedLines int
+
+	// OnError is called with write errors, as writes happen in the background rather than in Process.
+	OnError func(err error)
+
+	buffer  []string
+	mu      sync.Mutex
+	flusher background.Loop
+	writeMu sync.Mutex
+
+	written atomic.Uint64
+	dropped atomic.Uint64
+	failed  atomic.Uint64
+}
+
+// Stats counts the lines a Handler has handled.
+type Stats struct {
+	// Written is the number of lines successfully written.
+	Written uint64
+	// Dropped is the number of lines discarded because the buffer was full.
+	Dropped uint64
+	// Failed is the number of lines discarded because InfluxDB refused their batch.
+	Failed uint64
+	// Buffered is the number of lines waiting to be written.
+	Buffered int
+}
+
+func NewHandler(writer Writer) *Handler {
+	return &Handler{
+		Writer:             writer,
+		Measurement:        DefaultMeasurement,
+		MeasurementMetaKey: DefaultMeasurementMetaKey,
+		FlushInterval:      10 * time.Second,
+		MaxBatchSize:       5000,
+		MaxBufferedLines:   100000,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	line, ok := h.Line(chk, result)
+	if !ok {
+		return nil
+	}
+
+	if !h.flusher.Start(h.flushInterval(), h.Flush, h.OnError) {
+		return errors.New("influxdb handler is closed")
+	}
+
+	h.mu.Lock()
+	if len(h.buffer) >= h.maxBufferedLines() {
+		h.mu.Unlock()
+		h.dropped.Add(1)
+		chk.Debugf("influxdb buffer full, dropping result")
+		return nil
+	}
+	h.buffer = append(h.buffer, line)
+	full := len(h.buffer) >= h.maxBatchSize()
+	h.mu.Unlock()
+
+	if full {
+		h.flusher.Kick()
+	}
+
+	return nil
+}
+
+// Line returns the line protocol line (without trailing newline) for a Check's Result, or false if the Result has
+// no numeric metrics to write.
+func (h *Handler) Line(chk *check.Check, result *check.Result) (string, bool) {
+	var fields []string
+	for _, m := range result.Metrics {
+		if v, ok := formatFieldValue(m); ok {
+			fields = append(fields, escapeKey(m.Label)+"="+v)
+		}
+	}
+	if h.StateField != "" {
+		fields = append(fields, escapeKey(h.StateField)+"="+strconv.Itoa(int(result.State))+"i")
+	}
+	if len(fields) == 0 {
+		return "", false
+	}
+
+	measurement := h.Measurement
+	if measurement == "" {
+		measurement = DefaultMeasurement
+	}
+	metaKey := h.MeasurementMetaKey
+	if metaKey == "" {
+		metaKey = DefaultMeasurementMetaKey
+	}
+	if v, ok := chk.Meta[metaKey]; ok && fmt.Sprint(v) != "" {
+		measurement = fmt.Sprint(v)
+	}
+
+	tags := []string{"check_id=" + escapeKey(chk.Id)}
+	for _, key := range h.TagMetaKeys {
+		v, ok := chk.Meta[key]
+		if !ok || v == nil || fmt.Sprint(v) == "" {
+			continue
+		}
+		tags = append(tags, escapeKey(key)+"="+escapeKey(fmt.Sprint(v)))
+	}
+	slices.Sort(tags)
+
+	var b strings.Builder
+	b.WriteString(escapeMeasurement(measurement))
+	for _, t := range tags {
+		b.WriteByte(',')
+		b.WriteString(t)
+	}
+	b.WriteByte(' ')
+	b.WriteString(strings.Join(fields, ","))
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatInt(result.Time.UnixNano(), 10))
+
+	return b.String(), true
+}
+
+// Flush writes every buffered line now.
+func (h *Handler) Flush() error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	for {
+		batch := h.nextBatch()
+		if batch == nil {
+			return nil
+		}
+		if err := h.write(batch); err != nil {
+			if refused(err) {
+				h.removeBatch(len(batch))
+				h.failed.Add(uint64(len(batch)))
+			}
+			return err
+		}
+		h.removeBatch(len(batch))
+		h.written.Add(uint64(len(batch)))
+	}
+}
+
+// Close stops the background flusher and writes every buffered line.  Results processed after Close are refused.
+func (h *Handler) Close() error {
+	h.flusher.Stop()
+	return h.Flush()
+}
+
+// Stats returns the line counts of the Handler.
+func (h *Handler) Stats() Stats {
+	h.mu.Lock()
+	buffered := len(h.buffer)
+	h.mu.Unlock()
+
+	return Stats{
+		Written:  h.written.Load(),
+		Dropped:  h.dropped.Load(),
+		Failed:   h.failed.Load(),
+		Buffered: buffered,
+	}
+}
+
+// nextBatch returns a copy of up to MaxBatchSize lines from the front of the buffer, or nil if it is empty.  They
+// are left buffered until removeBatch, once written.
+func (h *Handler) nextBatch() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.buffer) == 0 {
+		return nil
+	}
+	return slices.Clone(h.buffer[:min(len(h.buffer), h.maxBatchSize())])
+}
+
+// removeBatch removes the n lines of a batch from the front of the buffer.
+func (h *Handler) removeBatch(n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.buffer = slices.Delete(h.buffer, 0, n)
+}
+
+func (h *Handler) write(batch []string) error {
+	var size int
+	for _, l := range batch {
+		size += len(l) + 1
+	}
+	body := make([]byte, 0, size)
+	for _, l := range batch {
+		body = append(body, l...)
+		body = append(body, '\n')
+	}
+
+	if err := h.Writer.Write(context.Background(), body); err != nil {
+		return fmt.Errorf("influxdb write of %d lines failed: %w", len(batch), err)
+	}
+	return nil
+}
+
+func (h *Handler) flushInterval() time.Duration {
+	if h.FlushInterval <= 0 {
+		return 10 * time.Second
+	}
+	return h.FlushInterval
+}
+
+func (h *Handler) maxBatchSize() int {
+	if h.MaxBatchSize <= 0 {
+		return 5000
+	}
+	return h.MaxBatchSize
+}
+
+func (h *Handler) maxBufferedLines() int {
+	if h.MaxBufferedLines <= 0 {
+		return 100000
+	}
+	return h.MaxBufferedLines
+}
+
+// refused returns true if err is InfluxDB refusing a batch, which would be refused again if retried.
+func refused(err error) bool {
+	var statusErr *retryhttp.StatusError
+	return errors.As(err, &statusErr) && !statusErr.Temporary()
+}
+
+// formatFieldValue formats a metric as a line protocol field value: counters as integers and gauges as floats.  The
+// type only depends on the metric type, so a field keeps the same type from one Result to the next.
+func formatFieldValue(m check.ResultMetric) (string, bool) {
+	if m.Type == check.ResultMetricCounter {
+		i, err := strconv.ParseInt(m.Value, 10, 64)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatInt(i, 10) + "i", true
+	}
+	f, err := strconv.ParseFloat(m.Value, 64)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64), true
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `, "\n", `\n`)
+	keyEscaper         = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `, "\n", `\n`)
+)
+
+// escapeMeasurement escapes commas and spaces in a measurement name.
+func escapeMeasurement(s string) string {
+	return measurementEscaper.Replace(s)
+}
+
+// escapeKey escapes commas, equals signs and spaces in tag keys, tag values and field keys.
+func escapeKey(s string) string {
+	return keyEscaper.Replace(s)
+}
@@ -0,0 +1,272 @@
+package influxdb
+
+import (
+	"context"
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingWriter is a Writer that records the batches written to it.
+type recordingWriter struct {
+	mu      sync.Mutex
+	batches []string
+	err     error
+}
+
+func (w *recordingWriter) Write(_ context.Context, lines []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.batches = append(w.batches, string(lines))
+	return nil
+}
+
+func (w *recordingWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.batches)
+}
+
+func testResult() *check.Result {
+	result := check.NewResult(check.StateWarn, "", []check.ResultMetric{
+		{Label: "avg rtt", Value: "12.5", Type: check.ResultMetricGauge},
+		{Label: "ifHCInOctets", Value: "18446744073709551615", Type: check.ResultMetricCounter},
+		{Label: "errors", Value: "7", Type: check.ResultMetricCounter},
+		{Label: "bogus", Value: "n/a", Type: check.ResultMetricGauge},
+	})
+	result.Time = time.Unix(1700000000, 123)
+	return result
+}
+
+func TestLine(t *testing.T) {
+	h := NewHandler(nil)
+	h.TagMetaKeys = []string{"site", "missing"}
+	h.StateField = "state"
+
+	chk := &check.Check{Id: "router 1", Meta: map[string]any{"site": "dc=1", DefaultMeasurementMetaKey: "net,ping"}}
+	line, ok := h.Line(chk, testResult())
+	if !ok {
+		t.Fatal("expected a line")
+	}
+
+	want := `net\,ping,check_id=router\ 1,site=dc\=1 avg\ rtt=12.5,errors=7i,state=1i 1700000000000000123`
+	if line != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, line)
+	}
+
+	h.StateField = ""
+	if _, ok := h.Line(chk, check.NewResult(check.StateOk, "", nil)); ok {
+		t.Error("expected no line for a result without metrics")
+	}
+}
+
+func TestFormatFieldValue(t *testing.T) {
+	tests := []struct {
+		metric check.ResultMetric
+		want   string
+		ok     bool
+	}{
+		{check.ResultMetric{Value: "7", Type: check.ResultMetricCounter}, "7i", true},
+		{check.ResultMetric{Value: "9223372036854775808", Type: check.ResultMetricCounter}, "", false},
+		{check.ResultMetric{Value: "7.5", Type: check.ResultMetricCounter}, "", false},
+		{check.ResultMetric{Value: "7", Type: check.ResultMetricGauge}, "7", true},
+		{check.ResultMetric{Value: "7.5", Type: check.ResultMetricGauge}, "7.5", true},
+		{check.ResultMetric{Value: "n/a", Type: check.ResultMetricGauge}, "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := formatFieldValue(tt.metric)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("formatFieldValue(%q, %v): expected %q, %v, got %q, %v", tt.metric.Value, tt.metric.Type, tt.want, tt.ok,
+				got, ok)
+		}
+	}
+}
+
+func TestBatchesAcrossChecks(t *testing.T) {
+	w := &recordingWriter{}
+	h := NewHandler(w)
+	h.MaxBatchSize = 2
+	h.FlushInterval = time.Hour
+
+	for i := 0; i < 5; i++ {
+		if err := h.Process(&check.Check{Id: "router" + strconv.Itoa(i)}, testResult(), nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// full batches are written in the background
+	deadline := time.Now().Add(2 * time.Second)
+	for w.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if w.count() != 3 {
+		t.Fatalf("expected 3 batches, got %d: %v", w.count(), w.batches)
+	}
+	for i, b := range w.batches {
+		if n := strings.Count(b, "\n"); n > 2 {
+			t.Errorf("batch %d has %d lines, exceeding max batch size", i, n)
+		}
+	}
+	if s := h.Stats(); s.Written != 5 || s.Buffered != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	w := &recordingWriter{}
+	h := NewHandler(w)
+	h.FlushInterval = 20 * time.Millisecond
+	defer h.Close()
+
+	_ = h.Process(&check.Check{Id: "router1"}, testResult(), nil)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for w.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if w.count() != 1 {
+		t.Errorf("expected buffered line to be written after flush interval")
+	}
+}
+
+func TestDropAndFailureAccounting(t *testing.T) {
+	w := &recordingWriter{err: errors.New("unavailable")}
+	h := NewHandler(w)
+	h.FlushInterval = time.Hour
+	h.MaxBufferedLines = 2
+
+	for i := 0; i < 3; i++ {
+		_ = h.Process(&check.Check{Id: "router1"}, testResult(), nil)
+	}
+	if s := h.Stats(); s.Dropped != 1 || s.Buffered != 2 {
+		t.Errorf("expected 1 dropped and 2 buffered, got %+v", s)
+	}
+
+	// the batch is kept to be retried while InfluxDB is unavailable
+	if err := h.Flush(); err == nil {
+		t.Error("expected write error")
+	}
+	if s := h.Stats(); s.Failed != 0 || s.Buffered != 2 {
+		t.Errorf("expected 2 still buffered, got %+v", s)
+	}
+
+	// and discarded once InfluxDB refuses it
+	w.mu.Lock()
+	w.err = &retryhttp.StatusError{StatusCode: http.StatusBadRequest, Body: "unable to parse"}
+	w.mu.Unlock()
+	if err := h.Close(); err == nil {
+		t.Error("expected write error")
+	}
+	if s := h.Stats(); s.Failed != 2 || s.Written != 0 || s.Buffered != 0 {
+		t.Errorf("expected 2 failed, got %+v", s)
+	}
+
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err == nil {
+		t.Error("expected an error processing after Close")
+	}
+}
+
+func TestHTTPWriters(t *testing.T) {
+	tests := []struct {
+		name       string
+		writer     func(url string) Writer
+		wantPath   string
+		wantQuery  string
+		wantHeader string
+	}{
+		{
+			name: "v1",
+			writer: func(url string) Writer {
+				return &HTTPV1{Url: url, Database: "metrics", RetentionPolicy: "month", Username: "u", Password: "p"}
+			},
+			wantPath:   "/write",
+			wantQuery:  "db=metrics&precision=ns&rp=month",
+			wantHeader: "Basic dTpw",
+		},
+		{
+			name: "v2",
+			writer: func(url string) Writer {
+				return &HTTPV2{Url: url + "/", Org: "acme", Bucket: "metrics", Token: "secret"}
+			},
+			wantPath:   "/api/v2/write",
+			wantQuery:  "bucket=metrics&org=acme&precision=ns",
+			wantHeader: "Token secret",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got *http.Request
+			var body []byte
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r
+				body, _ = io.ReadAll(r.Body)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer srv.Close()
+
+			h := NewHandler(tt.writer(srv.URL))
+			_ = h.Process(&check.Check{Id: "router1"}, testResult(), nil)
+			if err := h.Flush(); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if got.URL.Path != tt.wantPath || got.URL.RawQuery != tt.wantQuery {
+				t.Errorf("unexpected request %s", got.URL)
+			}
+			if a := got.Header.Get("Authorization"); a != tt.wantHeader {
+				t.Errorf("expected authorization %q, got %q", tt.wantHeader, a)
+			}
+			if !strings.HasPrefix(string(body), "gopoller,check_id=router1 ") {
+				t.Errorf("unexpected body %q", body)
+			}
+		})
+	}
+}
+
+func TestUDPWriterPacksDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	w := &UDP{Addr: conn.LocalAddr().String(), MaxPacketSize: 30}
+	defer w.Close()
+
+	lines := "aaaaaaaaaa 1\nbbbbbbbbbb 2\ncccccccccccccccccccccccccccc 3\nd 4\n"
+	if err := w.Write(context.Background(), []byte(lines)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"aaaaaaaaaa 1\nbbbbbbbbbb 2\n", "cccccccccccccccccccccccccccc 3\n", "d 4\n"}
+	buf := make([]byte, 1500)
+	for _, w := range want {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf[:n]) != w {
+			t.Errorf("expected datagram %q, got %q", w, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// HTTPV1 writes to the InfluxDB 1.x /write API.
+type HTTPV1 struct {
+	// Url is the base URL of the InfluxDB server (ex. http://localhost:8086).
+	Url             string
+	Database        string
+	RetentionPolicy string
+
+	// Username and Password are sent with basic authentication when Username is set.
+	Username string
+	Password string
+
+	// Retries is how many times to retry a write on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Client is the http.Client requests are made with (default has a 10 second timeout).
+	Client *http.Client
+}
+
+func (w *HTTPV1) Write(ctx context.Context, lines []byte) error {
+	q := url.Values{"db": {w.Database}, "precision": {"ns"}}
+	if w.RetentionPolicy != "" {
+		q.Set("rp", w.RetentionPolicy)
+	}
+
+	return post(ctx, w.Client, strings.TrimRight(w.Url, "/")+"/write?"+q.Encode(), lines, w.Retries, w.RetryBackoff,
+		func(req *http.Request) {
+			if w.Username != "" {
+				req.SetBasicAuth(w.Username, w.Password)
+			}
+		})
+}
+
+// HTTPV2 writes to the InfluxDB 2.x (and 3.x compatible) /api/v2/write API.
+type HTTPV2 struct {
+	// Url is the base URL of the InfluxDB server (ex. http://localhost:8086).
+	Url    string
+	Org    string
+	Bucket string
+	Token  string
+
+	// Retries is how many times to retry a write on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Client is the http.Client requests are made with (default has a 10 second timeout).
+	Client *http.Client
+}
+
+func (w *HTTPV2) Write(ctx context.Context, lines []byte) error {
+	q := url.Values{"org": {w.Org}, "bucket": {w.Bucket}, "precision": {"ns"}}
+
+	return post(ctx, w.Client, strings.TrimRight(w.Url, "/")+"/api/v2/write?"+q.Encode(), lines, w.Retries,
+		w.RetryBackoff, func(req *http.Request) {
+			req.Header.Set("Authorization", "Token "+w.Token)
+		})
+}
+
+func post(ctx context.Context, client *http.Client, url string, body []byte, retries int, backoff time.Duration,
+	setHeaders func(*http.Request)) error {
+	if client == nil {
+		client = defaultClient
+	}
+
+	_, err := retryhttp.Do(ctx, client, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		setHeaders(req)
+		return req, nil
+	}, retries, backoff)
+
+	return err
+}
+
+// UDP writes to an InfluxDB UDP listener, packing lines into datagrams of at most MaxPacketSize bytes.  UDP writes
+// are not acknowledged, so lost datagrams are not detected.
+type UDP struct {
+	Addr string
+
+	// MaxPacketSize is the most bytes sent per datagram (default 1400).  A single line larger than this is sent in
+	// a datagram of its own.
+	MaxPacketSize int
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (w *UDP) Write(_ context.Context, lines []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		conn, err := net.Dial("udp", w.Addr)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+
+	maxSize := w.MaxPacketSize
+	if maxSize <= 0 {
+		maxSize = 1400
+	}
+
+	for len(lines) > 0 {
+		n := packetEnd(lines, maxSize)
+		if _, err := w.conn.Write(lines[:n]); err != nil {
+			w.conn.Close()
+			w.conn = nil
+			return err
+		}
+		lines = lines[n:]
+	}
+
+	return nil
+}
+
+// Close closes the UDP socket.
+func (w *UDP) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// packetEnd returns the length of the longest run of whole lines at the start of lines fitting in maxSize bytes,
+// or the length of the first line if it alone is larger.
+func packetEnd(lines []byte, maxSize int) int {
+	end := 0
+	for end < len(lines) {
+		i := bytes.IndexByte(lines[end:], '\n')
+		next := len(lines)
+		if i >= 0 {
+			next = end + i + 1
+		}
+		if next > maxSize && end > 0 {
+			break
+		}
+		end = next
+		if end >= maxSize {
+			break
+		}
+	}
+	return end
+}
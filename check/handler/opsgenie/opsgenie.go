@@ -0,0 +1,197 @@
+// Package opsgenie provides a check.Handler that maps Incidents to Opsgenie (or Opsgenie-compatible) alerts.
+package opsgenie
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const DefaultBaseUrl = "https://api.opsgenie.com"
+
+// Alert is the body of an Opsgenie create alert request.
+type Alert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Priority    string            `json:"priority"`
+	Source      string            `json:"source,omitempty"`
+	Entity      string            `json:"entity,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// actionRequest is the body of an Opsgenie alert close/acknowledge request.
+type actionRequest struct {
+	Source string `json:"source,omitempty"`
+	User   string `json:"user,omitempty"`
+	Note   string `json:"note,omitempty"`
+}
+
+// Handler creates, acknowledges and closes Opsgenie alerts from Incident events, unacknowledging an alert (so it
+// notifies again) when its Incident's acknowledgement expires.  The alias of each alert is the Incident ID, so an
+// escalated or de-escalated Incident closes the previous Incident's alert and creates a new one.
+type Handler struct {
+	// ApiKey is the Opsgenie API integration key.
+	ApiKey string
+
+	// BaseUrl is the Opsgenie API base URL (default https://api.opsgenie.com).  Use https://api.eu.opsgenie.com for
+	// the EU instance or the URL of any Opsgenie-compatible API.
+	BaseUrl string
+
+	// Source is sent as the source of alerts and actions (default "gopoller").
+	Source string
+
+	// Tags returns tags for a Check's alerts.
+	Tags func(*check.Check) []string
+
+	// Retries is how many times to retry a request on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	Client *http.Client
+}
+
+func NewHandler(apiKey string) *Handler {
+	return &Handler{
+		ApiKey:       apiKey,
+		BaseUrl:      DefaultBaseUrl,
+		Source:       "gopoller",
+		Retries:      3,
+		RetryBackoff: time.Second,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	switch event.Type {
+	case check.IncidentOpened:
+		return h.create(chk, event)
+	case check.IncidentEscalated, check.IncidentDeEscalated:
+		if err := h.action(chk, event.PreviousIncident, "close", "superseded by incident "+event.Incident.Id.String()); err != nil {
+			return err
+		}
+		return h.create(chk, event)
+	case check.IncidentAcknowledged:
+		var note, user string
+		if ack := event.Incident.Acknowledgement; ack != nil {
+			note, user = ack.Comment, ack.By
+		}
+		return h.send(chk, "/v2/alerts/"+url.PathEscape(event.Incident.Id.String())+"/acknowledge?identifierType=alias",
+			&actionRequest{Source: h.source(), User: user, Note: note})
+	case check.IncidentAcknowledgementExpired:
+		return h.action(chk, event.Incident, "unacknowledge", "acknowledgement expired")
+	case check.IncidentResolved:
+		return h.action(chk, event.Incident, "close", "resolved")
+	}
+	return nil
+}
+
+func (h *Handler) create(chk *check.Check, event check.IncidentEvent) error {
+	incident := event.Incident
+
+	message := chk.Id + " is " + incident.ToState.String()
+	if incident.ReasonCode != "" {
+		message += ": " + incident.ReasonCode
+	}
+
+	details := map[string]string{
+		"check_id":    chk.Id,
+		"from_state":  incident.FromState.String(),
+		"to_state":    incident.ToState.String(),
+		"reason_code": incident.ReasonCode,
+	}
+	if event.Result != nil {
+		for _, m := range event.Result.Metrics {
+			details[m.Label] = m.Value
+		}
+	}
+
+	alert := &Alert{
+		Message:  message,
+		Alias:    incident.Id.String(),
+		Priority: Priority(incident.ToState),
+		Source:   h.source(),
+		Entity:   chk.Id,
+		Details:  details,
+	}
+	if h.Tags != nil {
+		alert.Tags = h.Tags(chk)
+	}
+
+	return h.send(chk, "/v2/alerts", alert)
+}
+
+func (h *Handler) action(chk *check.Check, incident *check.Incident, action, note string) error {
+	return h.send(chk, "/v2/alerts/"+url.PathEscape(incident.Id.String())+"/"+action+"?identifierType=alias",
+		&actionRequest{Source: h.source(), Note: note})
+}
+
+func (h *Handler) send(chk *check.Check, path string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	baseUrl := h.BaseUrl
+	if baseUrl == "" {
+		baseUrl = DefaultBaseUrl
+	}
+
+	chk.Debugf("sending opsgenie request to %s", path)
+
+	_, err = retryhttp.Do(context.Background(), h.client(), func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseUrl+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "GenieKey "+h.ApiKey)
+		return req, nil
+	}, h.Retries, h.RetryBackoff)
+
+	return err
+}
+
+func (h *Handler) source() string {
+	if h.Source == "" {
+		return "gopoller"
+	}
+	return h.Source
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h *Handler) client() *http.Client {
+	if h.Client == nil {
+		return defaultClient
+	}
+	return h.Client
+}
+
+// Priority maps a check.ResultState to an Opsgenie priority.
+func Priority(state check.ResultState) string {
+	switch state {
+	case check.StateCrit:
+		return "P1"
+	case check.StateWarn:
+		return "P3"
+	case check.StateOk:
+		return "P5"
+	default:
+		return "P2"
+	}
+}
@@ -0,0 +1,158 @@
+package opsgenie
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubRequest struct {
+	path  string
+	query string
+	auth  string
+	body  map[string]any
+}
+
+type stubServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []stubRequest
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	s := &stubServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, stubRequest{path: r.URL.Path, query: r.URL.RawQuery, auth: r.Header.Get("Authorization"), body: body})
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"result":"Request will be processed","requestId":"abc"}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestIncidentLifecycleMapsToAlerts(t *testing.T) {
+	srv := newStubServer(t)
+
+	h := NewHandler("api-key")
+	h.BaseUrl = srv.URL
+
+	chk := check.New("router1", check.WithHandlers([]check.Handler{h}))
+	chk.Command = testCommand{state: check.StateCrit, reason: "UNREACHABLE"}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	alias := chk.Incident.Id.String()
+
+	if err := chk.AcknowledgeIncident(check.Acknowledgement{By: "alice", Comment: "on it"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chk.Command = testCommand{state: check.StateOk}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []struct {
+		path string
+	}{
+		{"/v2/alerts"},
+		{"/v2/alerts/" + alias + "/acknowledge"},
+		{"/v2/alerts/" + alias + "/close"},
+	}
+	if len(srv.requests) != len(want) {
+		t.Fatalf("expected %d requests, got %d: %+v", len(want), len(srv.requests), srv.requests)
+	}
+	for i, w := range want {
+		r := srv.requests[i]
+		if r.path != w.path {
+			t.Errorf("request %d: expected path %s, got %s", i, w.path, r.path)
+		}
+		if r.auth != "GenieKey api-key" {
+			t.Errorf("request %d: expected GenieKey authorization, got %s", i, r.auth)
+		}
+		if i > 0 && r.query != "identifierType=alias" {
+			t.Errorf("request %d: expected alias identifier, got %s", i, r.query)
+		}
+	}
+
+	create := srv.requests[0].body
+	if create["alias"] != alias || create["priority"] != "P1" || create["message"] != "router1 is CRIT: UNREACHABLE" {
+		t.Errorf("unexpected create alert body %v", create)
+	}
+	if ack := srv.requests[1].body; ack["user"] != "alice" || ack["note"] != "on it" {
+		t.Errorf("unexpected acknowledge body %v", ack)
+	}
+}
+
+func TestEscalationClosesPreviousAlert(t *testing.T) {
+	srv := newStubServer(t)
+
+	h := NewHandler("api-key")
+	h.BaseUrl = srv.URL
+
+	previous := check.MakeIncidentFromResults(nil, check.NewResult(check.StateWarn, "", nil))
+	incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+	err := h.ProcessIncidentEvent(&check.Check{Id: "router1"}, check.IncidentEvent{
+		Type:             check.IncidentEscalated,
+		Incident:         incident,
+		PreviousIncident: previous,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(srv.requests))
+	}
+	if want := "/v2/alerts/" + previous.Id.String() + "/close"; srv.requests[0].path != want {
+		t.Errorf("expected %s, got %s", want, srv.requests[0].path)
+	}
+	if srv.requests[1].path != "/v2/alerts" || srv.requests[1].body["alias"] != incident.Id.String() {
+		t.Errorf("expected new alert for incident %s, got %+v", incident.Id, srv.requests[1])
+	}
+}
+
+func TestExpiredAcknowledgementUnacknowledges(t *testing.T) {
+	srv := newStubServer(t)
+
+	h := NewHandler("api-key")
+	h.BaseUrl = srv.URL
+
+	chk := check.New("router1", check.WithHandlers([]check.Handler{h}),
+		check.WithCommand(testCommand{state: check.StateCrit, reason: "UNREACHABLE"}))
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expires := time.Now()
+	if err := chk.AcknowledgeIncident(check.Acknowledgement{By: "alice", Expires: &expires}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.requests) != 3 {
+		t.Fatalf("expected 3 requests, got %+v", srv.requests)
+	}
+	if want := "/v2/alerts/" + chk.Incident.Id.String() + "/unacknowledge"; srv.requests[2].path != want {
+		t.Errorf("expected %s, got %s", want, srv.requests[2].path)
+	}
+}
+
+type testCommand struct {
+	state  check.ResultState
+	reason string
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(c.state, c.reason, nil), nil
+}
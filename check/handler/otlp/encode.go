@@ -0,0 +1,273 @@
+package otlp
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/internal/protowire"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dataPoint is a single gauge or sum sample of a metric.
+type dataPoint struct {
+	name  string
+	sum   bool
+	attrs []attribute
+	time  time.Time
+
+	// start is when a sum began accumulating.
+	start time.Time
+
+	isInt       bool
+	intValue    int64
+	doubleValue float64
+}
+
+// exportRequest is an ExportMetricsServiceRequest with a single resource and instrumentation scope.
+type exportRequest struct {
+	resource     map[string]string
+	scopeName    string
+	scopeVersion string
+	points       []dataPoint
+}
+
+// metric is the data points of one metric within a request.
+type metric struct {
+	name   string
+	sum    bool
+	points []dataPoint
+}
+
+// metrics groups the request's data points by metric, in the order each metric first appears.
+func (r *exportRequest) metrics() []*metric {
+	var metrics []*metric
+	index := make(map[string]*metric)
+	for _, p := range r.points {
+		key := p.name
+		if p.sum {
+			key += "\x00sum"
+		}
+		m, ok := index[key]
+		if !ok {
+			m = &metric{name: p.name, sum: p.sum}
+			index[key] = m
+			metrics = append(metrics, m)
+		}
+		m.points = append(m.points, p)
+	}
+	return metrics
+}
+
+func (r *exportRequest) resourceAttributes() []attribute {
+	attrs := make([]attribute, 0, len(r.resource))
+	for k, v := range r.resource {
+		attrs = append(attrs, attribute{key: k, value: v})
+	}
+	slices.SortFunc(attrs, func(a, b attribute) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return attrs
+}
+
+// aggregationTemporalityCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const aggregationTemporalityCumulative = 2
+
+// Protobuf field numbers of the opentelemetry-proto messages used, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+const (
+	fieldRequestResourceMetrics = 1
+
+	fieldResourceMetricsResource     = 1
+	fieldResourceMetricsScopeMetrics = 2
+
+	fieldResourceAttributes = 1
+
+	fieldScopeMetricsScope   = 1
+	fieldScopeMetricsMetrics = 2
+
+	fieldScopeName    = 1
+	fieldScopeVersion = 2
+
+	fieldMetricName  = 1
+	fieldMetricGauge = 5
+	fieldMetricSum   = 7
+
+	fieldGaugeDataPoints = 1
+
+	fieldSumDataPoints             = 1
+	fieldSumAggregationTemporality = 2
+	fieldSumIsMonotonic            = 3
+
+	fieldDataPointStartTimeUnixNano = 2
+	fieldDataPointTimeUnixNano      = 3
+	fieldDataPointAsDouble          = 4
+	fieldDataPointAsInt             = 6
+	fieldDataPointAttributes        = 7
+
+	fieldKeyValueKey   = 1
+	fieldKeyValueValue = 2
+
+	fieldAnyValueString = 1
+	fieldAnyValueBool   = 2
+	fieldAnyValueInt    = 3
+	fieldAnyValueDouble = 4
+)
+
+// appendKeyValue appends an attribute as a KeyValue.
+func appendKeyValue(b protowire.Buffer, field int, a attribute) protowire.Buffer {
+	return b.Message(field, func(kv protowire.Buffer) protowire.Buffer {
+		kv = kv.String(fieldKeyValueKey, a.key)
+		return kv.Message(fieldKeyValueValue, func(v protowire.Buffer) protowire.Buffer {
+			switch val := a.value.(type) {
+			case bool:
+				var i uint64
+				if val {
+					i = 1
+				}
+				return v.Varint(fieldAnyValueBool, i)
+			case int64:
+				return v.Varint(fieldAnyValueInt, uint64(val))
+			case float64:
+				return v.Fixed64(fieldAnyValueDouble, math.Float64bits(val))
+			default:
+				return v.String(fieldAnyValueString, val.(string))
+			}
+		})
+	})
+}
+
+// appendDataPoint appends a NumberDataPoint.
+func appendDataPoint(b protowire.Buffer, field int, p dataPoint) protowire.Buffer {
+	return b.Message(field, func(dp protowire.Buffer) protowire.Buffer {
+		if !p.start.IsZero() {
+			dp = dp.Fixed64(fieldDataPointStartTimeUnixNano, uint64(p.start.UnixNano()))
+		}
+		dp = dp.Fixed64(fieldDataPointTimeUnixNano, uint64(p.time.UnixNano()))
+		if p.isInt {
+			dp = dp.Fixed64(fieldDataPointAsInt, uint64(p.intValue))
+		} else {
+			dp = dp.Fixed64(fieldDataPointAsDouble, math.Float64bits(p.doubleValue))
+		}
+		for _, a := range p.attrs {
+			dp = appendKeyValue(dp, fieldDataPointAttributes, a)
+		}
+		return dp
+	})
+}
+
+// marshalProto encodes the request as an opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest.
+func (r *exportRequest) marshalProto() []byte {
+	return protowire.Buffer(nil).Message(fieldRequestResourceMetrics, func(rm protowire.Buffer) protowire.Buffer {
+		rm = rm.Message(fieldResourceMetricsResource, func(res protowire.Buffer) protowire.Buffer {
+			for _, a := range r.resourceAttributes() {
+				res = appendKeyValue(res, fieldResourceAttributes, a)
+			}
+			return res
+		})
+
+		return rm.Message(fieldResourceMetricsScopeMetrics, func(sm protowire.Buffer) protowire.Buffer {
+			sm = sm.Message(fieldScopeMetricsScope, func(s protowire.Buffer) protowire.Buffer {
+				s = s.String(fieldScopeName, r.scopeName)
+				if r.scopeVersion != "" {
+					s = s.String(fieldScopeVersion, r.scopeVersion)
+				}
+				return s
+			})
+
+			for _, m := range r.metrics() {
+				sm = sm.Message(fieldScopeMetricsMetrics, func(mb protowire.Buffer) protowire.Buffer {
+					mb = mb.String(fieldMetricName, m.name)
+					if m.sum {
+						return mb.Message(fieldMetricSum, func(s protowire.Buffer) protowire.Buffer {
+							for _, p := range m.points {
+								s = appendDataPoint(s, fieldSumDataPoints, p)
+							}
+							s = s.Varint(fieldSumAggregationTemporality, aggregationTemporalityCumulative)
+							return s.Varint(fieldSumIsMonotonic, 1)
+						})
+					}
+					return mb.Message(fieldMetricGauge, func(g protowire.Buffer) protowire.Buffer {
+						for _, p := range m.points {
+							g = appendDataPoint(g, fieldGaugeDataPoints, p)
+						}
+						return g
+					})
+				})
+			}
+			return sm
+		})
+	})
+}
+
+// marshalJSON encodes the request in the OTLP/JSON encoding, where 64-bit integers are strings and field names
+// are lowerCamelCase.
+func (r *exportRequest) marshalJSON() ([]byte, error) {
+	jsonAttrs := func(attrs []attribute) []map[string]any {
+		out := make([]map[string]any, 0, len(attrs))
+		for _, a := range attrs {
+			var value map[string]any
+			switch v := a.value.(type) {
+			case bool:
+				value = map[string]any{"boolValue": v}
+			case int64:
+				value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+			case float64:
+				value = map[string]any{"doubleValue": v}
+			default:
+				value = map[string]any{"stringValue": v}
+			}
+			out = append(out, map[string]any{"key": a.key, "value": value})
+		}
+		return out
+	}
+
+	var metrics []map[string]any
+	for _, m := range r.metrics() {
+		points := make([]map[string]any, 0, len(m.points))
+		for _, p := range m.points {
+			jp := map[string]any{
+				"attributes":   jsonAttrs(p.attrs),
+				"timeUnixNano": strconv.FormatInt(p.time.UnixNano(), 10),
+			}
+			if !p.start.IsZero() {
+				jp["startTimeUnixNano"] = strconv.FormatInt(p.start.UnixNano(), 10)
+			}
+			if p.isInt {
+				jp["asInt"] = strconv.FormatInt(p.intValue, 10)
+			} else {
+				jp["asDouble"] = p.doubleValue
+			}
+			points = append(points, jp)
+		}
+
+		jm := map[string]any{"name": m.name}
+		if m.sum {
+			jm["sum"] = map[string]any{
+				"dataPoints":             points,
+				"aggregationTemporality": aggregationTemporalityCumulative,
+				"isMonotonic":            true,
+			}
+		} else {
+			jm["gauge"] = map[string]any{"dataPoints": points}
+		}
+		metrics = append(metrics, jm)
+	}
+
+	scope := map[string]any{"name": r.scopeName}
+	if r.scopeVersion != "" {
+		scope["version"] = r.scopeVersion
+	}
+
+	return json.Marshal(map[string]any{
+		"resourceMetrics": []any{
+			map[string]any{
+				"resource": map[string]any{"attributes": jsonAttrs(r.resourceAttributes())},
+				"scopeMetrics": []any{
+					map[string]any{"scope": scope, "metrics": metrics},
+				},
+			},
+		},
+	})
+}
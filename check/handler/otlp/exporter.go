@@ -0,0 +1,264 @@
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/internal/background"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Encoding is an OTLP/HTTP payload encoding.
+type Encoding uint8
+
+const (
+	Protobuf Encoding = iota
+	JSON
+)
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// Exporter batches data points from any number of Handlers and POSTs them to an OTLP/HTTP receiver's
+// /v1/metrics endpoint, once MaxBatchSize data points are queued or every FlushInterval, whichever comes first.  A
+// batch that fails to export stays queued and is retried, unless the receiver refused it with a 4xx response.
+type Exporter struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver (ex. http://localhost:4318).  "/v1/metrics" is appended.
+	Endpoint string
+
+	Encoding Encoding
+
+	// Gzip compresses request bodies.
+	Gzip bool
+
+	// Headers are added to every request (ex. authentication).
+	Headers map[string]string
+
+	// ResourceAttributes describe the poller exporting the metrics (default service.name "gopoller" and
+	// host.name).
+	ResourceAttributes map[string]string
+
+	// ScopeName and ScopeVersion identify the instrumentation scope (default "github.com/seankndy/gopoller").
+	ScopeName    string
+	ScopeVersion string
+
+	// FlushInterval is the most time data points are queued before being exported (default 10 seconds).
+	FlushInterval time.Duration
+
+	// MaxBatchSize is the most data points exported per request (default 1000).
+	MaxBatchSize int
+
+	// MaxQueueSize is the most data points queued waiting to be exported.  Data points queued while it is full are
+	// dropped and counted in Dropped (default 100000).
+	MaxQueueSize int
+
+	// Retries is how many times to retry an export on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Client is the http.Client requests are made with (default has a 10 second timeout).
+	Client *http.Client
+
+	// OnError is called with export errors, as exports happen in the background rather than in Process.
+	OnError func(err error)
+
+	queue    []dataPoint
+	mu       sync.Mutex
+	exporter background.Loop
+	flushMu  sync.Mutex
+
+	dropped atomic.Uint64
+}
+
+// NewExporter creates a new Exporter sending to the OTLP/HTTP receiver at endpoint.
+func NewExporter(endpoint string, encoding Encoding) *Exporter {
+	hostname, _ := os.Hostname()
+
+	return &Exporter{
+		Endpoint: endpoint,
+		Encoding: encoding,
+		ResourceAttributes: map[string]string{
+			"service.name": "gopoller",
+			"host.name":    hostname,
+		},
+		ScopeName:     "github.com/seankndy/gopoller",
+		FlushInterval: 10 * time.Second,
+		MaxBatchSize:  1000,
+		MaxQueueSize:  100000,
+		Retries:       3,
+		RetryBackoff:  time.Second,
+	}
+}
+
+// Dropped returns the number of data points dropped because the queue was full.
+func (e *Exporter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+// Flush exports every queued data point now.
+func (e *Exporter) Flush(ctx context.Context) error {
+	e.flushMu.Lock()
+	defer e.flushMu.Unlock()
+
+	for {
+		batch := e.nextBatch()
+		if batch == nil {
+			return nil
+		}
+		if err := e.export(ctx, batch); err != nil {
+			if refused(err) {
+				e.removeBatch(len(batch))
+			}
+			return err
+		}
+		e.removeBatch(len(batch))
+	}
+}
+
+// Shutdown stops the background exporter and exports every queued data point.  Data points are refused after
+// Shutdown.
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.exporter.Stop()
+	return e.Flush(ctx)
+}
+
+// enqueue queues points for export, returning how many were dropped because the queue was full.
+func (e *Exporter) enqueue(points []dataPoint) (int, error) {
+	flush := func() error {
+		return e.Flush(context.Background())
+	}
+	if !e.exporter.Start(e.flushInterval(), flush, e.OnError) {
+		return 0, errors.New("otlp exporter is shut down")
+	}
+
+	e.mu.Lock()
+	room := e.maxQueueSize() - len(e.queue)
+	dropped := max(0, len(points)-room)
+	e.queue = append(e.queue, points[:len(points)-dropped]...)
+	full := len(e.queue) >= e.maxBatchSize()
+	e.mu.Unlock()
+
+	if dropped > 0 {
+		e.dropped.Add(uint64(dropped))
+	}
+	if full {
+		e.exporter.Kick()
+	}
+
+	return dropped, nil
+}
+
+// nextBatch returns a copy of up to MaxBatchSize data points from the front of the queue, or nil if it is empty.
+// They are left queued until removeBatch, once exported.
+func (e *Exporter) nextBatch() []dataPoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.queue) == 0 {
+		return nil
+	}
+	return slices.Clone(e.queue[:min(len(e.queue), e.maxBatchSize())])
+}
+
+// removeBatch removes the n data points of a batch from the front of the queue.
+func (e *Exporter) removeBatch(n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.queue = e.queue[n:]
+}
+
+func (e *Exporter) export(ctx context.Context, batch []dataPoint) error {
+	req := &exportRequest{
+		resource:     e.ResourceAttributes,
+		scopeName:    e.ScopeName,
+		scopeVersion: e.ScopeVersion,
+		points:       batch,
+	}
+
+	var body []byte
+	contentType := "application/x-protobuf"
+	if e.Encoding == JSON {
+		var err error
+		if body, err = req.marshalJSON(); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	} else {
+		body = req.marshalProto()
+	}
+
+	if e.Gzip {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	client := e.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	_, err := retryhttp.Do(ctx, client, func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+			strings.TrimRight(e.Endpoint, "/")+"/v1/metrics", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		if e.Gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		for k, v := range e.Headers {
+			req.Header.Set(k, v)
+		}
+		return req, nil
+	}, e.Retries, e.RetryBackoff)
+	if err != nil {
+		return fmt.Errorf("otlp export of %d data points failed: %w", len(batch), err)
+	}
+
+	return nil
+}
+
+func (e *Exporter) flushInterval() time.Duration {
+	if e.FlushInterval <= 0 {
+		return 10 * time.Second
+	}
+	return e.FlushInterval
+}
+
+func (e *Exporter) maxBatchSize() int {
+	if e.MaxBatchSize <= 0 {
+		return 1000
+	}
+	return e.MaxBatchSize
+}
+
+func (e *Exporter) maxQueueSize() int {
+	if e.MaxQueueSize <= 0 {
+		return 100000
+	}
+	return e.MaxQueueSize
+}
+
+// refused returns true if err is the receiver refusing a batch, which would be refused again if retried.
+func refused(err error) bool {
+	var statusErr *retryhttp.StatusError
+	return errors.As(err, &statusErr) && !statusErr.Temporary()
+}
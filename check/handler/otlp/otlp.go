@@ -0,0 +1,166 @@
+// Package otlp provides a check.Handler that exports Result metrics as OpenTelemetry metrics over OTLP/HTTP.
+package otlp
+
+import (
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Handler converts the metrics of every Result it processes into OpenTelemetry data points and queues them on
+// Exporter.  Gauges become Gauge data points and counters become cumulative, monotonic Sum data points, named
+// MetricPrefix + label.  Every data point has a check.id attribute plus the AttributeMetaKeys of Check.Meta, and
+// the Result time as its timestamp.
+//
+// A counter's actual start is unknown, so a Sum series starts at its first data point the Handler processes, and
+// again at the data point before it whenever its value decreases (the counter was reset).
+type Handler struct {
+	Exporter *Exporter
+
+	// MetricPrefix is prepended to metric labels to form metric names (default "gopoller.").
+	MetricPrefix string
+
+	// AttributeMetaKeys are the Check.Meta keys added as data point attributes.  Keys missing from a Check are
+	// omitted.
+	AttributeMetaKeys []string
+
+	// StateMetric, when set, also exports the check.ResultState as a gauge named MetricPrefix + StateMetric.
+	StateMetric string
+
+	sums map[string]*sumSeries
+	mu   sync.Mutex
+}
+
+// sumSeries is the start of a Sum series and its last data point, to detect counter resets.
+type sumSeries struct {
+	start    time.Time
+	last     float64
+	lastTime time.Time
+}
+
+func NewHandler(exporter *Exporter, attributeMetaKeys ...string) *Handler {
+	return &Handler{
+		Exporter:          exporter,
+		MetricPrefix:      "gopoller.",
+		AttributeMetaKeys: attributeMetaKeys,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	points := h.dataPoints(chk, result)
+	if len(points) == 0 {
+		return nil
+	}
+
+	dropped, err := h.Exporter.enqueue(points)
+	if dropped > 0 {
+		chk.Debugf("otlp export queue full, dropped %d data points", dropped)
+	}
+	return err
+}
+
+func (h *Handler) dataPoints(chk *check.Check, result *check.Result) []dataPoint {
+	attrs := []attribute{{key: "check.id", value: chk.Id}}
+	for _, key := range h.AttributeMetaKeys {
+		if v, ok := chk.Meta[key]; ok && v != nil {
+			attrs = append(attrs, newAttribute(key, v))
+		}
+	}
+
+	var points []dataPoint
+	for _, m := range result.Metrics {
+		p := dataPoint{
+			name:  h.MetricPrefix + m.Label,
+			sum:   m.Type == check.ResultMetricCounter,
+			attrs: attrs,
+			time:  result.Time,
+		}
+
+		if i, err := strconv.ParseInt(m.Value, 10, 64); err == nil {
+			p.isInt, p.intValue = true, i
+		} else if f, err := strconv.ParseFloat(m.Value, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			p.doubleValue = f
+		} else {
+			continue
+		}
+		if p.sum {
+			p.start = h.sumStart(p)
+		}
+
+		points = append(points, p)
+	}
+
+	if h.StateMetric != "" {
+		points = append(points, dataPoint{
+			name:     h.MetricPrefix + h.StateMetric,
+			attrs:    attrs,
+			time:     result.Time,
+			isInt:    true,
+			intValue: int64(result.State),
+		})
+	}
+
+	return points
+}
+
+// sumStart returns the start of the Sum series of p, and records p as its last data point.
+func (h *Handler) sumStart(p dataPoint) time.Time {
+	var key strings.Builder
+	key.WriteString(p.name)
+	for _, a := range p.attrs {
+		fmt.Fprintf(&key, "\x00%s=%v", a.key, a.value)
+	}
+	v := p.doubleValue
+	if p.isInt {
+		v = float64(p.intValue)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.sums[key.String()]
+	if !ok {
+		if h.sums == nil {
+			h.sums = make(map[string]*sumSeries)
+		}
+		s = &sumSeries{start: p.time}
+		h.sums[key.String()] = s
+	} else if v < s.last {
+		s.start = s.lastTime
+	}
+	s.last, s.lastTime = v, p.time
+	return s.start
+}
+
+// attribute is an OpenTelemetry attribute with a string, bool, int or double value.
+type attribute struct {
+	key   string
+	value any
+}
+
+// newAttribute converts a Check.Meta value to an attribute, keeping bools and numbers typed and formatting
+// anything else as a string.
+func newAttribute(key string, v any) attribute {
+	switch v := v.(type) {
+	case string, bool, int64, float64:
+		return attribute{key: key, value: v}
+	case int:
+		return attribute{key: key, value: int64(v)}
+	case int32:
+		return attribute{key: key, value: int64(v)}
+	case uint32:
+		return attribute{key: key, value: int64(v)}
+	case float32:
+		return attribute{key: key, value: float64(v)}
+	default:
+		return attribute{key: key, value: fmt.Sprint(v)}
+	}
+}
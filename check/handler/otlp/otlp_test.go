@@ -0,0 +1,329 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/protowire"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// receiver is a stub OTLP/HTTP receiver recording the request bodies it receives.
+type receiver struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	b, _ := io.ReadAll(body)
+
+	r.mu.Lock()
+	r.requests = append(r.requests, req)
+	r.bodies = append(r.bodies, b)
+	r.mu.Unlock()
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+// field is a decoded protobuf field.
+type field struct {
+	num   int
+	value uint64
+	bytes []byte
+}
+
+// decodeProto decodes the top-level fields of a protobuf message.
+func decodeProto(t *testing.T, b []byte) []field {
+	t.Helper()
+	var fields []field
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		b = b[n:]
+		f := field{num: int(tag >> 3)}
+		switch tag & 7 {
+		case protowire.Varint:
+			f.value, n = binary.Uvarint(b)
+			b = b[n:]
+		case protowire.Fixed64:
+			f.value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case protowire.Bytes:
+			l, n := binary.Uvarint(b)
+			f.bytes = b[n : n+int(l)]
+			b = b[n+int(l):]
+		default:
+			t.Fatalf("unexpected wire type %d", tag&7)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// get returns the fields numbered num.
+func get(fields []field, num int) []field {
+	var out []field
+	for _, f := range fields {
+		if f.num == num {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func testResult() *check.Result {
+	result := check.NewResult(check.StateWarn, "", []check.ResultMetric{
+		{Label: "avg_rtt_ms", Value: "12.5", Type: check.ResultMetricGauge},
+		{Label: "in_octets", Value: "1234", Type: check.ResultMetricCounter},
+		{Label: "bogus", Value: "n/a", Type: check.ResultMetricGauge},
+	})
+	result.Time = time.Unix(1700000000, 0)
+	return result
+}
+
+func TestExportsProtobuf(t *testing.T) {
+	rec := &receiver{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	exp := NewExporter(srv.URL, Protobuf)
+	exp.ResourceAttributes = map[string]string{"service.name": "poller-1"}
+	exp.Headers = map[string]string{"Authorization": "Bearer secret"}
+	exp.Gzip = true
+
+	h := NewHandler(exp, "site")
+	chk := &check.Check{Id: "router1", Meta: map[string]any{"site": "dc1"}}
+	if err := h.Process(chk, testResult(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if rec.count() != 1 {
+		t.Fatalf("expected 1 export request, got %d", rec.count())
+	}
+	req := rec.requests[0]
+	if req.URL.Path != "/v1/metrics" || req.Header.Get("Content-Type") != "application/x-protobuf" {
+		t.Errorf("unexpected request %s %s", req.URL.Path, req.Header.Get("Content-Type"))
+	}
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("expected configured headers to be sent")
+	}
+
+	rm := decodeProto(t, get(decodeProto(t, rec.bodies[0]), fieldRequestResourceMetrics)[0].bytes)
+	resource := decodeProto(t, get(rm, fieldResourceMetricsResource)[0].bytes)
+	kv := decodeProto(t, get(resource, fieldResourceAttributes)[0].bytes)
+	if string(get(kv, fieldKeyValueKey)[0].bytes) != "service.name" {
+		t.Errorf("expected service.name resource attribute")
+	}
+
+	sm := decodeProto(t, get(rm, fieldResourceMetricsScopeMetrics)[0].bytes)
+	metrics := get(sm, fieldScopeMetricsMetrics)
+	if len(metrics) != 2 {
+		t.Fatalf("expected 2 metrics, got %d", len(metrics))
+	}
+
+	gauge := decodeProto(t, metrics[0].bytes)
+	if name := string(get(gauge, fieldMetricName)[0].bytes); name != "gopoller.avg_rtt_ms" {
+		t.Errorf("unexpected metric name %s", name)
+	}
+	dp := decodeProto(t, get(decodeProto(t, get(gauge, fieldMetricGauge)[0].bytes), fieldGaugeDataPoints)[0].bytes)
+	if v := math.Float64frombits(get(dp, fieldDataPointAsDouble)[0].value); v != 12.5 {
+		t.Errorf("expected 12.5, got %v", v)
+	}
+	if ts := get(dp, fieldDataPointTimeUnixNano)[0].value; ts != uint64(1700000000*time.Second) {
+		t.Errorf("expected result time, got %d", ts)
+	}
+	if n := len(get(dp, fieldDataPointAttributes)); n != 2 {
+		t.Errorf("expected check.id and site attributes, got %d", n)
+	}
+
+	sum := decodeProto(t, get(decodeProto(t, metrics[1].bytes), fieldMetricSum)[0].bytes)
+	if get(sum, fieldSumAggregationTemporality)[0].value != aggregationTemporalityCumulative ||
+		get(sum, fieldSumIsMonotonic)[0].value != 1 {
+		t.Errorf("expected cumulative monotonic sum")
+	}
+	dp = decodeProto(t, get(sum, fieldSumDataPoints)[0].bytes)
+	if v := get(dp, fieldDataPointAsInt)[0].value; v != 1234 {
+		t.Errorf("expected 1234, got %d", v)
+	}
+	if start := get(dp, fieldDataPointStartTimeUnixNano); len(start) != 1 ||
+		start[0].value != uint64(1700000000*time.Second) {
+		t.Errorf("expected the sum to start at its first data point, got %v", start)
+	}
+}
+
+func TestExportsJSON(t *testing.T) {
+	rec := &receiver{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	exp := NewExporter(srv.URL, JSON)
+	h := NewHandler(exp)
+	h.StateMetric = "check.state"
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var req struct {
+		ResourceMetrics []struct {
+			ScopeMetrics []struct {
+				Metrics []struct {
+					Name  string
+					Gauge *struct {
+						DataPoints []struct {
+							TimeUnixNano string
+							AsDouble     *float64
+							AsInt        string
+						}
+					}
+					Sum *struct {
+						AggregationTemporality int
+						IsMonotonic            bool
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(rec.bodies[0], &req); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	if len(metrics) != 3 {
+		t.Fatalf("expected 3 metrics, got %d", len(metrics))
+	}
+	if dp := metrics[0].Gauge.DataPoints[0]; *dp.AsDouble != 12.5 || dp.TimeUnixNano != "1700000000000000000" {
+		t.Errorf("unexpected gauge data point %+v", dp)
+	}
+	if s := metrics[1].Sum; s == nil || s.AggregationTemporality != 2 || !s.IsMonotonic {
+		t.Errorf("expected cumulative monotonic sum, got %+v", s)
+	}
+	if metrics[2].Name != "gopoller.check.state" || metrics[2].Gauge.DataPoints[0].AsInt != "1" {
+		t.Errorf("unexpected state metric %+v", metrics[2])
+	}
+}
+
+func TestBatchesAndDrops(t *testing.T) {
+	rec := &receiver{}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	exp := NewExporter(srv.URL, Protobuf)
+	exp.FlushInterval = time.Hour
+	exp.MaxQueueSize = 5
+
+	h := NewHandler(exp)
+	for i := 0; i < 3; i++ {
+		_ = h.Process(&check.Check{Id: "router1"}, testResult(), nil)
+	}
+	if exp.Dropped() != 1 {
+		t.Errorf("expected 1 dropped data point, got %d", exp.Dropped())
+	}
+
+	exp.MaxBatchSize = 2
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.count() != 3 {
+		t.Errorf("expected 3 batches of at most 2 data points, got %d", rec.count())
+	}
+}
+
+func TestRetriesFailedBatches(t *testing.T) {
+	rec := &receiver{}
+	var status atomic.Int32
+	status.Store(http.StatusServiceUnavailable)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if code := int(status.Load()); code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		rec.ServeHTTP(w, req)
+	}))
+	defer srv.Close()
+
+	exp := NewExporter(srv.URL, Protobuf)
+	exp.FlushInterval = time.Hour
+	exp.Retries = 0
+	h := NewHandler(exp)
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the batch stays queued while the receiver is unavailable
+	if err := exp.Flush(context.Background()); err == nil {
+		t.Fatal("expected an export error")
+	}
+	status.Store(http.StatusOK)
+	if err := exp.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rec.count() != 1 {
+		t.Errorf("expected the failed batch to be exported, got %d requests", rec.count())
+	}
+
+	if err := h.Process(&check.Check{Id: "router1"}, testResult(), nil); err == nil {
+		t.Error("expected an error processing after Shutdown")
+	}
+}
+
+func TestSumStartTimes(t *testing.T) {
+	h := NewHandler(NewExporter("", Protobuf))
+	t0 := time.Unix(1700000000, 0)
+
+	tests := []struct {
+		checkId   string
+		value     string
+		at        time.Duration
+		wantStart time.Duration
+	}{
+		{"router1", "100", 0, 0},
+		{"router1", "200", time.Minute, 0},
+		{"router2", "5", time.Minute, time.Minute},
+		// reset, so the series starts again at the previous data point
+		{"router1", "50", 2 * time.Minute, time.Minute},
+		{"router1", "80", 3 * time.Minute, time.Minute},
+	}
+	for i, tt := range tests {
+		result := check.NewResult(check.StateOk, "", []check.ResultMetric{
+			{Label: "in_octets", Value: tt.value, Type: check.ResultMetricCounter},
+			{Label: "rtt", Value: "1", Type: check.ResultMetricGauge},
+		})
+		result.Time = t0.Add(tt.at)
+
+		points := h.dataPoints(&check.Check{Id: tt.checkId}, result)
+		if !points[0].start.Equal(t0.Add(tt.wantStart)) {
+			t.Errorf("%d: expected the sum to start at %v, got %v", i, t0.Add(tt.wantStart), points[0].start)
+		}
+		if !points[1].start.IsZero() {
+			t.Errorf("%d: expected no start time for a gauge, got %v", i, points[1].start)
+		}
+	}
+}
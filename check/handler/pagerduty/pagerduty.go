@@ -0,0 +1,202 @@
+// Package pagerduty provides a check.Handler that maps Incidents to PagerDuty Events API v2 alerts.
+package pagerduty
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"net/http"
+	"time"
+)
+
+const DefaultBaseUrl = "https://events.pagerduty.com"
+
+// Event is a PagerDuty Events API v2 event.
+type Event struct {
+	RoutingKey  string        `json:"routing_key"`
+	EventAction string        `json:"event_action"`
+	DedupKey    string        `json:"dedup_key"`
+	Payload     *EventPayload `json:"payload,omitempty"`
+}
+
+// EventPayload is the payload of a trigger Event.
+type EventPayload struct {
+	Summary       string         `json:"summary"`
+	Source        string         `json:"source"`
+	Severity      string         `json:"severity"`
+	Timestamp     string         `json:"timestamp,omitempty"`
+	Component     string         `json:"component,omitempty"`
+	Group         string         `json:"group,omitempty"`
+	Class         string         `json:"class,omitempty"`
+	CustomDetails map[string]any `json:"custom_details,omitempty"`
+}
+
+// Handler triggers, acknowledges and resolves PagerDuty alerts from Incident events.  The dedup_key of each alert is
+// the Incident ID, so an escalated or de-escalated Incident resolves the previous Incident's alert and triggers a new
+// one.
+//
+// PagerDuty merges a trigger into the open alert with the same dedup_key without un-acknowledging it, so when an
+// Incident's acknowledgement expires its alert is resolved and triggered again, which opens a new, unacknowledged
+// alert under the same dedup_key.
+type Handler struct {
+	// RoutingKey is the integration key of the PagerDuty service.
+	RoutingKey string
+
+	// BaseUrl is the Events API base URL (default https://events.pagerduty.com).
+	BaseUrl string
+
+	// Source returns the alert source for a Check (default is the Check's Id).
+	Source func(*check.Check) string
+
+	// Component, Group and Class return optional alert fields for a Check.
+	Component func(*check.Check) string
+	Group     func(*check.Check) string
+	Class     func(*check.Check) string
+
+	// Retries is how many times to retry a request on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	Client *http.Client
+}
+
+func NewHandler(routingKey string) *Handler {
+	return &Handler{
+		RoutingKey:   routingKey,
+		BaseUrl:      DefaultBaseUrl,
+		Retries:      3,
+		RetryBackoff: time.Second,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	switch event.Type {
+	case check.IncidentOpened:
+		return h.send(chk, h.triggerEvent(chk, event))
+	case check.IncidentAcknowledgementExpired:
+		if err := h.send(chk, h.event("resolve", event.Incident)); err != nil {
+			return err
+		}
+		return h.send(chk, h.triggerEvent(chk, event))
+	case check.IncidentEscalated, check.IncidentDeEscalated:
+		if err := h.send(chk, h.event("resolve", event.PreviousIncident)); err != nil {
+			return err
+		}
+		return h.send(chk, h.triggerEvent(chk, event))
+	case check.IncidentAcknowledged:
+		return h.send(chk, h.event("acknowledge", event.Incident))
+	case check.IncidentResolved:
+		return h.send(chk, h.event("resolve", event.Incident))
+	}
+	return nil
+}
+
+func (h *Handler) event(action string, incident *check.Incident) *Event {
+	return &Event{
+		RoutingKey:  h.RoutingKey,
+		EventAction: action,
+		DedupKey:    incident.Id.String(),
+	}
+}
+
+func (h *Handler) triggerEvent(chk *check.Check, event check.IncidentEvent) *Event {
+	incident := event.Incident
+
+	summary := chk.Id + " is " + incident.ToState.String()
+	if incident.ReasonCode != "" {
+		summary += ": " + incident.ReasonCode
+	}
+
+	details := map[string]any{
+		"check_id":    chk.Id,
+		"from_state":  incident.FromState.String(),
+		"to_state":    incident.ToState.String(),
+		"reason_code": incident.ReasonCode,
+	}
+	if event.Result != nil {
+		for _, m := range event.Result.Metrics {
+			details[m.Label] = m.Value
+		}
+	}
+
+	e := h.event("trigger", incident)
+	e.Payload = &EventPayload{
+		Summary:       summary,
+		Source:        chk.Id,
+		Severity:      Severity(incident.ToState),
+		Timestamp:     incident.Time.Format(time.RFC3339),
+		CustomDetails: details,
+	}
+	if h.Source != nil {
+		e.Payload.Source = h.Source(chk)
+	}
+	if h.Component != nil {
+		e.Payload.Component = h.Component(chk)
+	}
+	if h.Group != nil {
+		e.Payload.Group = h.Group(chk)
+	}
+	if h.Class != nil {
+		e.Payload.Class = h.Class(chk)
+	}
+	return e
+}
+
+func (h *Handler) send(chk *check.Check, e *Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	baseUrl := h.BaseUrl
+	if baseUrl == "" {
+		baseUrl = DefaultBaseUrl
+	}
+
+	chk.Debugf("sending pagerduty %s for dedup key %s", e.EventAction, e.DedupKey)
+
+	_, err = retryhttp.Do(context.Background(), h.client(), func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, baseUrl+"/v2/enqueue", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	}, h.Retries, h.RetryBackoff)
+
+	return err
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h *Handler) client() *http.Client {
+	if h.Client == nil {
+		return defaultClient
+	}
+	return h.Client
+}
+
+// Severity maps a check.ResultState to a PagerDuty severity.
+func Severity(state check.ResultState) string {
+	switch state {
+	case check.StateCrit:
+		return "critical"
+	case check.StateWarn:
+		return "warning"
+	case check.StateOk:
+		return "info"
+	default:
+		return "error"
+	}
+}
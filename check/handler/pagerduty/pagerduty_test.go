@@ -0,0 +1,131 @@
+package pagerduty
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type stubServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []Event
+}
+
+func newStubServer(t *testing.T) *stubServer {
+	s := &stubServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/enqueue" {
+			t.Errorf("unexpected path %s", r.URL.Path)
+		}
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("bad request body: %v", err)
+		}
+		s.mu.Lock()
+		s.events = append(s.events, e)
+		s.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte(`{"status":"success","dedup_key":"` + e.DedupKey + `"}`))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestIncidentLifecycleMapsToEvents(t *testing.T) {
+	srv := newStubServer(t)
+
+	h := NewHandler("routing-key")
+	h.BaseUrl = srv.URL
+
+	chk := check.New("router1", check.WithHandlers([]check.Handler{h}))
+	for _, state := range []check.ResultState{check.StateWarn, check.StateCrit} {
+		chk.Command = testCommand{state: state, reason: "LATENCY_HIGH"}
+		if err := chk.Execute(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	warnId := srv.events[0].DedupKey
+	critId := chk.Incident.Id.String()
+
+	if err := chk.AcknowledgeIncident(check.Acknowledgement{By: "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	chk.Command = testCommand{state: check.StateOk}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []struct {
+		action, dedupKey, severity string
+	}{
+		{"trigger", warnId, "warning"},
+		{"resolve", warnId, ""},
+		{"trigger", critId, "critical"},
+		{"acknowledge", critId, ""},
+		{"resolve", critId, ""},
+	}
+	if len(srv.events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(srv.events), srv.events)
+	}
+	for i, w := range want {
+		e := srv.events[i]
+		if e.EventAction != w.action || e.DedupKey != w.dedupKey || e.RoutingKey != "routing-key" {
+			t.Errorf("event %d: expected %s/%s, got %s/%s", i, w.action, w.dedupKey, e.EventAction, e.DedupKey)
+		}
+		if w.severity != "" && (e.Payload == nil || e.Payload.Severity != w.severity) {
+			t.Errorf("event %d: expected severity %s, got %+v", i, w.severity, e.Payload)
+		}
+	}
+	if got := srv.events[2].Payload.Summary; got != "router1 is CRIT: LATENCY_HIGH" {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
+
+func TestExpiredAcknowledgementRetriggers(t *testing.T) {
+	srv := newStubServer(t)
+
+	h := NewHandler("routing-key")
+	h.BaseUrl = srv.URL
+
+	chk := check.New("router1", check.WithHandlers([]check.Handler{h}),
+		check.WithCommand(testCommand{state: check.StateCrit, reason: "DOWN"}))
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expires := time.Now()
+	if err := chk.AcknowledgeIncident(check.Acknowledgement{By: "alice", Expires: &expires}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the acknowledged alert is resolved, as a trigger alone would be merged into it while it stays acknowledged
+	incidentId := chk.Incident.Id.String()
+	want := []string{"trigger", "acknowledge", "resolve", "trigger"}
+	if len(srv.events) != len(want) {
+		t.Fatalf("expected %d events, got %+v", len(want), srv.events)
+	}
+	for i, action := range want {
+		if e := srv.events[i]; e.EventAction != action || e.DedupKey != incidentId {
+			t.Errorf("event %d: expected %s/%s, got %s/%s", i, action, incidentId, e.EventAction, e.DedupKey)
+		}
+	}
+	if srv.events[3].Payload == nil {
+		t.Error("expected the re-triggered alert to have a payload")
+	}
+}
+
+type testCommand struct {
+	state  check.ResultState
+	reason string
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(c.state, c.reason, nil), nil
+}
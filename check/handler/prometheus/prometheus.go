@@ -0,0 +1,259 @@
+// Package prometheus provides a check.Handler that keeps the latest Result of each Check and serves them in the
+// Prometheus text exposition format.
+package prometheus
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Handler records the latest Result of every Check it processes and serves them as Prometheus metrics:
+//
+//	<namespace>_check_metric{check_id, label, <meta labels>}          gauge, one series per gauge ResultMetric
+//	<namespace>_check_counter_total{check_id, label, <meta labels>}   counter, one series per counter ResultMetric
+//	<namespace>_check_state{check_id, <meta labels>}                  gauge, the check.ResultState (0 OK, 1 WARN, 2 CRIT, 3 UNKNOWN)
+//	<namespace>_check_last_run_timestamp{check_id, <meta labels>}     gauge, Result time in unix seconds
+//
+// Handler is an http.Handler so it can be mounted at /metrics of an existing server, or use ListenAndServe.
+type Handler struct {
+	// Namespace prefixes every metric name (default "gopoller").
+	Namespace string
+
+	// MetaLabels are the Check.Meta keys added as labels to every series of a Check.  Label names are sanitized to
+	// the Prometheus label name charset, and a missing key yields an empty label value.  A name that would collide
+	// with check_id, label or an earlier MetaLabels name, or use the reserved "__" prefix, is prefixed with "meta_"
+	// until it is unique.
+	MetaLabels []string
+
+	// StaleAfter removes the series of Checks that have not produced a Result within the duration, so that removed
+	// Checks stop being exported.  Zero disables expiry; use Remove to drop a Check explicitly.
+	StaleAfter time.Duration
+
+	checks map[string]*checkSeries
+	mu     sync.RWMutex
+}
+
+// checkSeries is the latest state of a Check.
+type checkSeries struct {
+	checkId    string
+	metaValues []string
+	result     *check.Result
+	updated    time.Time
+}
+
+func NewHandler(metaLabels ...string) *Handler {
+	return &Handler{
+		Namespace:  "gopoller",
+		MetaLabels: metaLabels,
+		StaleAfter: 10 * time.Minute,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	metaValues := make([]string, len(h.MetaLabels))
+	for i, key := range h.MetaLabels {
+		if v, ok := chk.Meta[key]; ok && v != nil {
+			metaValues[i] = fmt.Sprint(v)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.checks == nil {
+		h.checks = make(map[string]*checkSeries)
+	}
+	h.checks[chk.Id] = &checkSeries{
+		checkId:    chk.Id,
+		metaValues: metaValues,
+		result:     result,
+		updated:    time.Now(),
+	}
+
+	return nil
+}
+
+// Remove stops exporting the series of the Check with ID checkId.
+func (h *Handler) Remove(checkId string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.checks, checkId)
+}
+
+// Expire removes the series of Checks last updated before t, returning how many Checks were removed.
+func (h *Handler) Expire(t time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var n int
+	for id, s := range h.checks {
+		if s.updated.Before(t) {
+			delete(h.checks, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	if h.StaleAfter > 0 {
+		h.Expire(time.Now().Add(-h.StaleAfter))
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	_ = h.Write(w)
+}
+
+// ListenAndServe serves the metrics at /metrics on addr until ctx is cancelled.
+func (h *Handler) ListenAndServe(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", h)
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Write writes the metrics of every Check in the Prometheus text format to w.
+func (h *Handler) Write(w io.Writer) error {
+	h.mu.RLock()
+	checks := make([]*checkSeries, 0, len(h.checks))
+	for _, s := range h.checks {
+		checks = append(checks, s)
+	}
+	h.mu.RUnlock()
+
+	slices.SortFunc(checks, func(a, b *checkSeries) int {
+		return strings.Compare(a.checkId, b.checkId)
+	})
+
+	namespace := h.Namespace
+	if namespace == "" {
+		namespace = "gopoller"
+	}
+	metaLabels := h.metaLabelNames()
+
+	bw := bufio.NewWriter(w)
+	family := func(name, typ, help string, series func(name string)) {
+		name = namespace + "_" + name
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		series(name)
+	}
+	sample := func(name string, s *checkSeries, metricLabel *string, value string) {
+		bw.WriteString(name)
+		bw.WriteString(`{check_id="`)
+		bw.WriteString(escapeLabelValue(s.checkId))
+		bw.WriteByte('"')
+		if metricLabel != nil {
+			bw.WriteString(`,label="`)
+			bw.WriteString(escapeLabelValue(*metricLabel))
+			bw.WriteByte('"')
+		}
+		for i, l := range metaLabels {
+			bw.WriteString("," + l + `="`)
+			bw.WriteString(escapeLabelValue(s.metaValues[i]))
+			bw.WriteByte('"')
+		}
+		bw.WriteString("} " + value + "\n")
+	}
+	// metrics without a type are exported as gauges
+	metrics := func(counters bool) func(name string) {
+		return func(name string) {
+			for _, s := range checks {
+				for _, m := range s.result.Metrics {
+					if (m.Type == check.ResultMetricCounter) != counters {
+						continue
+					}
+					v, err := strconv.ParseFloat(m.Value, 64)
+					if err != nil {
+						continue
+					}
+					sample(name, s, &m.Label, formatFloat(v))
+				}
+			}
+		}
+	}
+
+	family("check_metric", "gauge", "Gauge metric of a check's latest result.", metrics(false))
+	family("check_counter_total", "counter", "Counter metric of a check's latest result.", metrics(true))
+	family("check_state", "gauge", "State of a check's latest result (0 OK, 1 WARN, 2 CRIT, 3 UNKNOWN).", func(name string) {
+		for _, s := range checks {
+			sample(name, s, nil, strconv.Itoa(int(s.result.State)))
+		}
+	})
+	family("check_last_run_timestamp", "gauge", "Unix time of a check's latest result.", func(name string) {
+		for _, s := range checks {
+			sample(name, s, nil, formatFloat(float64(s.result.Time.UnixMilli())/1e3))
+		}
+	})
+
+	return bw.Flush()
+}
+
+// metaLabelNames returns the label names of MetaLabels, sanitized and prefixed as needed to be unique.
+func (h *Handler) metaLabelNames() []string {
+	used := map[string]bool{"check_id": true, "label": true}
+	names := make([]string, len(h.MetaLabels))
+	for i, l := range h.MetaLabels {
+		name := sanitizeLabelName(l)
+		for used[name] || strings.HasPrefix(name, "__") {
+			name = "meta_" + name
+		}
+		used[name] = true
+		names[i] = name
+	}
+	return names
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// escapeLabelValue escapes backslash, double-quote and line feed as required by the text format.
+func escapeLabelValue(v string) string {
+	if !strings.ContainsAny(v, "\\\"\n") {
+		return v
+	}
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// sanitizeLabelName replaces characters not valid in a Prometheus label name with underscores.
+func sanitizeLabelName(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		valid := c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (i > 0 && c >= '0' && c <= '9')
+		if !valid {
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
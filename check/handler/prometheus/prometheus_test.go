@@ -0,0 +1,133 @@
+package prometheus
+
+import (
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func process(t *testing.T, h *Handler, chk *check.Check, result *check.Result) {
+	t.Helper()
+	if err := h.Process(chk, result, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestServesMetricsInTextFormat(t *testing.T) {
+	h := NewHandler("site", "host-name")
+
+	result := check.NewResult(check.StateWarn, "", []check.ResultMetric{
+		{Label: "avg_rtt_ms", Value: "12.5", Type: check.ResultMetricGauge},
+		{Label: "ifHCInOctets", Value: "1234567", Type: check.ResultMetricCounter},
+		{Label: "bogus", Value: "n/a", Type: check.ResultMetricGauge},
+	})
+	result.Time = time.Unix(1700000000, 500000000)
+	process(t, h, &check.Check{Id: "router1", Meta: map[string]any{"site": `dc"1`}}, result)
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %s", ct)
+	}
+
+	want := []string{
+		"# TYPE gopoller_check_metric gauge",
+		`gopoller_check_metric{check_id="router1",label="avg_rtt_ms",site="dc\"1",host_name=""} 12.5`,
+		"# TYPE gopoller_check_counter_total counter",
+		`gopoller_check_counter_total{check_id="router1",label="ifHCInOctets",site="dc\"1",host_name=""} 1234567`,
+		`gopoller_check_state{check_id="router1",site="dc\"1",host_name=""} 1`,
+		`gopoller_check_last_run_timestamp{check_id="router1",site="dc\"1",host_name=""} 1700000000.5`,
+	}
+	for _, line := range want {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected output to contain %q, got:\n%s", line, body)
+		}
+	}
+	if strings.Contains(string(body), "bogus") {
+		t.Errorf("expected non-numeric metric to be skipped, got:\n%s", body)
+	}
+}
+
+func TestLatestResultReplacesPrevious(t *testing.T) {
+	h := NewHandler()
+	chk := &check.Check{Id: "router1"}
+
+	process(t, h, chk, check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "loss", Value: "0"}}))
+	process(t, h, chk, check.NewResult(check.StateCrit, "", []check.ResultMetric{{Label: "loss", Value: "100"}}))
+
+	var out strings.Builder
+	if err := h.Write(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Count(out.String(), `label="loss"`) != 1 {
+		t.Errorf("expected a single loss series, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `gopoller_check_metric{check_id="router1",label="loss"} 100`) {
+		t.Errorf("expected latest value, got:\n%s", out.String())
+	}
+}
+
+func TestStaleSeriesExpire(t *testing.T) {
+	h := NewHandler()
+	process(t, h, &check.Check{Id: "router1"}, check.NewResult(check.StateOk, "", nil))
+	process(t, h, &check.Check{Id: "router2"}, check.NewResult(check.StateOk, "", nil))
+
+	h.checks["router1"].updated = time.Now().Add(-time.Hour)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if strings.Contains(rec.Body.String(), "router1") {
+		t.Errorf("expected stale router1 to be expired, got:\n%s", rec.Body.String())
+	}
+	if !strings.Contains(rec.Body.String(), "router2") {
+		t.Errorf("expected router2 to remain, got:\n%s", rec.Body.String())
+	}
+
+	h.Remove("router2")
+	if n := h.Expire(time.Now()); n != 0 {
+		t.Errorf("expected nothing left to expire, expired %d", n)
+	}
+}
+
+func TestMetaLabelNames(t *testing.T) {
+	tests := []struct {
+		metaLabels []string
+		want       []string
+	}{
+		{[]string{"site", "host-name"}, []string{"site", "host_name"}},
+		{[]string{"check_id", "label"}, []string{"meta_check_id", "meta_label"}},
+		{[]string{"host-name", "host_name", "host.name"}, []string{"host_name", "meta_host_name", "meta_meta_host_name"}},
+		{[]string{"__name__"}, []string{"meta___name__"}},
+	}
+
+	for _, tt := range tests {
+		h := NewHandler(tt.metaLabels...)
+		if got := h.metaLabelNames(); !slices.Equal(got, tt.want) {
+			t.Errorf("%q: expected %q, got %q", tt.metaLabels, tt.want, got)
+		}
+	}
+
+	h := NewHandler("label")
+	process(t, h, &check.Check{Id: "router1", Meta: map[string]any{"label": "core"}},
+		check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "loss", Value: "0"}}))
+	var out strings.Builder
+	if err := h.Write(&out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(out.String(), `gopoller_check_metric{check_id="router1",label="loss",meta_label="core"} 0`) {
+		t.Errorf("expected the meta label to be prefixed, got:\n%s", out.String())
+	}
+}
@@ -0,0 +1,172 @@
+package rrdcached
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/internal/background"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BatchWriter coalesces update commands from any number of Handlers and sends them to rrdcached in a single BATCH,
+// once MaxBatchSize commands are pending or every FlushInterval, whichever comes first.  A BATCH that can't be sent
+// stays pending and is retried; one rrdcached responds to with errors is not, as it has been applied.  Close it on
+// shutdown to send any pending commands.
+type BatchWriter struct {
+	Pool *Pool
+
+	// FlushInterval is the most time commands are held before being sent (default 5 seconds).
+	FlushInterval time.Duration
+
+	// MaxBatchSize is the most commands sent per BATCH (default 1000).
+	MaxBatchSize int
+
+	// MaxPending is the most commands held waiting to be sent.  Commands written while it is full are dropped and
+	// counted in Dropped (default 100000).
+	MaxPending int
+
+	// OnError is called with errors sending batches, as they happen in the background rather than in Process.
+	OnError func(err error)
+
+	pending []*Cmd
+	mu      sync.Mutex
+	flusher background.Loop
+	flushMu sync.Mutex
+
+	dropped atomic.Uint64
+}
+
+func NewBatchWriter(pool *Pool) *BatchWriter {
+	return &BatchWriter{
+		Pool:          pool,
+		FlushInterval: 5 * time.Second,
+		MaxBatchSize:  1000,
+		MaxPending:    100000,
+	}
+}
+
+// Dropped returns the number of commands dropped because too many were pending.
+func (w *BatchWriter) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+// Write queues cmds to be sent in a later BATCH, returning how many were dropped because too many were pending.  It
+// returns an error once the BatchWriter is closed.
+func (w *BatchWriter) Write(cmds ...*Cmd) (int, error) {
+	if !w.flusher.Start(w.flushInterval(), w.Flush, w.OnError) {
+		return 0, errors.New("rrdcached batch writer is closed")
+	}
+
+	w.mu.Lock()
+	room := w.maxPending() - len(w.pending)
+	dropped := max(0, len(cmds)-room)
+	w.pending = append(w.pending, cmds[:len(cmds)-dropped]...)
+	full := len(w.pending) >= w.maxBatchSize()
+	w.mu.Unlock()
+
+	if dropped > 0 {
+		w.dropped.Add(uint64(dropped))
+	}
+	if full {
+		w.flusher.Kick()
+	}
+
+	return dropped, nil
+}
+
+// Flush sends every pending command now.
+func (w *BatchWriter) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	for {
+		batch := w.nextBatch()
+		if batch == nil {
+			return nil
+		}
+		if err := w.send(batch); err != nil {
+			if IsResponseError(err) {
+				w.removeBatch(len(batch))
+			}
+			return err
+		}
+		w.removeBatch(len(batch))
+	}
+}
+
+// Close stops the background flusher and sends every pending command.
+func (w *BatchWriter) Close() error {
+	w.flusher.Stop()
+	return w.Flush()
+}
+
+// nextBatch returns a copy of up to MaxBatchSize commands from the front of the pending ones, or nil if there are
+// none.  They are left pending until removeBatch, once sent.
+func (w *BatchWriter) nextBatch() []*Cmd {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.pending) == 0 {
+		return nil
+	}
+	return slices.Clone(w.pending[:min(len(w.pending), w.maxBatchSize())])
+}
+
+// removeBatch removes the n commands of a batch from the front of the pending ones.
+func (w *BatchWriter) removeBatch(n int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.pending = w.pending[n:]
+}
+
+func (w *BatchWriter) send(batch []*Cmd) error {
+	err := w.Pool.Do(func(client Client) error {
+		return client.Batch(batch...)
+	})
+	if err != nil {
+		forgetRejectedFiles(w.Pool, batch, err)
+		return fmt.Errorf("error batch-updating %d rrd files: %w", len(batch), err)
+	}
+	return nil
+}
+
+func (w *BatchWriter) flushInterval() time.Duration {
+	if w.FlushInterval <= 0 {
+		return 5 * time.Second
+	}
+	return w.FlushInterval
+}
+
+func (w *BatchWriter) maxBatchSize() int {
+	if w.MaxBatchSize <= 0 {
+		return 1000
+	}
+	return w.MaxBatchSize
+}
+
+func (w *BatchWriter) maxPending() int {
+	if w.MaxPending <= 0 {
+		return 100000
+	}
+	return w.MaxPending
+}
+
+// forgetRejectedFiles removes the files of the cmds rrdcached rejected in a BATCH from pool's existence cache, as
+// they may have been removed out from under us.  Files aren't forgotten on other errors, such as rrdcached being
+// unreachable, so that they aren't all checked again once it's back.
+func forgetRejectedFiles(pool *Pool, cmds []*Cmd, err error) {
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) {
+		return
+	}
+	for i := range batchErr.Failed {
+		if args := cmds[i].GetArgs(); len(args) > 0 {
+			if filename, ok := args[0].(string); ok {
+				pool.forgetFile(filename)
+			}
+		}
+	}
+}
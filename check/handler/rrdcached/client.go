@@ -17,7 +17,16 @@ type Client interface {
 	ExecCmd(*Cmd) ([]string, error)
 	Batch(...*Cmd) error
 	Last(filename string) (time.Time, error)
+	Info(filename string) ([]Info, error)
 	Create(filename string, ds []DS, rra []RRA, step time.Duration) error
+	// First returns the time of the first data point of the rra'th RRA of a file
+	First(filename string, rra int) (time.Time, error)
+	// Flush writes the updates of a file cached by rrdcached to disk
+	Flush(filename string) error
+	// Fetch reads consolidated data from a file using the text FETCH command
+	Fetch(filename string, cf string, opts FetchOptions) (*FetchResult, error)
+	// FetchBin reads consolidated data from a file using the binary FETCHBIN command
+	FetchBin(filename string, cf string, opts FetchOptions) (*FetchResult, error)
 }
 
 var DefaultClientDialer = new(GoRrdDialer)
@@ -126,6 +135,18 @@ func (v DS) DST() DST {
 	return v.dst
 }
 
+func (v DS) Heartbeat() int {
+	return v.heartbeat
+}
+
+func (v DS) Min() string {
+	return v.min
+}
+
+func (v DS) Max() string {
+	return v.max
+}
+
 const (
 	Average = "AVERAGE"
 	Min     = "MIN"
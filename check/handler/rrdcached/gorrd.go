@@ -1,7 +1,12 @@
 package rrdcached
 
 import (
+	"errors"
 	"github.com/multiplay/go-rrd"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -51,13 +56,25 @@ func (c *GoRrdClient) Batch(cmds ...*Cmd) error {
 	for i, cmd := range cmds {
 		convertedCmds[i] = c.convertCmd(cmd)
 	}
-	return c.Client.Batch(convertedCmds...)
+	return newBatchError(c.Client.Batch(convertedCmds...), len(cmds))
 }
 
 func (c *GoRrdClient) Last(filename string) (time.Time, error) {
 	return c.Client.Last(filename)
 }
 
+func (c *GoRrdClient) Info(filename string) ([]Info, error) {
+	infos, err := c.Client.Info(filename)
+	if err != nil {
+		return nil, err
+	}
+	converted := make([]Info, len(infos))
+	for i, v := range infos {
+		converted[i] = Info{Key: v.Key, Value: v.Value}
+	}
+	return converted, nil
+}
+
 func (c *GoRrdClient) Create(filename string, ds []DS, rra []RRA, step time.Duration) error {
 	convertedDS := make([]rrd.DS, len(ds))
 	for i, v := range ds {
@@ -70,6 +87,30 @@ func (c *GoRrdClient) Create(filename string, ds []DS, rra []RRA, step time.Dura
 	return c.Client.Create(filename, convertedDS, convertedRRA, rrd.Step(step))
 }
 
+func (c *GoRrdClient) First(filename string, rra int) (time.Time, error) {
+	return c.Client.First(filename, rra)
+}
+
+func (c *GoRrdClient) Flush(filename string) error {
+	return c.Client.Flush(filename)
+}
+
+func (c *GoRrdClient) Fetch(filename string, cf string, opts FetchOptions) (*FetchResult, error) {
+	fetch, err := c.Client.Fetch(filename, cf, opts.args()...)
+	if err != nil {
+		return nil, err
+	}
+	return c.convertFetch(fetch), nil
+}
+
+func (c *GoRrdClient) FetchBin(filename string, cf string, opts FetchOptions) (*FetchResult, error) {
+	fetch, err := c.Client.FetchBin(filename, cf, opts.args()...)
+	if err != nil {
+		return nil, err
+	}
+	return c.convertFetchBin(fetch), nil
+}
+
 // convertCmd takes a Cmd from this package and converts it to a go-rrd rrd.Cmd
 func (c *GoRrdClient) convertCmd(cmd *Cmd) *rrd.Cmd {
 	return rrd.NewCmd(cmd.GetCmd()).WithArgs(cmd.GetArgs()...)
@@ -84,3 +125,111 @@ func (c *GoRrdClient) convertDS(ds DS) rrd.DS {
 func (c *GoRrdClient) convertRRA(rra RRA) rrd.RRA {
 	return rrd.NewRRA(rra.String())
 }
+
+// IsResponseError returns true if err is an error response from rrdcached, after which the connection it was
+// received on is still usable.
+func IsResponseError(err error) bool {
+	var rrdErr *rrd.Error
+	return errors.As(err, &rrdErr)
+}
+
+// BatchError is the error response to a BATCH in which rrdcached rejected some of the commands.  It is a response
+// error (see IsResponseError).
+type BatchError struct {
+	// Failed maps the index of each rejected command in the BATCH to rrdcached's error message.
+	Failed map[int]string
+
+	err error
+}
+
+func (e *BatchError) Error() string {
+	return e.err.Error()
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.err
+}
+
+// batchErrorLineRe matches a line of a BATCH error response: the 1-based number of the rejected command and why.
+var batchErrorLineRe = regexp.MustCompile(`^(\d+) (.*)$`)
+
+// newBatchError returns err as a *BatchError when it is rrdcached rejecting commands of a BATCH of n commands, or
+// err unchanged otherwise.
+func newBatchError(err error, n int) error {
+	var rrdErr *rrd.Error
+	if !errors.As(err, &rrdErr) {
+		return err
+	}
+
+	failed := make(map[int]string)
+	for _, line := range strings.Split(rrdErr.Msg, "\n") {
+		m := batchErrorLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if i, err := strconv.Atoi(m[1]); err == nil && i >= 1 && i <= n {
+			failed[i-1] = m[2]
+		}
+	}
+	if len(failed) == 0 {
+		return err
+	}
+	return &BatchError{Failed: failed, err: err}
+}
+
+// convertFetch takes a go-rrd rrd.Fetch and converts it to a FetchResult
+func (c *GoRrdClient) convertFetch(fetch *rrd.Fetch) *FetchResult {
+	result := &FetchResult{
+		Start:       fetch.Start,
+		End:         fetch.End,
+		Step:        fetch.Step,
+		DataSources: fetch.Names,
+		Rows:        make([]FetchRow, len(fetch.Rows)),
+	}
+	for i, row := range fetch.Rows {
+		values := make([]float64, len(row.Data))
+		for j, v := range row.Data {
+			if v == nil {
+				values[j] = math.NaN()
+			} else {
+				values[j] = *v
+			}
+		}
+		result.Rows[i] = FetchRow{Time: row.Time, Values: values}
+	}
+	return result
+}
+
+// convertFetchBin takes a go-rrd rrd.FetchBin and converts it to a FetchResult.  FETCHBIN gives the values of each
+// data source without times, which are every Step after Start.
+func (c *GoRrdClient) convertFetchBin(fetch *rrd.FetchBin) *FetchResult {
+	result := &FetchResult{
+		Start: fetch.Start,
+		End:   fetch.End,
+		Step:  fetch.Step,
+	}
+
+	var records int
+	for _, ds := range fetch.DS {
+		result.DataSources = append(result.DataSources, ds.Name)
+		records = max(records, len(ds.Data))
+	}
+
+	result.Rows = make([]FetchRow, records)
+	for i := range result.Rows {
+		values := make([]float64, len(fetch.DS))
+		for j, ds := range fetch.DS {
+			values[j] = math.NaN()
+			if i < len(ds.Data) {
+				switch v := ds.Data[i].(type) {
+				case float64:
+					values[j] = v
+				case float32:
+					values[j] = float64(v)
+				}
+			}
+		}
+		result.Rows[i] = FetchRow{Time: fetch.Start.Add(time.Duration(i+1) * fetch.Step), Values: values}
+	}
+	return result
+}
@@ -3,7 +3,9 @@ package rrdcached
 import (
 	"fmt"
 	"github.com/seankndy/gopoller/check"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -15,7 +17,21 @@ type Handler struct {
 	// it's Result data.
 	GetRrdFileDefs func(*check.Check, *check.Result) []RrdFileDef
 
+	// Pool is the pool of connections to rrdcached used.  When nil, a Pool shared by every Handler for the same Addr
+	// is used (or one of the Handler's own, if SetClientDialer was called).
+	Pool *Pool
+
+	// BatchWriter, when set, queues update commands to be sent in a BATCH along with those of other Checks rather
+	// than sending them before Process returns.
+	BatchWriter *BatchWriter
+
+	// SchemaPolicy is what to do when the data sources of an existing file don't match its RrdFileDef (default
+	// SchemaIgnore).  Checking uses INFO rather than LAST when the file's existence isn't cached.
+	SchemaPolicy SchemaPolicy
+
 	clientDialer ClientDialer
+	ownPool      *Pool
+	mu           sync.Mutex
 }
 
 func NewHandler(addr string, getRrdFileDefs func(*check.Check, *check.Result) []RrdFileDef) *Handler {
@@ -27,7 +43,11 @@ func NewHandler(addr string, getRrdFileDefs func(*check.Check, *check.Result) []
 }
 
 func (h *Handler) SetClientDialer(dialer ClientDialer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	h.clientDialer = dialer
+	h.ownPool = nil
 }
 
 func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
@@ -46,59 +66,173 @@ func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incid
 		return
 	}
 
-	// connect to RRDCacheD
-	client, err := h.clientDialer.Dial(h.Addr)
+	pool := h.pool()
+
+	// create rrd files that don't exist
+	if rrdFileDefs, err = h.prepareFiles(chk, pool, rrdFileDefs); err != nil {
+		return err
+	}
+
+	// update rrd files
+	updateCmds := buildUpdateCommands(rrdFileDefs, result)
+	if updateCmds == nil {
+		return
+	}
+
+	if h.BatchWriter != nil {
+		var dropped int
+		dropped, err = h.BatchWriter.Write(updateCmds...)
+		if dropped > 0 {
+			chk.Debugf("too many pending rrdcached updates, dropped %d", dropped)
+		}
+		return err
+	}
+
+	cmdStrings := make([]string, len(updateCmds))
+	for i, uc := range updateCmds {
+		cmdStrings[i] = strings.TrimSpace(uc.String())
+	}
+	chk.Debugf("sending BATCH update: %s", strings.Join(cmdStrings, ", "))
+
+	err = pool.Do(func(client Client) error {
+		return client.Batch(updateCmds...)
+	})
 	if err != nil {
-		return fmt.Errorf("error connecting to rrdcached: %v", err)
+		forgetRejectedFiles(pool, updateCmds, err)
+		return fmt.Errorf("error batch-updating rrd files: %v", err)
 	}
-	defer func() {
-		errC := client.Close()
-		if errC != nil && err == nil {
-			err = fmt.Errorf("error closing connection to rrdcached: %v", errC)
+
+	return
+}
+
+// pool returns the Pool the Handler uses.
+func (h *Handler) pool() *Pool {
+	if h.Pool != nil {
+		return h.Pool
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.clientDialer == nil || h.clientDialer == DefaultClientDialer {
+		return sharedPool(h.Addr)
+	}
+	if h.ownPool == nil {
+		h.ownPool = NewPool(h.Addr, h.clientDialer)
+	}
+	return h.ownPool
+}
+
+// prepareFiles makes sure the rrd files of rrdFileDefs exist, creating those that don't and handling changed data
+// sources according to SchemaPolicy.  It returns a copy of rrdFileDefs with each Filename being the file to update.
+// Files known to exist from pool's existence cache aren't checked again, so rrdcached isn't contacted at all when
+// every file is known.
+func (h *Handler) prepareFiles(chk *check.Check, pool *Pool, rrdFileDefs []RrdFileDef) ([]RrdFileDef, error) {
+	prepared := make([]RrdFileDef, len(rrdFileDefs))
+	copy(prepared, rrdFileDefs)
+
+	var unknown []int
+	for i, rrdFile := range prepared {
+		if filename, ok := pool.knownFile(h.cacheKey(rrdFile)); ok {
+			prepared[i].Filename = filename
+		} else {
+			unknown = append(unknown, i)
 		}
+	}
+	if len(unknown) == 0 {
+		return prepared, nil
+	}
+
+	client, err := pool.Get()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to rrdcached: %v", err)
+	}
+	defer func() {
+		pool.Put(client, err)
 	}()
 
-	rrdFileExists := func(file string) (bool, error) {
-		_, err = client.Last(file)
-		if err != nil {
-			if strings.Contains(err.Error(), "No such file") {
-				return false, nil
-			}
-			return false, err
+	for _, i := range unknown {
+		key := h.cacheKey(prepared[i])
+		if prepared[i].Filename, err = h.prepareFile(chk, client, prepared[i]); err != nil {
+			return nil, err
 		}
-		return true, nil
+		pool.rememberFile(key, prepared[i].Filename)
 	}
+	return prepared, nil
+}
 
-	// create rrd files that don't exist
-	for _, rrdFile := range rrdFileDefs {
-		var exists bool
-		if exists, err = rrdFileExists(rrdFile.Filename); err != nil {
-			return fmt.Errorf("error checking if rrd file exists: %v", err)
-		} else if !exists {
-			chk.Debugf("rrd file %s does not exist, attempting to create it", rrdFile.Filename)
-			if err = client.Create(rrdFile.Filename, rrdFile.DataSources, rrdFile.RoundRobinArchives, rrdFile.Step); err != nil {
-				return fmt.Errorf("error creating rrd file: %v", err)
-			}
-		} else {
-			chk.Debugf("rrd file %s exists", rrdFile.Filename)
-		}
+// prepareFile makes sure the file of rrdFile exists, returning the file to update.
+func (h *Handler) prepareFile(chk *check.Check, client Client, rrdFile RrdFileDef) (string, error) {
+	if h.SchemaPolicy == SchemaIgnore {
+		return rrdFile.Filename, createFileIfNotExists(chk, client, rrdFile)
 	}
 
-	// update rrd files
-	if updateCmds := buildUpdateCommands(rrdFileDefs, result); updateCmds != nil {
-		cmdStrings := make([]string, len(updateCmds))
-		for i, uc := range updateCmds {
-			cmdStrings[i] = strings.TrimSpace(uc.String())
+	infos, err := client.Info(rrdFile.Filename)
+	if err != nil {
+		if isNotExist(err) {
+			return rrdFile.Filename, createFile(chk, client, rrdFile)
 		}
-		chk.Debugf("sending BATCH update: %s", strings.Join(cmdStrings, ", "))
+		return "", fmt.Errorf("error checking if rrd file exists: %v", err)
+	}
+	if sameDataSources(DataSourcesFromInfo(infos), rrdFile.DataSources) {
+		chk.Debugf("rrd file %s exists", rrdFile.Filename)
+		return rrdFile.Filename, nil
+	}
 
-		err = client.Batch(updateCmds...)
-		if err != nil {
-			return fmt.Errorf("error batch-updating rrd files: %v", err)
+	switch h.SchemaPolicy {
+	case SchemaNewFile:
+		newFile := rrdFile
+		newFile.Filename = schemaFilename(rrdFile.Filename, rrdFile.DataSources)
+		chk.Debugf("rrd file %s data sources changed, using %s", rrdFile.Filename, newFile.Filename)
+		return newFile.Filename, createFileIfNotExists(chk, client, newFile)
+	case SchemaTune:
+		chk.Debugf("rrd file %s data sources changed, re-creating it", rrdFile.Filename)
+		args := []any{rrdFile.Filename, fmt.Sprintf("-s %d", int64(rrdFile.Step/time.Second)), "-r " + rrdFile.Filename}
+		for _, ds := range rrdFile.DataSources {
+			args = append(args, ds.String())
+		}
+		for _, rra := range rrdFile.RoundRobinArchives {
+			args = append(args, rra.String())
+		}
+		if _, err = client.ExecCmd(NewCmd("create").WithArgs(args...)); err != nil {
+			return "", fmt.Errorf("error re-creating rrd file %s with new data sources: %v", rrdFile.Filename, err)
 		}
+		return rrdFile.Filename, nil
+	default:
+		return "", fmt.Errorf("rrd file %s data sources don't match its definition", rrdFile.Filename)
 	}
+}
 
-	return
+// cacheKey returns the key of rrdFile in the Pool's existence cache.  When data sources are checked, the key includes
+// them so that changing a RrdFileDef's data sources has it checked again.
+func (h *Handler) cacheKey(rrdFile RrdFileDef) string {
+	if h.SchemaPolicy == SchemaIgnore {
+		return rrdFile.Filename
+	}
+	return rrdFile.Filename + "\x00" + schemaHash(rrdFile.DataSources)
+}
+
+func createFileIfNotExists(chk *check.Check, client Client, rrdFile RrdFileDef) error {
+	if _, err := client.Last(rrdFile.Filename); err == nil {
+		chk.Debugf("rrd file %s exists", rrdFile.Filename)
+		return nil
+	} else if !isNotExist(err) {
+		return fmt.Errorf("error checking if rrd file exists: %v", err)
+	}
+	return createFile(chk, client, rrdFile)
+}
+
+func createFile(chk *check.Check, client Client, rrdFile RrdFileDef) error {
+	chk.Debugf("rrd file %s does not exist, attempting to create it", rrdFile.Filename)
+	if err := client.Create(rrdFile.Filename, rrdFile.DataSources, rrdFile.RoundRobinArchives, rrdFile.Step); err != nil {
+		return fmt.Errorf("error creating rrd file: %v", err)
+	}
+	return nil
+}
+
+// isNotExist returns true if err is rrdcached reporting that a file doesn't exist.
+func isNotExist(err error) bool {
+	return strings.Contains(err.Error(), "No such file")
 }
 
 // RrdFileDef defines a rrd file and it's characteristics
@@ -111,38 +245,54 @@ type RrdFileDef struct {
 	// Optional metric label to data source name mapping.  By default, metric labels will map to DS names identically.
 	// Use this if your metric name from the check command is different from your DS name.
 	DataSourceToMetricMappings map[string]string
+
+	// Optional names of the data sources to update, like the --template option of rrdtool update.  Data sources not
+	// named are updated with U (unknown).  rrdcached doesn't accept templates itself, so updates still give a value
+	// for every data source, in file order.
+	Template []string
 }
 
 func buildUpdateCommands(rrdFileDefs []RrdFileDef, result *check.Result) []*Cmd {
 	var updateCmds []*Cmd
 	for _, rrdFile := range rrdFileDefs {
-		var dsValues []string
+		updateCmds = append(updateCmds, NewCmd("update").WithArgs(
+			rrdFile.Filename,
+			fmt.Sprintf("%d:%s", result.Time.Unix(), strings.Join(UpdateValues(rrdFile, result), ":")),
+		))
+	}
+	return updateCmds
+}
 
-		for _, ds := range rrdFile.DataSources {
-			metricLabel := ds.Name()
+// UpdateValues returns the values of result's metrics to update rrdFile with, one per data source in order.
+func UpdateValues(rrdFile RrdFileDef, result *check.Result) []string {
+	dsValues := make([]string, len(rrdFile.DataSources))
 
-			if rrdFile.DataSourceToMetricMappings != nil {
-				if v, ok := rrdFile.DataSourceToMetricMappings[ds.Name()]; ok {
-					metricLabel = v
-				}
+	for i, ds := range rrdFile.DataSources {
+		// data sources with no metric or left out of the template are unknown rather than skipped, which would
+		// shift the values of the following data sources
+		dsValues[i] = "U"
+
+		if rrdFile.Template != nil && !slices.Contains(rrdFile.Template, ds.Name()) {
+			continue
+		}
+
+		metricLabel := ds.Name()
+
+		if rrdFile.DataSourceToMetricMappings != nil {
+			if v, ok := rrdFile.DataSourceToMetricMappings[ds.Name()]; ok {
+				metricLabel = v
 			}
+		}
 
-			var metric *check.ResultMetric
-			for _, m := range result.Metrics {
-				if m.Label == metricLabel {
-					metric = &m
-					break
+		for _, m := range result.Metrics {
+			if m.Label == metricLabel {
+				if m.Value != "" {
+					dsValues[i] = m.Value
 				}
-			}
-			if metric != nil {
-				dsValues = append(dsValues, metric.Value)
+				break
 			}
 		}
-
-		updateCmds = append(updateCmds, NewCmd("update").WithArgs(
-			rrdFile.Filename,
-			fmt.Sprintf("%d:%s", result.Time.Unix(), strings.Join(dsValues, ":")),
-		))
 	}
-	return updateCmds
+
+	return dsValues
 }
@@ -1,14 +1,19 @@
 package rrdcached
 
 import (
+	"errors"
 	"fmt"
+	"github.com/multiplay/go-rrd"
 	"github.com/seankndy/gopoller/check"
+	"math"
 	"reflect"
 	"testing"
 	"time"
 )
 
 var lastMock func(file string) (time.Time, error)
+var infoMock func(file string) ([]Info, error)
+var fetchMock func(file string, cf string, opts FetchOptions) (*FetchResult, error)
 
 func TestDoesNotConnectToRrdCacheDWhenGetRrdFileDefsNil(t *testing.T) {
 	mockRrdClient := &MockRrdClient{}
@@ -169,6 +174,310 @@ func TestIssuesCorrectBatchUpdateCommands(t *testing.T) {
 	}
 }
 
+func TestOnlyChecksRrdFilesExistOnce(t *testing.T) {
+	mockRrdClient := &MockRrdClient{}
+	mockRrdClientDialer := &MockRrdClientDialer{Client: mockRrdClient}
+	h := NewHandler("", func(*check.Check, *check.Result) []RrdFileDef {
+		return []RrdFileDef{
+			{Filename: "/foo1.rrd", DataSources: []DS{NewGaugeDS("metric1", 600, "U", "U")}},
+			{Filename: "/foo2.rrd", DataSources: []DS{NewGaugeDS("metric1", 600, "U", "U")}},
+		}
+	})
+	h.SetClientDialer(mockRrdClientDialer)
+
+	chk := &check.Check{}
+	result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "metric1", Value: "1"}})
+
+	for i := 0; i < 3; i++ {
+		if err := h.Process(chk, result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if mockRrdClient.LastCalled != 2 {
+		t.Errorf("expected LAST once per file, got %d calls", mockRrdClient.LastCalled)
+	}
+	if mockRrdClient.BatchCalled != 3 {
+		t.Errorf("expected a BATCH per Process, got %d", mockRrdClient.BatchCalled)
+	}
+	if mockRrdClientDialer.DialCalled != 1 {
+		t.Errorf("expected the connection to be reused, dialed %d times", mockRrdClientDialer.DialCalled)
+	}
+}
+
+func TestOnlyRejectedFilesAreCheckedAgain(t *testing.T) {
+	mockRrdClient := &MockRrdClient{}
+	h := NewHandler("", func(*check.Check, *check.Result) []RrdFileDef {
+		return []RrdFileDef{
+			{Filename: "/foo1.rrd", DataSources: []DS{NewGaugeDS("metric1", 600, "U", "U")}},
+			{Filename: "/foo2.rrd", DataSources: []DS{NewGaugeDS("metric1", 600, "U", "U")}},
+		}
+	})
+	h.SetClientDialer(&MockRrdClientDialer{Client: mockRrdClient})
+
+	chk := &check.Check{}
+	result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "metric1", Value: "1"}})
+
+	tests := []struct {
+		name     string
+		batchErr error
+		wantLast int
+	}{
+		{"files checked once", nil, 2},
+		{"connection errors keep the cache", errors.New("broken pipe"), 2},
+		{"rejected files are checked again", newBatchError(rrd.NewError(-1, "2 No such file: /foo2.rrd"), 2), 3},
+	}
+
+	for _, tt := range tests {
+		mockRrdClient.BatchErr = tt.batchErr
+		if err := h.Process(chk, result, nil); (err != nil) != (tt.batchErr != nil) {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		mockRrdClient.BatchErr = nil
+		if err := h.Process(chk, result, nil); err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if mockRrdClient.LastCalled != tt.wantLast {
+			t.Errorf("%s: expected %d LAST calls, got %d", tt.name, tt.wantLast, mockRrdClient.LastCalled)
+		}
+	}
+}
+
+func TestNewBatchError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantFailed map[int]string
+	}{
+		{"connection error", errors.New("broken pipe"), nil},
+		{"error response to BATCH", rrd.NewError(-1, "Unknown command"), nil},
+		{"rejected commands", rrd.NewError(-2, "1 No such file: /a.rrd\n3 illegal attempt to update using time 1"),
+			map[int]string{0: "No such file: /a.rrd", 2: "illegal attempt to update using time 1"}},
+		{"out of range command", rrd.NewError(-1, "4 No such file: /d.rrd"), nil},
+	}
+
+	for _, tt := range tests {
+		err := newBatchError(tt.err, 3)
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			if tt.wantFailed != nil {
+				t.Errorf("%s: expected a BatchError, got %v", tt.name, err)
+			} else if err != tt.err {
+				t.Errorf("%s: expected the error unchanged, got %v", tt.name, err)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(batchErr.Failed, tt.wantFailed) {
+			t.Errorf("%s: expected failed commands %v, got %v", tt.name, tt.wantFailed, batchErr.Failed)
+		}
+		if !IsResponseError(err) {
+			t.Errorf("%s: expected a response error", tt.name)
+		}
+	}
+}
+
+func TestBatchWriterCoalescesUpdates(t *testing.T) {
+	mockRrdClient := &MockRrdClient{}
+	pool := NewPool("", &MockRrdClientDialer{Client: mockRrdClient})
+	writer := NewBatchWriter(pool)
+	writer.FlushInterval = time.Hour
+
+	h := NewHandler("", func(chk *check.Check, _ *check.Result) []RrdFileDef {
+		return []RrdFileDef{
+			{Filename: "/" + chk.Id + ".rrd", DataSources: []DS{NewGaugeDS("metric1", 600, "U", "U")}},
+		}
+	})
+	h.Pool = pool
+	h.BatchWriter = writer
+
+	result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "metric1", Value: "1"}})
+	for _, id := range []string{"a", "b", "c"} {
+		if err := h.Process(&check.Check{Id: id}, result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if mockRrdClient.BatchCalled != 0 {
+		t.Fatalf("expected updates to be held until flushed")
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mockRrdClient.BatchCalled != 1 || len(mockRrdClient.BatchCmds[0]) != 3 {
+		t.Errorf("expected 3 updates in 1 BATCH, got %d batches: %v", mockRrdClient.BatchCalled, mockRrdClient.BatchCmds)
+	}
+}
+
+func TestBatchWriterRetriesUnsentBatches(t *testing.T) {
+	mockRrdClient := &MockRrdClient{BatchErr: errors.New("broken pipe")}
+	writer := NewBatchWriter(NewPool("", &MockRrdClientDialer{Client: mockRrdClient}))
+	writer.FlushInterval = time.Hour
+
+	if _, err := writer.Write(NewCmd("update").WithArgs("/a.rrd", "1:1")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := writer.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// a response error means rrdcached applied the BATCH, so it isn't sent again
+	mockRrdClient.BatchErr = rrd.NewError(-1, "illegal attempt to update using time 1")
+	if err := writer.Flush(); err == nil {
+		t.Fatal("expected an error")
+	}
+	mockRrdClient.BatchErr = nil
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if mockRrdClient.BatchCalled != 2 {
+		t.Errorf("expected the BATCH to be sent twice, got %d", mockRrdClient.BatchCalled)
+	}
+
+	if _, err := writer.Write(NewCmd("update").WithArgs("/a.rrd", "2:1")); err == nil {
+		t.Error("expected an error writing after Close")
+	}
+}
+
+func TestPoolDiscardsBrokenConnections(t *testing.T) {
+	dialer := &MockRrdClientDialer{Client: &MockRrdClient{}}
+	pool := NewPool("", dialer)
+
+	_ = pool.Do(func(Client) error { return nil })
+	_ = pool.Do(func(Client) error { return rrd.NewError(-1, "No such file: /foo.rrd") })
+	if dialer.DialCalled != 1 {
+		t.Errorf("expected connection to be reused after a response error, dialed %d times", dialer.DialCalled)
+	}
+
+	_ = pool.Do(func(Client) error { return errors.New("broken pipe") })
+	_ = pool.Do(func(Client) error { return nil })
+	if dialer.DialCalled != 2 {
+		t.Errorf("expected a new connection after a network error, dialed %d times", dialer.DialCalled)
+	}
+}
+
+func TestUpdatesMissingMetricsAsUnknown(t *testing.T) {
+	tm := time.Unix(556549200, 0)
+	result := &check.Result{
+		Metrics: []check.ResultMetric{
+			{Label: "metric2", Value: "2"},
+			{Label: "metric3", Value: "3"},
+		},
+		Time: tm,
+	}
+	dataSources := []DS{
+		NewGaugeDS("metric1", 600, "U", "U"),
+		NewGaugeDS("metric2", 600, "U", "U"),
+		NewGaugeDS("metric3", 600, "U", "U"),
+	}
+
+	tests := []struct {
+		name     string
+		template []string
+		want     string
+	}{
+		{"missing metric", nil, "update /foo.rrd 556549200:U:2:3\n"},
+		{"template", []string{"metric3"}, "update /foo.rrd 556549200:U:U:3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmds := buildUpdateCommands([]RrdFileDef{
+				{Filename: "/foo.rrd", DataSources: dataSources, Template: tt.template},
+			}, result)
+			if got := cmds[0].String(); got != tt.want {
+				t.Errorf("wanted %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSchemaPolicies(t *testing.T) {
+	rrdFileDef := RrdFileDef{
+		Filename: "/foo.rrd",
+		DataSources: []DS{
+			NewCounterDS("metric1", 600, "0", "U"),
+			NewGaugeDS("metric2", 600, "U", "U"),
+		},
+		Step: 300 * time.Second,
+	}
+	// the existing file only has metric1
+	infoMock = func(file string) ([]Info, error) {
+		if file != "/foo.rrd" {
+			return nil, fmt.Errorf("No such file: %s", file)
+		}
+		return []Info{
+			{Key: "filename", Value: "/foo.rrd"},
+			{Key: "ds[metric1].index", Value: int64(0)},
+			{Key: "ds[metric1].type", Value: "COUNTER"},
+			{Key: "ds[metric1].minimal_heartbeat", Value: int64(600)},
+			{Key: "ds[metric1].min", Value: 0.0},
+			{Key: "ds[metric1].max", Value: math.NaN()},
+		}, nil
+	}
+	lastMock = func(file string) (time.Time, error) {
+		return time.Time{}, fmt.Errorf("No such file: %s", file)
+	}
+	defer func() {
+		infoMock, lastMock = nil, nil
+	}()
+
+	process := func(policy SchemaPolicy) (*MockRrdClient, error) {
+		mockRrdClient := &MockRrdClient{}
+		h := NewHandler("", func(*check.Check, *check.Result) []RrdFileDef {
+			return []RrdFileDef{rrdFileDef}
+		})
+		h.SetClientDialer(&MockRrdClientDialer{Client: mockRrdClient})
+		h.SchemaPolicy = policy
+		return mockRrdClient, h.Process(&check.Check{}, check.NewResult(check.StateOk, "", nil), nil)
+	}
+
+	if _, err := process(SchemaError); err == nil {
+		t.Errorf("SchemaError: expected an error")
+	}
+
+	mockRrdClient, err := process(SchemaNewFile)
+	if err != nil {
+		t.Fatalf("SchemaNewFile: unexpected error: %v", err)
+	}
+	newFile := schemaFilename("/foo.rrd", rrdFileDef.DataSources)
+	if !reflect.DeepEqual(mockRrdClient.CreateFilenames, []string{newFile}) {
+		t.Errorf("SchemaNewFile: expected %s to be created, got %v", newFile, mockRrdClient.CreateFilenames)
+	}
+	if got := mockRrdClient.BatchCmds[0][0].GetArgs()[0]; got != newFile {
+		t.Errorf("SchemaNewFile: expected %s to be updated, got %v", newFile, got)
+	}
+
+	mockRrdClient, err = process(SchemaTune)
+	if err != nil {
+		t.Fatalf("SchemaTune: unexpected error: %v", err)
+	}
+	want := "create /foo.rrd -s 300 -r /foo.rrd DS:metric1:COUNTER:600:0:U DS:metric2:GAUGE:600:U:U\n"
+	if len(mockRrdClient.ExecCmds) != 1 || mockRrdClient.ExecCmds[0].String() != want {
+		t.Errorf("SchemaTune: expected %q, got %v", want, mockRrdClient.ExecCmds)
+	}
+}
+
+func TestDataSourcesFromInfoMatches(t *testing.T) {
+	infos := []Info{
+		{Key: "ds[b].index", Value: int64(1)},
+		{Key: "ds[b].type", Value: "GAUGE"},
+		{Key: "ds[b].minimal_heartbeat", Value: int64(600)},
+		{Key: "ds[b].min", Value: math.NaN()},
+		{Key: "ds[b].max", Value: 100.0},
+		{Key: "ds[a].index", Value: int64(0)},
+		{Key: "ds[a].type", Value: "DERIVE"},
+		{Key: "ds[a].minimal_heartbeat", Value: int64(120)},
+		{Key: "ds[a].min", Value: 0.0},
+		{Key: "ds[a].max", Value: math.NaN()},
+	}
+	want := []DS{
+		NewDeriveDS("a", 120, "0", "U"),
+		NewGaugeDS("b", 600, "U", "100"),
+	}
+	if got := DataSourcesFromInfo(infos); !sameDataSources(got, want) {
+		t.Errorf("wanted %v, got %v", want, got)
+	}
+}
+
 type MockRrdClientDialer struct {
 	Client     Client
 	DialCalled int
@@ -181,10 +490,14 @@ func (d *MockRrdClientDialer) Dial(string) (Client, error) {
 
 type MockRrdClient struct {
 	CloseCalled     int
+	LastCalled      int
 	CreateCalled    int
 	CreateFilenames []string
 	BatchCalled     int
 	BatchCmds       map[int][]*Cmd
+	BatchErr        error
+	ExecCmds        []*Cmd
+	FlushFilenames  []string
 }
 
 func (m *MockRrdClient) Close() error {
@@ -193,6 +506,7 @@ func (m *MockRrdClient) Close() error {
 }
 
 func (m *MockRrdClient) ExecCmd(cmd *Cmd) ([]string, error) {
+	m.ExecCmds = append(m.ExecCmds, cmd)
 	return []string{}, nil
 }
 
@@ -203,10 +517,12 @@ func (m *MockRrdClient) Batch(cmd ...*Cmd) error {
 	m.BatchCmds[m.BatchCalled] = cmd
 	m.BatchCalled++
 
-	return nil
+	return m.BatchErr
 }
 
 func (m *MockRrdClient) Last(filename string) (time.Time, error) {
+	m.LastCalled++
+
 	if lastMock != nil {
 		return lastMock(filename)
 	}
@@ -215,6 +531,13 @@ func (m *MockRrdClient) Last(filename string) (time.Time, error) {
 	return t, nil
 }
 
+func (m *MockRrdClient) Info(filename string) ([]Info, error) {
+	if infoMock != nil {
+		return infoMock(filename)
+	}
+	return nil, nil
+}
+
 func (m *MockRrdClient) Create(filename string, ds []DS, rra []RRA, step time.Duration) error {
 	m.CreateCalled++
 
@@ -222,3 +545,23 @@ func (m *MockRrdClient) Create(filename string, ds []DS, rra []RRA, step time.Du
 
 	return nil
 }
+
+func (m *MockRrdClient) First(filename string, rra int) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (m *MockRrdClient) Flush(filename string) error {
+	m.FlushFilenames = append(m.FlushFilenames, filename)
+	return nil
+}
+
+func (m *MockRrdClient) Fetch(filename string, cf string, opts FetchOptions) (*FetchResult, error) {
+	return m.FetchBin(filename, cf, opts)
+}
+
+func (m *MockRrdClient) FetchBin(filename string, cf string, opts FetchOptions) (*FetchResult, error) {
+	if fetchMock != nil {
+		return fetchMock(filename, cf, opts)
+	}
+	return &FetchResult{}, nil
+}
@@ -0,0 +1,182 @@
+package rrdcached
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Pool is a pool of connections (Clients) to a rrdcached server that are reused across Process calls and shared by
+// Handlers, along with a cache of the RRD files known to exist on the server.  A Pool is safe for concurrent use.
+type Pool struct {
+	Addr   string
+	Dialer ClientDialer
+
+	// MaxIdle is the most idle connections kept open for reuse (default 4).
+	MaxIdle int
+
+	// ExistsCacheTTL is how long a file is remembered to exist before LAST is used to check it again (default 1
+	// hour).  Files are also forgotten when rrdcached rejects an update to them.
+	ExistsCacheTTL time.Duration
+
+	idle   []Client
+	exists map[string]knownFile
+	// keys maps the filename of each exists entry back to its key
+	keys   map[string]string
+	closed bool
+	mu     sync.Mutex
+}
+
+func NewPool(addr string, dialer ClientDialer) *Pool {
+	return &Pool{
+		Addr:           addr,
+		Dialer:         dialer,
+		MaxIdle:        4,
+		ExistsCacheTTL: time.Hour,
+	}
+}
+
+var (
+	sharedPools   = make(map[string]*Pool)
+	sharedPoolsMu sync.Mutex
+)
+
+// sharedPool returns the Pool shared by every Handler using the DefaultClientDialer for the rrdcached at addr.
+func sharedPool(addr string) *Pool {
+	sharedPoolsMu.Lock()
+	defer sharedPoolsMu.Unlock()
+
+	p, ok := sharedPools[addr]
+	if !ok {
+		p = NewPool(addr, DefaultClientDialer)
+		sharedPools[addr] = p
+	}
+	return p
+}
+
+// Get returns an idle Client or dials a new one.  Return it with Put.
+func (p *Pool) Get() (Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("rrdcached pool is closed")
+	}
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, nil
+	}
+	p.mu.Unlock()
+
+	dialer := p.Dialer
+	if dialer == nil {
+		dialer = DefaultClientDialer
+	}
+	return dialer.Dial(p.Addr)
+}
+
+// Put returns a Client from Get to the pool.  err is the last error from using it; the Client is closed rather than
+// reused if the error may have left the connection unusable.
+func (p *Pool) Put(c Client, err error) {
+	if err != nil && !IsResponseError(err) {
+		c.Close()
+		return
+	}
+
+	p.mu.Lock()
+	maxIdle := p.MaxIdle
+	if maxIdle <= 0 {
+		maxIdle = 4
+	}
+	if p.closed || len(p.idle) >= maxIdle {
+		p.mu.Unlock()
+		c.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// Do calls fn with a Client from the pool.
+func (p *Pool) Do(fn func(Client) error) error {
+	c, err := p.Get()
+	if err != nil {
+		return err
+	}
+
+	err = fn(c)
+	p.Put(c, err)
+	return err
+}
+
+// Close closes the idle connections.  Clients in use are closed when returned.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.closed = true
+	p.mu.Unlock()
+
+	var errs error
+	for _, c := range idle {
+		if err := c.Close(); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
+	return errs
+}
+
+// knownFile is an entry of the Pool's cache of files known to exist.
+type knownFile struct {
+	// filename is the file updates go to, which differs from the cache key when a new file was created because the
+	// data sources changed (see SchemaNewFile).
+	filename string
+	at       time.Time
+}
+
+// knownFile returns the file updates for key go to, if it was recently seen to exist.
+func (p *Pool) knownFile(key string) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, ok := p.exists[key]
+	if !ok || time.Since(f.at) >= p.existsCacheTTL() {
+		return "", false
+	}
+	return f.filename, true
+}
+
+// rememberFile records that filename exists and that updates for key go to it.
+func (p *Pool) rememberFile(key, filename string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.exists == nil {
+		p.exists = make(map[string]knownFile)
+		p.keys = make(map[string]string)
+	}
+	if f, ok := p.exists[key]; ok {
+		delete(p.keys, f.filename)
+	}
+	p.exists[key] = knownFile{filename: filename, at: time.Now()}
+	p.keys[filename] = key
+}
+
+// forgetFile removes filename from the cache so that it is checked again next time it's updated.
+func (p *Pool) forgetFile(filename string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[filename]; ok {
+		delete(p.exists, key)
+		delete(p.keys, filename)
+	}
+}
+
+func (p *Pool) existsCacheTTL() time.Duration {
+	if p.ExistsCacheTTL <= 0 {
+		return time.Hour
+	}
+	return p.ExistsCacheTTL
+}
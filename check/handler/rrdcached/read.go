@@ -0,0 +1,113 @@
+package rrdcached
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// FetchOptions limits the time range read by FETCH and FETCHBIN.  A zero Start reads rrdcached's default range (the
+// last day) and a zero End reads up to now.
+type FetchOptions struct {
+	Start time.Time
+	End   time.Time
+}
+
+// args returns the options as FETCH/FETCHBIN arguments.
+func (o FetchOptions) args() []any {
+	if o.Start.IsZero() {
+		return nil
+	}
+	args := []any{o.Start.Unix()}
+	if !o.End.IsZero() {
+		args = append(args, o.End.Unix())
+	}
+	return args
+}
+
+// FetchResult is consolidated data read from a rrd file by FETCH or FETCHBIN.
+type FetchResult struct {
+	Start       time.Time
+	End         time.Time
+	Step        time.Duration
+	DataSources []string
+
+	// Rows are the data points, each with a value per DataSources.  Unknown values are NaN.
+	Rows []FetchRow
+}
+
+// FetchRow is the values of every data source at a point in time.
+type FetchRow struct {
+	Time   time.Time
+	Values []float64
+}
+
+// Series is the recorded data of a data source of a rrd file.
+type Series struct {
+	DataSource string
+
+	// Metric is the label of the Result metric the data source records.
+	Metric string
+
+	// Points are the data points in time order.  Unknown values are NaN.
+	Points []Point
+}
+
+// Point is a value at a point in time.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+// ReadSeries reads the data recorded in rrdFile between start and end, consolidated by cf (ex. Average), as a Series
+// per data source of rrdFile.  The file is flushed first so that updates still cached by rrdcached are included.
+func ReadSeries(client Client, rrdFile RrdFileDef, cf string, start, end time.Time) ([]Series, error) {
+	if err := client.Flush(rrdFile.Filename); err != nil {
+		return nil, fmt.Errorf("error flushing rrd file: %v", err)
+	}
+
+	fetched, err := client.FetchBin(rrdFile.Filename, cf, FetchOptions{Start: start, End: end})
+	if err != nil {
+		return nil, fmt.Errorf("error fetching rrd file: %v", err)
+	}
+
+	index := make(map[string]int, len(fetched.DataSources))
+	for i, name := range fetched.DataSources {
+		index[name] = i
+	}
+
+	series := make([]Series, 0, len(rrdFile.DataSources))
+	for _, ds := range rrdFile.DataSources {
+		s := Series{DataSource: ds.Name(), Metric: ds.Name()}
+		if v, ok := rrdFile.DataSourceToMetricMappings[ds.Name()]; ok {
+			s.Metric = v
+		}
+
+		i, ok := index[ds.Name()]
+		for _, row := range fetched.Rows {
+			p := Point{Time: row.Time, Value: math.NaN()}
+			if ok && i < len(row.Values) {
+				p.Value = row.Values[i]
+			}
+			s.Points = append(s.Points, p)
+		}
+		series = append(series, s)
+	}
+
+	return series, nil
+}
+
+// ReadSeries reads the data recorded in rrdFile using the Handler's Pool, see ReadSeries.  When rrdFile was
+// recently updated by the Handler, the file it was actually written to is read (see SchemaNewFile).
+func (h *Handler) ReadSeries(rrdFile RrdFileDef, cf string, start, end time.Time) (series []Series, err error) {
+	pool := h.pool()
+	if filename, ok := pool.knownFile(h.cacheKey(rrdFile)); ok {
+		rrdFile.Filename = filename
+	}
+
+	err = pool.Do(func(client Client) error {
+		series, err = ReadSeries(client, rrdFile, cf, start, end)
+		return err
+	})
+	return
+}
@@ -0,0 +1,105 @@
+package rrdcached
+
+import (
+	"encoding/binary"
+	"github.com/multiplay/go-rrd"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadSeries(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	var gotOpts FetchOptions
+	fetchMock = func(file string, cf string, opts FetchOptions) (*FetchResult, error) {
+		gotOpts = opts
+		return &FetchResult{
+			Start:       start,
+			Step:        300 * time.Second,
+			DataSources: []string{"metric2", "metric1"},
+			Rows: []FetchRow{
+				{Time: start.Add(300 * time.Second), Values: []float64{2, 1}},
+				{Time: start.Add(600 * time.Second), Values: []float64{math.NaN(), 3}},
+			},
+		}, nil
+	}
+	defer func() {
+		fetchMock = nil
+	}()
+
+	mockRrdClient := &MockRrdClient{}
+	series, err := ReadSeries(mockRrdClient, RrdFileDef{
+		Filename: "/foo.rrd",
+		DataSources: []DS{
+			NewGaugeDS("metric1", 600, "U", "U"),
+			NewGaugeDS("metric2", 600, "U", "U"),
+			NewGaugeDS("metric3", 600, "U", "U"),
+		},
+		DataSourceToMetricMappings: map[string]string{"metric1": "mymetric1"},
+	}, Average, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !reflect.DeepEqual(mockRrdClient.FlushFilenames, []string{"/foo.rrd"}) {
+		t.Errorf("expected file to be flushed before fetching")
+	}
+	if !gotOpts.Start.Equal(start) || !gotOpts.End.Equal(start.Add(time.Hour)) {
+		t.Errorf("unexpected fetch options %+v", gotOpts)
+	}
+	if len(series) != 3 {
+		t.Fatalf("expected a series per data source, got %d", len(series))
+	}
+	if s := series[0]; s.DataSource != "metric1" || s.Metric != "mymetric1" || s.Points[0].Value != 1 || s.Points[1].Value != 3 {
+		t.Errorf("unexpected metric1 series %+v", s)
+	}
+	if s := series[1]; s.Metric != "metric2" || s.Points[0].Value != 2 || !math.IsNaN(s.Points[1].Value) {
+		t.Errorf("unexpected metric2 series %+v", s)
+	}
+	if s := series[2]; len(s.Points) != 2 || !math.IsNaN(s.Points[0].Value) {
+		t.Errorf("expected unknown values for a data source missing from the file, got %+v", s)
+	}
+}
+
+func TestConvertFetchBin(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	fetch := &rrd.FetchBin{
+		FetchCommon: rrd.FetchCommon{Start: start, End: start.Add(600 * time.Second), Step: 300 * time.Second},
+		DS: []*rrd.FetchBinDS{
+			{Name: "a", Records: 2, Size: 8, Endian: binary.LittleEndian, Data: []any{1.5, math.NaN()}},
+			{Name: "b", Records: 2, Size: 4, Endian: binary.LittleEndian, Data: []any{float32(2), float32(3)}},
+		},
+	}
+
+	result := new(GoRrdClient).convertFetchBin(fetch)
+	if !reflect.DeepEqual(result.DataSources, []string{"a", "b"}) {
+		t.Errorf("unexpected data sources %v", result.DataSources)
+	}
+	if len(result.Rows) != 2 {
+		t.Fatalf("expected 2 rows, got %d", len(result.Rows))
+	}
+	if row := result.Rows[0]; !row.Time.Equal(start.Add(300*time.Second)) || row.Values[0] != 1.5 || row.Values[1] != 2 {
+		t.Errorf("unexpected first row %+v", row)
+	}
+	if row := result.Rows[1]; !math.IsNaN(row.Values[0]) || row.Values[1] != 3 {
+		t.Errorf("unexpected second row %+v", row)
+	}
+}
+
+func TestFetchOptionsArgs(t *testing.T) {
+	start, end := time.Unix(100, 0), time.Unix(200, 0)
+	tests := []struct {
+		opts FetchOptions
+		want []any
+	}{
+		{FetchOptions{}, nil},
+		{FetchOptions{Start: start}, []any{int64(100)}},
+		{FetchOptions{Start: start, End: end}, []any{int64(100), int64(200)}},
+	}
+	for _, tt := range tests {
+		if got := tt.opts.args(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v: wanted %v, got %v", tt.opts, tt.want, got)
+		}
+	}
+}
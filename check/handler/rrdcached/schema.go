@@ -0,0 +1,139 @@
+package rrdcached
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SchemaPolicy is what a Handler does when the data sources of an existing rrd file don't match those of its
+// RrdFileDef.
+type SchemaPolicy uint8
+
+const (
+	// SchemaIgnore doesn't check the data sources of existing files.
+	SchemaIgnore SchemaPolicy = iota
+	// SchemaError fails Process with an error, leaving the file untouched.
+	SchemaError
+	// SchemaNewFile leaves the file alone and creates a new one, named after the data sources, that updates go to
+	// instead (ex. foo.rrd becomes foo_1a2b3c4d.rrd).
+	SchemaNewFile
+	// SchemaTune re-creates the file with the new data sources, using the existing file as the source so that the
+	// data of data sources present in both is kept (requires rrdcached 1.5+).
+	SchemaTune
+)
+
+// Info is an item of the configuration information of a rrd file, as returned by INFO.  Value is a string, int64
+// or float64.
+type Info struct {
+	Key   string
+	Value any
+}
+
+var infoDSKeyRe = regexp.MustCompile(`^ds\[(.+)\]\.([a-z_]+)$`)
+
+// DataSourcesFromInfo returns the data sources of a rrd file from its INFO, in the order they are in the file.
+func DataSourcesFromInfo(infos []Info) []DS {
+	type dsInfo struct {
+		DS
+		index int
+	}
+
+	byName := make(map[string]*dsInfo)
+	var order []string
+	for _, info := range infos {
+		m := infoDSKeyRe.FindStringSubmatch(info.Key)
+		if m == nil {
+			continue
+		}
+		d, ok := byName[m[1]]
+		if !ok {
+			d = &dsInfo{DS: DS{name: m[1], min: "U", max: "U"}, index: len(order)}
+			byName[m[1]] = d
+			order = append(order, m[1])
+		}
+
+		switch m[2] {
+		case "index":
+			if v, ok := info.Value.(int64); ok {
+				d.index = int(v)
+			}
+		case "type":
+			d.dst = DST(fmt.Sprint(info.Value))
+		case "minimal_heartbeat":
+			if v, ok := info.Value.(int64); ok {
+				d.heartbeat = int(v)
+			}
+		case "min":
+			d.min = infoLimit(info.Value)
+		case "max":
+			d.max = infoLimit(info.Value)
+		}
+	}
+
+	dataSources := make([]*dsInfo, 0, len(order))
+	for _, name := range order {
+		dataSources = append(dataSources, byName[name])
+	}
+	slices.SortStableFunc(dataSources, func(a, b *dsInfo) int {
+		return a.index - b.index
+	})
+
+	ds := make([]DS, len(dataSources))
+	for i, d := range dataSources {
+		ds[i] = d.DS
+	}
+	return ds
+}
+
+// infoLimit formats a DS min/max INFO value the way they're given to NewDS.
+func infoLimit(v any) string {
+	f, ok := v.(float64)
+	if !ok || math.IsNaN(f) {
+		return "U"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// sameDataSources returns true if a and b define the same data sources in the same order.
+func sameDataSources(a, b []DS) bool {
+	return slices.EqualFunc(a, b, func(x, y DS) bool {
+		return x.name == y.name && x.dst == y.dst && x.heartbeat == y.heartbeat &&
+			sameLimit(x.min, y.min) && sameLimit(x.max, y.max)
+	})
+}
+
+// sameLimit compares DS min/max values numerically, so "0" and "0.0" or "U" and "NaN" are the same.
+func sameLimit(a, b string) bool {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b) || (isUnknownLimit(a) && isUnknownLimit(b))
+	}
+	return fa == fb || (math.IsNaN(fa) && math.IsNaN(fb))
+}
+
+func isUnknownLimit(v string) bool {
+	return v == "U" || strings.EqualFold(v, "nan")
+}
+
+// schemaHash returns a short hash identifying data sources.
+func schemaHash(ds []DS) string {
+	h := sha1.New()
+	for _, d := range ds {
+		fmt.Fprintln(h, d.String())
+	}
+	return hex.EncodeToString(h.Sum(nil))[:8]
+}
+
+// schemaFilename returns the name of the file created for data sources under SchemaNewFile.
+func schemaFilename(filename string, ds []DS) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "_" + schemaHash(ds) + ext
+}
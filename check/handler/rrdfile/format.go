@@ -0,0 +1,330 @@
+package rrdfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// The on-disk layout of rrdtool's format version 0003 (see rrd_format.h), which rrdtool writes in the platform's
+// native byte order and C struct alignment.  The sizes here are those of 64-bit platforms, where unsigned long and
+// time_t are 8 bytes and doubles are 8 byte aligned.
+const (
+	cookie      = "RRD"
+	version     = "0003"
+	floatCookie = 8.642135e130
+
+	// DS_NAM_SIZE, DST_SIZE and CF_NAM_SIZE
+	nameSize = 20
+	// LAST_DS_LEN
+	lastDSLen = 30
+
+	statHeadSize = 128 // cookie[4], version[5], padding, float_cookie, ds_cnt, rra_cnt, pdp_step, par[10]
+	dsDefSize    = 120 // ds_nam[20], dst[20], par[10]
+	rraDefSize   = 120 // cf_nam[20], padding, row_cnt, pdp_cnt, par[10]
+	liveHeadSize = 16  // last_up, last_up_usec
+	pdpPrepSize  = 112 // last_ds[30], padding, scratch[10]
+	cdpPrepSize  = 80  // scratch[10]
+	rraPtrSize   = 8   // cur_row
+)
+
+// Indexes of the par and scratch unival arrays used.
+const (
+	dsHeartbeat = 0
+	dsMin       = 1
+	dsMax       = 2
+
+	rraXff = 0
+
+	pdpUnknSecCnt = 0
+	pdpVal        = 1
+
+	cdpVal          = 0
+	cdpUnknPdpCnt   = 1
+	cdpPrimaryVal   = 8
+	cdpSecondaryVal = 9
+)
+
+var byteOrder = binary.NativeEndian
+
+// unival is an array of rrdtool's unival unions, each either an unsigned long count or a double value.
+type unival [10]uint64
+
+func (u *unival) cnt(i int) uint64 {
+	return u[i]
+}
+
+func (u *unival) setCnt(i int, v uint64) {
+	u[i] = v
+}
+
+func (u *unival) val(i int) float64 {
+	return math.Float64frombits(u[i])
+}
+
+func (u *unival) setVal(i int, v float64) {
+	u[i] = math.Float64bits(v)
+}
+
+type dsDef struct {
+	name string
+	dst  string
+	par  unival
+}
+
+type rraDef struct {
+	cf     string
+	rowCnt uint64
+	pdpCnt uint64
+	par    unival
+}
+
+type pdpPrep struct {
+	lastDS  string
+	scratch unival
+}
+
+// rrd is the entire contents of a rrd file.
+type rrd struct {
+	pdpStep    uint64
+	ds         []dsDef
+	rra        []rraDef
+	lastUp     int64
+	lastUpUsec int64
+	pdpPrep    []pdpPrep
+	// cdpPrep is the consolidation state of every data source of every RRA, RRA by RRA
+	cdpPrep []unival
+	rraPtr  []uint64
+	// data is the rows of every RRA, RRA by RRA, each row having a value per data source
+	data []float64
+}
+
+func (r *rrd) headerSize() int64 {
+	return headerSize(int64(len(r.ds)), int64(len(r.rra)))
+}
+
+// headerSize returns the size of everything but the RRA rows of a file with ds data sources and rra RRAs.
+func headerSize(ds, rra int64) int64 {
+	return statHeadSize + ds*dsDefSize + rra*rraDefSize + liveHeadSize + ds*pdpPrepSize + rra*ds*cdpPrepSize +
+		rra*rraPtrSize
+}
+
+// rraStart returns the index in data of the first row of the i'th RRA.
+func (r *rrd) rraStart(i int) uint64 {
+	var start uint64
+	for _, rra := range r.rra[:i] {
+		start += rra.rowCnt * uint64(len(r.ds))
+	}
+	return start
+}
+
+// encoder appends values in the file's byte order.
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [8]byte
+	byteOrder.PutUint64(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) float64(v float64) {
+	e.uint64(math.Float64bits(v))
+}
+
+// string writes s as a NUL padded char array of size n.
+func (e *encoder) string(s string, n int) {
+	b := make([]byte, n)
+	copy(b[:n-1], s)
+	e.Write(b)
+}
+
+func (e *encoder) unival(u unival) {
+	for _, v := range u {
+		e.uint64(v)
+	}
+}
+
+// encodeHeader encodes everything but the RRA rows.
+func (r *rrd) encodeHeader() []byte {
+	var e encoder
+
+	e.string(cookie, 4)
+	e.string(version, 5)
+	e.Write(make([]byte, 7))
+	e.float64(floatCookie)
+	e.uint64(uint64(len(r.ds)))
+	e.uint64(uint64(len(r.rra)))
+	e.uint64(r.pdpStep)
+	e.unival(unival{})
+
+	for _, ds := range r.ds {
+		e.string(ds.name, nameSize)
+		e.string(ds.dst, nameSize)
+		e.unival(ds.par)
+	}
+	for _, rra := range r.rra {
+		e.string(rra.cf, nameSize)
+		e.Write(make([]byte, 4))
+		e.uint64(rra.rowCnt)
+		e.uint64(rra.pdpCnt)
+		e.unival(rra.par)
+	}
+
+	e.uint64(uint64(r.lastUp))
+	e.uint64(uint64(r.lastUpUsec))
+
+	for _, pdp := range r.pdpPrep {
+		e.string(pdp.lastDS, lastDSLen)
+		e.Write(make([]byte, 2))
+		e.unival(pdp.scratch)
+	}
+	for _, cdp := range r.cdpPrep {
+		e.unival(cdp)
+	}
+	for _, ptr := range r.rraPtr {
+		e.uint64(ptr)
+	}
+
+	return e.Bytes()
+}
+
+// encode encodes the entire file.
+func (r *rrd) encode() []byte {
+	b := r.encodeHeader()
+	for _, v := range r.data {
+		b = byteOrder.AppendUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+// decoder reads values in the file's byte order.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return make([]byte, n)
+	}
+	if len(d.b) < n {
+		d.err = errors.New("rrd file is truncated")
+		return make([]byte, n)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) uint64() uint64 {
+	return byteOrder.Uint64(d.next(8))
+}
+
+func (d *decoder) float64() float64 {
+	return math.Float64frombits(d.uint64())
+}
+
+func (d *decoder) string(n int) string {
+	b := d.next(n)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+func (d *decoder) unival() unival {
+	var u unival
+	for i := range u {
+		u[i] = d.uint64()
+	}
+	return u
+}
+
+// decode decodes a rrd file.
+func decode(b []byte) (*rrd, error) {
+	r, rows, err := decodeHeader(b, int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+
+	d := &decoder{b: b[r.headerSize():]}
+	if dsCnt := uint64(len(r.ds)); dsCnt > 0 && rows > uint64(len(d.b))/8/dsCnt {
+		return nil, errors.New("rrd file is truncated")
+	}
+	r.data = make([]float64, rows*uint64(len(r.ds)))
+	for i := range r.data {
+		r.data[i] = d.float64()
+	}
+
+	return r, nil
+}
+
+// decodeHeader decodes everything but the RRA rows from b, the start of a rrd file of size bytes, returning the
+// total rows of the RRAs.
+func decodeHeader(b []byte, size int64) (*rrd, uint64, error) {
+	d := &decoder{b: b}
+
+	if c := d.string(4); c != cookie {
+		return nil, 0, errors.New("not a rrd file")
+	}
+	if v := d.string(5); v != "0003" && v != "0004" {
+		return nil, 0, fmt.Errorf("unsupported rrd file version %s", v)
+	}
+	d.next(7)
+	if d.float64() != floatCookie {
+		return nil, 0, errors.New("rrd file was created on a platform with a different byte order or alignment")
+	}
+
+	dsCnt, rraCnt := d.uint64(), d.uint64()
+	if dsCnt > 10000 || rraCnt > 10000 {
+		return nil, 0, errors.New("rrd file header is corrupt")
+	}
+	r := &rrd{
+		pdpStep: d.uint64(),
+		ds:      make([]dsDef, dsCnt),
+		rra:     make([]rraDef, rraCnt),
+		pdpPrep: make([]pdpPrep, dsCnt),
+		cdpPrep: make([]unival, rraCnt*dsCnt),
+		rraPtr:  make([]uint64, rraCnt),
+	}
+	d.unival()
+
+	for i := range r.ds {
+		r.ds[i] = dsDef{name: d.string(nameSize), dst: d.string(nameSize), par: d.unival()}
+	}
+	// every row is at least 8 bytes of the file, which bounds the row counts before they're summed
+	maxRows := uint64(max(size, 0)) / 8
+	var rows uint64
+	for i := range r.rra {
+		cf := d.string(nameSize)
+		d.next(4)
+		r.rra[i] = rraDef{cf: cf, rowCnt: d.uint64(), pdpCnt: d.uint64(), par: d.unival()}
+		if r.rra[i].rowCnt > maxRows-rows {
+			return nil, 0, errors.New("rrd file is truncated")
+		}
+		rows += r.rra[i].rowCnt
+	}
+
+	r.lastUp, r.lastUpUsec = int64(d.uint64()), int64(d.uint64())
+
+	for i := range r.pdpPrep {
+		lastDS := d.string(lastDSLen)
+		d.next(2)
+		r.pdpPrep[i] = pdpPrep{lastDS: lastDS, scratch: d.unival()}
+	}
+	for i := range r.cdpPrep {
+		r.cdpPrep[i] = d.unival()
+	}
+	for i := range r.rraPtr {
+		r.rraPtr[i] = d.uint64()
+	}
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+
+	return r, rows, nil
+}
@@ -0,0 +1,87 @@
+// Package rrdfile provides a check.Handler that writes result metrics to RRD files on local disk in rrdtool's file
+// format, for deployments without a rrdcached.  It takes the same rrdcached.RrdFileDef definitions as
+// rrdcached.Handler, so switching between them only changes the constructor.
+//
+// The file format is written from rrdtool's rrd_format.h for 64-bit platforms, and the tests only check it against
+// those layout constants: it is untested against files created or read by rrdtool itself, so check that rrdtool
+// reads the files on your platform before relying on them.
+package rrdfile
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/check/handler/rrdcached"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Handler processes check result metrics and writes them to local RRD files, creating the files (and their
+// directories) that don't exist.
+type Handler struct {
+	// GetRrdFileDefs should return a slice of RrdFileDefs defining the RRD file specifications for a given Check and
+	// it's Result data.
+	GetRrdFileDefs func(*check.Check, *check.Result) []rrdcached.RrdFileDef
+}
+
+func NewHandler(getRrdFileDefs func(*check.Check, *check.Result) []rrdcached.RrdFileDef) *Handler {
+	return &Handler{
+		GetRrdFileDefs: getRrdFileDefs,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	getRrdFileDefs := h.GetRrdFileDefs
+	if getRrdFileDefs == nil {
+		chk.Debugf("no rrd file def func defined")
+		return nil
+	}
+	rrdFileDefs := getRrdFileDefs(chk, result)
+	if rrdFileDefs == nil {
+		chk.Debugf("no rrd file defs returned from GetRrdFileDefs func")
+		return nil
+	}
+
+	var errs error
+	for _, rrdFile := range rrdFileDefs {
+		if err := createIfNotExists(chk, rrdFile, result.Time); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("error creating rrd file: %v", err))
+			continue
+		}
+
+		if err := Update(rrdFile.Filename, result.Time, rrdcached.UpdateValues(rrdFile, result)...); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("error updating rrd file: %v", err))
+		}
+	}
+
+	return errs
+}
+
+// createIfNotExists creates the file of rrdFile if it doesn't exist, with its last update 10 seconds before the
+// first Result to be written as rrdtool does.
+func createIfNotExists(chk *check.Check, rrdFile rrdcached.RrdFileDef, first time.Time) error {
+	if _, err := os.Stat(rrdFile.Filename); err == nil || !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	chk.Debugf("rrd file %s does not exist, attempting to create it", rrdFile.Filename)
+	if dir := filepath.Dir(rrdFile.Filename); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	err := Create(rrdFile.Filename, rrdFile.DataSources, rrdFile.RoundRobinArchives, rrdFile.Step,
+		first.Add(-10*time.Second))
+	if errors.Is(err, fs.ErrExist) {
+		// created by another Process since checking
+		return nil
+	}
+	return err
+}
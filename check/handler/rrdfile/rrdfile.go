@@ -0,0 +1,239 @@
+package rrdfile
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check/handler/rrdcached"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported data source types and consolidation functions.
+const (
+	gauge    = "GAUGE"
+	counter  = "COUNTER"
+	derive   = "DERIVE"
+	absolute = "ABSOLUTE"
+
+	average = "AVERAGE"
+	minimum = "MIN"
+	maximum = "MAX"
+	last    = "LAST"
+)
+
+// locks serializes access to each file within the process.  rrdtool's own fcntl locks aren't taken, so a file must
+// not be updated by rrdtool or rrdcached at the same time.
+var locks sync.Map
+
+func lock(filename string) func() {
+	mu, _ := locks.LoadOrStore(filename, new(sync.Mutex))
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
+
+// Create creates a rrd file with the data sources and round-robin archives given, as rrdtool create would.  Only
+// GAUGE, COUNTER, DERIVE and ABSOLUTE data sources and AVERAGE, MIN, MAX and LAST archives are supported.  The file's
+// last update time is start, so the first update must be after it.  An existing file is not overwritten.
+func Create(filename string, ds []rrdcached.DS, rra []rrdcached.RRA, step time.Duration, start time.Time) error {
+	if step < time.Second {
+		return errors.New("step must be at least 1 second")
+	}
+	if len(ds) == 0 || len(rra) == 0 {
+		return errors.New("at least one data source and round-robin archive are required")
+	}
+
+	dsDefs := make([]dsDef, len(ds))
+	for i, d := range ds {
+		var err error
+		if dsDefs[i], err = convertDS(d); err != nil {
+			return err
+		}
+	}
+	rraDefs := make([]rraDef, len(rra))
+	for i, a := range rra {
+		var err error
+		if rraDefs[i], err = convertRRA(a); err != nil {
+			return err
+		}
+	}
+
+	defer lock(filename)()
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	r := newRrd(dsDefs, rraDefs, uint64(step/time.Second), start.Unix())
+	if _, err = f.Write(r.encode()); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	return f.Close()
+}
+
+// Update updates a rrd file with values at t, as rrdtool update would.  There must be a value per data source in
+// the order they were created, "U" being unknown.
+func Update(filename string, t time.Time, values ...string) error {
+	defer lock(filename)()
+
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+
+	r, err := readHeader(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	rows, err := r.update(t, values)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	// write the rows first so the header never points at rows that weren't written
+	headerSize := r.headerSize()
+	b := make([]byte, len(r.ds)*8)
+	for _, row := range rows {
+		for j, v := range row.values {
+			byteOrder.PutUint64(b[j*8:], math.Float64bits(v))
+		}
+		if _, err = f.WriteAt(b, headerSize+int64(row.index)*8); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if _, err = f.WriteAt(r.encodeHeader(), 0); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Last returns the time of the last update of a rrd file.
+func Last(filename string) (time.Time, error) {
+	r, err := read(filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(r.lastUp, r.lastUpUsec*1000), nil
+}
+
+// readHeader reads everything but the RRA rows of a rrd file, as Update needs, checking that the file holds the
+// rows.
+func readHeader(f *os.File) (*rrd, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, statHeadSize)
+	if _, err = f.ReadAt(b, 0); errors.Is(err, io.EOF) {
+		return nil, errors.New("rrd file is truncated")
+	} else if err != nil {
+		return nil, err
+	}
+	// ds_cnt and rra_cnt follow the cookie, version and float cookie
+	dsCnt, rraCnt := byteOrder.Uint64(b[24:]), byteOrder.Uint64(b[32:])
+	if dsCnt <= 10000 && rraCnt <= 10000 {
+		b = make([]byte, headerSize(int64(dsCnt), int64(rraCnt)))
+		if _, err = f.ReadAt(b, 0); errors.Is(err, io.EOF) {
+			return nil, errors.New("rrd file is truncated")
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	r, rows, err := decodeHeader(b, info.Size())
+	if err != nil {
+		return nil, err
+	}
+	if dsCnt > 0 && rows > uint64(info.Size()-r.headerSize())/8/dsCnt {
+		return nil, errors.New("rrd file is truncated")
+	}
+	return r, nil
+}
+
+// read reads an entire rrd file.
+func read(filename string) (*rrd, error) {
+	defer lock(filename)()
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r, err := decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return r, nil
+}
+
+func convertDS(ds rrdcached.DS) (dsDef, error) {
+	dst := string(ds.DST())
+	switch dst {
+	case gauge, counter, derive, absolute:
+	default:
+		return dsDef{}, fmt.Errorf("unsupported data source type %s", dst)
+	}
+
+	def := dsDef{name: ds.Name(), dst: dst}
+	def.par.setCnt(dsHeartbeat, uint64(ds.Heartbeat()))
+
+	for _, limit := range []struct {
+		idx   int
+		value string
+	}{{dsMin, ds.Min()}, {dsMax, ds.Max()}} {
+		v := math.NaN()
+		if limit.value != "U" && limit.value != "" {
+			var err error
+			if v, err = strconv.ParseFloat(limit.value, 64); err != nil {
+				return dsDef{}, fmt.Errorf("invalid data source %s min/max: %s", ds.Name(), limit.value)
+			}
+		}
+		def.par.setVal(limit.idx, v)
+	}
+
+	return def, nil
+}
+
+// convertRRA parses a RRA:CF:xff:steps:rows definition.
+func convertRRA(rra rrdcached.RRA) (rraDef, error) {
+	parts := strings.Split(rra.String(), ":")
+	if len(parts) != 5 || parts[0] != "RRA" {
+		return rraDef{}, fmt.Errorf("unsupported round-robin archive %s", rra)
+	}
+
+	switch parts[1] {
+	case average, minimum, maximum, last:
+	default:
+		return rraDef{}, fmt.Errorf("unsupported consolidation function %s", parts[1])
+	}
+
+	xff, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || xff < 0 || xff >= 1 {
+		return rraDef{}, fmt.Errorf("invalid xff in %s", rra)
+	}
+	steps, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil || steps == 0 {
+		return rraDef{}, fmt.Errorf("invalid steps in %s", rra)
+	}
+	rows, err := strconv.ParseUint(parts[4], 10, 64)
+	if err != nil || rows == 0 {
+		return rraDef{}, fmt.Errorf("invalid rows in %s", rra)
+	}
+
+	def := rraDef{cf: parts[1], rowCnt: rows, pdpCnt: steps}
+	def.par.setVal(rraXff, xff)
+	return def, nil
+}
@@ -0,0 +1,271 @@
+package rrdfile
+
+import (
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/check/handler/rrdcached"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// t0 is aligned to the 300 second step and to 2 steps.
+var t0 = time.Unix(1699999800, 0)
+
+// rows returns the values of a data source in the i'th RRA of a file, oldest first.
+func rows(t *testing.T, filename string, rra, ds int) []float64 {
+	t.Helper()
+	r, err := read(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	start, cnt := r.rraStart(rra), r.rra[rra].rowCnt
+	var values []float64
+	for n := uint64(1); n <= cnt; n++ {
+		row := (r.rraPtr[rra] + n) % cnt
+		values = append(values, r.data[start+row*uint64(len(r.ds))+uint64(ds)])
+	}
+	return values
+}
+
+// lastRows returns the last n values of rows.
+func lastRows(values []float64, n int) []float64 {
+	return values[len(values)-n:]
+}
+
+func equal(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCreateWritesRrdtoolLayout(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.rrd")
+	err := Create(filename,
+		[]rrdcached.DS{rrdcached.NewGaugeDS("in", 600, "0", "U"), rrdcached.NewCounterDS("out", 600, "U", "U")},
+		[]rrdcached.RRA{rrdcached.NewAverageRRA(0.5, 1, 10), rrdcached.NewMaxRRA(0.5, 2, 5)},
+		300*time.Second, t0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	headerSize := statHeadSize + 2*dsDefSize + 2*rraDefSize + liveHeadSize + 2*pdpPrepSize + 4*cdpPrepSize + 2*rraPtrSize
+	if want := headerSize + (10+5)*2*8; len(b) != want {
+		t.Errorf("expected file size %d, got %d", want, len(b))
+	}
+	if string(b[:9]) != "RRD\x000003\x00" {
+		t.Errorf("unexpected cookie and version %q", b[:9])
+	}
+	if math.Float64frombits(byteOrder.Uint64(b[16:])) != floatCookie {
+		t.Errorf("expected float cookie at offset 16")
+	}
+	if pdpStep := byteOrder.Uint64(b[40:]); pdpStep != 300 {
+		t.Errorf("expected pdp step 300, got %d", pdpStep)
+	}
+	if string(b[statHeadSize:statHeadSize+2]) != "in" || string(b[statHeadSize+nameSize:statHeadSize+nameSize+5]) != "GAUGE" {
+		t.Errorf("expected first data source definition after the static header")
+	}
+
+	r, err := read(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r.lastUp != t0.Unix() || r.rra[1].cf != "MAX" || r.rra[1].pdpCnt != 2 || r.ds[0].par.val(dsMin) != 0 ||
+		!math.IsNaN(r.ds[0].par.val(dsMax)) {
+		t.Errorf("unexpected decoded header %+v", r)
+	}
+
+	if err := Create(filename, nil, nil, 300*time.Second, t0); err == nil {
+		t.Errorf("expected an error creating a file without data sources")
+	}
+	if err := Create(filename, []rrdcached.DS{rrdcached.NewGaugeDS("in", 600, "U", "U")},
+		[]rrdcached.RRA{rrdcached.NewAverageRRA(0.5, 1, 10)}, 300*time.Second, t0); err == nil {
+		t.Errorf("expected an error overwriting an existing file")
+	}
+}
+
+func TestUpdateConsolidates(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.rrd")
+	err := Create(filename,
+		[]rrdcached.DS{rrdcached.NewGaugeDS("gauge", 600, "U", "U"), rrdcached.NewCounterDS("counter", 600, "U", "U")},
+		[]rrdcached.RRA{
+			rrdcached.NewAverageRRA(0.5, 1, 10),
+			rrdcached.NewAverageRRA(0.5, 2, 5),
+			rrdcached.NewMaxRRA(0.5, 2, 5),
+			rrdcached.NewMinRRA(0.5, 2, 5),
+			rrdcached.NewLastRRA(0.5, 2, 5),
+		},
+		300*time.Second, t0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	updates := []struct {
+		offset time.Duration
+		gauge  string
+		count  string
+	}{
+		{300 * time.Second, "10", "1000"},
+		{450 * time.Second, "20", "2500"},
+		{600 * time.Second, "20", "4000"},
+		{900 * time.Second, "40", "4294967000"},
+		{1200 * time.Second, "U", "200"},
+	}
+	for _, u := range updates {
+		if err := Update(filename, t0.Add(u.offset), u.gauge, u.count); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		rra  int
+		ds   int
+		want []float64
+	}{
+		// a value is the rate since the previous update, so 20 at 450 and 600 covers the whole second step
+		{"gauge average", 0, 0, []float64{10, 20, 40, math.NaN()}},
+		// the counter is unknown until it has a previous value, then wraps at 32 bits
+		{"counter average", 0, 1, []float64{math.NaN(), 10, float64(4294967000-4000) / 300, 496.0 / 300}},
+		// the second CDP has one unknown PDP, which the xff of 0.5 allows
+		{"gauge 2 step average", 1, 0, []float64{15, 40}},
+		{"gauge 2 step max", 2, 0, []float64{20, 40}},
+		{"gauge 2 step min", 3, 0, []float64{10, 40}},
+		{"gauge 2 step last", 4, 0, []float64{20, math.NaN()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rows(t, filename, tt.rra, tt.ds)
+			if want := tt.want; !equal(lastRows(got, len(want)), want) {
+				t.Errorf("wanted %v, got %v", want, got)
+			}
+		})
+	}
+
+	last, err := Last(filename)
+	if err != nil || !last.Equal(t0.Add(1200*time.Second)) {
+		t.Errorf("unexpected last update %v (%v)", last, err)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.rrd")
+	err := Create(filename,
+		[]rrdcached.DS{rrdcached.NewGaugeDS("gauge", 600, "U", "100"), rrdcached.NewCounterDS("counter", 600, "U", "U")},
+		[]rrdcached.RRA{rrdcached.NewAverageRRA(0.5, 1, 10)},
+		300*time.Second, t0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err := Update(filename, t0, "1", "1"); err == nil {
+		t.Errorf("expected an error updating at the last update time")
+	}
+	if err := Update(filename, t0.Add(time.Second), "1"); err == nil {
+		t.Errorf("expected an error updating with too few values")
+	}
+	if err := Update(filename, t0.Add(time.Second), "1", "1.5"); err == nil {
+		t.Errorf("expected an error updating a counter with a non-integer")
+	}
+
+	// gauge is out of range, then the heartbeat is exceeded
+	if err := Update(filename, t0.Add(300*time.Second), "101", "1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := Update(filename, t0.Add(1200*time.Second), "50", "2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := rows(t, filename, 0, 0); !equal(lastRows(got, 4), []float64{math.NaN(), math.NaN(), math.NaN(), math.NaN()}) {
+		t.Errorf("expected unknown values, got %v", got)
+	}
+}
+
+func TestCorruptFiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "test.rrd")
+	err := Create(filename,
+		[]rrdcached.DS{rrdcached.NewGaugeDS("in", 600, "U", "U"), rrdcached.NewGaugeDS("out", 600, "U", "U")},
+		[]rrdcached.RRA{rrdcached.NewAverageRRA(0.5, 1, 10), rrdcached.NewMaxRRA(0.5, 2, 5)},
+		300*time.Second, t0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rowCnt := statHeadSize + 2*dsDefSize + nameSize + 4
+
+	tests := []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{"truncated rows", func(b []byte) []byte { return b[:len(b)-8] }},
+		{"truncated header", func(b []byte) []byte { return b[:statHeadSize+dsDefSize] }},
+		// rows*ds_cnt*8 overflows to 0
+		{"overflowing rows", func(b []byte) []byte {
+			byteOrder.PutUint64(b[rowCnt:], 1<<61)
+			return b
+		}},
+		// the row counts sum to a small number
+		{"overflowing row sum", func(b []byte) []byte {
+			byteOrder.PutUint64(b[rowCnt:], math.MaxUint64)
+			byteOrder.PutUint64(b[rowCnt+rraDefSize:], 16)
+			return b
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			corrupt := tt.corrupt(append([]byte(nil), b...))
+			if _, err := decode(corrupt); err == nil {
+				t.Errorf("expected an error decoding")
+			}
+			if err := os.WriteFile(filename, corrupt, 0644); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := Update(filename, t0.Add(300*time.Second), "1", "1"); err == nil {
+				t.Errorf("expected an error updating")
+			}
+		})
+	}
+}
+
+func TestHandlerCreatesAndUpdatesFiles(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "checks", "router1.rrd")
+	h := NewHandler(func(*check.Check, *check.Result) []rrdcached.RrdFileDef {
+		return []rrdcached.RrdFileDef{{
+			Filename: filename,
+			DataSources: []rrdcached.DS{
+				rrdcached.NewGaugeDS("rtt", 600, "U", "U"),
+				rrdcached.NewGaugeDS("loss", 600, "U", "U"),
+			},
+			RoundRobinArchives: []rrdcached.RRA{rrdcached.NewAverageRRA(0.5, 1, 10)},
+			Step:               300 * time.Second,
+		}}
+	})
+
+	for i, v := range []string{"5", "7"} {
+		result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "rtt", Value: v}})
+		result.Time = t0.Add(time.Duration(i+1) * 300 * time.Second)
+		if err := h.Process(&check.Check{}, result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if got := rows(t, filename, 0, 0); !equal(lastRows(got, 1), []float64{7}) {
+		t.Errorf("expected rtt to be recorded, got %v", got)
+	}
+	if got := rows(t, filename, 0, 1); !math.IsNaN(got[len(got)-1]) {
+		t.Errorf("expected missing loss metric to be unknown, got %v", got)
+	}
+}
@@ -0,0 +1,408 @@
+package rrdfile
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"time"
+)
+
+// newRrd returns a new rrd initialized the way rrdtool create does, with its last update at start.
+func newRrd(ds []dsDef, rra []rraDef, step uint64, start int64) *rrd {
+	r := &rrd{
+		pdpStep: step,
+		ds:      ds,
+		rra:     rra,
+		lastUp:  start,
+		pdpPrep: make([]pdpPrep, len(ds)),
+		cdpPrep: make([]unival, len(rra)*len(ds)),
+		rraPtr:  make([]uint64, len(rra)),
+	}
+
+	for i := range r.pdpPrep {
+		r.pdpPrep[i].lastDS = "U"
+		r.pdpPrep[i].scratch.setVal(pdpVal, 0)
+		r.pdpPrep[i].scratch.setCnt(pdpUnknSecCnt, uint64(start)%step)
+	}
+
+	var rows uint64
+	for i, def := range rra {
+		for j := range ds {
+			cdp := &r.cdpPrep[i*len(ds)+j]
+			cdp.setVal(cdpVal, math.NaN())
+			cdp.setCnt(cdpUnknPdpCnt,
+				((uint64(start)-r.pdpPrep[j].scratch.cnt(pdpUnknSecCnt))%(step*def.pdpCnt))/step)
+		}
+		r.rraPtr[i] = def.rowCnt - 1
+		rows += def.rowCnt
+	}
+
+	r.data = make([]float64, rows*uint64(len(ds)))
+	for i := range r.data {
+		r.data[i] = math.NaN()
+	}
+
+	return r
+}
+
+// update applies an update of values (one per data source, "U" for unknown) at t the way rrdtool update does,
+// returning the rows written.  The rows are also written to data when it is loaded.
+func (r *rrd) update(t time.Time, values []string) ([]row, error) {
+	if len(values) != len(r.ds) {
+		return nil, fmt.Errorf("expected %d data source values, got %d", len(r.ds), len(values))
+	}
+
+	now, nowUsec := t.Unix(), int64(t.Nanosecond()/1000)
+	if now < r.lastUp || (now == r.lastUp && nowUsec <= r.lastUpUsec) {
+		return nil, fmt.Errorf("illegal attempt to update using time %d when last update time is %d "+
+			"(minimum one second step)", now, r.lastUp)
+	}
+
+	interval := float64(now-r.lastUp) + float64(nowUsec-r.lastUpUsec)/1e6
+
+	step := int64(r.pdpStep)
+	procPdpSt := r.lastUp - r.lastUp%step
+	occuPdpAge := now % step
+	occuPdpSt := now - occuPdpAge
+
+	var preInt, postInt float64
+	if occuPdpSt > procPdpSt {
+		preInt = float64(occuPdpSt-r.lastUp) - float64(r.lastUpUsec)/1e6
+		postInt = float64(occuPdpAge) + float64(nowUsec)/1e6
+	} else {
+		preInt = interval
+	}
+
+	pdpNew, err := r.updatePdpPrep(values, interval)
+	if err != nil {
+		return nil, err
+	}
+
+	var written []row
+	if occuPdpSt > procPdpSt {
+		elapsedPdpSt := uint64((occuPdpSt - procPdpSt) / step)
+		pdpTemp := r.processAllPdpSt(interval, preInt, postInt, float64(occuPdpSt-procPdpSt), pdpNew)
+		stepCnts := r.updateAllCdpPrep(elapsedPdpSt, uint64(procPdpSt/step), pdpTemp)
+		written = r.writeToRras(stepCnts)
+	} else {
+		r.simpleUpdate(interval, pdpNew)
+	}
+
+	r.lastUp, r.lastUpUsec = now, nowUsec
+
+	return written, nil
+}
+
+// updatePdpPrep returns the amount each data source's value adds to the current PDP (the rate times the interval).
+func (r *rrd) updatePdpPrep(values []string, interval float64) ([]float64, error) {
+	pdpNew := make([]float64, len(r.ds))
+
+	for i, ds := range r.ds {
+		prep := &r.pdpPrep[i]
+		heartbeat := float64(ds.par.cnt(dsHeartbeat))
+		value := values[i]
+
+		// don't compute differences from values older than the heartbeat
+		if heartbeat < interval {
+			prep.lastDS = "U"
+		}
+
+		pdpNew[i] = math.NaN()
+		if value != "U" && heartbeat >= interval {
+			rate := math.NaN()
+
+			switch ds.dst {
+			case counter, derive:
+				if !isInteger(value, ds.dst == derive) {
+					return nil, fmt.Errorf("not a simple integer: '%s'", value)
+				}
+				if prep.lastDS != "U" {
+					diff := diff(value, prep.lastDS)
+					if ds.dst == counter {
+						// counter wrapped, assume 32 then 64 bit
+						if diff < 0 {
+							diff += 4294967296.0
+						}
+						if diff < 0 {
+							diff += 18446744069414584320.0
+						}
+					}
+					pdpNew[i] = diff
+					rate = diff / interval
+				}
+			case absolute:
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("not a simple unsigned number: '%s'", value)
+				}
+				pdpNew[i] = f
+				rate = f / interval
+			case gauge:
+				f, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return nil, fmt.Errorf("not a simple number: '%s'", value)
+				}
+				pdpNew[i] = f * interval
+				rate = f
+			default:
+				return nil, fmt.Errorf("unsupported data source type %s", ds.dst)
+			}
+
+			// rates out of the data source's range are unknown
+			if min, max := ds.par.val(dsMin), ds.par.val(dsMax); !math.IsNaN(rate) &&
+				((!math.IsNaN(max) && rate > max) || (!math.IsNaN(min) && rate < min)) {
+				pdpNew[i] = math.NaN()
+			}
+		}
+
+		if len(value) >= lastDSLen {
+			value = value[:lastDSLen-1]
+		}
+		prep.lastDS = value
+	}
+
+	return pdpNew, nil
+}
+
+// simpleUpdate adds to the current PDP of each data source when the update doesn't complete it.
+func (r *rrd) simpleUpdate(interval float64, pdpNew []float64) {
+	for i := range r.ds {
+		scratch := &r.pdpPrep[i].scratch
+		if math.IsNaN(pdpNew[i]) {
+			scratch.setCnt(pdpUnknSecCnt, scratch.cnt(pdpUnknSecCnt)+uint64(math.Floor(interval)))
+		} else if math.IsNaN(scratch.val(pdpVal)) {
+			scratch.setVal(pdpVal, pdpNew[i])
+		} else {
+			scratch.setVal(pdpVal, scratch.val(pdpVal)+pdpNew[i])
+		}
+	}
+}
+
+// processAllPdpSt completes the PDPs of each data source the update passes, returning their rates, and starts the
+// next PDP with the remainder of the update.
+func (r *rrd) processAllPdpSt(interval, preInt, postInt, diffPdpSt float64, pdpNew []float64) []float64 {
+	pdpTemp := make([]float64, len(r.ds))
+
+	for i, ds := range r.ds {
+		scratch := &r.pdpPrep[i].scratch
+
+		var preUnknown float64
+		if math.IsNaN(pdpNew[i]) {
+			preUnknown = preInt
+		} else {
+			if math.IsNaN(scratch.val(pdpVal)) {
+				scratch.setVal(pdpVal, 0)
+			}
+			scratch.setVal(pdpVal, scratch.val(pdpVal)+pdpNew[i]/interval*preInt)
+		}
+
+		// the PDP is unknown if the interval exceeds the heartbeat or more than half of it is unknown
+		if interval > float64(ds.par.cnt(dsHeartbeat)) ||
+			float64(r.pdpStep)/2.0 < float64(scratch.cnt(pdpUnknSecCnt)) {
+			pdpTemp[i] = math.NaN()
+		} else {
+			pdpTemp[i] = scratch.val(pdpVal) / (diffPdpSt - float64(scratch.cnt(pdpUnknSecCnt)) - preUnknown)
+		}
+
+		if math.IsNaN(pdpNew[i]) {
+			scratch.setCnt(pdpUnknSecCnt, uint64(math.Floor(postInt)))
+			scratch.setVal(pdpVal, math.NaN())
+		} else {
+			scratch.setCnt(pdpUnknSecCnt, 0)
+			scratch.setVal(pdpVal, pdpNew[i]/interval*postInt)
+		}
+	}
+
+	return pdpTemp
+}
+
+// updateAllCdpPrep consolidates the completed PDPs into each RRA's CDPs, returning the number of rows each RRA
+// has completed.
+func (r *rrd) updateAllCdpPrep(elapsedPdpSt, procPdpCnt uint64, pdpTemp []float64) []uint64 {
+	stepCnts := make([]uint64, len(r.rra))
+
+	for i, rra := range r.rra {
+		startPdpOffset := rra.pdpCnt - procPdpCnt%rra.pdpCnt
+		if startPdpOffset <= elapsedPdpSt {
+			stepCnts[i] = (elapsedPdpSt-startPdpOffset)/rra.pdpCnt + 1
+		}
+
+		for j := range r.ds {
+			cdp := &r.cdpPrep[i*len(r.ds)+j]
+			temp := pdpTemp[j]
+
+			if rra.pdpCnt == 1 {
+				cdp.setVal(cdpPrimaryVal, temp)
+				cdp.setVal(cdpSecondaryVal, temp)
+				continue
+			}
+
+			if stepCnts[i] == 0 {
+				// the CDP isn't complete yet
+				if math.IsNaN(temp) {
+					cdp.setCnt(cdpUnknPdpCnt, cdp.cnt(cdpUnknPdpCnt)+elapsedPdpSt)
+				} else {
+					cdp.setVal(cdpVal, calculateCdpVal(cdp.val(cdpVal), temp, elapsedPdpSt, rra.cf))
+				}
+				continue
+			}
+
+			// the primary value is the completed CDP, the secondary fills any further rows
+			if math.IsNaN(temp) {
+				cdp.setCnt(cdpUnknPdpCnt, cdp.cnt(cdpUnknPdpCnt)+startPdpOffset)
+				cdp.setVal(cdpSecondaryVal, math.NaN())
+			} else {
+				cdp.setVal(cdpSecondaryVal, temp)
+			}
+
+			if float64(cdp.cnt(cdpUnknPdpCnt)) > float64(rra.pdpCnt)*rra.par.val(rraXff) {
+				cdp.setVal(cdpPrimaryVal, math.NaN())
+			} else {
+				initializeCdpVal(cdp, rra.cf, temp, startPdpOffset, rra.pdpCnt)
+			}
+
+			cdp.setVal(cdpVal, initializeCarryOver(temp, rra.cf, elapsedPdpSt, startPdpOffset, rra.pdpCnt))
+			if math.IsNaN(temp) {
+				cdp.setCnt(cdpUnknPdpCnt, (elapsedPdpSt-startPdpOffset)%rra.pdpCnt)
+			} else {
+				cdp.setCnt(cdpUnknPdpCnt, 0)
+			}
+		}
+	}
+
+	return stepCnts
+}
+
+// row is a RRA row written by an update.
+type row struct {
+	// index is the index in data of the row's first value
+	index  uint64
+	values []float64
+}
+
+// writeToRras writes the completed rows of each RRA, returning them.
+func (r *rrd) writeToRras(stepCnts []uint64) []row {
+	var written []row
+	dsCnt := uint64(len(r.ds))
+
+	for i, rra := range r.rra {
+		start := r.rraStart(i)
+		for n := uint64(1); n <= stepCnts[i]; n++ {
+			r.rraPtr[i]++
+			if r.rraPtr[i] >= rra.rowCnt {
+				r.rraPtr[i] = 0
+			}
+			// rows that a later row of this update overwrites aren't worth writing
+			if stepCnts[i]-n >= rra.rowCnt {
+				continue
+			}
+
+			scratchIdx := cdpSecondaryVal
+			if n == 1 {
+				scratchIdx = cdpPrimaryVal
+			}
+			w := row{index: start + r.rraPtr[i]*dsCnt, values: make([]float64, len(r.ds))}
+			for j := range r.ds {
+				w.values[j] = r.cdpPrep[i*len(r.ds)+j].val(scratchIdx)
+			}
+			if r.data != nil {
+				copy(r.data[w.index:], w.values)
+			}
+			written = append(written, w)
+		}
+	}
+
+	return written
+}
+
+func initializeCdpVal(cdp *unival, cf string, pdpTemp float64, startPdpOffset, pdpCnt uint64) {
+	switch cf {
+	case average:
+		cum, cur := ifNaN(cdp.val(cdpVal), 0), ifNaN(pdpTemp, 0)
+		cdp.setVal(cdpPrimaryVal, (cum+cur*float64(startPdpOffset))/float64(pdpCnt-cdp.cnt(cdpUnknPdpCnt)))
+	case maximum:
+		cum, cur := ifNaN(cdp.val(cdpVal), math.Inf(-1)), ifNaN(pdpTemp, math.Inf(-1))
+		cdp.setVal(cdpPrimaryVal, math.Max(cum, cur))
+	case minimum:
+		cum, cur := ifNaN(cdp.val(cdpVal), math.Inf(1)), ifNaN(pdpTemp, math.Inf(1))
+		cdp.setVal(cdpPrimaryVal, math.Min(cum, cur))
+	default:
+		cdp.setVal(cdpPrimaryVal, pdpTemp)
+	}
+}
+
+// initializeCarryOver returns the CDP value to start the next CDP with, from the PDPs past the completed ones.
+func initializeCarryOver(pdpTemp float64, cf string, elapsedPdpSt, startPdpOffset, pdpCnt uint64) float64 {
+	pdpIntoCdpCnt := (elapsedPdpSt - startPdpOffset) % pdpCnt
+	if pdpIntoCdpCnt == 0 || math.IsNaN(pdpTemp) {
+		switch cf {
+		case maximum:
+			return math.Inf(-1)
+		case minimum:
+			return math.Inf(1)
+		case average:
+			return 0
+		default:
+			return math.NaN()
+		}
+	}
+	if cf == average {
+		return pdpTemp * float64(pdpIntoCdpCnt)
+	}
+	return pdpTemp
+}
+
+func calculateCdpVal(cdpVal, pdpTemp float64, elapsedPdpSt uint64, cf string) float64 {
+	if math.IsNaN(cdpVal) {
+		if cf == average {
+			return pdpTemp * float64(elapsedPdpSt)
+		}
+		return pdpTemp
+	}
+
+	switch cf {
+	case average:
+		return cdpVal + pdpTemp*float64(elapsedPdpSt)
+	case minimum:
+		return math.Min(cdpVal, pdpTemp)
+	case maximum:
+		return math.Max(cdpVal, pdpTemp)
+	default:
+		return pdpTemp
+	}
+}
+
+func ifNaN(v, def float64) float64 {
+	if math.IsNaN(v) {
+		return def
+	}
+	return v
+}
+
+// isInteger returns true if v is a string of digits, optionally negative.
+func isInteger(v string, signed bool) bool {
+	if signed && len(v) > 1 && v[0] == '-' {
+		v = v[1:]
+	}
+	if v == "" {
+		return false
+	}
+	for _, c := range v {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// diff returns a - b of two integer strings without losing precision to large counter values.
+func diff(a, b string) float64 {
+	x, okX := new(big.Int).SetString(a, 10)
+	y, okY := new(big.Int).SetString(b, 10)
+	if !okX || !okY {
+		return math.NaN()
+	}
+	f, _ := new(big.Float).SetInt(x.Sub(x, y)).Float64()
+	return f
+}
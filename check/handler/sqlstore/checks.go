@@ -0,0 +1,302 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"time"
+)
+
+// CheckStore keeps Checks in the gopoller_checks table.  It is a bufqueue.CheckProvider and bufqueue.CheckEnqueuer:
+// Provide loads the Checks that are due and Enqueue saves their last check time, last Result and Incident once
+// executed.
+//
+// Only a Check's id, PeriodicSchedule interval, Meta and SuppressIncidents are stored with it, so Configure is
+// called on every Check loaded to give it its Command and Handlers (usually based on its Meta).  Meta is stored as
+// JSON, so numbers are loaded as float64.
+type CheckStore struct {
+	DB *sql.DB
+
+	// Dialect is the SQL variant of DB (default SQLite).
+	Dialect *Dialect
+
+	// Configure sets up a Check loaded by Provide.  Checks it returns an error for, or that are left without a
+	// Schedule, are not provided.
+	Configure func(chk *check.Check) error
+
+	// BatchSize is the most Checks returned by Provide (default 1000).
+	BatchSize int
+
+	// LeaseDuration is how long Checks returned by Provide aren't provided again while waiting to be enqueued,
+	// in case the poller that was provided them stops without enqueuing them (default 10 minutes).
+	LeaseDuration time.Duration
+
+	// OnError is called with errors loading and saving Checks, as Provide and Enqueue can't return them.
+	OnError func(err error)
+
+	nowFunc func() time.Time
+}
+
+func NewCheckStore(db *sql.DB, dialect *Dialect, configure func(chk *check.Check) error) *CheckStore {
+	return &CheckStore{
+		DB:            db,
+		Dialect:       dialect,
+		Configure:     configure,
+		BatchSize:     1000,
+		LeaseDuration: 10 * time.Minute,
+	}
+}
+
+// Save inserts a Check, or updates the schedule interval, Meta and SuppressIncidents of a Check already stored.
+// Only PeriodicSchedules are stored; Checks with other schedules need theirs set by Configure.
+func (s *CheckStore) Save(chk *check.Check) error {
+	var interval *int
+	switch schedule := chk.Schedule.(type) {
+	case check.PeriodicSchedule:
+		interval = &schedule.IntervalSeconds
+	case *check.PeriodicSchedule:
+		interval = &schedule.IntervalSeconds
+	}
+
+	meta, err := marshalNullable(chk.Meta)
+	if err != nil {
+		return fmt.Errorf("error encoding check %s meta: %v", chk.Id, err)
+	}
+
+	query := s.dialect().upsert("gopoller_checks", "id", []string{"id", "interval_seconds", "meta", "suppress_incidents"})
+	if _, err = s.DB.Exec(query, chk.Id, interval, meta, chk.SuppressIncidents); err != nil {
+		return fmt.Errorf("error saving check %s: %v", chk.Id, err)
+	}
+	return nil
+}
+
+// Delete removes a Check.
+func (s *CheckStore) Delete(id string) error {
+	if _, err := s.DB.Exec(s.dialect().rebind("DELETE FROM gopoller_checks WHERE id = ?"), id); err != nil {
+		return fmt.Errorf("error deleting check %s: %v", id, err)
+	}
+	return nil
+}
+
+// Provide returns the Checks that are due, most overdue first, and leases them for LeaseDuration.
+func (s *CheckStore) Provide() []*check.Check {
+	chks, err := s.provide()
+	if err != nil {
+		s.onError(fmt.Errorf("error providing checks: %v", err))
+	}
+	return chks
+}
+
+func (s *CheckStore) provide() ([]*check.Check, error) {
+	ctx := context.Background()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	rows, err := tx.QueryContext(ctx, s.dialect().rebind(`SELECT id, interval_seconds, meta, suppress_incidents,
+		last_check, last_result, incident FROM gopoller_checks WHERE next_due IS NULL OR next_due <= ?
+		ORDER BY COALESCE(next_due, 0) LIMIT ?`+s.dialect().skipLocked), now.UnixMilli(), s.batchSize())
+	if err != nil {
+		return nil, err
+	}
+
+	var chks []*check.Check
+	var ids []any
+	for rows.Next() {
+		chk, err := scanCheck(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, chk.Id)
+		chks = append(chks, chk)
+	}
+	if err = errors.Join(rows.Err(), rows.Close()); err != nil {
+		return nil, err
+	}
+
+	// lease the checks, in statements small enough for the dialect's parameter limit
+	lease := now.Add(s.leaseDuration()).UnixMilli()
+	for batch := range chunks(ids, s.dialect().maxParams-1) {
+		query := "UPDATE gopoller_checks SET next_due = ? WHERE id IN " + placeholders(len(batch))
+		if _, err = tx.ExecContext(ctx, s.dialect().rebind(query), append([]any{lease}, batch...)...); err != nil {
+			return nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	configured := chks[:0]
+	for _, chk := range chks {
+		if s.Configure != nil {
+			if err := s.Configure(chk); err != nil {
+				s.onError(fmt.Errorf("error configuring check %s: %v", chk.Id, err))
+				continue
+			}
+		}
+		if chk.Schedule == nil {
+			s.onError(fmt.Errorf("check %s has no schedule", chk.Id))
+			continue
+		}
+		configured = append(configured, chk)
+	}
+	return configured, nil
+}
+
+// Enqueue saves the last check time, last Result and Incident of Checks, and when they are next due.
+func (s *CheckStore) Enqueue(chks []*check.Check) {
+	if err := s.enqueue(chks); err != nil {
+		s.onError(fmt.Errorf("error enqueuing %d checks: %v", len(chks), err))
+	}
+}
+
+func (s *CheckStore) enqueue(chks []*check.Check) error {
+	ctx := context.Background()
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, s.dialect().rebind(`UPDATE gopoller_checks
+		SET last_check = ?, last_result = ?, incident = ?, next_due = ? WHERE id = ?`))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, chk := range chks {
+		lastResult, err := marshalNullable(chk.LastResult)
+		if err != nil {
+			return fmt.Errorf("error encoding check %s result: %v", chk.Id, err)
+		}
+		incident, err := marshalNullable(chk.Incident)
+		if err != nil {
+			return fmt.Errorf("error encoding check %s incident: %v", chk.Id, err)
+		}
+
+		// checks without a schedule are always due
+		var nextDue *int64
+		if chk.Schedule != nil {
+			due := chk.DueAt().UnixMilli()
+			nextDue = &due
+		}
+
+		_, err = stmt.ExecContext(ctx, nullableMilli(chk.LastCheck), lastResult, incident, nextDue, chk.Id)
+		if err != nil {
+			return fmt.Errorf("error saving check %s: %v", chk.Id, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// scanCheck returns the Check of a row of id, interval_seconds, meta, suppress_incidents, last_check, last_result
+// and incident.
+func scanCheck(rows *sql.Rows) (*check.Check, error) {
+	var (
+		id                string
+		interval          sql.NullInt64
+		meta              sql.NullString
+		suppressIncidents bool
+		lastCheck         sql.NullInt64
+		lastResult        sql.NullString
+		incident          sql.NullString
+	)
+	if err := rows.Scan(&id, &interval, &meta, &suppressIncidents, &lastCheck, &lastResult, &incident); err != nil {
+		return nil, err
+	}
+
+	chk := check.New(id)
+	chk.SuppressIncidents = suppressIncidents
+	if interval.Valid {
+		chk.Schedule = &check.PeriodicSchedule{IntervalSeconds: int(interval.Int64)}
+	}
+	if lastCheck.Valid {
+		t := time.UnixMilli(lastCheck.Int64)
+		chk.LastCheck = &t
+	}
+
+	fields := []struct {
+		name  string
+		value sql.NullString
+		dest  any
+	}{
+		{"meta", meta, &chk.Meta},
+		{"result", lastResult, &chk.LastResult},
+		{"incident", incident, &chk.Incident},
+	}
+	for _, f := range fields {
+		if !f.value.Valid {
+			continue
+		}
+		if err := json.Unmarshal([]byte(f.value.String), f.dest); err != nil {
+			return nil, fmt.Errorf("error decoding check %s %s: %v", id, f.name, err)
+		}
+	}
+
+	return chk, nil
+}
+
+// marshalNullable returns v as JSON, or nil for a NULL if v is nil.
+func marshalNullable[T any](v T) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil || string(b) == "null" {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// chunks yields consecutive slices of s of at most n elements.
+func chunks[T any](s []T, n int) func(yield func([]T) bool) {
+	return func(yield func([]T) bool) {
+		for len(s) > 0 {
+			i := min(len(s), n)
+			if !yield(s[:i]) {
+				return
+			}
+			s = s[i:]
+		}
+	}
+}
+
+func (s *CheckStore) dialect() *Dialect {
+	if s.Dialect == nil {
+		return SQLite
+	}
+	return s.Dialect
+}
+
+func (s *CheckStore) batchSize() int {
+	if s.BatchSize <= 0 {
+		return 1000
+	}
+	return s.BatchSize
+}
+
+func (s *CheckStore) leaseDuration() time.Duration {
+	if s.LeaseDuration <= 0 {
+		return 10 * time.Minute
+	}
+	return s.LeaseDuration
+}
+
+func (s *CheckStore) now() time.Time {
+	if s.nowFunc != nil {
+		return s.nowFunc()
+	}
+	return time.Now()
+}
+
+func (s *CheckStore) onError(err error) {
+	if s.OnError != nil {
+		s.OnError(err)
+	}
+}
@@ -0,0 +1,119 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Dialect is the SQL variant of a database: SQLite, PostgreSQL or MySQL.  Queries are written with ? placeholders
+// and rewritten for the dialect.
+type Dialect struct {
+	Name string
+
+	// numberedPlaceholders rewrites ? placeholders as $1, $2 etc.
+	numberedPlaceholders bool
+	// autoIncrementKey is the column definition of an auto-incrementing integer primary key.
+	autoIncrementKey string
+	// skipLocked is appended to SELECTs that claim rows, so concurrent pollers claim different rows.
+	skipLocked string
+	// onDuplicateKey upserts with MySQL's ON DUPLICATE KEY UPDATE rather than ON CONFLICT.
+	onDuplicateKey bool
+	// maxParams is the most parameters used in a statement.
+	maxParams int
+}
+
+var (
+	SQLite = &Dialect{
+		Name:             "sqlite",
+		autoIncrementKey: "INTEGER PRIMARY KEY AUTOINCREMENT",
+		maxParams:        999,
+	}
+	PostgreSQL = &Dialect{
+		Name:                 "postgres",
+		numberedPlaceholders: true,
+		autoIncrementKey:     "BIGSERIAL PRIMARY KEY",
+		skipLocked:           " FOR UPDATE SKIP LOCKED",
+		maxParams:            65535,
+	}
+	MySQL = &Dialect{
+		Name:             "mysql",
+		autoIncrementKey: "BIGINT AUTO_INCREMENT PRIMARY KEY",
+		skipLocked:       " FOR UPDATE SKIP LOCKED",
+		onDuplicateKey:   true,
+		maxParams:        65535,
+	}
+)
+
+// rebind rewrites the ? placeholders of query for the dialect.  Queries must not contain literal question marks.
+func (d *Dialect) rebind(query string) string {
+	if !d.numberedPlaceholders {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// upsert returns a statement inserting a row of columns into table, or updating the columns other than key when a
+// row with the same key exists.
+func (d *Dialect) upsert(table, key string, columns []string) string {
+	var updates []string
+	for _, c := range columns {
+		if c == key {
+			continue
+		}
+		if d.onDuplicateKey {
+			updates = append(updates, c+" = VALUES("+c+")")
+		} else {
+			updates = append(updates, c+" = excluded."+c)
+		}
+	}
+
+	query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES " + placeholders(len(columns))
+	if d.onDuplicateKey {
+		query += " ON DUPLICATE KEY UPDATE "
+	} else {
+		query += " ON CONFLICT (" + key + ") DO UPDATE SET "
+	}
+	return d.rebind(query + strings.Join(updates, ", "))
+}
+
+// insert inserts rows of columns into table, using as few multi-row INSERTs as the dialect's parameter limit
+// allows.
+func (d *Dialect) insert(ctx context.Context, tx *sql.Tx, table string, columns []string, rows [][]any) error {
+	perStatement := max(1, d.maxParams/len(columns))
+	for len(rows) > 0 {
+		n := min(len(rows), perStatement)
+
+		values := make([]string, n)
+		args := make([]any, 0, n*len(columns))
+		for i, row := range rows[:n] {
+			values[i] = placeholders(len(columns))
+			args = append(args, row...)
+		}
+		rows = rows[n:]
+
+		query := "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES " + strings.Join(values, ", ")
+		if _, err := tx.ExecContext(ctx, d.rebind(query), args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// placeholders returns a parenthesized list of n ? placeholders.
+func placeholders(n int) string {
+	return "(" + strings.TrimSuffix(strings.Repeat("?, ", n), ", ") + ")"
+}
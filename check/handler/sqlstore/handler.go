@@ -0,0 +1,279 @@
+// Package sqlstore stores Check results, metrics and Incident transitions in a SQL database through database/sql,
+// and provides a bufqueue.CheckProvider and bufqueue.CheckEnqueuer that load Checks from and save Check state to the
+// same database.  SQLite, PostgreSQL and MySQL are supported; register the database's driver and call Migrate to
+// create the schema.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/background"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handler inserts every Result it processes into gopoller_results, its metrics into gopoller_metrics and the
+// Incident lifecycle events of the Check into gopoller_incident_events.  Rows are buffered and inserted in batches,
+// once MaxBatchSize rows are buffered or every FlushInterval, whichever comes first.  A batch that fails to insert
+// stays buffered and is retried.
+type Handler struct {
+	DB *sql.DB
+
+	// Dialect is the SQL variant of DB (default SQLite).
+	Dialect *Dialect
+
+	// FlushInterval is the most time rows are buffered before being inserted (default 5 seconds).
+	FlushInterval time.Duration
+
+	// MaxBatchSize is the most Results (and, separately, Incident events) inserted per transaction (default 500).
+	MaxBatchSize int
+
+	// MaxPending is the most Results and Incident events buffered waiting to be inserted.  Those processed while the
+	// buffer is full are dropped and counted in Dropped (default 100000).
+	MaxPending int
+
+	// OnError is called with insert errors, as inserts happen in the background rather than in Process.
+	OnError func(err error)
+
+	results []resultRow
+	events  []eventRow
+	mu      sync.Mutex
+	flusher background.Loop
+	flushMu sync.Mutex
+
+	dropped atomic.Uint64
+}
+
+// resultRow is a Result as it will be inserted, copied so later changes to the Result aren't seen.
+type resultRow struct {
+	checkId string
+	result  check.Result
+}
+
+type eventRow struct {
+	checkId            string
+	eventType          check.IncidentEventType
+	incident           check.Incident
+	previousIncidentId *string
+	resultId           *string
+	time               time.Time
+}
+
+func NewHandler(db *sql.DB, dialect *Dialect) *Handler {
+	return &Handler{
+		DB:            db,
+		Dialect:       dialect,
+		FlushInterval: 5 * time.Second,
+		MaxBatchSize:  500,
+		MaxPending:    100000,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	row := resultRow{checkId: chk.Id, result: *result}
+	row.result.Metrics = slices.Clone(result.Metrics)
+
+	if !h.flusher.Start(h.flushInterval(), h.Flush, h.OnError) {
+		return errors.New("sql handler is closed")
+	}
+
+	h.mu.Lock()
+	if len(h.results)+len(h.events) >= h.maxPending() {
+		h.mu.Unlock()
+		h.dropped.Add(1)
+		chk.Debugf("sql buffer full, dropping result")
+		return nil
+	}
+	h.results = append(h.results, row)
+	full := len(h.results) >= h.maxBatchSize()
+	h.mu.Unlock()
+
+	if full {
+		h.flusher.Kick()
+	}
+	return nil
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	row := eventRow{
+		checkId:   chk.Id,
+		eventType: event.Type,
+		incident:  *event.Incident.Clone(),
+		time:      event.Time,
+	}
+	if event.PreviousIncident != nil {
+		id := event.PreviousIncident.Id.String()
+		row.previousIncidentId = &id
+	}
+	if event.Result != nil {
+		id := event.Result.Id.String()
+		row.resultId = &id
+	}
+
+	if !h.flusher.Start(h.flushInterval(), h.Flush, h.OnError) {
+		return errors.New("sql handler is closed")
+	}
+
+	h.mu.Lock()
+	if len(h.results)+len(h.events) >= h.maxPending() {
+		h.mu.Unlock()
+		h.dropped.Add(1)
+		chk.Debugf("sql buffer full, dropping incident %s event", event.Type)
+		return nil
+	}
+	h.events = append(h.events, row)
+	full := len(h.events) >= h.maxBatchSize()
+	h.mu.Unlock()
+
+	if full {
+		h.flusher.Kick()
+	}
+	return nil
+}
+
+// Dropped returns the number of Results and Incident events dropped because the buffer was full.
+func (h *Handler) Dropped() uint64 {
+	return h.dropped.Load()
+}
+
+// Flush inserts every buffered row now.
+func (h *Handler) Flush() error {
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+
+	for {
+		results, events := h.nextBatch()
+		if results == nil && events == nil {
+			return nil
+		}
+		if err := h.insert(results, events); err != nil {
+			return err
+		}
+		h.removeBatch(len(results), len(events))
+	}
+}
+
+// Close stops the background flusher and inserts every buffered row.  Results and Incident events processed after
+// Close are refused.
+func (h *Handler) Close() error {
+	h.flusher.Stop()
+	return h.Flush()
+}
+
+// nextBatch returns copies of up to MaxBatchSize results and events from the front of the buffer, or nils if it is
+// empty.  They are left buffered until removeBatch, once inserted.
+func (h *Handler) nextBatch() ([]resultRow, []eventRow) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var results []resultRow
+	var events []eventRow
+	if len(h.results) > 0 {
+		results = slices.Clone(h.results[:min(len(h.results), h.maxBatchSize())])
+	}
+	if len(h.events) > 0 {
+		events = slices.Clone(h.events[:min(len(h.events), h.maxBatchSize())])
+	}
+	return results, events
+}
+
+// removeBatch removes the results and events of a batch from the front of the buffer.
+func (h *Handler) removeBatch(results, events int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.results = h.results[results:]
+	h.events = h.events[events:]
+}
+
+func (h *Handler) insert(results []resultRow, events []eventRow) error {
+	ctx := context.Background()
+	tx, err := h.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error inserting %d results and %d incident events: %v", len(results), len(events), err)
+	}
+	defer tx.Rollback()
+
+	var resultValues, metricValues, eventValues [][]any
+	for _, r := range results {
+		id := r.result.Id.String()
+		resultValues = append(resultValues,
+			[]any{id, r.checkId, int(r.result.State), r.result.ReasonCode, r.result.Time.UnixMilli()})
+		for _, m := range r.result.Metrics {
+			metricValues = append(metricValues, []any{id, m.Label, m.Value, int(m.Type)})
+		}
+	}
+	for _, e := range events {
+		eventValues = append(eventValues, []any{
+			e.checkId, e.incident.Id.String(), int(e.eventType), int(e.incident.FromState),
+			int(e.incident.ToState), e.incident.ReasonCode, e.incident.Time.UnixMilli(),
+			nullableMilli(e.incident.Resolved), e.previousIncidentId, e.resultId, e.time.UnixMilli(),
+		})
+	}
+
+	inserts := []struct {
+		table   string
+		columns []string
+		rows    [][]any
+	}{
+		{"gopoller_results", []string{"id", "check_id", "state", "reason_code", "time"}, resultValues},
+		{"gopoller_metrics", []string{"result_id", "label", "value", "type"}, metricValues},
+		{"gopoller_incident_events", []string{"check_id", "incident_id", "type", "from_state", "to_state",
+			"reason_code", "incident_time", "resolved", "previous_incident_id", "result_id", "time"}, eventValues},
+	}
+	for _, i := range inserts {
+		if err = h.dialect().insert(ctx, tx, i.table, i.columns, i.rows); err != nil {
+			return fmt.Errorf("error inserting into %s: %v", i.table, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("error inserting %d results and %d incident events: %v", len(results), len(events), err)
+	}
+	return nil
+}
+
+func (h *Handler) dialect() *Dialect {
+	if h.Dialect == nil {
+		return SQLite
+	}
+	return h.Dialect
+}
+
+func (h *Handler) flushInterval() time.Duration {
+	if h.FlushInterval <= 0 {
+		return 5 * time.Second
+	}
+	return h.FlushInterval
+}
+
+func (h *Handler) maxBatchSize() int {
+	if h.MaxBatchSize <= 0 {
+		return 500
+	}
+	return h.MaxBatchSize
+}
+
+func (h *Handler) maxPending() int {
+	if h.MaxPending <= 0 {
+		return 100000
+	}
+	return h.MaxPending
+}
+
+// nullableMilli returns t in Unix milliseconds, or nil for a NULL.
+func nullableMilli(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.UnixMilli()
+}
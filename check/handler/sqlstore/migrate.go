@@ -0,0 +1,111 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migrations returns the schema changes for a dialect, in the order they are applied.  Each migration's version is
+// its index + 1.  Released migrations must never change; alter the schema by adding a migration.
+//
+// Times are stored as Unix milliseconds.
+func migrations(d *Dialect) [][]string {
+	return [][]string{
+		{
+			`CREATE TABLE gopoller_checks (
+				id VARCHAR(255) NOT NULL PRIMARY KEY,
+				interval_seconds INTEGER,
+				meta TEXT,
+				suppress_incidents BOOLEAN NOT NULL DEFAULT FALSE,
+				last_check BIGINT,
+				last_result TEXT,
+				incident TEXT,
+				next_due BIGINT
+			)`,
+			`CREATE INDEX gopoller_checks_next_due ON gopoller_checks (next_due)`,
+			`CREATE TABLE gopoller_results (
+				id VARCHAR(36) NOT NULL PRIMARY KEY,
+				check_id VARCHAR(255) NOT NULL,
+				state SMALLINT NOT NULL,
+				reason_code VARCHAR(255) NOT NULL,
+				time BIGINT NOT NULL
+			)`,
+			`CREATE INDEX gopoller_results_check_time ON gopoller_results (check_id, time)`,
+			`CREATE TABLE gopoller_metrics (
+				id ` + d.autoIncrementKey + `,
+				result_id VARCHAR(36) NOT NULL,
+				label VARCHAR(255) NOT NULL,
+				value VARCHAR(255) NOT NULL,
+				type SMALLINT NOT NULL
+			)`,
+			`CREATE INDEX gopoller_metrics_result ON gopoller_metrics (result_id)`,
+			`CREATE TABLE gopoller_incident_events (
+				id ` + d.autoIncrementKey + `,
+				check_id VARCHAR(255) NOT NULL,
+				incident_id VARCHAR(36) NOT NULL,
+				type SMALLINT NOT NULL,
+				from_state SMALLINT NOT NULL,
+				to_state SMALLINT NOT NULL,
+				reason_code VARCHAR(255) NOT NULL,
+				incident_time BIGINT NOT NULL,
+				resolved BIGINT,
+				previous_incident_id VARCHAR(36),
+				result_id VARCHAR(36),
+				time BIGINT NOT NULL
+			)`,
+			`CREATE INDEX gopoller_incident_events_check_time ON gopoller_incident_events (check_id, time)`,
+			`CREATE INDEX gopoller_incident_events_incident ON gopoller_incident_events (incident_id)`,
+		},
+	}
+}
+
+// Migrate creates or updates the schema of db to the latest version, recording the versions applied in the
+// gopoller_schema_migrations table.  It is safe to call on every start.
+func Migrate(ctx context.Context, db *sql.DB, d *Dialect) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS gopoller_schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return fmt.Errorf("error creating migrations table: %v", err)
+	}
+
+	var current int
+	err = db.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM gopoller_schema_migrations").Scan(&current)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %v", err)
+	}
+
+	for i, statements := range migrations(d)[min(current, len(migrations(d))):] {
+		version := current + i + 1
+		if err = migrate(ctx, db, d, version, statements); err != nil {
+			return fmt.Errorf("error migrating schema to version %d: %v", version, err)
+		}
+	}
+	return nil
+}
+
+// migrate applies the statements of a version in a transaction.  MySQL commits DDL statements implicitly, so a
+// failed migration there may need cleaning up by hand.
+func migrate(ctx context.Context, db *sql.DB, d *Dialect, version int, statements []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, s := range statements {
+		if _, err = tx.ExecContext(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, d.rebind("INSERT INTO gopoller_schema_migrations (version, applied) VALUES (?, ?)"),
+		version, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
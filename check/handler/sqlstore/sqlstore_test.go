@@ -0,0 +1,343 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/google/uuid"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/seankndy/gopoller/bufqueue"
+	"github.com/seankndy/gopoller/check"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+var (
+	_ bufqueue.CheckProvider     = (*CheckStore)(nil)
+	_ bufqueue.CheckEnqueuer     = (*CheckStore)(nil)
+	_ check.IncidentEventHandler = (*Handler)(nil)
+)
+
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+	})
+	if err = Migrate(context.Background(), db, SQLite); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return db
+}
+
+func TestMigrateIsIdempotent(t *testing.T) {
+	db := openTestDB(t)
+	if err := Migrate(context.Background(), db, SQLite); err != nil {
+		t.Fatalf("unexpected error migrating again: %v", err)
+	}
+
+	var versions int
+	if err := db.QueryRow("SELECT COUNT(*) FROM gopoller_schema_migrations").Scan(&versions); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if versions != len(migrations(SQLite)) {
+		t.Errorf("expected %d migrations recorded, got %d", len(migrations(SQLite)), versions)
+	}
+}
+
+func TestDialects(t *testing.T) {
+	tests := []struct {
+		dialect *Dialect
+		rebind  string
+		upsert  string
+	}{
+		{
+			SQLite,
+			"a = ? AND b = ?",
+			"INSERT INTO t (id, a) VALUES (?, ?) ON CONFLICT (id) DO UPDATE SET a = excluded.a",
+		},
+		{
+			PostgreSQL,
+			"a = $1 AND b = $2",
+			"INSERT INTO t (id, a) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET a = excluded.a",
+		},
+		{
+			MySQL,
+			"a = ? AND b = ?",
+			"INSERT INTO t (id, a) VALUES (?, ?) ON DUPLICATE KEY UPDATE a = VALUES(a)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dialect.Name, func(t *testing.T) {
+			if got := tt.dialect.rebind("a = ? AND b = ?"); got != tt.rebind {
+				t.Errorf("wanted %q, got %q", tt.rebind, got)
+			}
+			if got := tt.dialect.upsert("t", "id", []string{"id", "a"}); got != tt.upsert {
+				t.Errorf("wanted %q, got %q", tt.upsert, got)
+			}
+		})
+	}
+}
+
+func TestHandlerInsertsResultsAndIncidentEvents(t *testing.T) {
+	db := openTestDB(t)
+	h := NewHandler(db, SQLite)
+	h.FlushInterval = time.Hour
+	h.MaxBatchSize = 1
+	// a small parameter limit splits the metric inserts
+	dialect := *SQLite
+	dialect.maxParams = 8
+	h.Dialect = &dialect
+
+	chk := check.New("router1")
+	first := check.NewResult(check.StateOk, "", []check.ResultMetric{
+		{Label: "rtt", Value: "1.5", Type: check.ResultMetricGauge},
+		{Label: "octets", Value: "100", Type: check.ResultMetricCounter},
+		{Label: "loss", Value: "0", Type: check.ResultMetricGauge},
+	})
+	second := check.NewResult(check.StateCrit, "TIMEOUT", nil)
+	for _, r := range []*check.Result{first, second} {
+		if err := h.Process(chk, r, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	previous := &check.Incident{Id: uuid.New(), FromState: check.StateOk, ToState: check.StateWarn, Time: first.Time}
+	previous.Resolve()
+	incident := check.MakeIncidentFromResults(first, second)
+	err := h.ProcessIncidentEvent(chk, check.IncidentEvent{
+		Type:             check.IncidentEscalated,
+		Incident:         incident,
+		PreviousIncident: previous,
+		Result:           second,
+		Time:             second.Time,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if err = h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows, err := db.Query("SELECT id, state, reason_code, time FROM gopoller_results WHERE check_id = ? ORDER BY state",
+		"router1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id, reasonCode string
+		var state int
+		var ms int64
+		if err := rows.Scan(&id, &state, &reasonCode, &ms); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		ids = append(ids, id)
+		if id == second.Id.String() && (state != int(check.StateCrit) || reasonCode != "TIMEOUT" ||
+			ms != second.Time.UnixMilli()) {
+			t.Errorf("unexpected result row %s %d %s %d", id, state, reasonCode, ms)
+		}
+	}
+	rows.Close()
+	if !slices.Equal(ids, []string{first.Id.String(), second.Id.String()}) {
+		t.Errorf("expected both results inserted, got %v", ids)
+	}
+
+	var metrics int
+	var value string
+	err = db.QueryRow("SELECT COUNT(*), MAX(CASE WHEN label = 'octets' THEN value END) FROM gopoller_metrics "+
+		"WHERE result_id = ? AND type = ?", first.Id.String(), int(check.ResultMetricCounter)).Scan(&metrics, &value)
+	if err != nil || metrics != 1 || value != "100" {
+		t.Errorf("unexpected counter metric %d %q (%v)", metrics, value, err)
+	}
+	if err = db.QueryRow("SELECT COUNT(*) FROM gopoller_metrics").Scan(&metrics); err != nil || metrics != 3 {
+		t.Errorf("expected 3 metrics, got %d (%v)", metrics, err)
+	}
+
+	var eventType, toState int
+	var previousId, resultId string
+	err = db.QueryRow("SELECT type, to_state, previous_incident_id, result_id FROM gopoller_incident_events "+
+		"WHERE incident_id = ?", incident.Id.String()).Scan(&eventType, &toState, &previousId, &resultId)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if eventType != int(check.IncidentEscalated) || toState != int(check.StateCrit) ||
+		previousId != previous.Id.String() || resultId != second.Id.String() {
+		t.Errorf("unexpected incident event row %d %d %s %s", eventType, toState, previousId, resultId)
+	}
+}
+
+func TestHandlerRetriesFailedInserts(t *testing.T) {
+	db := openTestDB(t)
+	h := NewHandler(db, SQLite)
+	h.FlushInterval = time.Hour
+	errs := make(chan error, 1)
+	h.OnError = func(err error) {
+		errs <- err
+	}
+
+	if _, err := db.Exec("ALTER TABLE gopoller_metrics RENAME TO gopoller_metrics_moved"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.MaxBatchSize = 1
+	result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "rtt", Value: "1"}})
+	if err := h.Process(check.New("router1"), result, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Errorf("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the background flush to report an error")
+	}
+
+	// the transaction was rolled back, so the result wasn't inserted without its metrics
+	var results int
+	if err := db.QueryRow("SELECT COUNT(*) FROM gopoller_results").Scan(&results); err != nil || results != 0 {
+		t.Errorf("expected no results, got %d (%v)", results, err)
+	}
+
+	// the failed batch is retried once the database recovers
+	if _, err := db.Exec("ALTER TABLE gopoller_metrics_moved RENAME TO gopoller_metrics"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var metrics int
+	if err := db.QueryRow("SELECT COUNT(*) FROM gopoller_results").Scan(&results); err != nil || results != 1 {
+		t.Errorf("expected 1 result, got %d (%v)", results, err)
+	}
+	if err := db.QueryRow("SELECT COUNT(*) FROM gopoller_metrics").Scan(&metrics); err != nil || metrics != 1 {
+		t.Errorf("expected 1 metric, got %d (%v)", metrics, err)
+	}
+
+	if err := h.Process(check.New("router1"), result, nil); err == nil {
+		t.Error("expected an error processing after Close")
+	}
+}
+
+func TestCheckStoreProvidesAndEnqueues(t *testing.T) {
+	db := openTestDB(t)
+	now := time.UnixMilli(1700000000000)
+	store := NewCheckStore(db, SQLite, func(chk *check.Check) error {
+		if chk.Meta["broken"] == true {
+			return errors.New("broken")
+		}
+		return nil
+	})
+	store.nowFunc = func() time.Time { return now }
+	var errs []error
+	store.OnError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	chks := []*check.Check{
+		check.New("a", check.WithPeriodicSchedule(60), check.WithMeta(map[string]any{"host": "10.0.0.1", "port": 161})),
+		check.New("b", check.WithSchedule(check.PeriodicSchedule{IntervalSeconds: 300}), check.WithSuppressedIncidents()),
+		check.New("broken", check.WithPeriodicSchedule(60), check.WithMeta(map[string]any{"broken": true})),
+		check.New("unscheduled"),
+	}
+	for _, chk := range chks {
+		if err := store.Save(chk); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	provided := store.Provide()
+	var ids []string
+	for _, chk := range provided {
+		ids = append(ids, chk.Id)
+	}
+	slices.Sort(ids)
+	if !slices.Equal(ids, []string{"a", "b"}) {
+		t.Fatalf("expected checks a and b, got %v", ids)
+	}
+	if len(errs) != 2 {
+		t.Errorf("expected errors for the broken and unscheduled checks, got %v", errs)
+	}
+	a := provided[slices.IndexFunc(provided, func(c *check.Check) bool { return c.Id == "a" })]
+	if a.Meta["host"] != "10.0.0.1" || a.Meta["port"] != float64(161) || a.SuppressIncidents {
+		t.Errorf("unexpected check a %+v", a)
+	}
+	if interval := a.Schedule.(*check.PeriodicSchedule).IntervalSeconds; interval != 60 {
+		t.Errorf("expected a 60 second interval, got %d", interval)
+	}
+
+	// provided checks are leased until enqueued
+	if again := store.Provide(); len(again) != 0 {
+		t.Errorf("expected leased checks not to be provided again, got %d", len(again))
+	}
+
+	lastCheck := now
+	a.LastCheck = &lastCheck
+	a.LastResult = check.NewResult(check.StateCrit, "TIMEOUT", []check.ResultMetric{{Label: "rtt", Value: "5"}})
+	a.Incident = check.MakeIncidentFromResults(nil, a.LastResult)
+	a.Incident.AddNote("ops", "looking")
+	store.Enqueue([]*check.Check{a})
+
+	now = now.Add(59 * time.Second)
+	if again := store.Provide(); len(again) != 0 {
+		t.Errorf("expected check a not to be due yet, got %d checks", len(again))
+	}
+
+	now = now.Add(time.Second)
+	provided = store.Provide()
+	if len(provided) != 1 || provided[0].Id != "a" {
+		t.Fatalf("expected check a to be due, got %v", provided)
+	}
+	a = provided[0]
+	if a.LastCheck == nil || !a.LastCheck.Equal(lastCheck) {
+		t.Errorf("unexpected last check %v", a.LastCheck)
+	}
+	if a.LastResult == nil || a.LastResult.State != check.StateCrit || a.LastResult.Metrics[0].Value != "5" {
+		t.Errorf("unexpected last result %+v", a.LastResult)
+	}
+	if a.Incident == nil || a.Incident.ToState != check.StateCrit || len(a.Incident.Notes) != 1 {
+		t.Errorf("unexpected incident %+v", a.Incident)
+	}
+	if len(errs) != 2 {
+		t.Errorf("unexpected errors %v", errs[2:])
+	}
+}
+
+func TestCheckStoreWithBufqueue(t *testing.T) {
+	db := openTestDB(t)
+	store := NewCheckStore(db, SQLite, nil)
+	store.OnError = func(err error) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := store.Save(check.New("a", check.WithPeriodicSchedule(60))); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q := bufqueue.NewQueue(store, store, time.Hour, ctx)
+
+	chk := q.Dequeue()
+	if chk == nil || chk.Id != "a" {
+		t.Fatalf("expected check a, got %v", chk)
+	}
+	now := time.Now()
+	chk.LastCheck = &now
+	q.Enqueue(chk)
+	q.Flush()
+
+	var nextDue int64
+	if err := db.QueryRow("SELECT next_due FROM gopoller_checks WHERE id = 'a'").Scan(&nextDue); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := now.Add(time.Minute).UnixMilli(); nextDue != want {
+		t.Errorf("expected next due %d, got %d", want, nextDue)
+	}
+}
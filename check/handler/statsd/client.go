@@ -0,0 +1,194 @@
+package statsd
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultMaxPacketSize keeps datagrams within a 1500 byte Ethernet MTU after IP and UDP headers.
+const DefaultMaxPacketSize = 1432
+
+// Client is a long-lived UDP statsd client that packs lines into datagrams of at most MaxPacketSize bytes.  Lines
+// are buffered until the next would overflow the datagram or FlushInterval passes, so lines from many Checks share
+// datagrams.  A Client is safe for concurrent use.
+type Client struct {
+	// Addr is the host:port of the statsd server.
+	Addr string
+
+	// MaxPacketSize is the most bytes sent per datagram (default DefaultMaxPacketSize).
+	MaxPacketSize int
+
+	// FlushInterval is the most time a line is buffered before being sent (default 1 second).
+	FlushInterval time.Duration
+
+	// OnError is called with errors of background flushes.
+	OnError func(err error)
+
+	conn  net.Conn
+	buf   []byte
+	timer *time.Timer
+	mu    sync.Mutex
+}
+
+func NewClient(addr string) *Client {
+	return &Client{
+		Addr:          addr,
+		MaxPacketSize: DefaultMaxPacketSize,
+		FlushInterval: time.Second,
+	}
+}
+
+// sharedClient is a Client shared by every Handler sending to the same statsd server.
+type sharedClient struct {
+	*Client
+	handlers map[*Handler]bool
+}
+
+var (
+	sharedClients   = make(map[string]*sharedClient)
+	sharedClientsMu sync.Mutex
+)
+
+// acquireSharedClient returns the Client shared by every Handler sending to the statsd server of h, registering h
+// so that its OnError is called with the Client's background flush errors.
+func acquireSharedClient(h *Handler) *Client {
+	hostPort := net.JoinHostPort(h.Addr, strconv.Itoa(int(h.Port)))
+
+	sharedClientsMu.Lock()
+	defer sharedClientsMu.Unlock()
+
+	c, ok := sharedClients[hostPort]
+	if !ok {
+		c = &sharedClient{Client: NewClient(hostPort), handlers: make(map[*Handler]bool)}
+		c.OnError = func(err error) {
+			sharedClientsMu.Lock()
+			var onErrors []func(error)
+			for h := range c.handlers {
+				if h.OnError != nil {
+					onErrors = append(onErrors, h.OnError)
+				}
+			}
+			sharedClientsMu.Unlock()
+
+			for _, onError := range onErrors {
+				onError(err)
+			}
+		}
+		sharedClients[hostPort] = c
+	}
+	c.handlers[h] = true
+	return c.Client
+}
+
+// releaseSharedClient unregisters h from the Client shared by the Handlers sending to its statsd server.  The
+// Client is closed once no Handler uses it, or else its buffered lines are sent.
+func releaseSharedClient(h *Handler) error {
+	hostPort := net.JoinHostPort(h.Addr, strconv.Itoa(int(h.Port)))
+
+	sharedClientsMu.Lock()
+	c, ok := sharedClients[hostPort]
+	if !ok || !c.handlers[h] {
+		sharedClientsMu.Unlock()
+		return nil
+	}
+	delete(c.handlers, h)
+	last := len(c.handlers) == 0
+	if last {
+		delete(sharedClients, hostPort)
+	}
+	sharedClientsMu.Unlock()
+
+	if last {
+		return c.Close()
+	}
+	return c.Flush()
+}
+
+// Send buffers lines, each a single statsd line without the trailing newline.  A full datagram is sent
+// immediately; the remainder is sent once FlushInterval passes or on Flush.
+func (c *Client) Send(lines ...string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	maxSize := c.MaxPacketSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxPacketSize
+	}
+
+	for _, line := range lines {
+		if len(c.buf) > 0 && len(c.buf)+1+len(line) > maxSize {
+			if err := c.flush(); err != nil {
+				return err
+			}
+		}
+		if len(c.buf) > 0 {
+			c.buf = append(c.buf, '\n')
+		}
+		c.buf = append(c.buf, line...)
+	}
+
+	if len(c.buf) > 0 && c.timer == nil {
+		interval := c.FlushInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		c.timer = time.AfterFunc(interval, func() {
+			if err := c.Flush(); err != nil && c.OnError != nil {
+				c.OnError(err)
+			}
+		})
+	}
+
+	return nil
+}
+
+// Flush sends any buffered lines now.
+func (c *Client) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.flush()
+}
+
+// Close sends any buffered lines and closes the socket.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.flush()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
+
+func (c *Client) flush() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return nil
+	}
+
+	if c.conn == nil {
+		dialer := net.Dialer{Timeout: 10 * time.Second}
+		conn, err := dialer.Dial("udp", c.Addr)
+		if err != nil {
+			c.buf = c.buf[:0]
+			return err
+		}
+		c.conn = conn
+	}
+
+	_, err := c.conn.Write(c.buf)
+	c.buf = c.buf[:0]
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return err
+}
@@ -1,11 +1,27 @@
 package statsd
 
 import (
+	"errors"
 	"fmt"
 	"github.com/seankndy/gopoller/check"
-	"net"
+	"slices"
+	"strconv"
 	"strings"
-	"time"
+	"sync/atomic"
+)
+
+// TagDialect is the statsd extension used to send tags.
+type TagDialect uint8
+
+const (
+	// NoTags sends no tags, for plain statsd servers.
+	NoTags TagDialect = iota
+	// DogStatsD appends tags as "|#key:value,key:value".
+	DogStatsD
+	// InfluxDB appends tags to the metric name as ",key=value,key=value" (Telegraf statsd input).
+	InfluxDB
+	// Graphite appends tags to the metric name as ";key=value;key=value".
+	Graphite
 )
 
 type Handler struct {
@@ -15,62 +31,204 @@ type Handler struct {
 	Port uint16
 	// MetricPrefix defines the statsd path prefix for a given Check and Result (default "")
 	MetricPrefix func(*check.Check, *check.Result) string
+
+	// Client sends the lines.  When nil, a Client shared by every Handler with the same Addr and Port is used, so
+	// that lines from many Checks are packed into the same datagrams.
+	Client *Client
+
+	// TagDialect is how TagMetaKeys are sent (default NoTags).
+	TagDialect TagDialect
+	// TagMetaKeys are the Check.Meta keys sent as tags.  Keys missing from a Check or with empty values are
+	// omitted.
+	TagMetaKeys []string
+
+	// StateMetric, when set, also sends the check.ResultState as a gauge with this label.
+	StateMetric string
+
+	// ResetNegativeGauges sends a 0 gauge before each negative gauge, for servers that treat a signed gauge value
+	// as a delta (ex. Etsy statsd).
+	ResetNegativeGauges bool
+
+	// OnError is called with errors sending lines, as buffered lines are sent in the background rather than in
+	// Process.  A datagram of the shared Client holds the lines of every Handler using it, so its errors are passed
+	// to each of their OnError.  Set Client.OnError instead when Client is set.
+	OnError func(err error)
+
+	closed atomic.Bool
 }
 
 func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
 	return
 }
 
-func (h *Handler) Process(chk *check.Check, newResult *check.Result, _ *check.Incident) (err error) {
-	if newResult.Metrics == nil {
-		return
+func (h *Handler) Process(chk *check.Check, newResult *check.Result, _ *check.Incident) error {
+	lines := h.buildLines(chk, newResult)
+	if len(lines) == 0 {
+		return nil
 	}
 
-	dialer := net.Dialer{Timeout: 10 * time.Second}
-	conn, err := dialer.Dial("udp", fmt.Sprintf("%s:%d", h.Addr, h.Port))
-	if err != nil {
-		return
+	if h.closed.Load() {
+		return errors.New("statsd handler is closed")
 	}
-	defer func() {
-		err = conn.Close()
-	}()
 
-	err = conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
-	if err != nil {
-		return
+	return h.client().Send(lines...)
+}
+
+// Flush sends the lines buffered by the Handler's Client now.
+func (h *Handler) Flush() error {
+	if h.closed.Load() {
+		return nil
 	}
+	return h.client().Flush()
+}
 
-	msg := h.buildProtocolMessage(chk, newResult)
-	var written int
-	for written < len(msg) {
-		var n int
-		n, err = conn.Write([]byte(msg[written:]))
-		if err != nil {
-			return
-		}
-		written += n
+// Close sends the lines buffered by the Handler's Client and closes it.  A shared Client is only closed once every
+// Handler using it is closed.  Results processed after Close are refused.
+func (h *Handler) Close() error {
+	h.closed.Store(true)
+	if h.Client != nil {
+		return h.Client.Close()
 	}
+	return releaseSharedClient(h)
+}
 
-	return
+// client returns the Client the Handler sends lines with.
+func (h *Handler) client() *Client {
+	if h.Client != nil {
+		return h.Client
+	}
+	return acquireSharedClient(h)
 }
 
-func (h *Handler) buildProtocolMessage(chk *check.Check, result *check.Result) string {
+func (h *Handler) buildLines(chk *check.Check, result *check.Result) []string {
 	var metricPrefix string
 	if h.MetricPrefix != nil {
 		metricPrefix = strings.TrimRight(strings.ToLower(h.MetricPrefix(chk, result)), ".")
 	}
+	name := func(label string) string {
+		if metricPrefix == "" {
+			return label
+		}
+		return metricPrefix + "." + label
+	}
 
-	var msg strings.Builder
+	tags := h.tags(chk)
+
+	var lines []string
 	for _, metric := range result.Metrics {
 		if metric.Value == "" {
 			continue
 		}
 
-		if metric.Value[:1] == "-" { // negative number
+		if metric.Type == check.ResultMetricCounter {
+			if delta, ok := counterDelta(chk.LastResult, metric); ok {
+				lines = append(lines, h.line(name(metric.Label), strconv.FormatUint(delta, 10), "c", tags))
+			}
+			continue
+		}
+
+		if h.ResetNegativeGauges && metric.Value[:1] == "-" {
 			// see https://github.com/statsd/statsd/blob/master/docs/metric_types.md#gauges
-			msg.WriteString(fmt.Sprintf("%s.%s:0|g\n", metricPrefix, metric.Label))
+			lines = append(lines, h.line(name(metric.Label), "0", "g", tags))
+		}
+		lines = append(lines, h.line(name(metric.Label), metric.Value, "g", tags))
+	}
+
+	if h.StateMetric != "" {
+		lines = append(lines, h.line(name(h.StateMetric), strconv.Itoa(int(result.State)), "g", tags))
+	}
+
+	return lines
+}
+
+// tag is a statsd tag key/value pair.
+type tag struct {
+	key, value string
+}
+
+func (h *Handler) tags(chk *check.Check) []tag {
+	if h.TagDialect == NoTags {
+		return nil
+	}
+
+	var tags []tag
+	for _, key := range h.TagMetaKeys {
+		v, ok := chk.Meta[key]
+		if !ok || v == nil || fmt.Sprint(v) == "" {
+			continue
+		}
+		tags = append(tags, tag{key: sanitizeTag(key), value: sanitizeTag(fmt.Sprint(v))})
+	}
+	slices.SortFunc(tags, func(a, b tag) int {
+		return strings.Compare(a.key, b.key)
+	})
+	return tags
+}
+
+// line formats a statsd line in the Handler's tag dialect.
+func (h *Handler) line(name, value, metricType string, tags []tag) string {
+	var b strings.Builder
+	b.WriteString(name)
+
+	switch h.TagDialect {
+	case InfluxDB:
+		for _, t := range tags {
+			b.WriteString("," + t.key + "=" + t.value)
+		}
+	case Graphite:
+		for _, t := range tags {
+			b.WriteString(";" + t.key + "=" + t.value)
+		}
+	}
+
+	b.WriteString(":" + value + "|" + metricType)
+
+	if h.TagDialect == DogStatsD && len(tags) > 0 {
+		b.WriteString("|#")
+		for i, t := range tags {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(t.key + ":" + t.value)
 		}
-		msg.WriteString(fmt.Sprintf("%s.%s:%s|g\n", metricPrefix, metric.Label, metric.Value))
 	}
-	return msg.String()
+
+	return b.String()
+}
+
+// counterDelta returns how much a counter metric increased since the same metric in lastResult.  It returns false
+// when there is no previous value or the counter went backwards (a reset or rollover), as the delta is unknown.
+func counterDelta(lastResult *check.Result, metric check.ResultMetric) (uint64, bool) {
+	if lastResult == nil {
+		return 0, false
+	}
+
+	current, err := strconv.ParseUint(metric.Value, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	for _, m := range lastResult.Metrics {
+		if m.Label != metric.Label {
+			continue
+		}
+		previous, err := strconv.ParseUint(m.Value, 10, 64)
+		if err != nil || current < previous {
+			return 0, false
+		}
+		return current - previous, true
+	}
+
+	return 0, false
+}
+
+// sanitizeTag replaces the characters that delimit tags in any dialect with underscores.
+func sanitizeTag(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ',', ':', '=', ';', '|', '#', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, s)
 }
@@ -0,0 +1,229 @@
+package statsd
+
+import (
+	"github.com/seankndy/gopoller/check"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildLines(t *testing.T) {
+	chk := &check.Check{
+		Id:   "router1",
+		Meta: map[string]any{"site": "dc 1", "role": "core", "empty": ""},
+		LastResult: check.NewResult(check.StateOk, "", []check.ResultMetric{
+			{Label: "in_octets", Value: "1000", Type: check.ResultMetricCounter},
+			{Label: "resets", Value: "50", Type: check.ResultMetricCounter},
+		}),
+	}
+	result := check.NewResult(check.StateWarn, "", []check.ResultMetric{
+		{Label: "temp", Value: "-5", Type: check.ResultMetricGauge},
+		{Label: "in_octets", Value: "1500", Type: check.ResultMetricCounter},
+		{Label: "resets", Value: "3", Type: check.ResultMetricCounter},
+		{Label: "new_counter", Value: "7", Type: check.ResultMetricCounter},
+	})
+
+	tests := []struct {
+		name    string
+		handler *Handler
+		want    []string
+	}{
+		{
+			name:    "no_tags",
+			handler: &Handler{},
+			want:    []string{"temp:-5|g", "in_octets:500|c"},
+		},
+		{
+			name: "dogstatsd_with_state_and_prefix",
+			handler: &Handler{
+				MetricPrefix: func(c *check.Check, _ *check.Result) string { return "Net." + c.Id + "." },
+				TagDialect:   DogStatsD,
+				TagMetaKeys:  []string{"site", "role", "empty", "missing"},
+				StateMetric:  "state",
+			},
+			want: []string{
+				"net.router1.temp:-5|g|#role:core,site:dc_1",
+				"net.router1.in_octets:500|c|#role:core,site:dc_1",
+				"net.router1.state:1|g|#role:core,site:dc_1",
+			},
+		},
+		{
+			name:    "influxdb",
+			handler: &Handler{TagDialect: InfluxDB, TagMetaKeys: []string{"role"}},
+			want:    []string{"temp,role=core:-5|g", "in_octets,role=core:500|c"},
+		},
+		{
+			name:    "graphite_reset_negative",
+			handler: &Handler{TagDialect: Graphite, TagMetaKeys: []string{"role"}, ResetNegativeGauges: true},
+			want:    []string{"temp;role=core:0|g", "temp;role=core:-5|g", "in_octets;role=core:500|c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.handler.buildLines(chk, result)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestClientPacksDatagrams(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	c := NewClient(conn.LocalAddr().String())
+	c.MaxPacketSize = 20
+	c.FlushInterval = time.Hour
+	defer c.Close()
+
+	h := &Handler{Client: c}
+	for _, id := range []string{"a", "b", "c"} {
+		result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: id + "_rtt", Value: "1"}})
+		if err := h.Process(&check.Check{Id: id}, result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{"a_rtt:1|g\nb_rtt:1|g", "c_rtt:1|g"}
+	buf := make([]byte, 1500)
+	for _, w := range want {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if string(buf[:n]) != w {
+			t.Errorf("expected datagram %q, got %q", w, buf[:n])
+		}
+	}
+}
+
+func TestClientFlushesAfterInterval(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	c := NewClient(conn.LocalAddr().String())
+	c.FlushInterval = 10 * time.Millisecond
+	defer c.Close()
+
+	if err := c.Send("rtt:1|g"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 1500)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected datagram after flush interval: %v", err)
+	}
+	if !strings.HasPrefix(string(buf[:n]), "rtt:1|g") {
+		t.Errorf("unexpected datagram %q", buf[:n])
+	}
+}
+
+func TestSharedClient(t *testing.T) {
+	h1 := &Handler{Addr: "127.0.0.1", Port: 8125}
+	h2 := &Handler{Addr: "127.0.0.1", Port: 8125}
+	h3 := &Handler{Addr: "::1", Port: 8125}
+	defer h1.Close()
+	defer h2.Close()
+	defer h3.Close()
+
+	if h1.client() != h2.client() {
+		t.Error("expected handlers for the same server to share a client")
+	}
+	if h1.client() == h3.client() {
+		t.Error("expected handlers for different servers to use different clients")
+	}
+	if got := h3.client().Addr; got != "[::1]:8125" {
+		t.Errorf("expected IPv6 address [::1]:8125, got %s", got)
+	}
+}
+
+func TestSharedClientReportsBackgroundErrorsToEachHandler(t *testing.T) {
+	errs := make(chan error, 10)
+	var handlers []*Handler
+	for i := 0; i < 2; i++ {
+		h := &Handler{Addr: "256.0.0.1", Port: 8125, OnError: func(err error) { errs <- err }}
+		h.client().FlushInterval = 10 * time.Millisecond
+		handlers = append(handlers, h)
+	}
+
+	chk := &check.Check{Id: "router1"}
+	result := &check.Result{Metrics: []check.ResultMetric{{Label: "rtt", Value: "1", Type: check.ResultMetricGauge}}}
+	if err := handlers[0].Process(chk, result, nil); err != nil {
+		t.Fatalf("expected the error to be reported in the background, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-errs:
+		case <-time.After(2 * time.Second):
+			t.Fatal("expected the background flush error to be passed to each handler's OnError")
+		}
+	}
+	if err := handlers[1].Process(chk, result, nil); err != nil {
+		t.Errorf("expected the error not to be returned to another handler, got %v", err)
+	}
+
+	for _, h := range handlers {
+		h.Close()
+	}
+}
+
+func TestCloseSendsBufferedLines(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	h1 := &Handler{Addr: "127.0.0.1", Port: uint16(addr.Port)}
+	h2 := &Handler{Addr: "127.0.0.1", Port: uint16(addr.Port)}
+	client := h1.client()
+	client.FlushInterval = time.Hour
+
+	chk := &check.Check{Id: "router1"}
+	result := &check.Result{Metrics: []check.ResultMetric{{Label: "rtt", Value: "1", Type: check.ResultMetricGauge}}}
+	for _, h := range []*Handler{h1, h2} {
+		if err := h.Process(chk, result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// the client is still used by h2, so closing h1 only sends the buffered lines
+	if err := h1.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	buf := make([]byte, 1500)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("expected the buffered lines to be sent on Close: %v", err)
+	}
+	if want := "rtt:1|g\nrtt:1|g"; string(buf[:n]) != want {
+		t.Errorf("expected datagram %q, got %q", want, buf[:n])
+	}
+	if err := h1.Process(chk, result, nil); err == nil {
+		t.Error("expected an error processing after Close")
+	}
+	if h2.client() != client {
+		t.Error("expected the shared client to stay in use by h2")
+	}
+	if err := h2.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+// Package syslog provides a check.Handler that sends Incident events, and optionally Results, as RFC 5424 syslog
+// messages over UDP, TCP, TLS or a unix socket.
+package syslog
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/seankndy/gopoller/check"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transport is how messages are sent to the syslog receiver.
+type Transport uint8
+
+const (
+	// UDP sends a datagram per message (RFC 5426).
+	UDP Transport = iota
+	// TCP sends messages with octet-counting framing (RFC 6587).
+	TCP
+	// TLS sends messages over TLS with octet-counting framing (RFC 5425).
+	TLS
+	// Unix sends a datagram per message to a unix socket, such as /dev/log (where journald also listens on
+	// systemd hosts).
+	Unix
+	// UnixStream sends messages to a stream unix socket with octet-counting framing.
+	UnixStream
+)
+
+// Facility is a syslog facility.
+type Facility uint8
+
+const (
+	Kern Facility = iota
+	User
+	Mail
+	Daemon
+	Auth
+	Syslog
+	Lpr
+	News
+	Uucp
+	Cron
+	Authpriv
+	Ftp
+	Local0 Facility = iota + 4
+	Local1
+	Local2
+	Local3
+	Local4
+	Local5
+	Local6
+	Local7
+)
+
+// Severity is a syslog severity.
+type Severity uint8
+
+const (
+	Emergency Severity = iota
+	Alert
+	Critical
+	Error
+	Warning
+	Notice
+	Informational
+	Debug
+)
+
+// SeverityOf returns the Severity of a check.ResultState: Critical for CRIT, Error for UNKNOWN, Warning for WARN and
+// Informational for OK.
+func SeverityOf(state check.ResultState) Severity {
+	switch state {
+	case check.StateOk:
+		return Informational
+	case check.StateWarn:
+		return Warning
+	case check.StateCrit:
+		return Critical
+	default:
+		return Error
+	}
+}
+
+// DefaultEnterpriseId is the private enterprise number reserved for documentation (RFC 5612), used in structured
+// data ids when Handler.EnterpriseId is empty.
+const DefaultEnterpriseId = "32473"
+
+// Handler sends a syslog message for every Incident event of the Checks it processes, and for every Result if
+// Results is set.  The connection is kept open across messages (and Checks sharing the Handler) and re-established
+// when it fails.
+//
+// Messages have the MSGID of the event type (ex. OPENED) or RESULT, a Severity from the state of the Incident or
+// Result (Notice for resolved and acknowledged Incidents), and structured data elements "check" (id, state and
+// reason), "metrics" (the Result metrics by label) and "meta" (the MetaKeys of Check.Meta).
+type Handler struct {
+	Transport Transport
+
+	// Addr is the host:port of the receiver, or the socket path for Unix transports.
+	Addr string
+
+	// TLSConfig configures the TLS transport.
+	TLSConfig *tls.Config
+
+	// Facility of the messages (NewHandler defaults to Daemon).
+	Facility Facility
+
+	// Hostname and AppName identify the sender (default the host name and "gopoller").
+	Hostname string
+	AppName  string
+
+	// EnterpriseId is the private enterprise number of the structured data ids (default DefaultEnterpriseId).
+	EnterpriseId string
+
+	// Results sends a message for every Result, not just Incident events.
+	Results bool
+
+	// MetaKeys are the Check.Meta keys added to the "meta" structured data element.  Keys missing from a Check are
+	// omitted.
+	MetaKeys []string
+
+	// Timeout bounds connecting and each write (default 10 seconds).
+	Timeout time.Duration
+
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func NewHandler(transport Transport, addr string) *Handler {
+	hostname, _ := os.Hostname()
+
+	return &Handler{
+		Transport: transport,
+		Addr:      addr,
+		Facility:  Daemon,
+		Hostname:  hostname,
+		AppName:   "gopoller",
+		Timeout:   10 * time.Second,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	if !h.Results {
+		return nil
+	}
+
+	msg := fmt.Sprintf("%s %s", chk.Id, result.State)
+	if result.ReasonCode != "" {
+		msg += " " + result.ReasonCode
+	}
+	return h.send(h.message(SeverityOf(result.State), "RESULT", result.Time, h.structuredData(chk, result), msg))
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	incident := event.Incident
+
+	severity := SeverityOf(incident.ToState)
+	switch event.Type {
+	case check.IncidentResolved, check.IncidentDiscarded, check.IncidentAcknowledged:
+		severity = Notice
+	}
+
+	msg := fmt.Sprintf("%s incident %s: %s -> %s", chk.Id, strings.ToLower(event.Type.String()), incident.FromState,
+		incident.ToState)
+	if incident.ReasonCode != "" {
+		msg += " (" + incident.ReasonCode + ")"
+	}
+	if ack := incident.Acknowledgement; event.Type == check.IncidentAcknowledged && ack != nil {
+		msg += " by " + ack.By
+	}
+
+	sd := h.structuredData(chk, event.Result)
+	sd[0].params = append(sd[0].params, param{"incident", incident.Id.String()})
+	if event.PreviousIncident != nil {
+		sd[0].params = append(sd[0].params, param{"previous_incident", event.PreviousIncident.Id.String()})
+	}
+
+	chk.Debugf("sending syslog message for incident %s event", event.Type)
+	return h.send(h.message(severity, event.Type.String(), event.Time, sd, msg))
+}
+
+// Close closes the connection to the receiver.
+func (h *Handler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
+
+type param struct {
+	name, value string
+}
+
+type element struct {
+	id     string
+	params []param
+}
+
+// structuredData returns the "check", "metrics" and "meta" elements of a Check and its Result (which may be nil).
+// Empty elements are omitted, except "check" which is always first.
+func (h *Handler) structuredData(chk *check.Check, result *check.Result) []element {
+	enterpriseId := h.EnterpriseId
+	if enterpriseId == "" {
+		enterpriseId = DefaultEnterpriseId
+	}
+
+	sd := []element{{id: "check@" + enterpriseId, params: []param{{"id", chk.Id}}}}
+	if result == nil {
+		return sd
+	}
+
+	sd[0].params = append(sd[0].params, param{"state", result.State.String()})
+	if result.ReasonCode != "" {
+		sd[0].params = append(sd[0].params, param{"reason", result.ReasonCode})
+	}
+
+	metrics := element{id: "metrics@" + enterpriseId}
+	for _, m := range result.Metrics {
+		metrics.params = append(metrics.params, param{m.Label, m.Value})
+	}
+	meta := element{id: "meta@" + enterpriseId}
+	for _, key := range h.MetaKeys {
+		if v, ok := chk.Meta[key]; ok && v != nil {
+			meta.params = append(meta.params, param{key, fmt.Sprint(v)})
+		}
+	}
+
+	for _, e := range []element{metrics, meta} {
+		if len(e.params) > 0 {
+			sd = append(sd, e)
+		}
+	}
+	return sd
+}
+
+// message returns an RFC 5424 message without framing.
+func (h *Handler) message(severity Severity, msgId string, t time.Time, sd []element, msg string) []byte {
+	b := []byte{'<'}
+	b = strconv.AppendInt(b, int64(h.Facility)*8+int64(severity), 10)
+	b = append(b, ">1 "...)
+	b = t.UTC().AppendFormat(b, "2006-01-02T15:04:05.000000Z07:00")
+	b = append(b, ' ')
+	b = append(b, header(h.Hostname, 255)...)
+	b = append(b, ' ')
+	b = append(b, header(h.AppName, 48)...)
+	b = append(b, ' ')
+	b = strconv.AppendInt(b, int64(os.Getpid()), 10)
+	b = append(b, ' ')
+	b = append(b, header(msgId, 32)...)
+	b = append(b, ' ')
+
+	if len(sd) == 0 {
+		b = append(b, '-')
+	}
+	for _, e := range sd {
+		b = append(b, '[')
+		b = append(b, sdName(e.id)...)
+		for _, p := range e.params {
+			b = append(b, ' ')
+			b = append(b, sdName(p.name)...)
+			b = append(b, '=', '"')
+			b = append(b, sdValueEscaper.Replace(p.value)...)
+			b = append(b, '"')
+		}
+		b = append(b, ']')
+	}
+
+	if msg != "" {
+		b = append(b, ' ')
+		b = append(b, msg...)
+	}
+	return b
+}
+
+var sdValueEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// header returns s as a header field: printable US-ASCII of at most maxLen characters, or "-" (the nil value) if
+// empty.
+func header(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "-"
+	}
+	return s[:min(len(s), maxLen)]
+}
+
+// sdName returns s as a structured data id or param name: at most 32 printable US-ASCII characters other than '=',
+// ' ', ']' and '"'.
+func sdName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 || slices.Contains([]rune{'=', ']', '"'}, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	if s == "" {
+		return "_"
+	}
+	return s[:min(len(s), 32)]
+}
+
+// send writes msg to the receiver, connecting if needed.  A failed write is retried once on a new connection, as the
+// error is usually the receiver having closed an idle connection.
+func (h *Handler) send(msg []byte) error {
+	if h.Transport != UDP && h.Transport != Unix {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if h.conn == nil {
+			if h.conn, err = h.dial(); err != nil {
+				h.conn = nil
+				return fmt.Errorf("error connecting to syslog %s: %v", h.Addr, err)
+			}
+		}
+
+		if err = h.conn.SetWriteDeadline(time.Now().Add(h.timeout())); err == nil {
+			if _, err = h.conn.Write(msg); err == nil {
+				return nil
+			}
+		}
+
+		h.conn.Close()
+		h.conn = nil
+	}
+
+	return fmt.Errorf("error sending to syslog %s: %v", h.Addr, err)
+}
+
+func (h *Handler) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: h.timeout()}
+	switch h.Transport {
+	case TCP:
+		return dialer.Dial("tcp", h.Addr)
+	case TLS:
+		return tls.DialWithDialer(dialer, "tcp", h.Addr, h.TLSConfig)
+	case Unix:
+		return dialer.Dial("unixgram", h.Addr)
+	case UnixStream:
+		return dialer.Dial("unix", h.Addr)
+	default:
+		return dialer.Dial("udp", h.Addr)
+	}
+}
+
+func (h *Handler) timeout() time.Duration {
+	if h.Timeout <= 0 {
+		return 10 * time.Second
+	}
+	return h.Timeout
+}
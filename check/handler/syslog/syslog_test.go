@@ -0,0 +1,300 @@
+package syslog
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/google/uuid"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfc5424 matches a message: PRI, version, timestamp, hostname, app name, procid, msgid, structured data and msg.
+var rfc5424 = regexp.MustCompile(`^<(\d+)>1 (\S+) (\S+) (\S+) (\d+) (\S+) ((?:\[.*\])|-)(?: (.*))?$`)
+
+// receive starts a syslog receiver for network and returns its address and the messages it receives.  Stream
+// transports are read with octet-counting framing.
+func receive(t *testing.T, network string, tlsConfig *tls.Config) (string, chan string) {
+	t.Helper()
+	messages := make(chan string, 10)
+
+	addr := "127.0.0.1:0"
+	if strings.HasPrefix(network, "unix") {
+		addr = filepath.Join(t.TempDir(), "log.sock")
+	}
+
+	if network == "udp" || network == "unixgram" {
+		pc, err := net.ListenPacket(network, addr)
+		if err != nil {
+			t.Fatalf("unable to listen: %v", err)
+		}
+		t.Cleanup(func() { pc.Close() })
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, _, err := pc.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				messages <- string(buf[:n])
+			}
+		}()
+		return pc.LocalAddr().String(), messages
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go readFrames(conn, messages)
+		}
+	}()
+	return l.Addr().String(), messages
+}
+
+func readFrames(conn net.Conn, messages chan string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if err != nil {
+			messages <- "bad frame length " + length
+			return
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(r, msg); err != nil {
+			return
+		}
+		messages <- string(msg)
+	}
+}
+
+func next(t *testing.T, messages chan string) string {
+	t.Helper()
+	select {
+	case msg := <-messages:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected a message")
+		return ""
+	}
+}
+
+// selfSignedConfigs returns a server config with a self-signed certificate for 127.0.0.1 and a client config
+// trusting it.
+func selfSignedConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "syslog"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		&tls.Config{RootCAs: pool}
+}
+
+func testIncidentEvent() check.IncidentEvent {
+	result := check.NewResult(check.StateCrit, "TIMEOUT", []check.ResultMetric{{Label: "rtt ms", Value: "1.5"}})
+	incident := check.MakeIncidentFromResults(check.NewResult(check.StateOk, "", nil), result)
+	return check.IncidentEvent{
+		Type:     check.IncidentOpened,
+		Incident: incident,
+		Result:   result,
+		Time:     time.Date(2023, 11, 14, 22, 13, 20, 123456000, time.UTC),
+	}
+}
+
+func TestTransports(t *testing.T) {
+	serverTLS, clientTLS := selfSignedConfigs(t)
+
+	tests := []struct {
+		name      string
+		transport Transport
+		network   string
+		serverTLS *tls.Config
+	}{
+		{"udp", UDP, "udp", nil},
+		{"tcp", TCP, "tcp", nil},
+		{"tls", TLS, "tcp", serverTLS},
+		{"unix", Unix, "unixgram", nil},
+		{"unix stream", UnixStream, "unix", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, messages := receive(t, tt.network, tt.serverTLS)
+			h := NewHandler(tt.transport, addr)
+			h.TLSConfig = clientTLS
+			h.Hostname = "poller1"
+			defer h.Close()
+
+			chk := check.New("router1")
+			for i := 0; i < 2; i++ {
+				if err := h.ProcessIncidentEvent(chk, testIncidentEvent()); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+			}
+			for i := 0; i < 2; i++ {
+				if msg := next(t, messages); !rfc5424.MatchString(msg) || !strings.Contains(msg, " poller1 gopoller ") {
+					t.Errorf("unexpected message %q", msg)
+				}
+			}
+		})
+	}
+}
+
+func TestIncidentEventMessage(t *testing.T) {
+	addr, messages := receive(t, "udp", nil)
+	h := NewHandler(UDP, addr)
+	h.Hostname = "poller 1"
+	h.Facility = Local3
+	h.MetaKeys = []string{"site", "missing"}
+	defer h.Close()
+
+	chk := check.New("router1", check.WithMeta(map[string]any{"site": `dc"1]`}))
+	event := testIncidentEvent()
+	event.PreviousIncident = &check.Incident{Id: uuid.New()}
+	if err := h.ProcessIncidentEvent(chk, event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := rfc5424.FindStringSubmatch(next(t, messages))
+	if m == nil {
+		t.Fatalf("expected an RFC 5424 message")
+	}
+	if pri := m[1]; pri != strconv.Itoa(int(Local3)*8+int(Critical)) {
+		t.Errorf("expected local3.crit priority, got %s", pri)
+	}
+	if m[2] != "2023-11-14T22:13:20.123456Z" || m[3] != "poller_1" || m[5] != strconv.Itoa(os.Getpid()) ||
+		m[6] != "OPENED" {
+		t.Errorf("unexpected header %q", m[0])
+	}
+	wantSD := `[check@32473 id="router1" state="CRIT" reason="TIMEOUT" incident="` + event.Incident.Id.String() +
+		`" previous_incident="` + event.PreviousIncident.Id.String() + `"][metrics@32473 rtt_ms="1.5"]` +
+		`[meta@32473 site="dc\"1\]"]`
+	if m[7] != wantSD {
+		t.Errorf("wanted structured data %s, got %s", wantSD, m[7])
+	}
+	if m[8] != "router1 incident opened: OK -> CRIT (TIMEOUT)" {
+		t.Errorf("unexpected msg %q", m[8])
+	}
+
+	// resolved incidents are notices
+	event.Type = check.IncidentResolved
+	event.Result = nil
+	if err := h.ProcessIncidentEvent(chk, event); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m = rfc5424.FindStringSubmatch(next(t, messages))
+	if m == nil || m[1] != strconv.Itoa(int(Local3)*8+int(Notice)) || m[6] != "RESOLVED" ||
+		strings.Contains(m[7], "metrics@") {
+		t.Errorf("unexpected resolved message %v", m)
+	}
+}
+
+func TestResults(t *testing.T) {
+	addr, messages := receive(t, "udp", nil)
+	h := NewHandler(UDP, addr)
+	defer h.Close()
+
+	chk := check.New("router1")
+	result := check.NewResult(check.StateWarn, "", []check.ResultMetric{{Label: "loss", Value: "50"}})
+	if err := h.Process(chk, result, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	select {
+	case msg := <-messages:
+		t.Fatalf("expected results not to be sent by default, got %q", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.Results = true
+	if err := h.Process(chk, result, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := rfc5424.FindStringSubmatch(next(t, messages))
+	if m == nil || m[1] != strconv.Itoa(int(Daemon)*8+int(Warning)) || m[6] != "RESULT" ||
+		m[7] != `[check@32473 id="router1" state="WARN"][metrics@32473 loss="50"]` || m[8] != "router1 WARN" {
+		t.Errorf("unexpected result message %v", m)
+	}
+}
+
+func TestReconnectsAfterWriteFailure(t *testing.T) {
+	addr, messages := receive(t, "tcp", nil)
+	h := NewHandler(TCP, addr)
+	defer h.Close()
+
+	chk := check.New("router1")
+	if err := h.ProcessIncidentEvent(chk, testIncidentEvent()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	next(t, messages)
+	h.conn.Close() // simulate a broken connection
+
+	if err := h.ProcessIncidentEvent(chk, testIncidentEvent()); err != nil {
+		t.Fatalf("expected reconnect, got error: %v", err)
+	}
+	next(t, messages)
+}
+
+func TestSeverityOf(t *testing.T) {
+	tests := []struct {
+		state check.ResultState
+		want  Severity
+	}{
+		{check.StateOk, Informational},
+		{check.StateWarn, Warning},
+		{check.StateCrit, Critical},
+		{check.StateUnknown, Error},
+	}
+	for _, tt := range tests {
+		if got := SeverityOf(tt.state); got != tt.want {
+			t.Errorf("%s: wanted %d, got %d", tt.state, tt.want, got)
+		}
+	}
+}
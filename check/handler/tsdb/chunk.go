@@ -0,0 +1,307 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"math"
+	"math/bits"
+)
+
+// point is a raw sample, or the aggregate of the samples in a bucket of a downsampled resolution.  A raw sample's
+// min and max are its value and its count is 1.
+type point struct {
+	t     int64 // milliseconds since the epoch
+	avg   float64
+	min   float64
+	max   float64
+	count float64
+}
+
+func rawPoint(t int64, v float64) point {
+	return point{t: t, avg: v, min: v, max: v, count: 1}
+}
+
+// columns is the number of values stored per point: raw chunks store only the value, downsampled chunks store the
+// average, min, max and count.
+const (
+	rawColumns        = 1
+	downsampleColumns = 4
+)
+
+func (p point) values(columns int) []float64 {
+	if columns == rawColumns {
+		return []float64{p.avg}
+	}
+	return []float64{p.avg, p.min, p.max, p.count}
+}
+
+func newPoint(t int64, values []float64) point {
+	if len(values) == rawColumns {
+		return rawPoint(t, values[0])
+	}
+	return point{t: t, avg: values[0], min: values[1], max: values[2], count: values[3]}
+}
+
+// A chunk is a run of points compressed as described in "Gorilla: A Fast, Scalable, In-Memory Time Series
+// Database": timestamps as delta-of-deltas and values XORed with the previous value of the same column.  On disk
+// chunks are framed by their length and followed by a CRC-32 of their contents, so a chunk torn by a crash is
+// detected and ignored.
+
+var errCorruptChunk = errors.New("corrupt chunk")
+
+// encodeChunk returns the framed chunk of points, with columns values per point.
+func encodeChunk(points []point, columns int) []byte {
+	w := &bitWriter{}
+	var prevT, prevDelta int64
+	xors := make([]xorState, columns)
+
+	for i, p := range points {
+		values := p.values(columns)
+		if i == 0 {
+			w.writeBits(uint64(p.t), 64)
+			for c, v := range values {
+				xors[c].prev = math.Float64bits(v)
+				w.writeBits(xors[c].prev, 64)
+			}
+		} else {
+			delta := p.t - prevT
+			writeDod(w, delta-prevDelta)
+			prevDelta = delta
+			for c, v := range values {
+				xors[c].write(w, math.Float64bits(v))
+			}
+		}
+		prevT = p.t
+	}
+
+	payload := []byte{byte(columns)}
+	payload = binary.AppendUvarint(payload, uint64(len(points)))
+	payload = append(payload, w.b...)
+
+	frame := binary.AppendUvarint(nil, uint64(len(payload)))
+	frame = append(frame, payload...)
+	return binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(payload))
+}
+
+// decodeChunks decodes the framed chunks of b in order.  Decoding stops at the first incomplete or corrupt chunk,
+// returning the points before it along with errCorruptChunk.
+func decodeChunks(b []byte) ([]point, error) {
+	var points []point
+	for len(b) > 0 {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l+4 {
+			return points, errCorruptChunk
+		}
+		payload := b[n : n+int(l)]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(b[n+int(l):]) {
+			return points, errCorruptChunk
+		}
+		b = b[n+int(l)+4:]
+
+		chunk, err := decodeChunk(payload)
+		if err != nil {
+			return points, err
+		}
+		points = append(points, chunk...)
+	}
+	return points, nil
+}
+
+func decodeChunk(payload []byte) ([]point, error) {
+	if len(payload) < 1 {
+		return nil, errCorruptChunk
+	}
+	columns := int(payload[0])
+	if columns != rawColumns && columns != downsampleColumns {
+		return nil, errCorruptChunk
+	}
+	count, n := binary.Uvarint(payload[1:])
+	if n <= 0 {
+		return nil, errCorruptChunk
+	}
+
+	r := &bitReader{b: payload[1+n:]}
+	points := make([]point, 0, count)
+	var t, delta int64
+	xors := make([]xorState, columns)
+	values := make([]float64, columns)
+
+	for i := uint64(0); i < count; i++ {
+		if i == 0 {
+			t = int64(r.readBits(64))
+			for c := range xors {
+				xors[c].prev = r.readBits(64)
+			}
+		} else {
+			delta += readDod(r)
+			t += delta
+			for c := range xors {
+				xors[c].read(r)
+			}
+		}
+		if r.err != nil {
+			return nil, errCorruptChunk
+		}
+		for c := range xors {
+			values[c] = math.Float64frombits(xors[c].prev)
+		}
+		points = append(points, newPoint(t, values))
+	}
+
+	return points, nil
+}
+
+// Delta-of-delta encodings, by their prefix: 0 for no change, or 10, 110, 1110 followed by a 14, 17 or 20 bit
+// signed value, or 1111 followed by 64 bits.
+var dodBuckets = []struct {
+	prefix, prefixBits uint64
+	bits               int
+}{
+	{0b10, 2, 14},
+	{0b110, 3, 17},
+	{0b1110, 4, 20},
+}
+
+func writeDod(w *bitWriter, dod int64) {
+	if dod == 0 {
+		w.writeBit(false)
+		return
+	}
+	for _, b := range dodBuckets {
+		if -(1<<(b.bits-1))+1 <= dod && dod <= 1<<(b.bits-1) {
+			w.writeBits(b.prefix, int(b.prefixBits))
+			w.writeBits(uint64(dod)&(1<<b.bits-1), b.bits)
+			return
+		}
+	}
+	w.writeBits(0b1111, 4)
+	w.writeBits(uint64(dod), 64)
+}
+
+func readDod(r *bitReader) int64 {
+	var prefix int
+	for prefix < 4 && r.readBit() {
+		prefix++
+	}
+	if prefix == 0 {
+		return 0
+	}
+	if prefix == 4 {
+		return int64(r.readBits(64))
+	}
+
+	n := dodBuckets[prefix-1].bits
+	v := int64(r.readBits(n))
+	if v > 1<<(n-1) {
+		v -= 1 << n
+	}
+	return v
+}
+
+// xorState is the state of a column's XOR encoding: the previous value and the window of meaningful bits last
+// written.
+type xorState struct {
+	prev     uint64
+	leading  int
+	trailing int
+	window   bool
+}
+
+// write writes v as 0 if it's the same as the previous value, 10 followed by the meaningful bits if they fit the
+// previous window, or 11 followed by a 5 bit count of leading zeros, 6 bit count of meaningful bits and the bits.
+func (x *xorState) write(w *bitWriter, v uint64) {
+	xor := v ^ x.prev
+	x.prev = v
+	if xor == 0 {
+		w.writeBit(false)
+		return
+	}
+	w.writeBit(true)
+
+	leading, trailing := min(bits.LeadingZeros64(xor), 31), bits.TrailingZeros64(xor)
+	if x.window && leading >= x.leading && trailing >= x.trailing {
+		w.writeBit(false)
+		w.writeBits(xor>>x.trailing, 64-x.leading-x.trailing)
+		return
+	}
+
+	w.writeBit(true)
+	significant := 64 - leading - trailing
+	w.writeBits(uint64(leading), 5)
+	w.writeBits(uint64(significant)&63, 6) // 64 is written as 0
+	w.writeBits(xor>>trailing, significant)
+	x.leading, x.trailing, x.window = leading, trailing, true
+}
+
+func (x *xorState) read(r *bitReader) {
+	if !r.readBit() {
+		return
+	}
+	if r.readBit() {
+		x.leading = int(r.readBits(5))
+		significant := int(r.readBits(6))
+		if significant == 0 {
+			significant = 64
+		}
+		x.trailing = 64 - x.leading - significant
+		x.window = true
+	}
+	if x.trailing < 0 {
+		r.err = errCorruptChunk
+		return
+	}
+	x.prev ^= r.readBits(64-x.leading-x.trailing) << x.trailing
+}
+
+// bitWriter appends bits, most significant first.
+type bitWriter struct {
+	b    []byte
+	free int // unused bits of the last byte
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.b = append(w.b, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.b[len(w.b)-1] |= 1 << w.free
+	}
+}
+
+// writeBits writes the n low bits of v.
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v>>i&1 == 1)
+	}
+}
+
+// bitReader reads bits written by a bitWriter.  Reading past the end sets err and returns zeros.
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) readBit() bool {
+	if r.pos >= len(r.b)*8 {
+		r.err = errCorruptChunk
+		return false
+	}
+	bit := r.b[r.pos/8]>>(7-r.pos%8)&1 == 1
+	r.pos++
+	return bit
+}
+
+func (r *bitReader) readBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if r.readBit() {
+			v |= 1
+		}
+	}
+	return v
+}
@@ -0,0 +1,51 @@
+// Package tsdb provides an embedded time-series database, Store, and a check.Handler that stores Result metrics in
+// it, so small deployments can keep and query metric history without an external metrics system.
+package tsdb
+
+import (
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"math"
+	"strconv"
+)
+
+// Handler appends the metrics of every Result it processes to Store, as series keyed by check id and metric label
+// and timed by Result.Time.  Counters are stored as their raw values, so rates must be derived when querying.
+type Handler struct {
+	Store *Store
+
+	// StateMetric, when set, also stores the check.ResultState as a metric with this label.
+	StateMetric string
+}
+
+func NewHandler(store *Store) *Handler {
+	return &Handler{
+		Store: store,
+	}
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, _ *check.Incident) error {
+	var errs error
+	for _, m := range result.Metrics {
+		v, err := strconv.ParseFloat(m.Value, 64)
+		if err != nil || math.IsNaN(v) {
+			chk.Debugf("skipping non-numeric metric %s value %q", m.Label, m.Value)
+			continue
+		}
+		if err = h.Store.Append(chk.Id, m.Label, result.Time, v); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	if h.StateMetric != "" {
+		if err := h.Store.Append(chk.Id, h.StateMetric, result.Time, float64(result.State)); err != nil {
+			errs = errors.Join(errs, err)
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,270 @@
+package tsdb
+
+import (
+	"errors"
+	"maps"
+	"math"
+	"slices"
+	"time"
+)
+
+// Sample is a value of a series at a point in time.
+type Sample struct {
+	Time  time.Time
+	Value float64
+}
+
+// Aggregation is how Aggregate combines the samples in each step.
+type Aggregation uint8
+
+const (
+	Avg Aggregation = iota
+	Min
+	Max
+	Sum
+	Count
+	// Last is the last sample of each step.  Downsampled data only has averages, so their average is used.
+	Last
+)
+
+// Query returns the samples of a check's metric from start up to (not including) end, oldest first.  Where raw
+// samples have expired, the averages of the finest downsampled resolution available are returned instead.
+func (s *Store) Query(checkId, metric string, start, end time.Time) ([]Sample, error) {
+	key := seriesKey{checkId, metric}
+	h := s.lockHead(key)
+	defer s.unlockHead(key, h)
+
+	points, err := s.points(key, h, start.UnixMilli(), end.UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	samples := make([]Sample, len(points))
+	for i, p := range points {
+		samples[i] = Sample{Time: time.UnixMilli(p.t), Value: p.avg}
+	}
+	return samples, nil
+}
+
+// LastN returns the last n samples of a check's metric, oldest first.
+func (s *Store) LastN(checkId, metric string, n int) ([]Sample, error) {
+	key := seriesKey{checkId, metric}
+	h := s.lockHead(key)
+	defer s.unlockHead(key, h)
+
+	points := slices.Clone(h.points)
+
+	// the newest raw blocks are usually enough, otherwise fall back to reading everything
+	starts, err := s.blocks(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(starts) - 1; i >= 0 && len(points) < n; i-- {
+		block, err := s.readBlock(key, 0, starts[i])
+		if err != nil && !errors.Is(err, errCorruptChunk) {
+			return nil, err
+		}
+		points = append(block, points...)
+	}
+	if len(points) < n {
+		if points, err = s.points(key, h, math.MinInt64, math.MaxInt64); err != nil {
+			return nil, err
+		}
+	}
+
+	points = points[max(0, len(points)-n):]
+	samples := make([]Sample, len(points))
+	for i, p := range points {
+		samples[i] = Sample{Time: time.UnixMilli(p.t), Value: p.avg}
+	}
+	return samples, nil
+}
+
+// Aggregate returns the samples of a check's metric from start up to (not including) end combined by agg into a
+// sample per step, timed by the start of the step.  Steps without samples are omitted.
+func (s *Store) Aggregate(checkId, metric string, start, end time.Time, step time.Duration, agg Aggregation) ([]Sample, error) {
+	if step < time.Millisecond {
+		return nil, errors.New("step must be at least 1 millisecond")
+	}
+
+	key := seriesKey{checkId, metric}
+	h := s.lockHead(key)
+	points, err := s.points(key, h, start.UnixMilli(), end.UnixMilli())
+	s.unlockHead(key, h)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []Sample
+	var bucket point
+	var last float64
+	emit := func() {
+		if bucket.count == 0 {
+			return
+		}
+		var v float64
+		switch agg {
+		case Min:
+			v = bucket.min
+		case Max:
+			v = bucket.max
+		case Sum:
+			v = bucket.avg * bucket.count
+		case Count:
+			v = bucket.count
+		case Last:
+			v = last
+		default:
+			v = bucket.avg
+		}
+		samples = append(samples, Sample{Time: time.UnixMilli(bucket.t), Value: v})
+	}
+
+	for _, p := range points {
+		t := p.t - ((p.t%step.Milliseconds())+step.Milliseconds())%step.Milliseconds()
+		if bucket.count > 0 && bucket.t == t {
+			bucket = merge(bucket, p)
+		} else {
+			emit()
+			bucket = point{t: t, avg: p.avg, min: p.min, max: p.max, count: p.count}
+		}
+		last = p.avg
+	}
+	emit()
+
+	return samples, nil
+}
+
+// Checks returns the ids of the checks with stored samples.
+func (s *Store) Checks() ([]string, error) {
+	keys, err := s.allSeries()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, key := range keys {
+		if !slices.Contains(ids, key.checkId) {
+			ids = append(ids, key.checkId)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// Metrics returns the labels of a check's metrics with stored samples.
+func (s *Store) Metrics(checkId string) ([]string, error) {
+	keys, err := s.allSeries()
+	if err != nil {
+		return nil, err
+	}
+	var metrics []string
+	for _, key := range keys {
+		if key.checkId == checkId && !slices.Contains(metrics, key.metric) {
+			metrics = append(metrics, key.metric)
+		}
+	}
+	slices.Sort(metrics)
+	return metrics, nil
+}
+
+// allSeries returns the series on disk and those with samples only in memory.
+func (s *Store) allSeries() ([]seriesKey, error) {
+	keys, err := s.seriesOnDisk()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	heads := maps.Clone(s.heads)
+	s.mu.Unlock()
+
+	for key, h := range heads {
+		h.mu.Lock()
+		if !h.removed && len(h.points) > 0 && !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+		h.mu.Unlock()
+	}
+	return keys, nil
+}
+
+// points returns the points of a series from start up to end (milliseconds), oldest first, at the finest
+// resolution available for each time.  The series' head must be locked.
+func (s *Store) points(key seriesKey, h *head, start, end int64) ([]point, error) {
+	points, err := s.resolutionPoints(key, 0, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range h.points {
+		if p.t >= start && p.t < end {
+			points = append(points, p)
+		}
+	}
+
+	// coarser resolutions fill in before the oldest data of finer ones
+	cutoff, err := s.oldest(key, h, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range s.Downsamples {
+		if cutoff <= start {
+			break
+		}
+		older, err := s.resolutionPoints(key, d.Step, start, min(end, cutoff))
+		if err != nil {
+			return nil, err
+		}
+		older = slices.DeleteFunc(older, func(p point) bool { return p.t >= cutoff })
+		points = append(older, points...)
+
+		oldest, err := s.oldest(key, h, d.Step)
+		if err != nil {
+			return nil, err
+		}
+		cutoff = min(cutoff, oldest)
+	}
+
+	return points, nil
+}
+
+// resolutionPoints returns the points of the blocks of a resolution from start up to end.
+func (s *Store) resolutionPoints(key seriesKey, step time.Duration, start, end int64) ([]point, error) {
+	starts, err := s.blocks(key, step)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := s.blockDuration(step).Milliseconds()
+	var points []point
+	for _, blockStart := range starts {
+		if blockStart >= end || blockStart+duration <= start {
+			continue
+		}
+		block, err := s.readBlock(key, step, blockStart)
+		if err != nil && !errors.Is(err, errCorruptChunk) {
+			return nil, err
+		}
+		for _, p := range block {
+			if p.t >= start && p.t < end {
+				points = append(points, p)
+			}
+		}
+	}
+	return points, nil
+}
+
+// oldest returns the start of the oldest block of a resolution, or the newest possible time if there are none (or,
+// for raw data, only samples in memory).
+func (s *Store) oldest(key seriesKey, h *head, step time.Duration) (int64, error) {
+	starts, err := s.blocks(key, step)
+	if err != nil {
+		return 0, err
+	}
+	if len(starts) > 0 {
+		return starts[0], nil
+	}
+	if step == 0 && len(h.points) > 0 {
+		return h.points[0].t, nil
+	}
+	return math.MaxInt64, nil
+}
@@ -0,0 +1,557 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"github.com/seankndy/gopoller/internal/background"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrOutOfOrder is returned by Append for a sample that isn't after the last sample of its series.
+var ErrOutOfOrder = errors.New("sample is not after the last sample of its series")
+
+// Downsample is a lower resolution copy of a series' samples, kept after the raw samples expire.  Each Step long
+// bucket of samples is stored as their average, min, max and count.
+type Downsample struct {
+	// Step is the bucket size.  It must evenly divide the Store's BlockDuration.
+	Step time.Duration
+
+	// Retention is how long the buckets are kept.
+	Retention time.Duration
+}
+
+// Store is an embedded time-series database storing the samples of each check metric (a series) in compressed
+// chunk files under Dir, laid out as Dir/<check id>/<metric>/<resolution>/<block start>.chunks.
+//
+// Samples are held in memory until ChunkSamples of a series accumulate or FlushInterval passes, then appended to the
+// file of the BlockDuration long block they fall in.  Raw blocks older than Retention are downsampled into each of
+// Downsamples and removed, every CompactInterval.  Close the Store on shutdown to write samples still in memory.
+//
+// Each series is locked separately, so writing, compacting or querying one series doesn't hold up the others.
+type Store struct {
+	Dir string
+
+	// Retention is how long raw samples are kept (default 7 days).
+	Retention time.Duration
+
+	// Downsamples are the lower resolutions raw samples are kept at once they expire, finest first.
+	Downsamples []Downsample
+
+	// BlockDuration is the time span of each raw chunk file (default 6 hours).  Retention is applied to whole blocks.
+	BlockDuration time.Duration
+
+	// ChunkSamples is the most samples compressed together in a chunk (default 120).
+	ChunkSamples int
+
+	// FlushInterval is the most time samples are held in memory before being written (default 1 minute).
+	FlushInterval time.Duration
+
+	// CompactInterval is how often retention and downsampling are applied (default 1 hour).
+	CompactInterval time.Duration
+
+	// OnError is called with errors flushing and compacting, as they happen in the background.
+	OnError func(err error)
+
+	heads     map[seriesKey]*head
+	mu        sync.Mutex // guards heads, not the heads themselves
+	flusher   background.Loop
+	compactor background.Loop
+	nowFunc   func() time.Time
+}
+
+func NewStore(dir string) *Store {
+	return &Store{
+		Dir:             dir,
+		Retention:       7 * 24 * time.Hour,
+		BlockDuration:   6 * time.Hour,
+		ChunkSamples:    120,
+		FlushInterval:   time.Minute,
+		CompactInterval: time.Hour,
+	}
+}
+
+type seriesKey struct {
+	checkId string
+	metric  string
+}
+
+// head is the in-memory state of a series.  Its mutex is held while the series' files are read or written.
+type head struct {
+	points []point // samples not written yet
+	last   int64   // time of the last sample, or -1 if the series has none
+	loaded bool    // last has been read from disk
+
+	// removed is set once the head is dropped from Store.heads, so whoever was waiting to lock it looks it up again.
+	removed bool
+	mu      sync.Mutex
+}
+
+// Append adds a sample of a check's metric.  Samples of a series must be appended in time order.
+func (s *Store) Append(checkId, metric string, t time.Time, v float64) error {
+	if !s.flusher.Start(s.flushInterval(), s.Flush, s.OnError) ||
+		!s.compactor.Start(s.compactInterval(), s.Compact, s.OnError) {
+		return errors.New("tsdb store is closed")
+	}
+
+	key := seriesKey{checkId, metric}
+	h := s.lockHead(key)
+	defer s.unlockHead(key, h)
+
+	if err := s.loadHead(key, h); err != nil {
+		return err
+	}
+
+	ts := t.UnixMilli()
+	if ts <= h.last {
+		return fmt.Errorf("%s %s at %s: %w", checkId, metric, t, ErrOutOfOrder)
+	}
+
+	// chunks never span blocks
+	if len(h.points) > 0 && s.blockStart(h.points[0].t, 0) != s.blockStart(ts, 0) {
+		if err := s.writeHead(key, h); err != nil {
+			return err
+		}
+	}
+
+	h.points = append(h.points, rawPoint(ts, v))
+	h.last = ts
+
+	if len(h.points) >= s.chunkSamples() {
+		return s.writeHead(key, h)
+	}
+	return nil
+}
+
+// Flush writes every sample held in memory.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	heads := maps.Clone(s.heads)
+	s.mu.Unlock()
+
+	var errs error
+	for key, h := range heads {
+		h.mu.Lock()
+		if !h.removed {
+			if err := s.writeHead(key, h); err != nil {
+				errs = errors.Join(errs, err)
+			}
+		}
+		h.mu.Unlock()
+	}
+	return errs
+}
+
+// Close stops flushing and compacting in the background and writes every sample held in memory.  Samples appended
+// after Close are refused.
+func (s *Store) Close() error {
+	s.flusher.Stop()
+	s.compactor.Stop()
+	return s.Flush()
+}
+
+// Compact removes raw blocks older than Retention after downsampling them into each of Downsamples, and removes
+// downsampled blocks older than their Retention.
+func (s *Store) Compact() error {
+	for _, d := range s.Downsamples {
+		if d.Step < time.Second || s.blockDuration(0)%d.Step != 0 {
+			return fmt.Errorf("downsample step %s doesn't evenly divide the block duration", d.Step)
+		}
+	}
+
+	if err := s.Flush(); err != nil {
+		return err
+	}
+
+	keys, err := s.seriesOnDisk()
+	if err != nil {
+		return err
+	}
+
+	now := s.now().UnixMilli()
+	var errs error
+	for _, key := range keys {
+		h := s.lockHead(key)
+		if err := s.compactSeries(key, h, now); err != nil {
+			errs = errors.Join(errs, fmt.Errorf("error compacting %s %s: %w", key.checkId, key.metric, err))
+		}
+		s.unlockHead(key, h)
+	}
+	return errs
+}
+
+// compactSeries compacts the blocks of a series.  The series' head must be locked.
+func (s *Store) compactSeries(key seriesKey, h *head, now int64) error {
+	rawCutoff := now - s.retention().Milliseconds()
+	starts, err := s.blocks(key, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, start := range starts {
+		if start+s.blockDuration(0).Milliseconds() > rawCutoff {
+			break
+		}
+
+		points, err := s.readBlock(key, 0, start)
+		if err != nil && !errors.Is(err, errCorruptChunk) {
+			return err
+		}
+		for _, d := range s.Downsamples {
+			if err = s.appendDownsampled(key, d.Step, downsample(points, d.Step)); err != nil {
+				return err
+			}
+		}
+		if err = os.Remove(s.blockPath(key, 0, start)); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range s.Downsamples {
+		cutoff := now - d.Retention.Milliseconds()
+		starts, err := s.blocks(key, d.Step)
+		if err != nil {
+			return err
+		}
+		for _, start := range starts {
+			if start+s.blockDuration(d.Step).Milliseconds() > cutoff {
+				break
+			}
+			if err = os.Remove(s.blockPath(key, d.Step, start)); err != nil {
+				return err
+			}
+		}
+	}
+
+	// remove the directories of series with nothing left
+	for _, dir := range []string{s.seriesDir(key), filepath.Dir(s.seriesDir(key))} {
+		_ = removeEmptyDirs(dir)
+	}
+	if len(h.points) == 0 {
+		if _, err := os.Stat(s.seriesDir(key)); errors.Is(err, fs.ErrNotExist) {
+			h.loaded = false // forget the series, unlockHead drops it
+		}
+	}
+
+	return nil
+}
+
+// appendDownsampled appends buckets to the blocks of the step resolution, skipping any already there in case a
+// previous compaction was interrupted before removing the raw block.
+func (s *Store) appendDownsampled(key seriesKey, step time.Duration, buckets []point) error {
+	for len(buckets) > 0 {
+		start := s.blockStart(buckets[0].t, step)
+		n := 1
+		for n < len(buckets) && s.blockStart(buckets[n].t, step) == start {
+			n++
+		}
+		block := buckets[:n]
+		buckets = buckets[n:]
+
+		existing, err := s.readBlock(key, step, start)
+		if err != nil && !errors.Is(err, errCorruptChunk) && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if len(existing) > 0 {
+			last := existing[len(existing)-1].t
+			block = slices.DeleteFunc(block, func(p point) bool { return p.t <= last })
+		}
+		if len(block) == 0 {
+			continue
+		}
+
+		if err = s.appendChunk(key, step, start, encodeChunk(block, downsampleColumns)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downsample aggregates points into step long buckets, timed by their start.
+func downsample(points []point, step time.Duration) []point {
+	var buckets []point
+	for _, p := range points {
+		t := p.t - p.t%step.Milliseconds()
+		if n := len(buckets); n > 0 && buckets[n-1].t == t {
+			buckets[n-1] = merge(buckets[n-1], p)
+		} else {
+			buckets = append(buckets, point{t: t, avg: p.avg, min: p.min, max: p.max, count: p.count})
+		}
+	}
+	return buckets
+}
+
+// merge combines the aggregates of a and b.
+func merge(a, b point) point {
+	count := a.count + b.count
+	return point{
+		t:     a.t,
+		avg:   (a.avg*a.count + b.avg*b.count) / count,
+		min:   min(a.min, b.min),
+		max:   max(a.max, b.max),
+		count: count,
+	}
+}
+
+// lockHead returns the head of a series locked, creating it if needed.  Release it with unlockHead.
+func (s *Store) lockHead(key seriesKey) *head {
+	for {
+		s.mu.Lock()
+		h, ok := s.heads[key]
+		if !ok {
+			h = &head{last: -1}
+			if s.heads == nil {
+				s.heads = make(map[seriesKey]*head)
+			}
+			s.heads[key] = h
+		}
+		s.mu.Unlock()
+
+		h.mu.Lock()
+		if !h.removed {
+			return h
+		}
+		h.mu.Unlock()
+	}
+}
+
+// unlockHead unlocks the head of a series, dropping it if it holds nothing that isn't on disk.
+func (s *Store) unlockHead(key seriesKey, h *head) {
+	if !h.loaded && len(h.points) == 0 {
+		s.mu.Lock()
+		delete(s.heads, key)
+		s.mu.Unlock()
+		h.removed = true
+	}
+	h.mu.Unlock()
+}
+
+// loadHead reads the time of the last sample written to disk into a locked head, if it hasn't been already.
+func (s *Store) loadHead(key seriesKey, h *head) error {
+	if h.loaded {
+		return nil
+	}
+
+	h.last = -1
+	starts, err := s.blocks(key, 0)
+	if err != nil {
+		return err
+	}
+	for i := len(starts) - 1; i >= 0 && h.last < 0; i-- {
+		points, err := s.readBlock(key, 0, starts[i])
+		if err != nil && !errors.Is(err, errCorruptChunk) {
+			return err
+		}
+		if len(points) > 0 {
+			h.last = points[len(points)-1].t
+		}
+	}
+	h.loaded = true
+	return nil
+}
+
+// writeHead appends the samples held in memory for a series to its block file.
+func (s *Store) writeHead(key seriesKey, h *head) error {
+	if len(h.points) == 0 {
+		return nil
+	}
+	start := s.blockStart(h.points[0].t, 0)
+	if err := s.appendChunk(key, 0, start, encodeChunk(h.points, rawColumns)); err != nil {
+		return fmt.Errorf("error writing %s %s samples: %w", key.checkId, key.metric, err)
+	}
+	h.points = nil
+	return nil
+}
+
+func (s *Store) appendChunk(key seriesKey, step time.Duration, start int64, chunk []byte) error {
+	path := s.blockPath(key, step, start)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(chunk); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readBlock returns the points of a block file.  A corrupt chunk (ex. torn by a crash) ends the block, returning
+// the points before it along with errCorruptChunk.
+func (s *Store) readBlock(key seriesKey, step time.Duration, start int64) ([]point, error) {
+	b, err := os.ReadFile(s.blockPath(key, step, start))
+	if err != nil {
+		return nil, err
+	}
+	return decodeChunks(b)
+}
+
+// blocks returns the start times of the blocks of a series at a resolution (0 being raw), oldest first.
+func (s *Store) blocks(key seriesKey, step time.Duration) ([]int64, error) {
+	entries, err := os.ReadDir(filepath.Join(s.seriesDir(key), resolutionDir(step)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var starts []int64
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".chunks")
+		if !ok {
+			continue
+		}
+		if start, err := strconv.ParseInt(name, 10, 64); err == nil {
+			starts = append(starts, start)
+		}
+	}
+	slices.Sort(starts)
+	return starts, nil
+}
+
+// seriesOnDisk returns every series with a directory under Dir.
+func (s *Store) seriesOnDisk() ([]seriesKey, error) {
+	checks, err := os.ReadDir(s.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keys []seriesKey
+	for _, c := range checks {
+		checkId, err := unescapeName(c.Name())
+		if !c.IsDir() || err != nil {
+			continue
+		}
+		metrics, err := os.ReadDir(filepath.Join(s.Dir, c.Name()))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // removed by a compaction meanwhile
+		} else if err != nil {
+			return nil, err
+		}
+		for _, m := range metrics {
+			if metric, err := unescapeName(m.Name()); m.IsDir() && err == nil {
+				keys = append(keys, seriesKey{checkId, metric})
+			}
+		}
+	}
+	return keys, nil
+}
+
+func (s *Store) seriesDir(key seriesKey) string {
+	return filepath.Join(s.Dir, escapeName(key.checkId), escapeName(key.metric))
+}
+
+func (s *Store) blockPath(key seriesKey, step time.Duration, start int64) string {
+	return filepath.Join(s.seriesDir(key), resolutionDir(step), strconv.FormatInt(start, 10)+".chunks")
+}
+
+// blockStart returns the start of the block of a resolution that t (milliseconds) falls in.
+func (s *Store) blockStart(t int64, step time.Duration) int64 {
+	d := s.blockDuration(step).Milliseconds()
+	return t - ((t%d)+d)%d
+}
+
+// blockDuration returns the time span of the blocks of a resolution (0 being raw).  Downsampled blocks span enough
+// raw blocks to hold about ChunkSamples buckets.
+func (s *Store) blockDuration(step time.Duration) time.Duration {
+	d := s.BlockDuration
+	if d <= 0 {
+		d = 6 * time.Hour
+	}
+	if step > 0 {
+		d *= max(1, time.Duration(s.chunkSamples())*step/d)
+	}
+	return d
+}
+
+func (s *Store) retention() time.Duration {
+	if s.Retention <= 0 {
+		return 7 * 24 * time.Hour
+	}
+	return s.Retention
+}
+
+func (s *Store) chunkSamples() int {
+	if s.ChunkSamples <= 0 {
+		return 120
+	}
+	return s.ChunkSamples
+}
+
+func (s *Store) flushInterval() time.Duration {
+	if s.FlushInterval <= 0 {
+		return time.Minute
+	}
+	return s.FlushInterval
+}
+
+func (s *Store) compactInterval() time.Duration {
+	if s.CompactInterval <= 0 {
+		return time.Hour
+	}
+	return s.CompactInterval
+}
+
+func (s *Store) now() time.Time {
+	if s.nowFunc != nil {
+		return s.nowFunc()
+	}
+	return time.Now()
+}
+
+// resolutionDir returns the directory name of a resolution: "raw", or the downsample step in seconds.
+func resolutionDir(step time.Duration) string {
+	if step == 0 {
+		return "raw"
+	}
+	return strconv.FormatInt(int64(step/time.Second), 10) + "s"
+}
+
+// escapeName escapes a check id or metric label for use as a directory name, including a leading dot so that
+// names can't be "." or "..".  The empty name is "%00".
+func escapeName(name string) string {
+	if name == "" {
+		return "%00"
+	}
+	escaped := url.PathEscape(name)
+	if strings.HasPrefix(escaped, ".") {
+		escaped = "%2E" + escaped[1:]
+	}
+	return escaped
+}
+
+func unescapeName(name string) (string, error) {
+	if name == "%00" {
+		return "", nil
+	}
+	return url.PathUnescape(name)
+}
+
+// removeEmptyDirs removes dir and its subdirectories if they contain no files.
+func removeEmptyDirs(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			return nil
+		}
+		_ = removeEmptyDirs(filepath.Join(dir, e.Name()))
+	}
+	return os.Remove(dir)
+}
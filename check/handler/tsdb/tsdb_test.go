@@ -0,0 +1,416 @@
+package tsdb
+
+import (
+	"errors"
+	"github.com/seankndy/gopoller/check"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// t0 is aligned to the hour.
+var t0 = time.Date(2023, 11, 14, 0, 0, 0, 0, time.UTC)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s := NewStore(t.TempDir())
+	s.FlushInterval = time.Hour
+	s.CompactInterval = time.Hour
+	s.OnError = func(err error) {
+		t.Errorf("unexpected background error: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Errorf("unexpected error closing store: %v", err)
+		}
+	})
+	return s
+}
+
+func values(samples []Sample) []float64 {
+	var v []float64
+	for _, s := range samples {
+		v = append(v, s.Value)
+	}
+	return v
+}
+
+// pointsWithDods returns points whose timestamps have the delta-of-deltas dods.
+func pointsWithDods(dods ...int64) []point {
+	points := []point{rawPoint(1700000000000, 0)}
+	var delta int64
+	for i, dod := range dods {
+		delta += dod
+		points = append(points, rawPoint(points[i].t+delta, float64(i)))
+	}
+	return points
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		points  []point
+		columns int
+	}{
+		{"empty", nil, rawColumns},
+		{"single", []point{rawPoint(1700000000000, 1.5)}, rawColumns},
+		{"regular", []point{rawPoint(1000, 1), rawPoint(2000, 1), rawPoint(3000, 2), rawPoint(4000, -7.25)}, rawColumns},
+		{"delta of delta edges", pointsWithDods(0, 8192, -8191, 8193, -8192, 1<<19, -(1<<19)+1, 1<<19+1, 1<<40, -(1 << 40)), rawColumns},
+		{"special values", []point{
+			rawPoint(1, math.Inf(1)), rawPoint(2, math.Inf(-1)), rawPoint(3, 0), rawPoint(4, math.MaxFloat64),
+			rawPoint(5, math.SmallestNonzeroFloat64), rawPoint(6, -0.1),
+		}, rawColumns},
+		{"downsampled", []point{
+			{t: 0, avg: 2.5, min: 1, max: 4, count: 4},
+			{t: 600000, avg: 3, min: 3, max: 3, count: 1},
+			{t: 1200000, avg: 10.125, min: -1, max: 100, count: 30},
+		}, downsampleColumns},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeChunks(encodeChunk(tt.points, tt.columns))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.points) {
+				t.Errorf("wanted %v, got %v", tt.points, got)
+			}
+		})
+	}
+}
+
+func TestDecodeChunksStopsAtCorruptChunk(t *testing.T) {
+	first := []point{rawPoint(1000, 1), rawPoint(2000, 2)}
+	b := encodeChunk(first, rawColumns)
+	second := encodeChunk([]point{rawPoint(3000, 3)}, rawColumns)
+
+	// torn write
+	got, err := decodeChunks(append(slices.Clone(b), second[:len(second)-1]...))
+	if !errors.Is(err, errCorruptChunk) || !slices.Equal(got, first) {
+		t.Errorf("expected points before a torn chunk and errCorruptChunk, got %v (%v)", got, err)
+	}
+
+	// flipped bit
+	second[2] ^= 1
+	got, err = decodeChunks(append(slices.Clone(b), second...))
+	if !errors.Is(err, errCorruptChunk) || !slices.Equal(got, first) {
+		t.Errorf("expected points before a corrupt chunk and errCorruptChunk, got %v (%v)", got, err)
+	}
+}
+
+func TestAppendAndQuery(t *testing.T) {
+	s := newTestStore(t)
+	s.ChunkSamples = 4
+
+	for i := 0; i < 10; i++ {
+		if err := s.Append("check1", "rtt", t0.Add(time.Duration(i)*time.Minute), float64(i)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := s.Append("check1", "loss", t0, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Append("check1", "rtt", t0.Add(9*time.Minute), 1); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("expected ErrOutOfOrder, got %v", err)
+	}
+
+	// samples are read from chunk files and memory alike
+	samples, err := s.Query("check1", "rtt", t0.Add(2*time.Minute), t0.Add(9*time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []float64{2, 3, 4, 5, 6, 7, 8}; !slices.Equal(values(samples), want) {
+		t.Errorf("wanted %v, got %v", want, values(samples))
+	}
+	if !samples[0].Time.Equal(t0.Add(2 * time.Minute)) {
+		t.Errorf("unexpected first sample time %v", samples[0].Time)
+	}
+
+	samples, err = s.LastN("check1", "rtt", 3)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []float64{7, 8, 9}; !slices.Equal(values(samples), want) {
+		t.Errorf("wanted %v, got %v", want, values(samples))
+	}
+	if samples, _ = s.LastN("check1", "rtt", 100); len(samples) != 10 {
+		t.Errorf("expected all 10 samples, got %d", len(samples))
+	}
+
+	if metrics, err := s.Metrics("check1"); err != nil || !slices.Equal(metrics, []string{"loss", "rtt"}) {
+		t.Errorf("unexpected metrics %v (%v)", metrics, err)
+	}
+
+	// a reopened store continues from the samples written
+	if err = s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	reopened := newTestStore(t)
+	reopened.Dir = s.Dir
+	if err := reopened.Append("check1", "rtt", t0.Add(9*time.Minute), 1); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("expected ErrOutOfOrder after reopening, got %v", err)
+	}
+	if checks, err := reopened.Checks(); err != nil || !slices.Equal(checks, []string{"check1"}) {
+		t.Errorf("unexpected checks %v (%v)", checks, err)
+	}
+	if samples, _ = reopened.Query("check1", "rtt", t0, t0.Add(time.Hour)); len(samples) != 10 {
+		t.Errorf("expected 10 samples after reopening, got %d", len(samples))
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	s := newTestStore(t)
+	for i, v := range []float64{1, 5, 3, 10, 2} {
+		if err := s.Append("check1", "rtt", t0.Add(time.Duration(i)*time.Minute), v); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tests := []struct {
+		agg  Aggregation
+		want []float64
+	}{
+		{Avg, []float64{3, 6.5, 2}},
+		{Min, []float64{1, 3, 2}},
+		{Max, []float64{5, 10, 2}},
+		{Sum, []float64{6, 13, 2}},
+		{Count, []float64{2, 2, 1}},
+		{Last, []float64{5, 10, 2}},
+	}
+	for _, tt := range tests {
+		samples, err := s.Aggregate("check1", "rtt", t0, t0.Add(time.Hour), 2*time.Minute, tt.agg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if !slices.Equal(values(samples), tt.want) {
+			t.Errorf("aggregation %d: wanted %v, got %v", tt.agg, tt.want, values(samples))
+		}
+		if len(samples) > 1 && !samples[1].Time.Equal(t0.Add(2*time.Minute)) {
+			t.Errorf("expected samples timed by the start of their step, got %v", samples[1].Time)
+		}
+	}
+
+	if _, err := s.Aggregate("check1", "rtt", t0, t0.Add(time.Hour), 0, Avg); err == nil {
+		t.Errorf("expected an error aggregating without a step")
+	}
+}
+
+func TestCompactDownsamplesAndExpires(t *testing.T) {
+	s := newTestStore(t)
+	s.BlockDuration = time.Hour
+	s.ChunkSamples = 4
+	s.Retention = 2 * time.Hour
+	s.Downsamples = []Downsample{{Step: 10 * time.Minute, Retention: 24 * time.Hour}}
+
+	// a sample every 5 minutes for 4 hours
+	for i := 0; i < 48; i++ {
+		if err := s.Append("check1", "rtt", t0.Add(time.Duration(i)*5*time.Minute), float64(i)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	s.nowFunc = func() time.Time { return t0.Add(4 * time.Hour) }
+	if err := s.Compact(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if starts, _ := s.blocks(seriesKey{"check1", "rtt"}, 0); len(starts) != 2 {
+		t.Errorf("expected the 2 newest raw blocks to remain, got %v", starts)
+	}
+	// compacting again finds nothing more to expire
+	if err := s.Compact(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	samples, err := s.Query("check1", "rtt", t0, t0.Add(4*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var want []float64
+	for k := 0; k < 12; k++ {
+		want = append(want, float64(2*k)+0.5)
+	}
+	for i := 24; i < 48; i++ {
+		want = append(want, float64(i))
+	}
+	if !slices.Equal(values(samples), want) {
+		t.Errorf("wanted %v, got %v", want, values(samples))
+	}
+	if !samples[1].Time.Equal(t0.Add(10*time.Minute)) || !samples[12].Time.Equal(t0.Add(2*time.Hour)) {
+		t.Errorf("unexpected sample times %v, %v", samples[1].Time, samples[12].Time)
+	}
+
+	// counts carry over from downsampled buckets
+	samples, err = s.Aggregate("check1", "rtt", t0, t0.Add(4*time.Hour), time.Hour, Count)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []float64{12, 12, 12, 12}; !slices.Equal(values(samples), want) {
+		t.Errorf("wanted %v, got %v", want, values(samples))
+	}
+
+	s.nowFunc = func() time.Time { return t0.Add(30 * time.Hour) }
+	if err := s.Compact(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if checks, err := s.Checks(); err != nil || len(checks) != 0 {
+		t.Errorf("expected every series to expire, got %v (%v)", checks, err)
+	}
+	if entries, _ := os.ReadDir(s.Dir); len(entries) != 0 {
+		t.Errorf("expected empty directories to be removed, got %v", entries)
+	}
+}
+
+func TestSeriesAreLockedSeparately(t *testing.T) {
+	s := newTestStore(t)
+
+	// hold a series as if its samples were being written
+	key := seriesKey{"check1", "rtt"}
+	h := s.lockHead(key)
+	defer s.unlockHead(key, h)
+
+	done := make(chan error, 1)
+	go func() {
+		if err := s.Append("check2", "rtt", t0, 1); err != nil {
+			done <- err
+			return
+		}
+		_, err := s.Query("check2", "rtt", t0, t0.Add(time.Minute))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("another series waited on the locked one")
+	}
+}
+
+func TestConcurrentAppendQueryCompact(t *testing.T) {
+	s := newTestStore(t)
+	s.BlockDuration = time.Hour
+	s.ChunkSamples = 4
+	s.Retention = time.Hour
+	s.Downsamples = []Downsample{{Step: 10 * time.Minute, Retention: 24 * time.Hour}}
+	s.nowFunc = func() time.Time { return t0.Add(24 * time.Hour) }
+
+	var wg sync.WaitGroup
+	for _, checkId := range []string{"check1", "check2", "check3"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				if err := s.Append(checkId, "rtt", t0.Add(time.Duration(i)*time.Minute), float64(i)); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				if _, err := s.LastN(checkId, "rtt", 5); err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			if err := s.Compact(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if _, err := s.Checks(); err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		}
+	}()
+	wg.Wait()
+
+	if err := s.Compact(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	samples, err := s.Query("check2", "rtt", t0, t0.Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the raw samples have all expired into 10 minute averages
+	if len(samples) != 10 {
+		t.Errorf("expected 10 downsampled samples, got %d: %v", len(samples), samples)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Append("check1", "rtt", t0.Add(24*time.Hour), 1); err == nil {
+		t.Error("expected an error appending after Close")
+	}
+}
+
+func TestCompactRejectsInvalidDownsampleStep(t *testing.T) {
+	s := newTestStore(t)
+	s.Downsamples = []Downsample{{Step: 7 * time.Minute, Retention: time.Hour}}
+	if err := s.Compact(); err == nil {
+		t.Errorf("expected an error compacting with a step that doesn't divide the block duration")
+	}
+}
+
+func TestEscapedNames(t *testing.T) {
+	s := newTestStore(t)
+	for _, name := range []string{"", "..", "a/b", "50%"} {
+		if err := s.Append(name, name, t0, 1); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := s.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	entries, _ := os.ReadDir(s.Dir)
+	if len(entries) != 4 {
+		t.Errorf("expected a directory per check, got %v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(s.Dir), "raw")); err == nil {
+		t.Errorf("expected names not to escape the store directory")
+	}
+	if checks, err := s.Checks(); err != nil || !slices.Equal(checks, []string{"", "..", "50%", "a/b"}) {
+		t.Errorf("unexpected checks %q (%v)", checks, err)
+	}
+}
+
+func TestHandlerStoresMetrics(t *testing.T) {
+	s := newTestStore(t)
+	h := NewHandler(s)
+	h.StateMetric = "state"
+
+	chk := &check.Check{Id: "router1"}
+	for i, v := range []string{"1.5", "2.5"} {
+		result := check.NewResult(check.StateWarn, "", []check.ResultMetric{
+			{Label: "rtt", Value: v, Type: check.ResultMetricGauge},
+			{Label: "octets", Value: "18446744073709551615", Type: check.ResultMetricCounter},
+			{Label: "bad", Value: "n/a", Type: check.ResultMetricGauge},
+		})
+		result.Time = t0.Add(time.Duration(i) * time.Minute)
+		if err := h.Process(chk, result, nil); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if metrics, _ := s.Metrics("router1"); !slices.Equal(metrics, []string{"octets", "rtt", "state"}) {
+		t.Errorf("unexpected metrics %v", metrics)
+	}
+	if samples, _ := s.Query("router1", "rtt", t0, t0.Add(time.Hour)); !slices.Equal(values(samples), []float64{1.5, 2.5}) {
+		t.Errorf("unexpected rtt samples %v", samples)
+	}
+	if samples, _ := s.LastN("router1", "state", 1); !slices.Equal(values(samples), []float64{float64(check.StateWarn)}) {
+		t.Errorf("unexpected state samples %v", samples)
+	}
+
+	result := check.NewResult(check.StateOk, "", []check.ResultMetric{{Label: "rtt", Value: "1"}})
+	result.Time = t0
+	if err := h.Process(chk, result, nil); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("expected ErrOutOfOrder processing an old result, got %v", err)
+	}
+}
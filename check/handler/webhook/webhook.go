@@ -0,0 +1,261 @@
+// Package webhook provides a check.Handler that POSTs Incident events (and optionally every Result) to a URL with a
+// templated payload.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"github.com/seankndy/gopoller/internal/retryhttp"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	DefaultSignatureHeader = "X-Gopoller-Signature"
+	DefaultDedupeKeyHeader = "X-Gopoller-Dedupe-Key"
+)
+
+// DefaultEvents are the Incident events sent when Handler.Events is nil.
+var DefaultEvents = []check.IncidentEventType{
+	check.IncidentOpened,
+	check.IncidentEscalated,
+	check.IncidentDeEscalated,
+	check.IncidentResolved,
+	check.IncidentAcknowledgementExpired,
+}
+
+// FuncMap holds the functions available to payload templates in addition to the text/template builtins.
+var FuncMap = template.FuncMap{
+	// json encodes a value as JSON, ex. {{ json .Check.Id }}
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"rfc3339": func(t time.Time) string {
+		return t.Format(time.RFC3339)
+	},
+}
+
+// DefaultTemplate renders a JSON payload and is used when Handler.Template is nil.
+var DefaultTemplate = template.Must(template.New("webhook").Funcs(FuncMap).Parse(`{
+  "kind": {{ json .Kind }},
+  "event": {{ json .Event }},
+  "dedupe_key": {{ json .DedupeKey }},
+  "check_id": {{ json .Check.Id }},
+  "meta": {{ json .Meta }},
+  "result": {{ json .Result }},
+  "incident": {{ json .Incident }},
+  "previous_incident": {{ json .PreviousIncident }}
+}`))
+
+// Payload is the data the payload template is executed with.
+type Payload struct {
+	// Kind is "incident" for Incident events and "result" for Results.
+	Kind string
+
+	// Event is the check.IncidentEventType as a string (ex. OPENED, RESOLVED) or empty for Results.
+	Event string
+
+	// DedupeKey is the Incident ID so that receivers can correlate open and resolve events of the same Incident.
+	DedupeKey string
+
+	Check            *check.Check
+	Result           *check.Result
+	Incident         *check.Incident
+	PreviousIncident *check.Incident
+	Meta             map[string]any
+}
+
+// Handler sends Incident events, and optionally every Result, as an HTTP request to URL.
+type Handler struct {
+	URL string
+
+	// Method is the HTTP method (default POST).
+	Method string
+
+	// Template renders the request body from a Payload (default DefaultTemplate).
+	Template *template.Template
+
+	// Headers are added to every request.  Content-Type defaults to application/json.
+	Headers map[string]string
+
+	// Secret, when set, signs the request body with HMAC-SHA256.  The hex digest is sent as "sha256=<digest>" in the
+	// SignatureHeader header.
+	Secret          []byte
+	SignatureHeader string
+
+	// DedupeKeyHeader is the header the Payload DedupeKey is sent in (default X-Gopoller-Dedupe-Key).
+	DedupeKeyHeader string
+
+	// Events are the Incident events to send (default DefaultEvents).
+	Events []check.IncidentEventType
+
+	// SendResults sends every Result in addition to Incident events.
+	SendResults bool
+
+	// Retries is how many times to retry a request on network errors and 5xx responses, waiting RetryBackoff
+	// (doubling each retry) between them.
+	Retries      int
+	RetryBackoff time.Duration
+
+	// Client is the http.Client requests are made with (default has a 10 second timeout).
+	Client *http.Client
+}
+
+// NewHandler creates a new Handler posting to url with a payload template parsed from tmpl.  An empty tmpl uses
+// DefaultTemplate.
+func NewHandler(url, tmpl string) (*Handler, error) {
+	h := &Handler{
+		URL:          url,
+		Retries:      3,
+		RetryBackoff: time.Second,
+	}
+
+	if tmpl != "" {
+		t, err := template.New("webhook").Funcs(FuncMap).Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		h.Template = t
+	}
+
+	return h, nil
+}
+
+func (h *Handler) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (h *Handler) Process(chk *check.Check, result *check.Result, newIncident *check.Incident) error {
+	if !h.SendResults {
+		return nil
+	}
+
+	// chk.Incident is only replaced by newIncident once every Handler has processed the Result
+	incident := newIncident
+	if incident == nil {
+		incident = chk.Incident
+	}
+
+	p := &Payload{
+		Kind:     "result",
+		Check:    chk,
+		Result:   result,
+		Incident: incident,
+		Meta:     chk.Meta,
+	}
+	if incident != nil {
+		p.DedupeKey = incident.Id.String()
+	}
+
+	return h.send(chk, p)
+}
+
+func (h *Handler) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	events := h.Events
+	if events == nil {
+		events = DefaultEvents
+	}
+	if !slices.Contains(events, event.Type) {
+		return nil
+	}
+
+	return h.send(chk, &Payload{
+		Kind:             "incident",
+		Event:            event.Type.String(),
+		DedupeKey:        event.Incident.Id.String(),
+		Check:            chk,
+		Result:           event.Result,
+		Incident:         event.Incident,
+		PreviousIncident: event.PreviousIncident,
+		Meta:             chk.Meta,
+	})
+}
+
+func (h *Handler) send(chk *check.Check, p *Payload) error {
+	body, err := h.render(p)
+	if err != nil {
+		return err
+	}
+
+	method := h.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+
+	chk.Debugf("sending %s %s webhook to %s", p.Kind, p.Event, h.URL)
+
+	_, err = retryhttp.Do(context.Background(), h.client(), func(ctx context.Context) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, h.URL, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		h.setHeaders(req, body, p)
+		return req, nil
+	}, h.Retries, h.RetryBackoff)
+
+	return err
+}
+
+func (h *Handler) render(p *Payload) ([]byte, error) {
+	tmpl := h.Template
+	if tmpl == nil {
+		tmpl = DefaultTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, p); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (h *Handler) setHeaders(req *http.Request, body []byte, p *Payload) {
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range h.Headers {
+		req.Header.Set(k, v)
+	}
+
+	if p.DedupeKey != "" {
+		header := h.DedupeKeyHeader
+		if header == "" {
+			header = DefaultDedupeKeyHeader
+		}
+		req.Header.Set(header, p.DedupeKey)
+	}
+
+	if len(h.Secret) > 0 {
+		header := h.SignatureHeader
+		if header == "" {
+			header = DefaultSignatureHeader
+		}
+		req.Header.Set(header, "sha256="+Sign(h.Secret, body))
+	}
+}
+
+var defaultClient = &http.Client{Timeout: 10 * time.Second}
+
+func (h *Handler) client() *http.Client {
+	if h.Client == nil {
+		return defaultClient
+	}
+	return h.Client
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of body using secret.  Receivers can use it to verify the signature
+// header.
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,212 @@
+package webhook
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+type testServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []recordedRequest
+	statuses []int
+}
+
+func newTestServer(statuses ...int) *testServer {
+	s := &testServer{statuses: statuses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, recordedRequest{header: r.Header, body: body})
+		status := http.StatusOK
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func TestSendsTemplatedIncidentEventsWithDedupeKey(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	h, err := NewHandler(srv.URL, `{"id":{{ json .DedupeKey }},"event":"{{ .Event }}","check":"{{ .Check.Id }}","site":"{{ index .Meta "site" }}"}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	h.Headers = map[string]string{"Authorization": "Bearer abc"}
+
+	chk := check.New("check1",
+		check.WithMeta(map[string]any{"site": "dc1"}),
+		check.WithHandlers([]check.Handler{h}),
+	)
+
+	chk.Command = testCommand{state: check.StateCrit}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	incidentId := chk.Incident.Id.String()
+
+	chk.Command = testCommand{state: check.StateOk}
+	if err := chk.Execute(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(srv.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %d", len(srv.requests))
+	}
+	for i, wantEvent := range []string{"OPENED", "RESOLVED"} {
+		r := srv.requests[i]
+		var got map[string]string
+		if err := json.Unmarshal(r.body, &got); err != nil {
+			t.Fatalf("request %d: bad payload %s: %v", i, r.body, err)
+		}
+		want := map[string]string{"id": incidentId, "event": wantEvent, "check": "check1", "site": "dc1"}
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("request %d: expected %s=%s, got %s", i, k, v, got[k])
+			}
+		}
+		if r.header.Get(DefaultDedupeKeyHeader) != incidentId {
+			t.Errorf("request %d: expected dedupe key header %s, got %s", i, incidentId, r.header.Get(DefaultDedupeKeyHeader))
+		}
+		if r.header.Get("Authorization") != "Bearer abc" {
+			t.Errorf("request %d: expected custom header to be sent", i)
+		}
+	}
+}
+
+func TestSignsBody(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	h, _ := NewHandler(srv.URL, "")
+	h.Secret = []byte("s3cret")
+
+	chk := &check.Check{Id: "check1"}
+	incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+	if err := h.ProcessIncidentEvent(chk, check.IncidentEvent{Type: check.IncidentOpened, Incident: incident}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	r := srv.requests[0]
+	if want := "sha256=" + Sign([]byte("s3cret"), r.body); r.header.Get(DefaultSignatureHeader) != want {
+		t.Errorf("expected signature %s, got %s", want, r.header.Get(DefaultSignatureHeader))
+	}
+	if !json.Valid(r.body) {
+		t.Errorf("expected default template to render valid JSON, got %s", r.body)
+	}
+}
+
+func TestRetriesOn5xxOnly(t *testing.T) {
+	tests := []struct {
+		statuses     []int
+		wantRequests int
+		wantErr      bool
+	}{
+		{statuses: []int{500, 502, 200}, wantRequests: 3, wantErr: false},
+		{statuses: []int{500, 500, 500, 500}, wantRequests: 3, wantErr: true},
+		{statuses: []int{400}, wantRequests: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		srv := newTestServer(tt.statuses...)
+
+		h, _ := NewHandler(srv.URL, "")
+		h.Retries = 2
+		h.RetryBackoff = time.Millisecond
+		h.SendResults = true
+
+		err := h.Process(&check.Check{Id: "check1"}, check.NewResult(check.StateOk, "", nil), nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("statuses %v: expected error=%v, got %v", tt.statuses, tt.wantErr, err)
+		}
+		if len(srv.requests) != tt.wantRequests {
+			t.Errorf("statuses %v: expected %d requests, got %d", tt.statuses, tt.wantRequests, len(srv.requests))
+		}
+		srv.Close()
+	}
+}
+
+func TestIgnoresUnselectedEvents(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	h, _ := NewHandler(srv.URL, "")
+	incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+	_ = h.ProcessIncidentEvent(&check.Check{}, check.IncidentEvent{Type: check.IncidentDiscarded, Incident: incident})
+	_ = h.Process(&check.Check{}, check.NewResult(check.StateOk, "", nil), nil)
+
+	if len(srv.requests) != 0 {
+		t.Errorf("expected no requests, got %d", len(srv.requests))
+	}
+}
+
+func TestResultCarriesIncidentItOpens(t *testing.T) {
+	srv := newTestServer()
+	defer srv.Close()
+
+	h, _ := NewHandler(srv.URL, "")
+	h.SendResults = true
+	chk := check.New("check1", check.WithHandlers([]check.Handler{h}))
+
+	for _, state := range []check.ResultState{check.StateCrit, check.StateOk, check.StateCrit} {
+		chk.Command = testCommand{state: state}
+		srv.mu.Lock()
+		srv.requests = nil
+		srv.mu.Unlock()
+		if err := chk.Execute(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if state != check.StateCrit {
+			continue
+		}
+
+		incidentId := chk.Incident.Id.String()
+		var results int
+		for _, r := range srv.requests {
+			var got struct {
+				Kind      string `json:"kind"`
+				DedupeKey string `json:"dedupe_key"`
+				Incident  *struct{ Id string }
+			}
+			if err := json.Unmarshal(r.body, &got); err != nil {
+				t.Fatalf("bad payload %s: %v", r.body, err)
+			}
+			if got.Kind != "result" {
+				continue
+			}
+			results++
+			if got.DedupeKey != incidentId || got.Incident == nil || got.Incident.Id != incidentId {
+				t.Errorf("expected the result to carry the opened incident %s, got %s", incidentId, r.body)
+			}
+			if r.header.Get(DefaultDedupeKeyHeader) != incidentId {
+				t.Errorf("expected dedupe key header %s, got %s", incidentId, r.header.Get(DefaultDedupeKeyHeader))
+			}
+		}
+		if results != 1 {
+			t.Errorf("expected 1 result request, got %d", results)
+		}
+	}
+}
+
+type testCommand struct {
+	state check.ResultState
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(c.state, "", nil), nil
+}
@@ -2,35 +2,123 @@ package check
 
 import (
 	"github.com/google/uuid"
+	"slices"
 	"time"
 )
 
 // Incident defines a Check that has undergone a non-OK state change.
 type Incident struct {
-	Id           uuid.UUID
-	FromState    ResultState
-	ToState      ResultState
-	ReasonCode   string
-	Time         time.Time
-	Resolved     *time.Time
+	Id         uuid.UUID
+	FromState  ResultState
+	ToState    ResultState
+	ReasonCode string
+	Time       time.Time
+	Resolved   *time.Time
+
+	// Acknowledgement is the current acknowledgement of the Incident or nil.
+	// It may have expired, use IsAcknowledged() to test it.
+	Acknowledgement *Acknowledgement
+
+	// Acknowledged is when the Incident was acknowledged or nil.
+	//
+	// Deprecated: use Acknowledgement, which this mirrors the Time of.
 	Acknowledged *time.Time
+
+	// Notes is the timeline of the Incident, oldest first.  It holds notes
+	// added with AddNote() as well as entries recorded when the Incident is
+	// acknowledged or resolved.
+	Notes []IncidentNote
+}
+
+// Acknowledgement records who acknowledged an Incident, why and for how long.
+type Acknowledgement struct {
+	By      string
+	Comment string
+	Time    time.Time
+
+	// Expires is when the acknowledgement lapses so that the Incident is
+	// notified on again.  nil means it never expires.
+	Expires *time.Time
+
+	// Sticky acknowledgements carry over to the new Incident when a Check
+	// changes from one non-OK state to another, until the Check returns to OK.
+	// Non-sticky acknowledgements only apply to the Incident acknowledged.
+	Sticky bool
+}
+
+// IsExpiredAt returns true if the acknowledgement has lapsed at time t.
+func (a *Acknowledgement) IsExpiredAt(t time.Time) bool {
+	return a.Expires != nil && !t.Before(*a.Expires)
+}
+
+// IncidentNote is an entry on an Incident's timeline.  Author is empty for
+// entries recorded automatically.
+type IncidentNote struct {
+	Time   time.Time
+	Author string
+	Text   string
 }
 
 // Resolve sets the Incident to resolved at the current time.
 func (i *Incident) Resolve() {
 	t := time.Now()
 	i.Resolved = &t
+	i.addNote(t, "", "resolved")
 }
 
 // Acknowledge sets the Incident to acknowledged at the current time.
+//
+// Deprecated: use AcknowledgeWith, which records who acknowledged it and why.
 func (i *Incident) Acknowledge() {
-	t := time.Now()
+	i.AcknowledgeWith(Acknowledgement{})
+}
+
+// AcknowledgeWith acknowledges the Incident with ack.  If ack.Time is zero, it
+// is set to the current time.
+func (i *Incident) AcknowledgeWith(ack Acknowledgement) {
+	if ack.Time.IsZero() {
+		ack.Time = time.Now()
+	}
+	i.Acknowledgement = &ack
+	t := ack.Time
 	i.Acknowledged = &t
+
+	text := "acknowledged"
+	if ack.Expires != nil {
+		text += " until " + ack.Expires.Format(time.RFC3339)
+	}
+	if ack.Sticky {
+		text += " (sticky)"
+	}
+	if ack.Comment != "" {
+		text += ": " + ack.Comment
+	}
+	i.addNote(ack.Time, ack.By, text)
 }
 
-// IsAcknowledged returns true if incident has been acknowledged.
+// Unacknowledge removes the Incident's acknowledgement.
+func (i *Incident) Unacknowledge(by string) {
+	if i.Acknowledgement == nil && i.Acknowledged == nil {
+		return
+	}
+	i.Acknowledgement, i.Acknowledged = nil, nil
+	i.addNote(time.Now(), by, "acknowledgement removed")
+}
+
+// IsAcknowledged returns true if incident has been acknowledged and the
+// acknowledgement has not expired.
 func (i *Incident) IsAcknowledged() bool {
-	return i.Acknowledged != nil
+	return i.IsAcknowledgedAt(time.Now())
+}
+
+// IsAcknowledgedAt returns true if incident is acknowledged at time t.  An
+// Incident with only the deprecated Acknowledged set is acknowledged
+// indefinitely.
+func (i *Incident) IsAcknowledgedAt(t time.Time) bool {
+	if i.Acknowledgement == nil {
+		return i.Acknowledged != nil
+	}
+	return !i.Acknowledgement.IsExpiredAt(t)
 }
 
 // IsResolved returns true if incident has been resolved.
@@ -38,6 +126,63 @@ func (i *Incident) IsResolved() bool {
 	return i.Resolved != nil
 }
 
+// AddNote adds a note from author to the Incident's timeline.
+func (i *Incident) AddNote(author, text string) {
+	i.addNote(time.Now(), author, text)
+}
+
+func (i *Incident) addNote(t time.Time, author, text string) {
+	i.Notes = append(i.Notes, IncidentNote{Time: t, Author: author, Text: text})
+}
+
+// expireAcknowledgement removes the Incident's acknowledgement if it has
+// expired at time t, returning true if it did.
+func (i *Incident) expireAcknowledgement(t time.Time) bool {
+	if i.Acknowledgement == nil || !i.Acknowledgement.IsExpiredAt(t) {
+		return false
+	}
+	i.addNote(t, "", "acknowledgement by "+i.Acknowledgement.By+" expired")
+	i.Acknowledgement, i.Acknowledged = nil, nil
+	return true
+}
+
+// inheritStickyAcknowledgement carries a sticky, unexpired acknowledgement of
+// previous over to the Incident.
+func (i *Incident) inheritStickyAcknowledgement(previous *Incident, t time.Time) {
+	ack := previous.Acknowledgement
+	if ack == nil || !ack.Sticky || ack.IsExpiredAt(t) {
+		return
+	}
+	c := *ack
+	i.Acknowledgement = &c
+	at := c.Time
+	i.Acknowledged = &at
+	i.addNote(t, "", "sticky acknowledgement by "+ack.By+" carried over from incident "+previous.Id.String())
+}
+
+// Clone returns a deep copy of the Incident.
+func (i *Incident) Clone() *Incident {
+	c := *i
+	if i.Resolved != nil {
+		t := *i.Resolved
+		c.Resolved = &t
+	}
+	if i.Acknowledgement != nil {
+		a := *i.Acknowledgement
+		if a.Expires != nil {
+			t := *a.Expires
+			a.Expires = &t
+		}
+		c.Acknowledgement = &a
+	}
+	if i.Acknowledged != nil {
+		t := *i.Acknowledged
+		c.Acknowledged = &t
+	}
+	c.Notes = slices.Clone(i.Notes)
+	return &c
+}
+
 // MakeIncidentFromResults creates a new Incident based on a Check last Result,
 // and it's current Result.
 func MakeIncidentFromResults(lastResult *Result, currentResult *Result) *Incident {
@@ -53,3 +198,135 @@ func MakeIncidentFromResults(lastResult *Result, currentResult *Result) *Inciden
 		Time:       time.Now(),
 	}
 }
+
+// IncidentEventType is the type of lifecycle change an Incident has undergone.
+type IncidentEventType uint8
+
+const (
+	// IncidentOpened is a new Incident for a Check that had no unresolved Incident.
+	IncidentOpened IncidentEventType = 1
+	// IncidentEscalated is a new Incident to a worse state, superseding (and resolving) the previous Incident.
+	IncidentEscalated IncidentEventType = 2
+	// IncidentDeEscalated is a new Incident to a less severe non-OK state, superseding (and resolving) the
+	// previous Incident.
+	IncidentDeEscalated IncidentEventType = 3
+	// IncidentResolved is an Incident resolved by the Check returning to OK.
+	IncidentResolved IncidentEventType = 4
+	// IncidentAcknowledged is an Incident that has been acknowledged.
+	IncidentAcknowledged IncidentEventType = 5
+	// IncidentDiscarded is an already resolved Incident being removed from its Check.
+	IncidentDiscarded IncidentEventType = 6
+	// IncidentAcknowledgementExpired is an open Incident whose acknowledgement has lapsed.
+	IncidentAcknowledgementExpired IncidentEventType = 7
+)
+
+func (t IncidentEventType) String() string {
+	switch t {
+	case IncidentOpened:
+		return "OPENED"
+	case IncidentEscalated:
+		return "ESCALATED"
+	case IncidentDeEscalated:
+		return "DEESCALATED"
+	case IncidentResolved:
+		return "RESOLVED"
+	case IncidentAcknowledged:
+		return "ACKNOWLEDGED"
+	case IncidentDiscarded:
+		return "DISCARDED"
+	case IncidentAcknowledgementExpired:
+		return "ACK_EXPIRED"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// IncidentEvent describes a lifecycle change of an Incident.
+type IncidentEvent struct {
+	Type     IncidentEventType
+	Incident *Incident
+
+	// PreviousIncident is the Incident that was superseded by Incident for
+	// IncidentEscalated and IncidentDeEscalated events, otherwise nil.
+	PreviousIncident *Incident
+
+	// Result is the Result that caused the event, or nil if the event did
+	// not come from the Check executing (ex. IncidentAcknowledged).
+	Result *Result
+
+	Time time.Time
+}
+
+func newIncidentEvent(eventType IncidentEventType, incident, previousIncident *Incident, result *Result) IncidentEvent {
+	return IncidentEvent{
+		Type:             eventType,
+		Incident:         incident,
+		PreviousIncident: previousIncident,
+		Result:           result,
+		Time:             time.Now(),
+	}
+}
+
+// IncidentStore stores the Incidents of Checks so that open and historical
+// Incidents can be queried.
+type IncidentStore interface {
+	// Save inserts or updates the Incident belonging to the Check with ID
+	// checkId.
+	Save(checkId string, incident *Incident) error
+
+	// Get returns the IncidentRecord for the Incident with ID id, or nil if
+	// there is none.
+	Get(id uuid.UUID) (*IncidentRecord, error)
+
+	// Find returns the IncidentRecords matching filter, ordered by Incident
+	// time.
+	Find(filter IncidentFilter) ([]*IncidentRecord, error)
+}
+
+// IncidentRecord is an Incident as stored by an IncidentStore.
+type IncidentRecord struct {
+	CheckId  string
+	Incident Incident
+}
+
+// IncidentFilter narrows the IncidentRecords returned by IncidentStore.Find().
+// Zero value fields match everything.
+type IncidentFilter struct {
+	// CheckId matches Incidents belonging to the Check with this ID.
+	CheckId string
+
+	// States matches Incidents with any of these ToStates.
+	States []ResultState
+
+	// Resolved matches resolved Incidents when true and open Incidents when
+	// false.
+	Resolved *bool
+
+	// Since and Until match Incidents with a Time within [Since, Until).
+	Since time.Time
+	Until time.Time
+
+	// Limit caps the number of IncidentRecords returned, keeping the most
+	// recent.
+	Limit int
+}
+
+// Matches returns true if the IncidentRecord r satisfies the filter.
+func (f IncidentFilter) Matches(r *IncidentRecord) bool {
+	if f.CheckId != "" && r.CheckId != f.CheckId {
+		return false
+	}
+	if len(f.States) > 0 && !slices.Contains(f.States, r.Incident.ToState) {
+		return false
+	}
+	if f.Resolved != nil && *f.Resolved != r.Incident.IsResolved() {
+		return false
+	}
+	if !f.Since.IsZero() && r.Incident.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !r.Incident.Time.Before(f.Until) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package check
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestIncident_AcknowledgeRecordsMetadataAndNote(t *testing.T) {
+	i := &Incident{}
+	expires := time.Now().Add(time.Hour)
+	i.AcknowledgeWith(Acknowledgement{By: "alice", Comment: "looking into it", Expires: &expires})
+
+	if !i.IsAcknowledged() {
+		t.Fatal("expected incident to be acknowledged")
+	}
+	if i.Acknowledgement.By != "alice" || i.Acknowledgement.Time.IsZero() {
+		t.Errorf("unexpected acknowledgement %+v", i.Acknowledgement)
+	}
+	if len(i.Notes) != 1 || i.Notes[0].Author != "alice" {
+		t.Errorf("expected a single note from alice, got %+v", i.Notes)
+	}
+}
+
+func TestIncident_DeprecatedAcknowledge(t *testing.T) {
+	i := &Incident{}
+	i.Acknowledge()
+	if !i.IsAcknowledged() || i.Acknowledged == nil || !i.Acknowledged.Equal(i.Acknowledgement.Time) {
+		t.Fatalf("expected Acknowledged to mirror the acknowledgement, got %v %+v", i.Acknowledged, i.Acknowledgement)
+	}
+
+	i.Unacknowledge("alice")
+	if i.IsAcknowledged() || i.Acknowledged != nil {
+		t.Errorf("expected the acknowledgement removed")
+	}
+
+	// incidents persisted before Acknowledgement existed only have Acknowledged
+	at := time.Now()
+	legacy := &Incident{Acknowledged: &at}
+	if !legacy.IsAcknowledged() {
+		t.Errorf("expected an incident with only Acknowledged set to be acknowledged")
+	}
+}
+
+func TestIncident_IsAcknowledgedHonorsExpiry(t *testing.T) {
+	i := &Incident{}
+	expires := time.Now().Add(time.Hour)
+	i.AcknowledgeWith(Acknowledgement{By: "alice", Expires: &expires})
+
+	if !i.IsAcknowledgedAt(expires.Add(-time.Second)) {
+		t.Error("expected incident to be acknowledged before expiry")
+	}
+	if i.IsAcknowledgedAt(expires) {
+		t.Error("expected incident to not be acknowledged at expiry")
+	}
+}
+
+func TestIncident_SerializesRoundTrip(t *testing.T) {
+	expires := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	i := MakeIncidentFromResults(nil, NewResult(StateCrit, "TEST", nil))
+	i.AcknowledgeWith(Acknowledgement{By: "alice", Comment: "ack", Expires: &expires, Sticky: true, Time: expires.Add(-time.Hour)})
+	i.AddNote("bob", "rebooted the router")
+
+	b, err := json.Marshal(i)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got Incident
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got.Acknowledgement == nil || *got.Acknowledgement.Expires != expires || !got.Acknowledgement.Sticky {
+		t.Errorf("expected acknowledgement to survive serialization, got %+v", got.Acknowledgement)
+	}
+	b2, err := json.Marshal(&got)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(b) != string(b2) {
+		t.Errorf("expected %s, got %s", b, b2)
+	}
+}
+
+func TestCheck_StickyAcknowledgementCarriesOverStateChanges(t *testing.T) {
+	tests := []struct {
+		sticky bool
+		want   bool
+	}{
+		{sticky: true, want: true},
+		{sticky: false, want: false},
+	}
+
+	for _, tt := range tests {
+		c := &Check{Command: testCommand{result: NewResult(StateWarn, "", nil)}}
+		_ = c.Execute()
+		_ = c.AcknowledgeIncident(Acknowledgement{By: "alice", Sticky: tt.sticky})
+
+		c.Command = testCommand{result: NewResult(StateCrit, "", nil)}
+		_ = c.Execute()
+
+		if got := c.Incident.IsAcknowledged(); got != tt.want {
+			t.Errorf("sticky=%v: expected escalated incident acknowledged=%v, got %v", tt.sticky, tt.want, got)
+		}
+	}
+}
+
+func TestCheck_StickyAcknowledgementDoesNotSurviveRecovery(t *testing.T) {
+	c := &Check{Command: testCommand{result: NewResult(StateWarn, "", nil)}}
+	_ = c.Execute()
+	_ = c.AcknowledgeIncident(Acknowledgement{By: "alice", Sticky: true})
+
+	for _, state := range []ResultState{StateOk, StateOk, StateWarn} {
+		c.Command = testCommand{result: NewResult(state, "", nil)}
+		_ = c.Execute()
+	}
+
+	if c.Incident.IsAcknowledged() {
+		t.Error("expected incident after recovery to not be acknowledged")
+	}
+}
+
+func TestCheck_ExecuteExpiresAcknowledgement(t *testing.T) {
+	h := &testEventHandler{}
+	c := &Check{Handlers: []Handler{h}, Command: testCommand{result: NewResult(StateCrit, "", nil)}}
+	_ = c.Execute()
+
+	expires := time.Now().Add(-time.Second)
+	_ = c.AcknowledgeIncident(Acknowledgement{By: "alice", Expires: &expires})
+
+	h.events = nil
+	_ = c.Execute()
+	if len(h.events) != 1 || h.events[0].Type != IncidentAcknowledgementExpired {
+		t.Fatalf("expected a single acknowledgement expired event, got %v", h.events)
+	}
+	if c.Incident.Acknowledgement != nil {
+		t.Error("expected expired acknowledgement to be removed")
+	}
+
+	h.events = nil
+	_ = c.Execute()
+	if len(h.events) != 0 {
+		t.Errorf("expected no further events, got %v", h.events)
+	}
+}
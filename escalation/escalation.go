@@ -0,0 +1,424 @@
+// Package escalation runs notification policies against open Incidents.  Each Policy is a timeline of Steps (for
+// example, notify team A immediately, team B after 15 minutes, then repeat every hour) that is stopped when the
+// Incident is acknowledged or resolved.
+package escalation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-multierror"
+	"github.com/seankndy/gopoller/check"
+	"sync"
+	"time"
+)
+
+// DefaultPolicyMetaKey is the Check.Meta key holding the name of the Policy to escalate a Check's Incidents with.
+const DefaultPolicyMetaKey = "escalation_policy"
+
+// Clock provides the current time to a Manager.  Tests can substitute a fake clock to control the timeline.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// Notifier delivers an escalation notification.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotifierFunc adapts an ordinary function to a Notifier.
+type NotifierFunc func(ctx context.Context, n Notification) error
+
+func (f NotifierFunc) Notify(ctx context.Context, n Notification) error {
+	return f(ctx, n)
+}
+
+// Notification is passed to the Notifiers of a Step when it fires.
+type Notification struct {
+	Escalation Escalation
+	Step       Step
+
+	// Repeat is 0 the first time a Step fires and counts up each time Policy.RepeatEvery fires it again.
+	Repeat int
+}
+
+// Step is a single stage of a Policy.
+type Step struct {
+	Name string
+
+	// After is the delay from the start of the escalation before this Step fires.
+	After time.Duration
+
+	Notifiers []Notifier
+}
+
+// Policy is the timeline of Steps to run for an Incident.
+type Policy struct {
+	Name  string
+	Steps []Step
+
+	// RepeatEvery fires the final Step again this often once every Step has fired, for as long as the Incident is
+	// unacknowledged and unresolved.  0 disables repeating.
+	RepeatEvery time.Duration
+
+	// MaxRepeats caps the number of repeats (0 is unlimited).
+	MaxRepeats int
+}
+
+// Escalation is the state of an escalation in progress for an Incident.  It only contains exported fields so that
+// a Store can serialize it.
+type Escalation struct {
+	CheckId  string
+	Incident check.Incident
+	Policy   string
+
+	Started      time.Time
+	NextStep     int
+	LastNotified time.Time
+	Repeats      int
+}
+
+// Store persists Escalations so they survive restarts.
+type Store interface {
+	Save(e *Escalation) error
+	Delete(incidentId uuid.UUID) error
+	All() ([]*Escalation, error)
+}
+
+// Manager starts and stops Escalations from Incident lifecycle events and runs their Policies.  It is a
+// check.Handler (and check.IncidentEventHandler) so it is added to the Handlers of the Checks it should escalate,
+// while Run() drives the timeline.
+type Manager struct {
+	// Policies are the escalation policies by name.
+	Policies map[string]*Policy
+
+	// PolicyName returns the name of the Policy for a Check, or "" to not escalate it.  By default, the name is
+	// read from the Check's Meta under DefaultPolicyMetaKey.
+	PolicyName func(*check.Check) string
+
+	// Store persists the Escalations (default is an in-memory store).
+	Store Store
+
+	// Clock provides the current time (default is the system clock).
+	Clock Clock
+
+	// Interval is how often Run() advances Escalations (default 10 seconds).
+	Interval time.Duration
+
+	// NotifyTimeout bounds each Notifier call so a hung notification endpoint cannot stall escalations (default 30
+	// seconds).
+	NotifyTimeout time.Duration
+
+	// OnError is called by Run() with errors from advancing Escalations (useful for logging).
+	OnError func(err error)
+
+	// inflight are the Escalations whose due Steps are being notified, by Incident ID.
+	inflight map[uuid.UUID]*claim
+	mu       sync.Mutex
+}
+
+// claim is an Escalation advanced past its due Steps, which are notified without holding Manager.mu.
+type claim struct {
+	escalation    *Escalation
+	notifications []Notification
+
+	// stopped is set when the Escalation is stopped while being notified, so it isn't saved again.
+	stopped bool
+}
+
+func NewManager(policies []*Policy, store Store) *Manager {
+	m := &Manager{
+		Policies:      make(map[string]*Policy, len(policies)),
+		Store:         store,
+		Clock:         systemClock{},
+		Interval:      10 * time.Second,
+		NotifyTimeout: 30 * time.Second,
+	}
+	for _, p := range policies {
+		m.Policies[p.Name] = p
+	}
+	return m
+}
+
+func (m *Manager) Mutate(*check.Check, *check.Result, *check.Incident) {
+	return
+}
+
+func (m *Manager) Process(*check.Check, *check.Result, *check.Incident) error {
+	return nil
+}
+
+func (m *Manager) ProcessIncidentEvent(chk *check.Check, event check.IncidentEvent) error {
+	switch event.Type {
+	case check.IncidentOpened, check.IncidentAcknowledgementExpired:
+		return m.start(chk, event.Incident)
+	case check.IncidentEscalated, check.IncidentDeEscalated:
+		if err := m.stop(event.PreviousIncident.Id); err != nil {
+			return err
+		}
+		return m.start(chk, event.Incident)
+	case check.IncidentResolved, check.IncidentAcknowledged, check.IncidentDiscarded:
+		return m.stop(event.Incident.Id)
+	}
+	return nil
+}
+
+// start begins escalating incident, immediately firing any Steps due right away.
+func (m *Manager) start(chk *check.Check, incident *check.Incident) error {
+	name := m.policyName(chk)
+	if name == "" {
+		return nil
+	}
+	if _, ok := m.Policies[name]; !ok {
+		return fmt.Errorf("escalation policy %s not defined", name)
+	}
+	if incident.IsAcknowledgedAt(m.now()) {
+		chk.Debugf("not escalating acknowledged incident %s", incident.Id)
+		return nil
+	}
+
+	chk.Debugf("starting escalation policy %s for incident %s", name, incident.Id)
+
+	e := &Escalation{
+		CheckId:  chk.Id,
+		Incident: *incident.Clone(),
+		Policy:   name,
+		Started:  m.now(),
+	}
+
+	m.mu.Lock()
+	m.abandon(incident.Id)
+	if err := m.store().Save(e); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	c, err := m.claim(e)
+	m.mu.Unlock()
+
+	if c == nil {
+		return err
+	}
+	return m.fire(context.Background(), []*claim{c})
+}
+
+func (m *Manager) stop(incidentId uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.abandon(incidentId)
+	return m.store().Delete(incidentId)
+}
+
+// abandon keeps an Escalation being notified from being saved once its notifications finish.  m.mu must be held.
+func (m *Manager) abandon(incidentId uuid.UUID) {
+	if c, ok := m.inflight[incidentId]; ok {
+		c.stopped = true
+		delete(m.inflight, incidentId)
+	}
+}
+
+// Run advances Escalations every Interval until ctx is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	interval := m.Interval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.Tick(ctx); err != nil && m.OnError != nil {
+				m.OnError(err)
+			}
+		}
+	}
+}
+
+// Tick advances every Escalation, firing the Steps that are due.
+func (m *Manager) Tick(ctx context.Context) error {
+	m.mu.Lock()
+	escalations, err := m.store().All()
+	if err != nil {
+		m.mu.Unlock()
+		return err
+	}
+
+	var errs error
+	var claims []*claim
+	for _, e := range escalations {
+		c, err := m.claim(e)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+		}
+		if c != nil {
+			claims = append(claims, c)
+		}
+	}
+	m.mu.Unlock()
+
+	if err := m.fire(ctx, claims); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return errs
+}
+
+// claim advances e past the Steps that are due, returning them to be notified, or nil if none are due or e is
+// already being notified.  An Escalation that should no longer run is deleted.  m.mu must be held.
+func (m *Manager) claim(e *Escalation) (*claim, error) {
+	now := m.now()
+
+	policy, ok := m.Policies[e.Policy]
+	if !ok || e.Incident.IsResolved() || e.Incident.IsAcknowledgedAt(now) {
+		return nil, m.store().Delete(e.Incident.Id)
+	}
+	if _, ok := m.inflight[e.Incident.Id]; ok {
+		return nil, nil
+	}
+
+	c := &claim{escalation: e}
+	for e.NextStep < len(policy.Steps) && now.Sub(e.Started) >= policy.Steps[e.NextStep].After {
+		c.notifications = append(c.notifications, Notification{Escalation: *e, Step: policy.Steps[e.NextStep]})
+		e.NextStep++
+		e.LastNotified = now
+	}
+
+	if len(c.notifications) == 0 && e.NextStep == len(policy.Steps) && len(policy.Steps) > 0 &&
+		policy.RepeatEvery > 0 && (policy.MaxRepeats == 0 || e.Repeats < policy.MaxRepeats) &&
+		now.Sub(e.LastNotified) >= policy.RepeatEvery {
+		e.Repeats++
+		c.notifications = append(c.notifications,
+			Notification{Escalation: *e, Step: policy.Steps[len(policy.Steps)-1], Repeat: e.Repeats})
+		e.LastNotified = now
+	}
+
+	if len(c.notifications) == 0 {
+		return nil, nil
+	}
+	if m.inflight == nil {
+		m.inflight = make(map[uuid.UUID]*claim)
+	}
+	m.inflight[e.Incident.Id] = c
+	return c, nil
+}
+
+// fire notifies the claimed Steps without holding m.mu, then saves the Escalations that weren't stopped meanwhile.
+func (m *Manager) fire(ctx context.Context, claims []*claim) error {
+	var errs error
+	for _, c := range claims {
+		for _, n := range c.notifications {
+			if err := m.notify(ctx, n); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, c := range claims {
+		if c.stopped {
+			continue
+		}
+		delete(m.inflight, c.escalation.Incident.Id)
+		if err := m.store().Save(c.escalation); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// notify passes n to the Notifiers of its Step, bounding each by NotifyTimeout.
+func (m *Manager) notify(ctx context.Context, n Notification) error {
+	var errs error
+	for _, notifier := range n.Step.Notifiers {
+		notifyCtx, cancel := context.WithTimeout(ctx, m.notifyTimeout())
+		err := notifier.Notify(notifyCtx, n)
+		cancel()
+		if err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("error notifying step %s of incident %s: %w", n.Step.Name,
+				n.Escalation.Incident.Id, err))
+		}
+	}
+	return errs
+}
+
+func (m *Manager) policyName(chk *check.Check) string {
+	if m.PolicyName != nil {
+		return m.PolicyName(chk)
+	}
+	name, _ := chk.Meta[DefaultPolicyMetaKey].(string)
+	return name
+}
+
+func (m *Manager) now() time.Time {
+	if m.Clock == nil {
+		return time.Now()
+	}
+	return m.Clock.Now()
+}
+
+func (m *Manager) notifyTimeout() time.Duration {
+	if m.NotifyTimeout <= 0 {
+		return 30 * time.Second
+	}
+	return m.NotifyTimeout
+}
+
+func (m *Manager) store() Store {
+	if m.Store == nil {
+		m.Store = NewMemoryStore()
+	}
+	return m.Store
+}
+
+// MemoryStore is a Store that keeps Escalations in memory.  It does not survive restarts on its own.
+type MemoryStore struct {
+	escalations map[uuid.UUID]Escalation
+	mu          sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{escalations: make(map[uuid.UUID]Escalation)}
+}
+
+func (s *MemoryStore) Save(e *Escalation) error {
+	if e == nil {
+		return errors.New("nil escalation")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.escalations[e.Incident.Id] = *e
+	return nil
+}
+
+func (s *MemoryStore) Delete(incidentId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.escalations, incidentId)
+	return nil
+}
+
+func (s *MemoryStore) All() ([]*Escalation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all := make([]*Escalation, 0, len(s.escalations))
+	for _, e := range s.escalations {
+		all = append(all, &e)
+	}
+	return all, nil
+}
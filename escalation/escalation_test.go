@@ -0,0 +1,198 @@
+package escalation
+
+import (
+	"context"
+	"github.com/seankndy/gopoller/check"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+type recordingNotifier struct {
+	name  string
+	calls *[]string
+}
+
+func (n recordingNotifier) Notify(_ context.Context, notification Notification) error {
+	*n.calls = append(*n.calls, n.name)
+	return nil
+}
+
+func newTestManager(store Store) (*Manager, *fakeClock, *[]string) {
+	var calls []string
+	policy := &Policy{
+		Name: "noc",
+		Steps: []Step{
+			{Name: "team-a", Notifiers: []Notifier{recordingNotifier{name: "a", calls: &calls}}},
+			{Name: "team-b", After: 15 * time.Minute, Notifiers: []Notifier{recordingNotifier{name: "b", calls: &calls}}},
+		},
+		RepeatEvery: time.Hour,
+	}
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	m := NewManager([]*Policy{policy}, store)
+	m.Clock = clock
+	return m, clock, &calls
+}
+
+func newTestCheck(m *Manager) *check.Check {
+	return check.New("check1",
+		check.WithMeta(map[string]any{DefaultPolicyMetaKey: "noc"}),
+		check.WithHandlers([]check.Handler{m}),
+	)
+}
+
+func TestManagerRunsPolicyTimeline(t *testing.T) {
+	m, clock, calls := newTestManager(nil)
+	chk := newTestCheck(m)
+	incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+
+	if err := m.ProcessIncidentEvent(chk, check.IncidentEvent{Type: check.IncidentOpened, Incident: incident}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"a"}; !reflect.DeepEqual(want, *calls) {
+		t.Fatalf("expected %v immediately, got %v", want, *calls)
+	}
+
+	steps := []struct {
+		advance time.Duration
+		want    []string
+	}{
+		{advance: 10 * time.Minute, want: []string{"a"}},
+		{advance: 5 * time.Minute, want: []string{"a", "b"}},
+		{advance: 30 * time.Minute, want: []string{"a", "b"}},
+		{advance: 30 * time.Minute, want: []string{"a", "b", "b"}},
+		{advance: time.Hour, want: []string{"a", "b", "b", "b"}},
+	}
+	for i, step := range steps {
+		clock.Advance(step.advance)
+		if err := m.Tick(context.Background()); err != nil {
+			t.Fatalf("step %d: unexpected error: %v", i, err)
+		}
+		if !reflect.DeepEqual(step.want, *calls) {
+			t.Errorf("step %d: expected %v, got %v", i, step.want, *calls)
+		}
+	}
+}
+
+func TestManagerStopsOnAcknowledgeAndResolve(t *testing.T) {
+	for _, eventType := range []check.IncidentEventType{check.IncidentAcknowledged, check.IncidentResolved} {
+		m, clock, calls := newTestManager(nil)
+		chk := newTestCheck(m)
+		incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+
+		_ = m.ProcessIncidentEvent(chk, check.IncidentEvent{Type: check.IncidentOpened, Incident: incident})
+		_ = m.ProcessIncidentEvent(chk, check.IncidentEvent{Type: eventType, Incident: incident})
+
+		clock.Advance(24 * time.Hour)
+		_ = m.Tick(context.Background())
+
+		if want := []string{"a"}; !reflect.DeepEqual(want, *calls) {
+			t.Errorf("%s: expected %v, got %v", eventType, want, *calls)
+		}
+	}
+}
+
+func TestManagerEscalatesThroughCheckExecution(t *testing.T) {
+	m, _, calls := newTestManager(nil)
+	chk := newTestCheck(m)
+	chk.Command = testCommand{state: check.StateCrit}
+
+	_ = chk.Execute()
+	if want := []string{"a"}; !reflect.DeepEqual(want, *calls) {
+		t.Fatalf("expected %v, got %v", want, *calls)
+	}
+
+	if err := chk.AcknowledgeIncident(check.Acknowledgement{By: "alice"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if all, _ := m.Store.All(); len(all) != 0 {
+		t.Errorf("expected escalation to stop after acknowledgement, got %d open", len(all))
+	}
+}
+
+func TestManagerSurvivesRestartWithFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "escalations.json")
+
+	m, clock, calls := newTestManager(NewFileStore(path))
+	chk := newTestCheck(m)
+	incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+	_ = m.ProcessIncidentEvent(chk, check.IncidentEvent{Type: check.IncidentOpened, Incident: incident})
+
+	// "restart" with a new manager reading the same file
+	m2, _, calls2 := newTestManager(NewFileStore(path))
+	m2.Clock = clock
+	clock.Advance(15 * time.Minute)
+	if err := m2.Tick(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if want := []string{"a"}; !reflect.DeepEqual(want, *calls) {
+		t.Errorf("expected first manager to notify %v, got %v", want, *calls)
+	}
+	if want := []string{"b"}; !reflect.DeepEqual(want, *calls2) {
+		t.Errorf("expected restarted manager to notify %v, got %v", want, *calls2)
+	}
+}
+
+func TestManagerNotifiesWithoutHoldingLock(t *testing.T) {
+	started := make(chan struct{})
+	hung := NotifierFunc(func(ctx context.Context, n Notification) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	m := NewManager([]*Policy{{Name: "noc", Steps: []Step{{Name: "pager", Notifiers: []Notifier{hung}}}}}, nil)
+	m.NotifyTimeout = 200 * time.Millisecond
+	chk := newTestCheck(m)
+	incident := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "", nil))
+
+	opened := make(chan error, 1)
+	go func() {
+		opened <- m.ProcessIncidentEvent(chk, check.IncidentEvent{Type: check.IncidentOpened, Incident: incident})
+	}()
+	<-started
+
+	// resolving while the pager hangs neither waits for it nor is undone when it returns
+	resolved := make(chan error, 1)
+	go func() {
+		resolved <- m.ProcessIncidentEvent(chk, check.IncidentEvent{Type: check.IncidentResolved, Incident: incident})
+	}()
+	select {
+	case <-resolved:
+	case <-opened:
+		t.Fatalf("expected the resolve to finish while the notification hangs")
+	}
+
+	select {
+	case err := <-opened:
+		if err == nil {
+			t.Errorf("expected the hung notification to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the notification to be bounded by NotifyTimeout")
+	}
+	if all, _ := m.Store.All(); len(all) != 0 {
+		t.Errorf("expected the resolved escalation to stay stopped, got %d open", len(all))
+	}
+}
+
+type testCommand struct {
+	state check.ResultState
+}
+
+func (c testCommand) Run(*check.Check) (*check.Result, error) {
+	return check.NewResult(c.state, "", nil), nil
+}
@@ -0,0 +1,119 @@
+package escalation
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/google/uuid"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore is a Store that persists Escalations as JSON to a file so that they survive restarts.  The file is
+// rewritten atomically on every change, so it is suited to the modest number of Escalations open at any time.
+type FileStore struct {
+	Path string
+
+	escalations map[uuid.UUID]Escalation
+	mu          sync.Mutex
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{Path: path}
+}
+
+func (s *FileStore) Save(e *Escalation) error {
+	if e == nil {
+		return errors.New("nil escalation")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	s.escalations[e.Incident.Id] = *e
+	return s.write()
+}
+
+func (s *FileStore) Delete(incidentId uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return err
+	}
+	if _, ok := s.escalations[incidentId]; !ok {
+		return nil
+	}
+	delete(s.escalations, incidentId)
+	return s.write()
+}
+
+func (s *FileStore) All() ([]*Escalation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	all := make([]*Escalation, 0, len(s.escalations))
+	for _, e := range s.escalations {
+		all = append(all, &e)
+	}
+	return all, nil
+}
+
+// load reads the file the first time the store is used.  s.mu must be held.
+func (s *FileStore) load() error {
+	if s.escalations != nil {
+		return nil
+	}
+
+	b, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.escalations = make(map[uuid.UUID]Escalation)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var escalations []Escalation
+	if err := json.Unmarshal(b, &escalations); err != nil {
+		return err
+	}
+	s.escalations = make(map[uuid.UUID]Escalation, len(escalations))
+	for _, e := range escalations {
+		s.escalations[e.Incident.Id] = e
+	}
+	return nil
+}
+
+// write atomically replaces the file with the current Escalations.  s.mu must be held.
+func (s *FileStore) write() error {
+	escalations := make([]Escalation, 0, len(s.escalations))
+	for _, e := range s.escalations {
+		escalations = append(escalations, e)
+	}
+	b, err := json.Marshal(escalations)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(b); err == nil {
+		err = tmp.Sync()
+	}
+	if errC := tmp.Close(); err == nil {
+		err = errC
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
@@ -0,0 +1,108 @@
+// Package background runs the periodic work of handlers, such as flushing buffers, in a goroutine started on first
+// use and stopped when the handler is closed.
+package background
+
+import (
+	"sync"
+	"time"
+)
+
+// Loop calls a function in a goroutine every interval, and sooner when kicked, until it is stopped.  The zero Loop
+// is ready to use.
+type Loop struct {
+	kick    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+	stopped bool
+	mu      sync.Mutex
+}
+
+// Start starts calling fn every interval unless the Loop is already running, passing the errors fn returns to onError
+// (when not nil).  It returns false once the Loop is stopped, so the caller can refuse work that would never be done.
+//
+// After fn fails, kicks are ignored until the next interval so that a failing destination is retried every interval
+// rather than on every kick.
+func (l *Loop) Start(interval time.Duration, fn func() error, onError func(error)) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.stopped {
+		return false
+	}
+	if l.stop == nil {
+		l.kick = make(chan struct{}, 1)
+		l.stop, l.done = make(chan struct{}), make(chan struct{})
+		go run(interval, fn, onError, l.kick, l.stop, l.done)
+	}
+	return true
+}
+
+// Kick calls fn as soon as a call in progress returns, if the Loop is running.
+func (l *Loop) Kick() {
+	l.mu.Lock()
+	kick := l.kick
+	l.mu.Unlock()
+
+	if kick == nil {
+		return
+	}
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+}
+
+// Stop stops the Loop, waiting for a call of fn in progress to return.  A stopped Loop doesn't start again.
+func (l *Loop) Stop() {
+	l.mu.Lock()
+	stop, done, stopped := l.stop, l.done, l.stopped
+	l.stopped = true
+	l.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	if !stopped {
+		close(stop)
+	}
+	<-done
+}
+
+// Stopped returns true once Stop has been called.
+func (l *Loop) Stopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.stopped
+}
+
+func run(interval time.Duration, fn func() error, onError func(error), kick, stop, done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var failed bool
+	for {
+		if failed {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		} else {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			case <-kick:
+			}
+		}
+
+		err := fn()
+		failed = err != nil
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
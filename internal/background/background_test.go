@@ -0,0 +1,72 @@
+package background
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLoop(t *testing.T) {
+	var l Loop
+	var calls atomic.Int32
+	called := make(chan struct{}, 10)
+	fn := func() error {
+		calls.Add(1)
+		called <- struct{}{}
+		return nil
+	}
+
+	// kicking a loop that isn't running does nothing
+	l.Kick()
+
+	if !l.Start(time.Hour, fn, nil) || !l.Start(time.Hour, fn, nil) {
+		t.Fatal("expected the loop to start")
+	}
+	l.Kick()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a kick to call fn")
+	}
+
+	l.Stop()
+	l.Stop()
+	if !l.Stopped() || l.Start(time.Hour, fn, nil) {
+		t.Error("expected the loop not to start once stopped")
+	}
+	l.Kick()
+	if n := calls.Load(); n != 1 {
+		t.Errorf("expected 1 call, got %d", n)
+	}
+}
+
+func TestLoopIgnoresKicksAfterFailure(t *testing.T) {
+	var l Loop
+	defer l.Stop()
+
+	errs := make(chan error, 10)
+	l.Start(time.Hour, func() error { return errors.New("unavailable") }, func(err error) { errs <- err })
+
+	l.Kick()
+	select {
+	case <-errs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the error to be reported")
+	}
+
+	l.Kick()
+	select {
+	case err := <-errs:
+		t.Errorf("expected the kick to be ignored until the next interval, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	var l Loop
+	l.Stop()
+	if l.Start(time.Hour, func() error { return nil }, nil) {
+		t.Error("expected the loop not to start once stopped")
+	}
+}
@@ -0,0 +1,48 @@
+// Package metamodel holds the helpers shared by handlers that keep learned state in Check.HandlerState.
+package metamodel
+
+import (
+	"encoding/json"
+	"github.com/seankndy/gopoller/check"
+)
+
+// Load returns the M stored in the Check's HandlerState under key, creating it if it does not exist.  An M that was
+// deserialized generically (ex. into a map[string]any from JSON) is converted back into an M; one that cannot be is
+// discarded.  name describes the model in debug logging.
+func Load[M any](chk *check.Check, key, name string) *M {
+	if chk.HandlerState == nil {
+		chk.HandlerState = make(map[string]any)
+	}
+
+	var model *M
+	switch v := chk.HandlerState[key].(type) {
+	case *M:
+		model = v
+	case M:
+		model = &v
+	case nil:
+	default:
+		model = new(M)
+		if b, err := json.Marshal(v); err != nil || json.Unmarshal(b, model) != nil {
+			chk.Debugf("discarding unreadable %s model in handler state key %s", name, key)
+			model = nil
+		}
+	}
+
+	if model == nil {
+		model = new(M)
+	}
+	chk.HandlerState[key] = model
+
+	return model
+}
+
+// FindMetric returns the Result's metric with label, or nil if it has none.
+func FindMetric(result *check.Result, label string) *check.ResultMetric {
+	for i := range result.Metrics {
+		if result.Metrics[i].Label == label {
+			return &result.Metrics[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+// Package protowire appends protocol buffer encoded fields, for handlers encoding messages without generated code.
+package protowire
+
+import (
+	"encoding/binary"
+)
+
+// Wire types.
+const (
+	Varint  = 0
+	Fixed64 = 1
+	Bytes   = 2
+)
+
+// Buffer appends protobuf encoded fields.  Every field is appended, even with a zero value, so fields of a oneof
+// can be encoded; leave out the fields outside of a oneof that have zero values to match proto3 encoders.
+type Buffer []byte
+
+func (b Buffer) Tag(field, wireType int) Buffer {
+	return binary.AppendUvarint(b, uint64(field<<3|wireType))
+}
+
+func (b Buffer) Varint(field int, v uint64) Buffer {
+	return binary.AppendUvarint(b.Tag(field, Varint), v)
+}
+
+func (b Buffer) Fixed64(field int, v uint64) Buffer {
+	return binary.LittleEndian.AppendUint64(b.Tag(field, Fixed64), v)
+}
+
+func (b Buffer) Bytes(field int, v []byte) Buffer {
+	b = binary.AppendUvarint(b.Tag(field, Bytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+func (b Buffer) String(field int, v string) Buffer {
+	b = binary.AppendUvarint(b.Tag(field, Bytes), uint64(len(v)))
+	return append(b, v...)
+}
+
+// Message appends the embedded message encoded by fn.
+func (b Buffer) Message(field int, fn func(Buffer) Buffer) Buffer {
+	return b.Bytes(field, fn(nil))
+}
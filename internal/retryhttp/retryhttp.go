@@ -0,0 +1,84 @@
+// Package retryhttp sends HTTP requests for handlers, retrying transient failures.
+package retryhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// StatusError is returned when the server responds with a non-2xx status.
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary returns true if the request may succeed if retried.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Do sends the request built by newRequest with client and returns the response body.  Network errors, 5xx and 429
+// responses are retried up to retries times, waiting backoff before the first retry and doubling it each time.
+// newRequest is called for every attempt so that the request body can be re-read.
+func Do(
+	ctx context.Context,
+	client *http.Client,
+	newRequest func(ctx context.Context) (*http.Request, error),
+	retries int,
+	backoff time.Duration,
+) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		body, err := do(client, req)
+		if err == nil {
+			return body, nil
+		}
+
+		if statusErr, ok := err.(*StatusError); ok && !statusErr.Temporary() {
+			return nil, err
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	return body, nil
+}
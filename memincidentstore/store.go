@@ -0,0 +1,99 @@
+package memincidentstore
+
+import (
+	"github.com/google/uuid"
+	"github.com/seankndy/gopoller/check"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Store is a check.IncidentStore that keeps its Incidents in memory.  Incidents
+// are copied on Save() and on retrieval so that later changes to a Check's
+// Incident are only reflected once saved again.
+type Store struct {
+	records map[uuid.UUID]*check.IncidentRecord
+	sync.RWMutex
+}
+
+func NewStore() *Store {
+	return &Store{
+		records: make(map[uuid.UUID]*check.IncidentRecord),
+	}
+}
+
+func (s *Store) Save(checkId string, incident *check.Incident) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.records[incident.Id] = &check.IncidentRecord{
+		CheckId:  checkId,
+		Incident: *incident.Clone(),
+	}
+
+	return nil
+}
+
+func (s *Store) Get(id uuid.UUID) (*check.IncidentRecord, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	r, ok := s.records[id]
+	if !ok {
+		return nil, nil
+	}
+
+	return clone(r), nil
+}
+
+func (s *Store) Find(filter check.IncidentFilter) ([]*check.IncidentRecord, error) {
+	s.RLock()
+	var found []*check.IncidentRecord
+	for _, r := range s.records {
+		if filter.Matches(r) {
+			found = append(found, clone(r))
+		}
+	}
+	s.RUnlock()
+
+	slices.SortFunc(found, func(a, b *check.IncidentRecord) int {
+		return a.Incident.Time.Compare(b.Incident.Time)
+	})
+
+	if filter.Limit > 0 && len(found) > filter.Limit {
+		found = found[len(found)-filter.Limit:]
+	}
+
+	return found, nil
+}
+
+// Purge removes Incidents that were resolved before t, returning the number
+// removed.
+func (s *Store) Purge(t time.Time) int {
+	s.Lock()
+	defer s.Unlock()
+
+	var n int
+	for id, r := range s.records {
+		if r.Incident.Resolved != nil && r.Incident.Resolved.Before(t) {
+			delete(s.records, id)
+			n++
+		}
+	}
+	return n
+}
+
+// Count returns the number of Incidents in the store.
+func (s *Store) Count() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.records)
+}
+
+func clone(r *check.IncidentRecord) *check.IncidentRecord {
+	return &check.IncidentRecord{
+		CheckId:  r.CheckId,
+		Incident: *r.Incident.Clone(),
+	}
+}
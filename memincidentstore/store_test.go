@@ -0,0 +1,96 @@
+package memincidentstore
+
+import (
+	"github.com/seankndy/gopoller/check"
+	"testing"
+	"time"
+)
+
+func TestStoreSavesCopies(t *testing.T) {
+	s := NewStore()
+	i := check.MakeIncidentFromResults(nil, check.NewResult(check.StateCrit, "TEST", nil))
+
+	if err := s.Save("check1", i); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	i.Resolve()
+
+	r, err := s.Get(i.Id)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if r == nil {
+		t.Fatal("Get(): expected a record, got nil")
+	}
+	if r.CheckId != "check1" {
+		t.Errorf("Get(): expected check id check1, got %v", r.CheckId)
+	}
+	if r.Incident.IsResolved() {
+		t.Error("Get(): expected stored incident to be unaffected by later changes")
+	}
+}
+
+func TestStoreFind(t *testing.T) {
+	s := NewStore()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	resolvedAt := base.Add(time.Hour)
+
+	incidents := []struct {
+		checkId  string
+		incident *check.Incident
+	}{
+		{"check1", &check.Incident{ToState: check.StateWarn, Time: base}},
+		{"check1", &check.Incident{ToState: check.StateCrit, Time: base.Add(10 * time.Minute), Resolved: &resolvedAt}},
+		{"check2", &check.Incident{ToState: check.StateCrit, Time: base.Add(20 * time.Minute)}},
+		{"check3", &check.Incident{ToState: check.StateUnknown, Time: base.Add(30 * time.Minute)}},
+	}
+	for i := range incidents {
+		incidents[i].incident.Id = [16]byte{byte(i + 1)}
+		_ = s.Save(incidents[i].checkId, incidents[i].incident)
+	}
+
+	open := false
+	tests := []struct {
+		name   string
+		filter check.IncidentFilter
+		want   []int
+	}{
+		{name: "all", filter: check.IncidentFilter{}, want: []int{0, 1, 2, 3}},
+		{name: "by_check", filter: check.IncidentFilter{CheckId: "check1"}, want: []int{0, 1}},
+		{name: "by_state", filter: check.IncidentFilter{States: []check.ResultState{check.StateCrit}}, want: []int{1, 2}},
+		{name: "open", filter: check.IncidentFilter{Resolved: &open}, want: []int{0, 2, 3}},
+		{name: "time_range", filter: check.IncidentFilter{Since: base.Add(10 * time.Minute), Until: base.Add(30 * time.Minute)}, want: []int{1, 2}},
+		{name: "limit", filter: check.IncidentFilter{Limit: 2}, want: []int{2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.Find(tt.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Find(): expected %d records, got %d", len(tt.want), len(got))
+			}
+			for i, idx := range tt.want {
+				if got[i].Incident.Id != incidents[idx].incident.Id {
+					t.Errorf("Find(): expected record %d to be incident %v, got %v", i, incidents[idx].incident.Id, got[i].Incident.Id)
+				}
+			}
+		})
+	}
+}
+
+func TestStorePurge(t *testing.T) {
+	s := NewStore()
+	resolvedAt := time.Now().Add(-time.Hour)
+	_ = s.Save("check1", &check.Incident{Id: [16]byte{1}, Resolved: &resolvedAt})
+	_ = s.Save("check1", &check.Incident{Id: [16]byte{2}})
+
+	if n := s.Purge(time.Now()); n != 1 {
+		t.Errorf("Purge(): expected 1 removed, got %d", n)
+	}
+	if n := s.Count(); n != 1 {
+		t.Errorf("Count(): expected 1, got %d", n)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/seankndy/gopoller/check"
+	"go.opentelemetry.io/otel/trace"
 	"os"
 	"sync"
 	"time"
@@ -27,6 +28,10 @@ type Server struct {
 
 	// Callback triggered just after a check finishes execution (useful for logging)
 	OnCheckFinished func(chk *check.Check, runDuration time.Duration)
+
+	// Tracer, when set, is given to every check prior to execution so that its execution is traced (see
+	// check.Check.ExecuteContext)
+	Tracer trace.Tracer
 }
 
 type Option func(*Server)
@@ -57,6 +62,12 @@ func WithMaxRunningChecks(n int) Option {
 	}
 }
 
+func WithTracer(tracer trace.Tracer) Option {
+	return func(s *Server) {
+		s.Tracer = tracer
+	}
+}
+
 // Run starts the server.  ctx is a context.Context that when cancelled will
 // stop the server after the currently executing checks finish.
 func (s *Server) Run(ctx context.Context) {
@@ -127,8 +138,11 @@ loop:
 				if onCheckExecuting != nil {
 					onCheckExecuting(chk)
 				}
+				if s.Tracer != nil {
+					chk.SetTracer(s.Tracer)
+				}
 				startTime := time.Now()
-				if err := chk.Execute(); err != nil {
+				if err := chk.ExecuteContext(ctx); err != nil {
 					onCheckErrored := s.OnCheckErrored
 					if onCheckErrored != nil {
 						onCheckErrored(chk, err)